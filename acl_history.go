@@ -0,0 +1,139 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hsdsDomainFileVersionLoader is the interface wrapping the
+// LoadDomainFileVersions method.
+//
+// LoadDomainFileVersions returns the key of the domain file of the domain
+// identified by name and all versions of it, sorted by their last
+// modification time in descending order.
+type hsdsDomainFileVersionLoader interface {
+	LoadDomainFileVersions(ctx context.Context, name string) (string, []*hsdsVersion, error)
+}
+
+// aclHistoryLoader is the combination of the hsdsDomainFileVersionLoader and
+// hsdsObjectLoader interfaces.
+type aclHistoryLoader interface {
+	hsdsDomainFileVersionLoader
+	hsdsObjectLoader
+}
+
+// aclVersion is the ACL of a domain as of a single version of its domain
+// file.
+type aclVersion struct {
+	Version *hsdsVersion
+	ACLs    hsdsACL
+}
+
+// loadACLHistory loads all versions of the domain file of the domain
+// identified by name and returns their ACLs, oldest first. Delete markers are
+// skipped.
+func loadACLHistory(ctx context.Context, loader aclHistoryLoader, name string) ([]*aclVersion, error) {
+	key, versions, err := loader.LoadDomainFileVersions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var history []*aclVersion
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if v.DeleteMarker {
+			continue
+		}
+		b, err := loader.LoadObject(ctx, key, v.ID)
+		if err != nil {
+			return nil, err
+		}
+		d := &hsdsDomain{}
+		err = json.Unmarshal(b, d)
+		if err != nil {
+			return nil, fmt.Errorf("%s version %s: %w", key, v.ID, err)
+		}
+		history = append(history, &aclVersion{Version: v, ACLs: d.ACLs})
+	}
+	return history, nil
+}
+
+// String returns the names of the permissions granted by p, separated by
+// commas, or "none" if p grants no permissions.
+func (p *hsdsPermissions) String() string {
+	if p == nil {
+		return "none"
+	}
+	var names []string
+	for _, perm := range []struct {
+		name    string
+		granted bool
+	}{
+		{"create", p.Create},
+		{"read", p.Read},
+		{"update", p.Update},
+		{"delete", p.Delete},
+		{"readACL", p.ReadACL},
+		{"updateACL", p.UpdateACL},
+	} {
+		if perm.granted {
+			names = append(names, perm.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// writeACLHistory writes the ACLs of each version in history to w, below the
+// domain's name. Starting with the second version, each user's entry is
+// marked with "+" if it has been added, "-" if it has been removed and "~" if
+// its permissions have changed since the previous version.
+func writeACLHistory(w io.Writer, name string, history []*aclVersion) {
+	fmt.Fprintf(w, "%s:\n", name)
+	var previous hsdsACL
+	for i, av := range history {
+		fmt.Fprintf(w, "    %s\t%s\n", av.Version.ID, av.Version.LastModified.Local().Format(time.RFC3339))
+
+		users := map[string]bool{}
+		for user := range av.ACLs {
+			users[user] = true
+		}
+		for user := range previous {
+			users[user] = true
+		}
+		sorted := make([]string, 0, len(users))
+		for user := range users {
+			sorted = append(sorted, user)
+		}
+		sort.Strings(sorted)
+
+		for _, user := range sorted {
+			perms, ok := av.ACLs[user]
+			old, wasOK := previous[user]
+			mark := " "
+			switch {
+			case i == 0:
+			case ok && !wasOK:
+				mark = "+"
+			case !ok && wasOK:
+				mark = "-"
+				perms = old
+			case perms.String() != old.String():
+				mark = "~"
+			}
+			fmt.Fprintf(w, "      %s %s\t%s\n", mark, user, perms)
+		}
+		previous = av.ACLs
+	}
+	fmt.Fprintln(w)
+}
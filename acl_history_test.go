@@ -0,0 +1,56 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACLHistory(t *testing.T) {
+	key := "home/user/domain.h5/.domain.json"
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{
+				Key: key, VersionID: "domain-v2", LastModified: testTimestamp.Add(time.Hour),
+				Data: []byte(`{"owner": "alice", "acls": {"alice": {"read": true, "update": true}, "bob": {"read": true}}}`),
+			},
+			{
+				Key: key, VersionID: "domain-v1", LastModified: testTimestamp,
+				Data: []byte(`{"owner": "alice", "acls": {"alice": {"read": true}, "default": {"read": true}}}`),
+			},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	history, err := loadACLHistory(context.Background(), loader, "home/user/domain.h5")
+	if err != nil {
+		t.Fatalf("loadACLHistory() err = %v (want nil)", err)
+	}
+	if len(history) != 2 || history[0].Version.ID != "domain-v1" {
+		t.Fatalf("loadACLHistory() = %d versions (want domain-v1 and domain-v2)", len(history))
+	}
+
+	var buf bytes.Buffer
+	writeACLHistory(&buf, "home/user/domain.h5", history)
+	lines := strings.Split(buf.String(), "\n")
+	want := []string{
+		"home/user/domain.h5:",
+		"    domain-v1\t" + testTimestamp.Local().Format(time.RFC3339),
+		"        alice\tread",
+		"        default\tread",
+		"    domain-v2\t" + testTimestamp.Add(time.Hour).Local().Format(time.RFC3339),
+		"      ~ alice\tread,update",
+		"      + bob\tread",
+		"      - default\tread",
+		"",
+		"",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("writeACLHistory() =\n%s\n(want\n%s)", buf.String(), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errTooManyFailures indicates that a run has been aborted by a
+// circuitBreaker.
+var errTooManyFailures = errors.New("too many failures, aborting")
+
+// circuitBreaker tracks the outcomes of the most recent downloads and trips
+// once the fraction of failures among them exceeds a threshold, so runs
+// against a degraded backend are aborted instead of skipping object after
+// object. It is safe for concurrent use. All methods of a nil *circuitBreaker
+// are no-ops.
+type circuitBreaker struct {
+	// Window is the number of most recent outcomes considered.
+	Window int
+	// Threshold is the fraction of failures within a full window above which
+	// the breaker trips.
+	Threshold float64
+
+	mu sync.Mutex
+	// outcomes is a ring buffer of the most recent outcomes, true denoting a
+	// failure.
+	outcomes []bool
+	next     int
+	failures int
+	tripped  bool
+}
+
+// Record records the outcome of a download. Once the breaker has tripped, an
+// error wrapping errTooManyFailures is returned for this and all following
+// outcomes.
+func (b *circuitBreaker) Record(failed bool) error {
+	if b == nil || b.Window <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.outcomes) < b.Window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % b.Window
+	}
+	if failed {
+		b.failures++
+	}
+	if len(b.outcomes) == b.Window && float64(b.failures)/float64(b.Window) > b.Threshold {
+		b.tripped = true
+	}
+	if b.tripped {
+		return fmt.Errorf("%w: more than %.0f%% of the last %d downloads failed", errTooManyFailures, b.Threshold*100, b.Window)
+	}
+	return nil
+}
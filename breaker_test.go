@@ -0,0 +1,53 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+type circuitBreakerTestcase struct {
+	name     string
+	outcomes []bool
+	// tripAt is the index of the outcome tripping the breaker, or -1.
+	tripAt int
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	testCases := []circuitBreakerTestcase{
+		{name: "no-failures", outcomes: []bool{false, false, false, false, false}, tripAt: -1},
+		{name: "window-not-full", outcomes: []bool{true, true, true}, tripAt: -1},
+		{name: "above-threshold", outcomes: []bool{false, true, true, true}, tripAt: 3},
+		{name: "at-threshold", outcomes: []bool{false, true, false, true, false, true}, tripAt: -1},
+		{name: "failures-leave-window", outcomes: []bool{true, true, false, false, false, false, true, true}, tripAt: -1},
+		{name: "sliding", outcomes: []bool{false, false, false, false, true, true, true}, tripAt: 6},
+	}
+
+	for _, tc := range testCases {
+		b := &circuitBreaker{Window: 4, Threshold: 0.5}
+		tripped := -1
+		for i, failed := range tc.outcomes {
+			err := b.Record(failed)
+			if err != nil && tripped < 0 {
+				if !errors.Is(err, errTooManyFailures) {
+					t.Errorf("%s: Record() err = %v (want %v)", tc.name, err, errTooManyFailures)
+				}
+				tripped = i
+			}
+			if err == nil && tripped >= 0 {
+				t.Errorf("%s: Record() err = nil after tripping", tc.name)
+			}
+		}
+		if tripped != tc.tripAt {
+			t.Errorf("%s: breaker tripped at %d (want %d)", tc.name, tripped, tc.tripAt)
+		}
+	}
+
+	var b *circuitBreaker
+	if err := b.Record(true); err != nil {
+		t.Errorf("nil: Record() err = %v (want nil)", err)
+	}
+}
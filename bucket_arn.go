@@ -0,0 +1,75 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bucketARN is the Amazon Resource Name of an S3 access point or of an S3 on
+// Outposts access point, which the S3 API accepts in place of a bucket name.
+type bucketARN struct {
+	Partition string
+	Service   string
+	Region    string
+	AccountID string
+	// Resource is the part following the account ID, e.g.
+	// accesspoint/my-access-point.
+	Resource string
+}
+
+// invalidBucketARNError indicates that an ARN does not identify an access
+// point.
+type invalidBucketARNError struct {
+	ARN    string
+	Reason string
+}
+
+func (err *invalidBucketARNError) Error() string {
+	return fmt.Sprintf("invalid access point ARN %q: %s", err.ARN, err.Reason)
+}
+
+// isBucketARN reports whether bucket is an ARN rather than a bucket name.
+// Bucket names cannot contain colons, so the prefix is unambiguous.
+func isBucketARN(bucket string) bool {
+	return strings.HasPrefix(bucket, "arn:")
+}
+
+// parseBucketARN parses s, which is either of the form
+//
+//	arn:PARTITION:s3:REGION:ACCOUNT:accesspoint/NAME
+//	arn:PARTITION:s3-outposts:REGION:ACCOUNT:outpost/OUTPOST/accesspoint/NAME
+func parseBucketARN(s string) (*bucketARN, error) {
+	parts := strings.SplitN(s, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return nil, &invalidBucketARNError{ARN: s, Reason: "not an ARN"}
+	}
+	arn := &bucketARN{
+		Partition: parts[1],
+		Service:   parts[2],
+		Region:    parts[3],
+		AccountID: parts[4],
+		Resource:  parts[5],
+	}
+	if arn.Partition == "" || arn.Region == "" || arn.AccountID == "" {
+		return nil, &invalidBucketARNError{ARN: s, Reason: "missing partition, region or account ID"}
+	}
+
+	resource := strings.Split(arn.Resource, "/")
+	switch arn.Service {
+	case "s3":
+		if len(resource) != 2 || resource[0] != "accesspoint" || resource[1] == "" {
+			return nil, &invalidBucketARNError{ARN: s, Reason: "resource is not accesspoint/NAME"}
+		}
+	case "s3-outposts":
+		if len(resource) != 4 || resource[0] != "outpost" || resource[1] == "" || resource[2] != "accesspoint" || resource[3] == "" {
+			return nil, &invalidBucketARNError{ARN: s, Reason: "resource is not outpost/OUTPOST/accesspoint/NAME"}
+		}
+	default:
+		return nil, &invalidBucketARNError{ARN: s, Reason: fmt.Sprintf("unsupported service %s", arn.Service)}
+	}
+	return arn, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+type parseBucketARNTestcase struct {
+	arn    string
+	region string
+	valid  bool
+}
+
+func TestParseBucketARN(t *testing.T) {
+	testCases := []parseBucketARNTestcase{
+		{arn: "arn:aws:s3:eu-central-1:123456789012:accesspoint/hsds", region: "eu-central-1", valid: true},
+		{arn: "arn:aws-cn:s3:cn-north-1:123456789012:accesspoint/hsds", region: "cn-north-1", valid: true},
+		{arn: "arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/accesspoint/hsds", region: "us-west-2", valid: true},
+		{arn: "arn:aws:s3:::bucket"},
+		{arn: "arn:aws:s3:eu-central-1:123456789012:accesspoint/"},
+		{arn: "arn:aws:s3:eu-central-1:123456789012:bucket/hsds"},
+		{arn: "arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/bucket/hsds"},
+		{arn: "arn:aws:s3-object-lambda:eu-central-1:123456789012:accesspoint/hsds"},
+		{arn: "arn:aws:s3"},
+	}
+
+	for _, tc := range testCases {
+		if !isBucketARN(tc.arn) {
+			t.Errorf("%s: isBucketARN() = false (want true)", tc.arn)
+		}
+		arn, err := parseBucketARN(tc.arn)
+		if !tc.valid {
+			var invalid *invalidBucketARNError
+			if !errors.As(err, &invalid) {
+				t.Errorf("%s: parseBucketARN() err = %v (want *invalidBucketARNError)", tc.arn, err)
+			}
+			continue
+		}
+		if err != nil || arn.Region != tc.region {
+			t.Errorf("%s: parseBucketARN() = %+v, %v (want region %s)", tc.arn, arn, err, tc.region)
+		}
+	}
+
+	if isBucketARN("my-bucket") {
+		t.Errorf("my-bucket: isBucketARN() = true (want false)")
+	}
+}
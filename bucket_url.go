@@ -0,0 +1,43 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bucketURLPrefix starts BUCKET arguments that are given as S3 URLs rather
+// than as bucket names.
+const bucketURLPrefix = "s3://"
+
+// invalidBucketURLError indicates that a BUCKET argument given as S3 URL does
+// not name a bucket.
+type invalidBucketURLError struct {
+	URL    string
+	Reason string
+}
+
+func (err *invalidBucketURLError) Error() string {
+	return fmt.Sprintf("invalid bucket URL %q: %s", err.URL, err.Reason)
+}
+
+// parseBucketArg splits the BUCKET argument s into the bucket and a key
+// prefix. Users often pass S3 URLs like s3://bucket/prefix out of habit, whose
+// path is returned as prefix without leading and trailing slashes. Any other
+// argument is returned as bucket with an empty prefix.
+func parseBucketArg(s string) (bucket, prefix string, err error) {
+	if !strings.HasPrefix(s, bucketURLPrefix) {
+		return s, "", nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, bucketURLPrefix), "/", 2)
+	if parts[0] == "" {
+		return "", "", &invalidBucketURLError{URL: s, Reason: "missing bucket"}
+	}
+	if len(parts) == 2 {
+		prefix = strings.Trim(parts[1], "/")
+	}
+	return parts[0], prefix, nil
+}
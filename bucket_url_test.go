@@ -0,0 +1,44 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+type parseBucketArgTestcase struct {
+	arg    string
+	bucket string
+	prefix string
+	valid  bool
+}
+
+func TestParseBucketArg(t *testing.T) {
+	testCases := []parseBucketArgTestcase{
+		{arg: "mybucket", bucket: "mybucket", valid: true},
+		{arg: "s3://mybucket", bucket: "mybucket", valid: true},
+		{arg: "s3://mybucket/", bucket: "mybucket", valid: true},
+		{arg: "s3://mybucket/prefix", bucket: "mybucket", prefix: "prefix", valid: true},
+		{arg: "s3://mybucket/home/user/", bucket: "mybucket", prefix: "home/user", valid: true},
+		{arg: "arn:aws:s3:eu-central-1:123456789012:accesspoint/hsds", bucket: "arn:aws:s3:eu-central-1:123456789012:accesspoint/hsds", valid: true},
+		{arg: "s3://"},
+		{arg: "s3:///prefix"},
+	}
+
+	for _, tc := range testCases {
+		bucket, prefix, err := parseBucketArg(tc.arg)
+		if !tc.valid {
+			var invalid *invalidBucketURLError
+			if !errors.As(err, &invalid) {
+				t.Errorf("%s: parseBucketArg() err = %v (want *invalidBucketURLError)", tc.arg, err)
+			}
+			continue
+		}
+		if err != nil || bucket != tc.bucket || prefix != tc.prefix {
+			t.Errorf("%s: parseBucketArg() = %q, %q, %v (want %q, %q)", tc.arg, bucket, prefix, err, tc.bucket, tc.prefix)
+		}
+	}
+}
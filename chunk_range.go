@@ -0,0 +1,116 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// chunkInterval is the half-open interval [Lo, Hi) of chunk indices in a
+// single dimension. A negative Hi means that the interval is unbounded.
+type chunkInterval struct {
+	Lo int
+	Hi int
+}
+
+// chunkRange is a filter selecting dataset chunks by their chunk indices. It
+// consists of one interval per dimension.
+type chunkRange []chunkInterval
+
+// invalidChunkRangeError indicates that a chunk range could not be parsed.
+type invalidChunkRangeError struct {
+	Range string
+}
+
+func (err *invalidChunkRangeError) Error() string {
+	return fmt.Sprintf("hsds: invalid chunk range '%s'", err.Range)
+}
+
+func parseChunkIndexBound(s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid chunk index '%s'", s)
+	}
+	return i, nil
+}
+
+// parseChunkRange parses s, which is a comma-separated list of Python-style
+// slices, one per dimension. Each slice is either of the form "lo:hi", where
+// both bounds are optional, or a single chunk index. For example, "0:2,:,5"
+// selects the first two chunks in the first dimension, all chunks in the
+// second dimension and the sixth chunk in the third dimension.
+func parseChunkRange(s string) (chunkRange, error) {
+	var r chunkRange
+	for _, dim := range strings.Split(s, ",") {
+		bounds := strings.Split(strings.TrimSpace(dim), ":")
+		interval := chunkInterval{Hi: -1}
+		var err error
+		switch len(bounds) {
+		case 1:
+			interval.Lo, err = parseChunkIndexBound(bounds[0])
+			interval.Hi = interval.Lo + 1
+		case 2:
+			if bounds[0] != "" {
+				interval.Lo, err = parseChunkIndexBound(bounds[0])
+			}
+			if err == nil && bounds[1] != "" {
+				interval.Hi, err = parseChunkIndexBound(bounds[1])
+			}
+		default:
+			err = fmt.Errorf("too many bounds in '%s'", dim)
+		}
+		if err != nil {
+			return nil, &invalidChunkRangeError{Range: s}
+		}
+		r = append(r, interval)
+	}
+	return r, nil
+}
+
+// parseChunkIndex parses a chunk index of the form "0_1_2" into its
+// per-dimension components.
+func parseChunkIndex(s string) ([]int, error) {
+	parts := strings.Split(s, "_")
+	index := make([]int, len(parts))
+	for i, part := range parts {
+		var err error
+		index[i], err = parseChunkIndexBound(part)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// Contains returns whether the chunk identified by index lies within r.
+// Chunks whose number of dimensions differs from r's are never contained.
+func (r chunkRange) Contains(index []int) bool {
+	if len(index) != len(r) {
+		return false
+	}
+	for i, interval := range r {
+		if index[i] < interval.Lo || (interval.Hi >= 0 && index[i] >= interval.Hi) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns whether the object identified by key should be replicated.
+// Only chunks of datasets with the same number of dimensions as r are
+// filtered; all other objects always match.
+func (r chunkRange) Match(key string) bool {
+	k, err := parseObjectKey(key)
+	if err != nil || !k.IsChunk() {
+		return true
+	}
+	index, err := parseChunkIndex(k.Chunk)
+	if err != nil || len(index) != len(r) {
+		return true
+	}
+	return r.Contains(index)
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type parseChunkRangeTestcase struct {
+	name    string
+	r       string
+	want    chunkRange
+	wantErr bool
+}
+
+func TestParseChunkRange(t *testing.T) {
+	testCases := []parseChunkRangeTestcase{
+		{
+			name: "bounded",
+			r:    "0:2,1:3",
+			want: chunkRange{{Lo: 0, Hi: 2}, {Lo: 1, Hi: 3}},
+		},
+		{
+			name: "open-and-single",
+			r:    ":,4:,5",
+			want: chunkRange{{Lo: 0, Hi: -1}, {Lo: 4, Hi: -1}, {Lo: 5, Hi: 6}},
+		},
+		{
+			name:    "negative-index",
+			r:       "-1:2",
+			wantErr: true,
+		},
+		{
+			name:    "too-many-bounds",
+			r:       "0:1:2",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseChunkRange(tc.r)
+		var rangeErr *invalidChunkRangeError
+		if tc.wantErr != errors.As(err, &rangeErr) {
+			t.Errorf("%s: parseChunkRange() err = %v (want error: %t)", tc.name, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: parseChunkRange() = %v (want %v)", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestChunkRange_Match(t *testing.T) {
+	r, err := parseChunkRange("0:2,1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataset := "db/d12a20a5-6c27622f/d/693e-302825-f8c087/"
+	keys := map[string]bool{
+		dataset + ".dataset.json": true,
+		dataset + "0_0":           false,
+		dataset + "0_1":           true,
+		dataset + "1_5":           true,
+		dataset + "2_1":           false,
+		dataset + "3":             true,
+		testGroupKey:              true,
+	}
+	for key, want := range keys {
+		if got := r.Match(key); got != want {
+			t.Errorf("Match(%q) = %t (want %t)", key, got, want)
+		}
+	}
+}
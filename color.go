@@ -0,0 +1,69 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "os"
+
+// ANSI escape sequences used to highlight terminal output.
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiBlue    = "\x1b[34m"
+	ansiGreen   = "\x1b[32m"
+	ansiMagenta = "\x1b[35m"
+	ansiYellow  = "\x1b[33m"
+)
+
+// colorEnabled reports whether output written to f should be colored. This is
+// only the case if f is a terminal and the NO_COLOR environment variable is
+// not set.
+func colorEnabled(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorizer highlights output using ANSI escape sequences. If Enabled is
+// false, all strings are returned unmodified.
+type colorizer struct {
+	Enabled bool
+}
+
+func (c colorizer) wrap(seq, s string) string {
+	if !c.Enabled {
+		return s
+	}
+	return seq + s + ansiReset
+}
+
+// Bold returns s in bold.
+func (c colorizer) Bold(s string) string {
+	return c.wrap(ansiBold, s)
+}
+
+// Key returns key colored according to the kind of domain object it
+// identifies. Keys that cannot be parsed are returned unmodified.
+func (c colorizer) Key(key string) string {
+	k, err := parseObjectKey(key)
+	if err != nil {
+		return key
+	}
+	switch {
+	case k.IsChunk():
+		return c.wrap(ansiYellow, key)
+	case k.Type == entityTypeGroup:
+		return c.wrap(ansiBlue, key)
+	case k.Type == entityTypeDataset:
+		return c.wrap(ansiGreen, key)
+	case k.Type == entityTypeCommittedType:
+		return c.wrap(ansiMagenta, key)
+	}
+	return key
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+)
+
+// Compression formats recognized by detectCompression.
+const (
+	compressionGzip = "gzip"
+	compressionZlib = "zlib"
+)
+
+// detectCompression returns the compression format of b based on its magic
+// bytes, or the empty string if b is not in a recognized format.
+func detectCompression(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	switch {
+	case b[0] == 0x1f && b[1] == 0x8b:
+		return compressionGzip
+	case b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0:
+		// A zlib header uses the deflate method and its two bytes are a
+		// multiple of 31.
+		return compressionZlib
+	}
+	return ""
+}
+
+// decompressDetected decompresses b if it is in a format recognized by
+// detectCompression and returns the decompressed data along with the format.
+// Data in unknown formats is returned unmodified with an empty format. As
+// magic bytes may occur by chance, so is data that fails to decompress.
+func decompressDetected(b []byte) ([]byte, string) {
+	format := detectCompression(b)
+	var r io.ReadCloser
+	var err error
+	switch format {
+	case compressionGzip:
+		r, err = gzip.NewReader(bytes.NewReader(b))
+	case compressionZlib:
+		r, err = zlib.NewReader(bytes.NewReader(b))
+	default:
+		return b, ""
+	}
+	if err != nil {
+		return b, ""
+	}
+	defer r.Close()
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		return b, ""
+	}
+	return d, format
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"testing"
+)
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	err := zw.Close()
+	if err != nil {
+		t.Fatalf("gzip.Writer.Close() err = %v (want nil)", err)
+	}
+	return buf.Bytes()
+}
+
+func zlibbed(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(b)
+	err := zw.Close()
+	if err != nil {
+		t.Fatalf("zlib.Writer.Close() err = %v (want nil)", err)
+	}
+	return buf.Bytes()
+}
+
+type decompressDetectedTestcase struct {
+	name       string
+	data       []byte
+	want       []byte
+	wantFormat string
+}
+
+func TestDecompressDetected(t *testing.T) {
+	testCases := []decompressDetectedTestcase{
+		{
+			name:       "gzip",
+			data:       gzipped(t, []byte("chunk")),
+			want:       []byte("chunk"),
+			wantFormat: compressionGzip,
+		},
+		{
+			name:       "zlib",
+			data:       zlibbed(t, []byte("chunk")),
+			want:       []byte("chunk"),
+			wantFormat: compressionZlib,
+		},
+		{
+			name: "plain",
+			data: []byte("chunk"),
+			want: []byte("chunk"),
+		},
+		{
+			name: "gzip-magic-only",
+			data: []byte{0x1f, 0x8b, 0x00},
+			want: []byte{0x1f, 0x8b, 0x00},
+		},
+	}
+
+	for _, tc := range testCases {
+		got, format := decompressDetected(tc.data)
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: decompressDetected() = %q (want %q)", tc.name, got, tc.want)
+		}
+		if format != tc.wantFormat {
+			t.Errorf("%s: decompressDetected() format = %q (want %q)", tc.name, format, tc.wantFormat)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Default prices of S3 GET requests and of data transfer out to the internet
+// in us-east-1.
+const (
+	defaultCostRequest = 0.0000004
+	defaultCostGB      = 0.09
+)
+
+// bytesPerGB is the number of bytes S3 bills as one gigabyte.
+const bytesPerGB = 1 << 30
+
+// costRates are the prices a dump's cost is estimated with.
+type costRates struct {
+	// Request is the price of a single GET request.
+	Request float64
+	// GB is the price of transferring a gigabyte.
+	GB float64
+}
+
+// costEstimate is the estimated cost of downloading a number of objects.
+type costEstimate struct {
+	Requests int
+	Bytes    int64
+	Cost     float64
+}
+
+// add adds the requests and bytes of other to e and recomputes e's cost.
+func (e *costEstimate) add(other costEstimate, rates costRates) {
+	e.Requests += other.Requests
+	e.Bytes += other.Bytes
+	e.Cost = rates.cost(e.Requests, e.Bytes)
+}
+
+func (rates costRates) cost(requests int, bytes int64) float64 {
+	return float64(requests)*rates.Request + float64(bytes)/bytesPerGB*rates.GB
+}
+
+// estimatePlanCost estimates the cost of executing plan. Each selected
+// version, or each stored version if the plan records their history, is
+// downloaded with a single request, as is the domain file. The size of the
+// domain file is not known from the listing and is neglected.
+func estimatePlanCost(plan *domainPlan, rates costRates) costEstimate {
+	e := costEstimate{Requests: 1}
+	for key, version := range plan.Objects {
+		if history, ok := plan.History[key]; ok {
+			for _, hv := range history {
+				e.Requests++
+				e.Bytes += hv.Size
+			}
+			continue
+		}
+		e.Requests++
+		e.Bytes += version.Size
+	}
+	e.Cost = rates.cost(e.Requests, e.Bytes)
+	return e
+}
+
+// measureCost resolves the object versions of all domains identified by
+// domains and reports the estimated cost of downloading them to w, for each
+// domain and in total. The estimate is based on the version listing only, no
+// object is downloaded.
+func measureCost(ctx context.Context, w io.Writer, loader hsdsLoader, domains []string, rates costRates, opts *runOptions) error {
+	var total costEstimate
+	for _, name := range domains {
+		plan, err := resolveDomain(ctx, loader, name, opts)
+		if err != nil {
+			return err
+		}
+		e := estimatePlanCost(plan, rates)
+		fmt.Fprintf(w, "%s: %d requests, %d bytes, estimated cost %.4f\n", name, e.Requests, e.Bytes, e.Cost)
+		total.add(e, rates)
+	}
+	fmt.Fprintf(w, "total: %d requests, %d bytes, estimated cost %.4f\n", total.Requests, total.Bytes, total.Cost)
+	return nil
+}
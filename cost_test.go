@@ -0,0 +1,70 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+)
+
+type estimatePlanCostTestcase struct {
+	name string
+	plan *domainPlan
+	want costEstimate
+}
+
+func TestEstimatePlanCost(t *testing.T) {
+	rates := costRates{Request: 0.001, GB: 0.5}
+	objects := map[string]*hsdsVersion{
+		testGroupKey: {ID: "group-v1", Size: bytesPerGB},
+		testChunkKey: {ID: "chunk-v2", Size: 3 * bytesPerGB},
+	}
+	testCases := []estimatePlanCostTestcase{
+		{
+			name: "empty",
+			plan: &domainPlan{},
+			want: costEstimate{Requests: 1, Cost: 0.001},
+		},
+		{
+			name: "selected",
+			plan: &domainPlan{Objects: objects},
+			want: costEstimate{Requests: 3, Bytes: 4 * bytesPerGB, Cost: 2.003},
+		},
+		{
+			name: "history",
+			plan: &domainPlan{
+				Objects: objects,
+				History: map[string][]*hsdsVersion{
+					testChunkKey: {objects[testChunkKey], {ID: "chunk-v1", Size: bytesPerGB / 2}},
+				},
+			},
+			want: costEstimate{Requests: 4, Bytes: 4*bytesPerGB + bytesPerGB/2, Cost: 2.254},
+		},
+	}
+
+	for _, tc := range testCases {
+		got := estimatePlanCost(tc.plan, rates)
+		if got.Requests != tc.want.Requests || got.Bytes != tc.want.Bytes || math.Abs(got.Cost-tc.want.Cost) > 1e-9 {
+			t.Errorf("%s: estimatePlanCost() = %+v (want %+v)", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMeasureCost(t *testing.T) {
+	var buf bytes.Buffer
+	rates := costRates{Request: 0.5, GB: bytesPerGB}
+	err := measureCost(context.Background(), &buf, newTestLoader(), []string{"home/user/domain.h5"}, rates, &runOptions{NotAfter: testTimestamp})
+	if err != nil {
+		t.Fatalf("measureCost() err = %v (want nil)", err)
+	}
+	// The domain file, the group and chunk-v1 are downloaded with 9 bytes.
+	want := "home/user/domain.h5: 3 requests, 9 bytes, estimated cost 10.5000\n" +
+		"total: 3 requests, 9 bytes, estimated cost 10.5000\n"
+	if got := buf.String(); got != want {
+		t.Errorf("measureCost() output = %q (want %q)", got, want)
+	}
+}
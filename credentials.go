@@ -0,0 +1,244 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// isExpiredCredentials reports whether err has been caused by a request
+// signed with credentials that have expired, e.g. temporary STS credentials
+// outliving their session.
+func isExpiredCredentials(err error) bool {
+	var ae interface{ ErrorCode() string }
+	if !errors.As(err, &ae) {
+		return false
+	}
+	switch ae.ErrorCode() {
+	case "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired":
+		return true
+	}
+	return false
+}
+
+// credentialsInvalidator is the interface wrapping the Invalidate method.
+//
+// Invalidate discards cached credentials, so they are retrieved again from
+// the underlying provider on the next request. It is implemented by
+// aws.CredentialsCache.
+type credentialsInvalidator interface {
+	Invalidate()
+}
+
+// refreshingS3Client is an s3API that retries requests failing due to
+// expired credentials once, after invalidating the cached credentials. This
+// allows long runs to outlive the temporary credentials they started with.
+// It also implements the s3StorerAPI interface, so dumps into a bucket do
+// the same.
+type refreshingS3Client struct {
+	s3API
+	// Credentials are the cached credentials used by the underlying client.
+	Credentials credentialsInvalidator
+
+	// selector sends S3 Select requests with the underlying client.
+	selector s3Selector
+	// storer sends the requests storing dumps with the underlying client.
+	storer s3StorerAPI
+}
+
+// newRefreshingS3Client returns an S3 client for conf that caches its
+// credentials and refreshes them if they expire during a run.
+func newRefreshingS3Client(conf aws.Config, optFns ...func(*s3.Options)) *refreshingS3Client {
+	cache, ok := conf.Credentials.(*aws.CredentialsCache)
+	if !ok && conf.Credentials != nil {
+		cache = aws.NewCredentialsCache(conf.Credentials)
+		conf.Credentials = cache
+	}
+	client := s3.NewFromConfig(conf, optFns...)
+	c := &refreshingS3Client{s3API: client, selector: &s3ClientSelector{Client: client}, storer: client}
+	if cache != nil {
+		c.Credentials = cache
+	}
+	return c
+}
+
+func (c *refreshingS3Client) retry(fn func() error) error {
+	err := fn()
+	if isExpiredCredentials(err) && c.Credentials != nil {
+		c.Credentials.Invalidate()
+		err = fn()
+	}
+	return err
+}
+
+func (c *refreshingS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	var output *s3.GetObjectOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.GetObject(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	var output *s3.HeadObjectOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.HeadObject(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	var output *s3.ListObjectVersionsOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.ListObjectVersions(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var output *s3.ListObjectsV2Output
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.ListObjectsV2(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error) {
+	var output *s3.GetBucketVersioningOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.GetBucketVersioning(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error) {
+	var output *s3.GetBucketLocationOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.GetBucketLocation(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	var output *s3.GetObjectTaggingOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.GetObjectTagging(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) GetObjectAcl(ctx context.Context, params *s3.GetObjectAclInput, optFns ...func(*s3.Options)) (*s3.GetObjectAclOutput, error) {
+	var output *s3.GetObjectAclOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.GetObjectAcl(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) GetBucketOwnershipControls(ctx context.Context, params *s3.GetBucketOwnershipControlsInput, optFns ...func(*s3.Options)) (*s3.GetBucketOwnershipControlsOutput, error) {
+	var output *s3.GetBucketOwnershipControlsOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.GetBucketOwnershipControls(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	var output *s3.RestoreObjectOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.RestoreObject(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	var output *s3.HeadBucketOutput
+	err := c.retry(func() (err error) {
+		output, err = c.s3API.HeadBucket(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+// SelectRecords implements the s3Selector interface, so S3 Select requests
+// share the client's credentials and are retried like all other requests.
+func (c *refreshingS3Client) SelectRecords(ctx context.Context, params *s3.SelectObjectContentInput) ([]byte, error) {
+	var data []byte
+	err := c.retry(func() (err error) {
+		data, err = c.selector.SelectRecords(ctx, params)
+		return err
+	})
+	return data, err
+}
+
+// PutObject stores an object. As the first attempt consumes the body, a
+// seekable body is rewound before it is sent again.
+func (c *refreshingS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var rewind func() error
+	if s, ok := params.Body.(io.Seeker); ok {
+		pos, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		rewind = func() error {
+			_, err := s.Seek(pos, io.SeekStart)
+			return err
+		}
+	}
+	var output *s3.PutObjectOutput
+	err := c.retry(func() (err error) {
+		if rewind != nil {
+			err = rewind()
+			if err != nil {
+				return err
+			}
+		}
+		output, err = c.storer.PutObject(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	var output *s3.CopyObjectOutput
+	err := c.retry(func() (err error) {
+		output, err = c.storer.CopyObject(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	var output *s3.PutObjectTaggingOutput
+	err := c.retry(func() (err error) {
+		output, err = c.storer.PutObjectTagging(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *refreshingS3Client) PutObjectAcl(ctx context.Context, params *s3.PutObjectAclInput, optFns ...func(*s3.Options)) (*s3.PutObjectAclOutput, error) {
+	var output *s3.PutObjectAclOutput
+	err := c.retry(func() (err error) {
+		output, err = c.storer.PutObjectAcl(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeExpiringProvider is an aws.CredentialsProvider whose first credentials
+// are rejected as expired by fakeSigningS3Client. All later ones are valid.
+type fakeExpiringProvider struct {
+	Calls int
+}
+
+func (p *fakeExpiringProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	p.Calls++
+	id := "key"
+	if p.Calls == 1 {
+		id = "expiredkey"
+	}
+	return aws.Credentials{AccessKeyID: id, SecretAccessKey: "secret"}, nil
+}
+
+// fakeSigningS3Client is a fakeS3Client that retrieves credentials for each
+// GetObject call and rejects expired ones like S3 would.
+type fakeSigningS3Client struct {
+	*fakeS3Client
+	Credentials aws.CredentialsProvider
+}
+
+func (c *fakeSigningS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	creds, err := c.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "expiredkey" {
+		return nil, &fakeAPIError{Code: "ExpiredToken"}
+	}
+	return c.fakeS3Client.GetObject(ctx, params, optFns...)
+}
+
+func TestRefreshingS3Client(t *testing.T) {
+	provider := &fakeExpiringProvider{}
+	cache := aws.NewCredentialsCache(provider)
+	client := &refreshingS3Client{
+		s3API: &fakeSigningS3Client{
+			fakeS3Client: &fakeS3Client{
+				Objects: []*fakeS3Object{
+					{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+				},
+			},
+			Credentials: cache,
+		},
+		Credentials: cache,
+	}
+
+	output, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String(testGroupKey),
+	})
+	if err != nil {
+		t.Fatalf("GetObject() err = %v (want nil)", err)
+	}
+	defer output.Body.Close()
+	got, err := ioutil.ReadAll(output.Body)
+	if err != nil || string(got) != "group" {
+		t.Errorf("GetObject() body = %q, %v (want %q)", got, err, "group")
+	}
+	if provider.Calls != 2 {
+		t.Errorf("GetObject() credential retrievals = %d (want 2)", provider.Calls)
+	}
+}
+
+// fakeSigningSelector is an s3Selector that rejects expired credentials like
+// fakeSigningS3Client.
+type fakeSigningSelector struct {
+	Credentials aws.CredentialsProvider
+}
+
+func (s *fakeSigningSelector) SelectRecords(ctx context.Context, params *s3.SelectObjectContentInput) ([]byte, error) {
+	creds, err := s.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "expiredkey" {
+		return nil, &fakeAPIError{Code: "ExpiredToken"}
+	}
+	return []byte(`{"id": "root"}`), nil
+}
+
+func TestRefreshingS3Client_SelectRecords(t *testing.T) {
+	provider := &fakeExpiringProvider{}
+	cache := aws.NewCredentialsCache(provider)
+	client := &refreshingS3Client{
+		s3API:       &fakeS3Client{},
+		Credentials: cache,
+		selector:    &fakeSigningSelector{Credentials: cache},
+	}
+
+	got, err := client.SelectRecords(context.Background(), &s3.SelectObjectContentInput{})
+	if err != nil || string(got) != `{"id": "root"}` {
+		t.Errorf("SelectRecords() = %q, %v (want %q)", got, err, `{"id": "root"}`)
+	}
+	if provider.Calls != 2 {
+		t.Errorf("SelectRecords() credential retrievals = %d (want 2)", provider.Calls)
+	}
+}
+
+// fakeSigningStorerClient is a fakeS3StorerClient that rejects expired
+// credentials like fakeSigningS3Client. Like S3, it reads the body of
+// rejected PutObject requests.
+type fakeSigningStorerClient struct {
+	*fakeS3StorerClient
+	Credentials aws.CredentialsProvider
+}
+
+func (c *fakeSigningStorerClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	creds, err := c.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "expiredkey" {
+		ioutil.ReadAll(params.Body)
+		return nil, &fakeAPIError{Code: "ExpiredToken"}
+	}
+	return c.fakeS3StorerClient.PutObject(ctx, params, optFns...)
+}
+
+func TestRefreshingS3Client_PutObject(t *testing.T) {
+	provider := &fakeExpiringProvider{}
+	cache := aws.NewCredentialsCache(provider)
+	storer := &fakeS3StorerClient{}
+	client := &refreshingS3Client{
+		s3API:       &fakeS3Client{},
+		Credentials: cache,
+		storer:      &fakeSigningStorerClient{fakeS3StorerClient: storer, Credentials: cache},
+	}
+
+	_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String(testGroupKey),
+		Body:   bytes.NewReader([]byte("group")),
+	})
+	if err != nil {
+		t.Fatalf("PutObject() err = %v (want nil)", err)
+	}
+	if got := string(storer.Objects[testGroupKey]); got != "group" {
+		t.Errorf("PutObject() stored %q (want %q)", got, "group")
+	}
+	if provider.Calls != 2 {
+		t.Errorf("PutObject() credential retrievals = %d (want 2)", provider.Calls)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Schemes of destination URLs.
+const (
+	// destSchemeFile stores dumps on the local filesystem.
+	destSchemeFile = "file"
+	// destSchemeS3 stores dumps in an S3 bucket.
+	destSchemeS3 = "s3"
+	// destSchemeStdout writes dumps to stdout as a single stream. It is
+	// selected with the destination "-" rather than by a URL.
+	destSchemeStdout = "stdout"
+	// destSchemeHTTP and destSchemeHTTPS restore dumps into an HSDS service
+	// through its REST API.
+	destSchemeHTTP  = "http"
+	destSchemeHTTPS = "https"
+)
+
+// destination is the target of a dump, given as URL with -dest, e.g.
+// file:///mnt/dump, s3://bucket/prefix or http://hsds.example.com:5101, or as
+// "-" for stdout.
+type destination struct {
+	Scheme string
+	// Bucket is the bucket of s3 destinations.
+	Bucket string
+	// Path is the directory of file destinations and the key prefix of s3
+	// destinations.
+	Path string
+	// Endpoint is the base URL of the HSDS service of http and https
+	// destinations.
+	Endpoint string
+}
+
+// invalidDestinationError indicates that a destination URL cannot be used.
+type invalidDestinationError struct {
+	Dest   string
+	Reason string
+}
+
+func (err *invalidDestinationError) Error() string {
+	return fmt.Sprintf("invalid destination %q: %s", err.Dest, err.Reason)
+}
+
+// parseDestination parses the destination URL s. Destinations without a
+// scheme are directories on the local filesystem, except for "-", which is
+// stdout.
+func parseDestination(s string) (*destination, error) {
+	if s == "-" {
+		return &destination{Scheme: destSchemeStdout}, nil
+	}
+	if !strings.Contains(s, "://") {
+		if s == "" {
+			return nil, &invalidDestinationError{Dest: s, Reason: "empty path"}
+		}
+		return &destination{Scheme: destSchemeFile, Path: s}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, &invalidDestinationError{Dest: s, Reason: err.Error()}
+	}
+
+	switch u.Scheme {
+	case destSchemeFile:
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, &invalidDestinationError{Dest: s, Reason: "remote hosts are not supported"}
+		}
+		if u.Path == "" {
+			return nil, &invalidDestinationError{Dest: s, Reason: "empty path"}
+		}
+		return &destination{Scheme: destSchemeFile, Path: filepath.FromSlash(u.Path)}, nil
+	case destSchemeS3:
+		if u.Host == "" {
+			return nil, &invalidDestinationError{Dest: s, Reason: "missing bucket"}
+		}
+		return &destination{Scheme: destSchemeS3, Bucket: u.Host, Path: strings.Trim(u.Path, "/")}, nil
+	case destSchemeHTTP, destSchemeHTTPS:
+		if u.Host == "" {
+			return nil, &invalidDestinationError{Dest: s, Reason: "missing host"}
+		}
+		if u.User != nil {
+			return nil, &invalidDestinationError{Dest: s, Reason: "credentials must be set with HS_USERNAME and HS_PASSWORD"}
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return nil, &invalidDestinationError{Dest: s, Reason: "queries and fragments are not supported"}
+		}
+		endpoint := u.Scheme + "://" + u.Host + strings.TrimSuffix(u.Path, "/")
+		return &destination{Scheme: u.Scheme, Endpoint: endpoint}, nil
+	default:
+		return nil, &invalidDestinationError{Dest: s, Reason: fmt.Sprintf("unsupported scheme %s", u.Scheme)}
+	}
+}
+
+// Local reports whether d is a directory on the local filesystem.
+func (d *destination) Local() bool {
+	return d.Scheme == destSchemeFile
+}
+
+// Storer returns the storer writing to d. File destinations are written by
+// local, whose root must have been set to d.Path already. S3 destinations are
+// written by an s3HSDSStorer using the client returned by newClient, stdout
+// by a streamHSDSStorer. HTTP destinations are restored by an hsdsAPIStorer,
+// authenticated with the HS_USERNAME and HS_PASSWORD environment variables.
+func (d *destination) Storer(local *filesystemHSDSStorer, newClient func() s3StorerAPI) hsdsStorer {
+	if d.Local() {
+		return local
+	}
+	if d.Scheme == destSchemeStdout {
+		return &streamHSDSStorer{W: os.Stdout}
+	}
+	if d.Scheme == destSchemeHTTP || d.Scheme == destSchemeHTTPS {
+		return &hsdsAPIStorer{
+			Endpoint: d.Endpoint,
+			Username: os.Getenv("HS_USERNAME"),
+			Password: os.Getenv("HS_PASSWORD"),
+		}
+	}
+	return &s3HSDSStorer{Client: newClient(), Bucket: d.Bucket, Prefix: d.Path}
+}
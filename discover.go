@@ -0,0 +1,78 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// domainFileName is the name of the object holding a domain's metadata. It is
+// stored below the domain's name.
+const domainFileName = ".domain.json"
+
+// hsdsDomainDiscoverer is the interface wrapping the DiscoverDomains method.
+//
+// DiscoverDomains returns the names of all domains and folders stored below
+// folder, including those in nested folders.
+type hsdsDomainDiscoverer interface {
+	DiscoverDomains(ctx context.Context, folder string) ([]string, error)
+}
+
+// selectDomains returns the names of the domains to process for the given
+// command-line arguments. If opts.Discover is true, args are folders, which
+// are expanded to all domains below them using loader. Folders themselves are
+// skipped, as they have no objects to replicate.
+//
+// If opts.Owner is not empty, only domains owned by that user are returned.
+// If opts.Class is not empty, only domains of that class are returned,
+// including folders.
+func selectDomains(ctx context.Context, loader hsdsDomainLoader, args []string, opts *runOptions) ([]string, error) {
+	if !opts.Discover && opts.Owner == "" && opts.Class == "" {
+		return args, nil
+	}
+
+	names := args
+	if opts.Discover {
+		var discoverer hsdsDomainDiscoverer
+		ok := findLoader(loader, func(l interface{}) (ok bool) {
+			discoverer, ok = l.(hsdsDomainDiscoverer)
+			return ok
+		})
+		if !ok {
+			return nil, errors.New("loader does not support discovering domains")
+		}
+		names = nil
+		for _, folder := range args {
+			found, err := discoverer.DiscoverDomains(ctx, strings.Trim(folder, "/"))
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, found...)
+		}
+	}
+
+	var domains []string
+	for _, name := range names {
+		domain, err := loader.LoadDomain(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Class != "" {
+			if class := domain.DomainClass(); class != opts.Class {
+				debug("skipping %s: class %s does not match %s", name, class, opts.Class)
+				continue
+			}
+		} else if opts.Discover && domain.DomainClass() == domainClassFolder {
+			continue
+		}
+		if opts.Owner != "" && domain.Owner != opts.Owner {
+			continue
+		}
+		domains = append(domains, name)
+	}
+	return domains, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func domainObject(t *testing.T, name string, domain *hsdsDomain) *fakeS3Object {
+	b, err := json.Marshal(domain)
+	if err != nil {
+		t.Fatalf("json.Marshal() err = %v (want nil)", err)
+	}
+	return &fakeS3Object{
+		Key:          name + "/" + domainFileName,
+		VersionID:    name + "-v1",
+		LastModified: testTimestamp,
+		Data:         b,
+	}
+}
+
+func TestSelectDomains_Owner(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			domainObject(t, "home", &hsdsDomain{Owner: "admin"}),
+			domainObject(t, "home/alice", &hsdsDomain{Owner: "alice"}),
+			domainObject(t, "home/alice/a.h5", &hsdsDomain{Owner: "alice", Root: &testRootID}),
+			domainObject(t, "home/alice/shared/b.h5", &hsdsDomain{Owner: "bob", Root: &testRootID}),
+			domainObject(t, "home/bob/c.h5", &hsdsDomain{Owner: "bob", Root: &testRootID}),
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	opts := &runOptions{Discover: true, Owner: "bob"}
+
+	domains, err := selectDomains(context.Background(), loader, []string{"/home/"}, opts)
+	if err != nil {
+		t.Fatalf("selectDomains() err = %v (want nil)", err)
+	}
+	want := []string{"home/alice/shared/b.h5", "home/bob/c.h5"}
+	if !reflect.DeepEqual(domains, want) {
+		t.Fatalf("selectDomains() = %q (want %q)", domains, want)
+	}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	err = replicate(loader, storer, domains, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	for _, name := range []string{"home/alice/a.h5", "home/alice/shared/b.h5", "home/bob/c.h5"} {
+		_, err := os.Stat(filepath.Join(root, filepath.FromSlash(name), domainFileName))
+		dumped := err == nil
+		if want := name != "home/alice/a.h5"; dumped != want {
+			t.Errorf("replicate() dumped %s = %v (want %v)", name, dumped, want)
+		}
+	}
+}
+
+type selectDomainsClassTestcase struct {
+	class string
+	want  []string
+}
+
+func TestSelectDomains_Class(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			domainObject(t, "home", &hsdsDomain{Owner: "admin"}),
+			domainObject(t, "home/alice", &hsdsDomain{Owner: "alice", Class: domainClassFolder}),
+			domainObject(t, "home/alice/a.h5", &hsdsDomain{Owner: "alice", Root: &testRootID, Class: domainClassDomain}),
+			domainObject(t, "home/bob/c.h5", &hsdsDomain{Owner: "bob", Root: &testRootID}),
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+
+	testCases := []selectDomainsClassTestcase{
+		{class: "", want: []string{"home/alice/a.h5", "home/bob/c.h5"}},
+		{class: domainClassDomain, want: []string{"home/alice/a.h5", "home/bob/c.h5"}},
+		{class: domainClassFolder, want: []string{"home/alice"}},
+	}
+	for _, tc := range testCases {
+		opts := &runOptions{Discover: true, Class: tc.class}
+		domains, err := selectDomains(context.Background(), loader, []string{"home"}, opts)
+		if err != nil {
+			t.Fatalf("%q: selectDomains() err = %v (want nil)", tc.class, err)
+		}
+		if !reflect.DeepEqual(domains, tc.want) {
+			t.Errorf("%q: selectDomains() = %q (want %q)", tc.class, domains, tc.want)
+		}
+	}
+
+	// Without -discover, the named folder is skipped as well.
+	domains, err := selectDomains(context.Background(), loader, []string{"home/alice", "home/bob/c.h5"}, &runOptions{Class: domainClassDomain})
+	if err != nil {
+		t.Fatalf("selectDomains() err = %v (want nil)", err)
+	}
+	if want := []string{"home/bob/c.h5"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("selectDomains() = %q (want %q)", domains, want)
+	}
+
+	// Folders are dumped as their domain files only.
+	root := t.TempDir()
+	err = replicate(loader, &filesystemHSDSStorer{Root: root}, []string{"home/alice"}, &runOptions{})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "home", "alice", domainFileName)); err != nil {
+		t.Errorf("replicate() did not store the folder's domain file: %v", err)
+	}
+	if err := validDomainClass("file"); err == nil {
+		t.Errorf("validDomainClass(%q) err = nil (want error)", "file")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// linkedDomainName returns the name of the domain that the external link
+// target refers to from the domain identified by from. Absolute targets, e.g.
+// /home/user/other.h5, name the domain directly, relative targets are
+// resolved against the folder of from.
+func linkedDomainName(from, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return strings.TrimPrefix(path.Clean(target), "/")
+	}
+	return path.Join(path.Dir(from), target)
+}
+
+// externalDomains returns the names of the domains that the groups of the
+// domain described by plan link to with external links, sorted by name. The
+// selected versions of the group metadata objects are loaded from loader.
+func externalDomains(ctx context.Context, loader hsdsObjectLoader, plan *domainPlan) ([]string, error) {
+	domains := map[string]bool{}
+	for key, version := range plan.Objects {
+		k, err := parseObjectKey(key)
+		if err != nil || k.Type != entityTypeGroup || k.IsChunk() {
+			continue
+		}
+		data, err := loadObjectVersion(ctx, loader, key, version, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		group := &hsdsGroup{}
+		err = json.Unmarshal(data, group)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range group.Links {
+			if link.Class != hsdsLinkClassExternal || link.H5Domain == "" {
+				continue
+			}
+			domains[linkedDomainName(plan.Name, link.H5Domain)] = true
+		}
+	}
+	delete(domains, plan.Name)
+
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// domainQueue is the list of domains processed by a run, to which the
+// domains referenced by external links are appended while they are followed.
+type domainQueue struct {
+	// Names are the names of the queued domains in processing order.
+	Names []string
+	// MaxDomains is the number of domains beyond which no further linked
+	// domains are queued. It is unlimited if it is zero.
+	MaxDomains int
+
+	// depth maps the names of the queued domains to the number of links
+	// followed to reach them.
+	depth map[string]int
+	// limitWarning makes sure that reaching MaxDomains is only reported
+	// once.
+	limitWarning bool
+}
+
+func newDomainQueue(names []string, maxDomains int) *domainQueue {
+	q := &domainQueue{MaxDomains: maxDomains, depth: map[string]int{}}
+	for _, name := range names {
+		if _, ok := q.depth[name]; !ok {
+			q.depth[name] = 0
+		}
+		q.Names = append(q.Names, name)
+	}
+	return q
+}
+
+// Linked reports whether the domain identified by name has only been queued
+// because another domain links to it.
+func (q *domainQueue) Linked(name string) bool {
+	return q.depth[name] > 0
+}
+
+// Follow queues the domains that the domain described by plan links to, if
+// they have not been queued yet and plan's domain has been reached by
+// following less than maxDepth links. Domains that have been queued before
+// are not queued again, so cyclic links are followed only once.
+func (q *domainQueue) Follow(ctx context.Context, loader hsdsObjectLoader, plan *domainPlan, maxDepth int) error {
+	depth := q.depth[plan.Name]
+	if depth >= maxDepth {
+		return nil
+	}
+	names, err := externalDomains(ctx, loader, plan)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := q.depth[name]; ok {
+			continue
+		}
+		if q.MaxDomains > 0 && len(q.Names) >= q.MaxDomains {
+			if !q.limitWarning {
+				warn("not following link from domain %q to %q: %d domains queued already", plan.Name, name, len(q.Names))
+				q.limitWarning = true
+			}
+			continue
+		}
+		debug("domain %q links to domain %q", plan.Name, name)
+		q.depth[name] = depth + 1
+		q.Names = append(q.Names, name)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type linkedDomainNameTestcase struct {
+	from   string
+	target string
+	want   string
+}
+
+func TestLinkedDomainName(t *testing.T) {
+	testcases := []linkedDomainNameTestcase{
+		{"home/user/a.h5", "/home/other/b.h5", "home/other/b.h5"},
+		{"home/user/a.h5", "b.h5", "home/user/b.h5"},
+		{"home/user/a.h5", "../other/b.h5", "home/other/b.h5"},
+		{"home/user/a.h5", "//home/other/./b.h5", "home/other/b.h5"},
+	}
+	for _, tc := range testcases {
+		got := linkedDomainName(tc.from, tc.target)
+		if got != tc.want {
+			t.Errorf("%s -> %s: linkedDomainName() = %q (want %q)", tc.from, tc.target, got, tc.want)
+		}
+	}
+}
+
+type followDomainLinksTestcase struct {
+	depth      int
+	maxDomains int
+	want       []string
+}
+
+func TestReplicate_FollowDomainLinks(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	rootB := MustParseID("g-a1b2c3d4-e5f60718-59a2-a82de4-afeaa7")
+	rootC := MustParseID("g-0badc0de-12345678-59a2-a82de4-afeaa7")
+	// a links to b, which links back to a, to c and to a missing domain.
+	groups := map[string]string{
+		testGroupKey: `{"links": {
+			"b": {"class": "H5L_TYPE_EXTERNAL", "h5domain": "/home/user/b.h5", "h5path": "/"}}}`,
+		"db/a1b2c3d4-e5f60718/.group.json": `{"links": {
+			"a": {"class": "H5L_TYPE_EXTERNAL", "h5domain": "a.h5", "h5path": "/"},
+			"c": {"class": "H5L_TYPE_EXTERNAL", "h5domain": "/home/other/c.h5", "h5path": "/"},
+			"gone": {"class": "H5L_TYPE_EXTERNAL", "h5domain": "missing.h5", "h5path": "/"}}}`,
+		"db/0badc0de-12345678/.group.json": `{"links": {}}`,
+	}
+	all := []string{"home/user/a.h5", "home/user/b.h5", "home/other/c.h5"}
+
+	testcases := []followDomainLinksTestcase{
+		{depth: 0, want: all[:1]},
+		{depth: 1, want: all[:2]},
+		{depth: 2, want: all},
+		{depth: 2, maxDomains: 2, want: all[:2]},
+	}
+	for _, tc := range testcases {
+		loader := &fakeHSDSLoader{
+			Domains: map[string]*hsdsDomain{
+				"home/user/a.h5":  {Root: &testRootID},
+				"home/user/b.h5":  {Root: &rootB},
+				"home/other/c.h5": {Root: &rootC},
+			},
+			Versions: map[string][]*hsdsVersion{},
+			Objects:  map[string][]byte{},
+		}
+		for key, data := range groups {
+			loader.Versions[key] = []*hsdsVersion{{ID: key + "-v1", LastModified: testTimestamp, Size: int64(len(data))}}
+			loader.Objects[key+"-v1"] = []byte(data)
+		}
+
+		root := t.TempDir()
+		storer := &filesystemHSDSStorer{Root: root}
+		opts := &runOptions{FollowDomainLinks: tc.depth, MaxDomains: tc.maxDomains}
+		err := replicate(loader, storer, all[:1], opts)
+		if err != nil {
+			t.Errorf("%+v: replicate() err = %v (want nil)", tc, err)
+			continue
+		}
+		var got []string
+		for _, name := range all {
+			_, err := os.Stat(filepath.Join(root, filepath.FromSlash(name), ".domain.json"))
+			if err == nil {
+				got = append(got, name)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: replicate() stored %q (want %q)", tc, got, tc.want)
+		}
+		if n := loader.DomainCalls["home/user/a.h5"]; n != 1 {
+			t.Errorf("%+v: replicate() loaded home/user/a.h5 %d times (want 1)", tc, n)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Encodings used to map domain names to the keys of their metadata objects.
+const (
+	// nameEncodingPath uses the domain name as the key's path, e.g.
+	// "home/user/domain.h5".
+	nameEncodingPath = "path"
+	// nameEncodingDNS maps DNS-style domain names to paths by reversing their
+	// labels, e.g. "domain.user.home" to "home/user/domain".
+	nameEncodingDNS = "dns"
+	// nameEncodingPercent percent-encodes each path segment of the domain
+	// name, e.g. "home/user/my domain.h5" to "home/user/my%20domain.h5".
+	nameEncodingPercent = "percent"
+)
+
+// unknownNameEncodingError indicates that a domain name encoding is not
+// supported.
+type unknownNameEncodingError struct {
+	Encoding string
+}
+
+func (err *unknownNameEncodingError) Error() string {
+	return fmt.Sprintf("unknown domain name encoding '%s' (want %s, %s or %s)",
+		err.Encoding, nameEncodingPath, nameEncodingDNS, nameEncodingPercent)
+}
+
+// validNameEncoding returns an error if encoding is not a supported domain
+// name encoding. The empty string is equivalent to nameEncodingPath.
+func validNameEncoding(encoding string) error {
+	switch encoding {
+	case "", nameEncodingPath, nameEncodingDNS, nameEncodingPercent:
+		return nil
+	}
+	return &unknownNameEncodingError{Encoding: encoding}
+}
+
+// domainKey returns the key of the metadata object of the domain identified
+// by name, transformed according to encoding.
+func domainKey(encoding, name string) (string, error) {
+	switch encoding {
+	case "", nameEncodingPath:
+		return path.Join(name, domainFileName), nil
+	case nameEncodingDNS:
+		labels := strings.Split(strings.Trim(name, "."), ".")
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return path.Join(path.Join(labels...), domainFileName), nil
+	case nameEncodingPercent:
+		segments := strings.Split(strings.Trim(name, "/"), "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		return path.Join(path.Join(segments...), domainFileName), nil
+	}
+	return "", &unknownNameEncodingError{Encoding: encoding}
+}
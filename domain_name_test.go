@@ -0,0 +1,69 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+type domainKeyTestcase struct {
+	name     string
+	encoding string
+	domain   string
+	want     string
+	wantErr  bool
+}
+
+func TestDomainKey(t *testing.T) {
+	testCases := []domainKeyTestcase{
+		{
+			name:   "default",
+			domain: "home/user/domain.h5",
+			want:   "home/user/domain.h5/.domain.json",
+		},
+		{
+			name:     "path",
+			encoding: nameEncodingPath,
+			domain:   "home/user/domain.h5",
+			want:     "home/user/domain.h5/.domain.json",
+		},
+		{
+			name:     "dns",
+			encoding: nameEncodingDNS,
+			domain:   "tall.test.hdfgroup.org",
+			want:     "org/hdfgroup/test/tall/.domain.json",
+		},
+		{
+			name:     "percent",
+			encoding: nameEncodingPercent,
+			domain:   "/home/user/my domain?.h5",
+			want:     "home/user/my%20domain%3F.h5/.domain.json",
+		},
+		{
+			name:     "unknown",
+			encoding: "base64",
+			domain:   "home/user/domain.h5",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := domainKey(tc.encoding, tc.domain)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: domainKey() err = nil (want error)", tc.name)
+			}
+			if validNameEncoding(tc.encoding) == nil {
+				t.Errorf("%s: validNameEncoding() = nil (want error)", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: domainKey() err = %v (want nil)", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: domainKey() = %q (want %q)", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// domainSchema is the JSON schema describing the structure of the
+// .domain.json files hss3dump expects. Only the subset of JSON schema
+// understood by jsonSchema is used.
+const domainSchema = `{
+	"type": "object",
+	"required": ["owner", "acls"],
+	"properties": {
+		"owner": {"type": "string"},
+		"root": {"type": "string"},
+		"class": {"type": "string"},
+		"created": {"type": "number"},
+		"lastModified": {"type": "number"},
+		"acls": {
+			"type": "object",
+			"additionalProperties": {
+				"type": "object",
+				"required": ["create", "read", "update", "delete", "readACL", "updateACL"],
+				"properties": {
+					"create": {"type": "boolean"},
+					"read": {"type": "boolean"},
+					"update": {"type": "boolean"},
+					"delete": {"type": "boolean"},
+					"readACL": {"type": "boolean"},
+					"updateACL": {"type": "boolean"}
+				}
+			}
+		}
+	}
+}`
+
+// jsonSchema is a minimal JSON schema supporting the type, required,
+// properties and additionalProperties keywords.
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+}
+
+// schemaError indicates that a JSON document does not match a schema. Path
+// identifies the offending field, e.g. "$.acls.alice.read".
+type schemaError struct {
+	Path string
+	Msg  string
+}
+
+func (e *schemaError) Error() string {
+	return fmt.Sprintf("schema: %s: %s", e.Path, e.Msg)
+}
+
+// validateDomainSchema validates the encoded domain b against domainSchema.
+func validateDomainSchema(b []byte) error {
+	schema := &jsonSchema{}
+	err := json.Unmarshal([]byte(domainSchema), schema)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	return schema.validate("$", v)
+}
+
+// jsonType returns the JSON schema type name of a value decoded by
+// encoding/json.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func (s *jsonSchema) validate(path string, v interface{}) error {
+	if s.Type != "" && jsonType(v) != s.Type {
+		return &schemaError{Path: path, Msg: fmt.Sprintf("got %s (want %s)", jsonType(v), s.Type)}
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			return &schemaError{Path: path + "." + name, Msg: "missing required field"}
+		}
+	}
+
+	// Validate fields in a deterministic order, so the same field is
+	// reported for the same document.
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fs, ok := s.Properties[name]
+		if !ok {
+			fs = s.AdditionalProperties
+		}
+		if fs == nil {
+			continue
+		}
+		err := fs.validate(path+"."+name, obj[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
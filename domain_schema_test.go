@@ -0,0 +1,75 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type validateDomainSchemaTestcase struct {
+	name     string
+	domain   string
+	wantPath string
+}
+
+func TestValidateDomainSchema(t *testing.T) {
+	testCases := []validateDomainSchemaTestcase{
+		{
+			name:   "valid",
+			domain: `{"owner": "alice", "root": "g-d12a20a5-6c27622f-2b1b-bbd9a2-f8c087", "acls": {"alice": {"create": true, "read": true, "update": true, "delete": true, "readACL": true, "updateACL": true}}}`,
+		},
+		{
+			name:     "missing-owner",
+			domain:   `{"acls": {}}`,
+			wantPath: "$.owner",
+		},
+		{
+			name:     "missing-permission",
+			domain:   `{"owner": "alice", "acls": {"alice": {"create": true, "read": true, "update": true, "delete": true, "readACL": true}}}`,
+			wantPath: "$.acls.alice.updateACL",
+		},
+		{
+			name:     "wrong-type",
+			domain:   `{"owner": "alice", "acls": {}, "created": "yesterday"}`,
+			wantPath: "$.created",
+		},
+	}
+
+	for _, tc := range testCases {
+		err := validateDomainSchema([]byte(tc.domain))
+		if tc.wantPath == "" {
+			if err != nil {
+				t.Errorf("%s: validateDomainSchema() err = %v (want nil)", tc.name, err)
+			}
+			continue
+		}
+		var se *schemaError
+		if !errors.As(err, &se) || se.Path != tc.wantPath {
+			t.Errorf("%s: validateDomainSchema() err = %v (want error at %s)", tc.name, err, tc.wantPath)
+		}
+	}
+}
+
+func TestS3HSDSDomainLoader_ValidateSchema(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: "home/domain.h5/.domain.json", VersionID: "v1", LastModified: testTimestamp, Data: []byte(`{"acls": {}}`)},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	_, err := loader.LoadDomain(context.Background(), "home/domain.h5")
+	if err != nil {
+		t.Errorf("LoadDomain() err = %v (want nil without validation)", err)
+	}
+
+	loader.ValidateSchema = true
+	_, err = loader.LoadDomain(context.Background(), "home/domain.h5")
+	var se *schemaError
+	if !errors.As(err, &se) || se.Path != "$.owner" {
+		t.Errorf("LoadDomain() err = %v (want missing owner)", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Types of the events written by an eventStream.
+const (
+	eventDomainStart = "domain_start"
+	eventDomainDone  = "domain_done"
+	eventObject      = "object"
+)
+
+// Statuses of the objects and domains reported by an eventStream.
+const (
+	eventStatusStored  = "stored"
+	eventStatusSkipped = "skipped"
+	eventStatusFailed  = "failed"
+	eventStatusOK      = "ok"
+)
+
+// event is a single event written by an eventStream.
+type event struct {
+	Type    string `json:"type"`
+	Domain  string `json:"domain"`
+	Key     string `json:"key,omitempty"`
+	Version string `json:"version,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// eventStream writes the progress of a run as newline-delimited JSON events,
+// one per started and finished domain and one per completed object. It is
+// safe for concurrent use. All methods of a nil *eventStream are no-ops.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+
+	domain string
+	plan   *domainPlan
+}
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{enc: json.NewEncoder(w)}
+}
+
+// emit writes e. Once writing an event has failed, a warning is issued and
+// all further events are dropped, as consumers cannot recover from a partial
+// stream anyway.
+func (s *eventStream) emit(e *event) {
+	if s.err != nil {
+		return
+	}
+	s.err = s.enc.Encode(e)
+	if s.err != nil {
+		warn("cannot write events: %v", s.err)
+	}
+}
+
+// StartDomain reports that the replication of the domain identified by name
+// has started. All objects reported until the next call are attributed to
+// it.
+func (s *eventStream) StartDomain(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.domain = name
+	s.plan = nil
+	s.emit(&event{Type: eventDomainStart, Domain: name})
+}
+
+// SetPlan sets the plan of the current domain, which provides the versions
+// of the reported objects.
+func (s *eventStream) SetPlan(plan *domainPlan) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plan = plan
+}
+
+// FinishDomain reports that the replication of the current domain has
+// finished. err is the error that aborted it or nil.
+func (s *eventStream) FinishDomain(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &event{Type: eventDomainDone, Domain: s.domain, Status: eventStatusOK}
+	if err != nil {
+		e.Status = eventStatusFailed
+		e.Error = err.Error()
+	}
+	s.emit(e)
+	s.domain = ""
+	s.plan = nil
+}
+
+// Object reports that the object identified by key has been completed with
+// the given status, after size bytes have been stored for it.
+func (s *eventStream) Object(key string, size int, status string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &event{Type: eventObject, Domain: s.domain, Key: key, Bytes: int64(size), Status: status}
+	if s.plan != nil {
+		if v, ok := s.plan.Objects[key]; ok {
+			e.Version = v.ID
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.emit(e)
+}
@@ -0,0 +1,53 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestReplicate_Events(t *testing.T) {
+	var buf bytes.Buffer
+	loader := newTestLoader()
+	opts := &runOptions{NotAfter: testTimestamp, Events: newEventStream(&buf)}
+	storer := &filesystemHSDSStorer{Root: t.TempDir()}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	var events []*event
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		e := &event{}
+		err := json.Unmarshal(scanner.Bytes(), e)
+		if err != nil {
+			t.Fatalf("event %q is not valid JSON: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 4 {
+		t.Fatalf("replicate() wrote %d events (want 4)", len(events))
+	}
+	if events[0].Type != eventDomainStart || events[0].Domain != "home/user/domain.h5" {
+		t.Errorf("first event = %+v (want domain_start)", events[0])
+	}
+	if last := events[3]; last.Type != eventDomainDone || last.Status != eventStatusOK {
+		t.Errorf("last event = %+v (want successful domain_done)", last)
+	}
+	versions := map[string]string{}
+	for _, e := range events[1:3] {
+		if e.Type != eventObject || e.Status != eventStatusStored || e.Domain != "home/user/domain.h5" {
+			t.Errorf("event = %+v (want stored object)", e)
+		}
+		versions[e.Key] = e.Version
+	}
+	if versions[testChunkKey] != "chunk-v1" || versions[testGroupKey] != "group-v1" {
+		t.Errorf("object event versions = %v (want chunk-v1 and group-v1)", versions)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// exitUsage is the exit code of invocations with unsupported combinations of
+// flags. It matches the exit code of the flag package for invalid flags.
+const exitUsage = 2
+
+// flagRule restricts the flags that may be combined with a flag.
+type flagRule struct {
+	// Flag is the flag the rule applies to if it is set.
+	Flag string
+	// Conflicts lists the flags that cannot be set along with Flag.
+	Conflicts []string
+	// Requires lists the flags of which at least one must be set along with
+	// Flag.
+	Requires []string
+}
+
+// flagConflictError indicates that a flag has been set along with a
+// conflicting flag or without a flag it requires.
+type flagConflictError struct {
+	Flag string
+	// Value describes the value of Flag that causes the conflict, if the
+	// conflict depends on it.
+	Value string
+	// Conflict is the conflicting flag, if any.
+	Conflict string
+	// Requires lists the flags of which none has been set.
+	Requires []string
+}
+
+func (err *flagConflictError) Error() string {
+	flag := "-" + err.Flag
+	if err.Value != "" {
+		flag += " " + err.Value
+	}
+	if err.Conflict != "" {
+		return fmt.Sprintf("%s cannot be combined with -%s", flag, err.Conflict)
+	}
+	return fmt.Sprintf("%s requires %s", flag, joinFlags(err.Requires))
+}
+
+// joinFlags returns the names of flags prefixed with dashes as an
+// enumeration, e.g. "-b, -b-map or -consistent".
+func joinFlags(flags []string) string {
+	s := make([]string, len(flags))
+	for i, f := range flags {
+		s[i] = "-" + f
+	}
+	if len(s) == 1 {
+		return s[0]
+	}
+	return strings.Join(s[:len(s)-1], ", ") + " or " + s[len(s)-1]
+}
+
+// exclusiveFlags returns rules that forbid combining any two of flags.
+func exclusiveFlags(flags ...string) []flagRule {
+	rules := make([]flagRule, 0, len(flags))
+	for i, f := range flags {
+		rules = append(rules, flagRule{Flag: f, Conflicts: flags[i+1:]})
+	}
+	return rules
+}
+
+// commandFlags are the flags selecting commands other than dumping domains.
+var commandFlags = []string{
+	"l", "acl-history", "list-owners", "list-prefixes", "list-versions-for",
+	"object", "verify-sizes", "measure-only", "measure-cost", "restore-from-archive", "plan", "execute",
+	"chunk-reassembly", "probe",
+}
+
+// flagRules are the rules all invocations must satisfy. Commands are mutually
+// exclusive.
+var flagRules = append(exclusiveFlags(commandFlags...), []flagRule{
+	{Flag: "verbatim", Conflicts: []string{"canonicalize-ids", "detect-compression", "all-versions", "compress-domain-json", "indent", "normalize-timestamps"}},
+	{Flag: "skip-unchanged-domains", Conflicts: []string{"b", "b-map"}},
+	{Flag: "exact-time", Requires: []string{"b", "b-map"}},
+	{Flag: "dedupe-versions", Requires: []string{"all-versions"}},
+	{Flag: "hardlink-latest", Requires: []string{"all-versions"}},
+	{Flag: "version", Requires: []string{"object"}},
+	{Flag: "resume-verify", Requires: []string{"manifest"}},
+	{Flag: "summary", Requires: []string{"l"}},
+	{Flag: "max-domains", Requires: []string{"follow-domain-links"}},
+	// S3 Select cannot parse compressed metadata objects.
+	{Flag: "use-s3-select", Requires: []string{"chunk-reassembly"}, Conflicts: []string{"detect-compression"}},
+	{Flag: "j", Requires: []string{"verify-sizes"}},
+	{Flag: "cost-request", Requires: []string{"measure-cost"}},
+	{Flag: "cost-gb", Requires: []string{"measure-cost"}},
+	{Flag: "restore-tier", Requires: []string{"restore-from-archive"}},
+	{Flag: "restore-days", Requires: []string{"restore-from-archive"}},
+	{Flag: "version-cache-ttl", Requires: []string{"version-cache"}},
+	{Flag: "cache-size", Requires: []string{"cache-dir"}},
+	{Flag: "failure-window", Requires: []string{"max-failure-rate"}},
+	{Flag: "redact", Requires: []string{"acl-history", "list-owners"}},
+}...)
+
+// flagEnabled reports whether the flag name has been set to a value other
+// than one disabling it, given the values of the set flags.
+func flagEnabled(set map[string]string, name string) bool {
+	v, ok := set[name]
+	return ok && v != "" && v != "false" && v != "0"
+}
+
+// validateFlags checks the flags in set, which maps the names of the flags
+// set on the command line to their values, against rules. The first
+// violated rule is returned as a flagConflictError.
+func validateFlags(set map[string]string, rules []flagRule) error {
+	for _, r := range rules {
+		if !flagEnabled(set, r.Flag) {
+			continue
+		}
+		for _, c := range r.Conflicts {
+			if flagEnabled(set, c) {
+				return &flagConflictError{Flag: r.Flag, Conflict: c}
+			}
+		}
+		if len(r.Requires) == 0 {
+			continue
+		}
+		found := false
+		for _, req := range r.Requires {
+			if flagEnabled(set, req) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &flagConflictError{Flag: r.Flag, Requires: r.Requires}
+		}
+	}
+	return nil
+}
+
+// snapshotConflicts are the flags that cannot be combined with multiple -b
+// timestamps, as only dumps are stored in one snapshot directory per
+// timestamp.
+var snapshotConflicts = []string{
+	"l", "acl-history", "list-owners", "verify-sizes", "measure-only", "measure-cost",
+	"restore-from-archive", "chunk-reassembly", "plan", "execute", "manifest", "index",
+}
+
+// remoteDestConflicts are the flags that require a local destination.
+var remoteDestConflicts = []string{"manifest", "index", "verify-sizes", "chunk-reassembly", "since-manifest", "temp-dir"}
+
+// validateFlagValues checks the combinations of flags that are unsupported
+// only for some of their values, which flagRules cannot express. set maps the
+// names of the flags set on the command line to their values, before and dest
+// are the parsed values of -b and -dest, if set. Violations are returned as
+// flagConflictErrors, like those of validateFlags.
+func validateFlagValues(set map[string]string, before *beforeValue, dest *destination) error {
+	// The default overwrite policy is overwritePolicyOverwrite.
+	if flagEnabled(set, "resume-verify") && set["overwrite-policy"] != overwritePolicySkip {
+		return &flagConflictError{Flag: "resume-verify", Requires: []string{"overwrite-policy " + overwritePolicySkip}}
+	}
+	if before.DomainOffset != nil && len(before.Times) > 0 {
+		return &flagConflictError{Flag: "b", Value: domainTimePrefix + "DURATION", Conflict: "b TIMESTAMP"}
+	}
+	if len(before.Times) > 1 {
+		for _, c := range snapshotConflicts {
+			if flagEnabled(set, c) {
+				return &flagConflictError{Flag: "b", Value: "TIMESTAMP -b TIMESTAMP", Conflict: c}
+			}
+		}
+	}
+	if dest == nil || dest.Local() {
+		return nil
+	}
+	for _, c := range remoteDestConflicts {
+		if flagEnabled(set, c) {
+			return &flagConflictError{Flag: "dest", Value: set["dest"], Conflict: c}
+		}
+	}
+	if len(before.Times) > 1 {
+		return &flagConflictError{Flag: "dest", Value: set["dest"], Conflict: "b TIMESTAMP -b TIMESTAMP"}
+	}
+	if dest.Scheme == destSchemeStdout {
+		if flagEnabled(set, "events") {
+			return &flagConflictError{Flag: "dest", Value: set["dest"], Conflict: "events"}
+		}
+		if set["summary-json"] == "-" {
+			return &flagConflictError{Flag: "dest", Value: set["dest"], Conflict: "summary-json -"}
+		}
+	}
+	return nil
+}
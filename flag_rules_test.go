@@ -0,0 +1,190 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+type validateFlagsTestcase struct {
+	name    string
+	set     map[string]string
+	wantErr string
+}
+
+func TestValidateFlags(t *testing.T) {
+	testCases := []validateFlagsTestcase{
+		{
+			name: "dump",
+			set:  map[string]string{"b": "2022-10-10T00:00:00Z", "exact-time": "true", "all-versions": "true", "dedupe-versions": "true"},
+		},
+		{
+			name:    "commands",
+			set:     map[string]string{"l": "true", "plan": "plan.json"},
+			wantErr: "-l cannot be combined with -plan",
+		},
+		{
+			name:    "later commands",
+			set:     map[string]string{"verify-sizes": "true", "chunk-reassembly": "true"},
+			wantErr: "-verify-sizes cannot be combined with -chunk-reassembly",
+		},
+		{
+			name: "disabled command",
+			set:  map[string]string{"l": "false", "measure-only": "0", "plan": "plan.json"},
+		},
+		{
+			name:    "verbatim",
+			set:     map[string]string{"verbatim": "true", "detect-compression": "true"},
+			wantErr: "-verbatim cannot be combined with -detect-compression",
+		},
+		{
+			name:    "s3 select with compressed metadata",
+			set:     map[string]string{"use-s3-select": "true", "chunk-reassembly": "true", "detect-compression": "true"},
+			wantErr: "-use-s3-select cannot be combined with -detect-compression",
+		},
+		{
+			name:    "missing requirement",
+			set:     map[string]string{"dedupe-versions": "true"},
+			wantErr: "-dedupe-versions requires -all-versions",
+		},
+		{
+			name:    "missing alternative requirements",
+			set:     map[string]string{"exact-time": "true"},
+			wantErr: "-exact-time requires -b or -b-map",
+		},
+		{
+			name:    "redact",
+			set:     map[string]string{"redact": "true", "l": "true"},
+			wantErr: "-redact requires -acl-history or -list-owners",
+		},
+	}
+
+	for _, tc := range testCases {
+		err := validateFlags(tc.set, flagRules)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: validateFlags() err = %v (want nil)", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%s: validateFlags() err = %v (want %s)", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJoinFlags(t *testing.T) {
+	got := joinFlags([]string{"b", "b-map", "consistent"})
+	want := "-b, -b-map or -consistent"
+	if got != want {
+		t.Errorf("joinFlags() = %q (want %q)", got, want)
+	}
+}
+
+type validateFlagValuesTestcase struct {
+	name    string
+	set     map[string]string
+	before  []string
+	dest    string
+	wantErr string
+}
+
+func TestValidateFlagValues(t *testing.T) {
+	testCases := []validateFlagValuesTestcase{
+		{
+			name:   "dump",
+			set:    map[string]string{"r": "/mnt/dump"},
+			before: []string{"2022-10-10T00:00:00Z", "2022-10-11T00:00:00Z"},
+		},
+		{
+			name:    "snapshots",
+			set:     map[string]string{"l": "true"},
+			before:  []string{"2022-10-10T00:00:00Z", "2022-10-11T00:00:00Z"},
+			wantErr: "-b TIMESTAMP -b TIMESTAMP cannot be combined with -l",
+		},
+		{
+			name:    "snapshots with manifest",
+			set:     map[string]string{"manifest": "manifest.json"},
+			before:  []string{"2022-10-10T00:00:00Z", "2022-10-11T00:00:00Z"},
+			wantErr: "-b TIMESTAMP -b TIMESTAMP cannot be combined with -manifest",
+		},
+		{
+			name: "resume verify",
+			set:  map[string]string{"manifest": "manifest.json", "resume-verify": "true", "overwrite-policy": "skip"},
+		},
+		{
+			name:    "resume verify overwriting",
+			set:     map[string]string{"manifest": "manifest.json", "resume-verify": "true"},
+			wantErr: "-resume-verify requires -overwrite-policy skip",
+		},
+		{
+			name:    "domain offset",
+			before:  []string{"domain-1h", "2022-10-10T00:00:00Z"},
+			wantErr: "-b domain-DURATION cannot be combined with -b TIMESTAMP",
+		},
+		{
+			name: "local destination",
+			set:  map[string]string{"index": "true"},
+			dest: "file:///mnt/dump",
+		},
+		{
+			name:    "s3 destination",
+			set:     map[string]string{"index": "true"},
+			dest:    "s3://archive/hsds",
+			wantErr: "-dest s3://archive/hsds cannot be combined with -index",
+		},
+		{
+			name:    "s3 destination snapshots",
+			before:  []string{"2022-10-10T00:00:00Z", "2022-10-11T00:00:00Z"},
+			dest:    "s3://archive/hsds",
+			wantErr: "-dest s3://archive/hsds cannot be combined with -b TIMESTAMP -b TIMESTAMP",
+		},
+		{
+			name: "stdout destination",
+			set:  map[string]string{"summary-json": "summary.json"},
+			dest: "-",
+		},
+		{
+			name:    "stdout destination summary",
+			set:     map[string]string{"summary-json": "-"},
+			dest:    "-",
+			wantErr: "-dest - cannot be combined with -summary-json -",
+		},
+	}
+
+	for _, tc := range testCases {
+		set := map[string]string{}
+		for name, value := range tc.set {
+			set[name] = value
+		}
+		before := &beforeValue{}
+		for _, b := range tc.before {
+			err := before.Set(b)
+			if err != nil {
+				t.Fatalf("%s: Set(%q) err = %v", tc.name, b, err)
+			}
+		}
+		var dest *destination
+		if tc.dest != "" {
+			set["dest"] = tc.dest
+			var err error
+			dest, err = parseDestination(tc.dest)
+			if err != nil {
+				t.Fatalf("%s: parseDestination(%q) err = %v", tc.name, tc.dest, err)
+			}
+		}
+
+		err := validateFlagValues(set, before, dest)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: validateFlagValues() err = %v (want nil)", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%s: validateFlagValues() err = %v (want %s)", tc.name, err, tc.wantErr)
+		}
+	}
+}
@@ -5,13 +5,23 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type pathError struct {
@@ -22,16 +32,476 @@ func (err *pathError) Error() string {
 	return fmt.Sprintf("filesystem: '%s' is not a valid filename", err.path)
 }
 
+// Policies that control how filesystemHSDSStorer handles files that already
+// exist.
+const (
+	// overwritePolicyOverwrite replaces existing files.
+	overwritePolicyOverwrite = "overwrite"
+	// overwritePolicySkip keeps existing files and does not write them.
+	overwritePolicySkip = "skip"
+	// overwritePolicyError fails when a file already exists.
+	overwritePolicyError = "error"
+	// overwritePolicyBackup renames existing files by appending .bak to
+	// their names before writing them.
+	overwritePolicyBackup = "backup"
+)
+
+// unknownOverwritePolicyError indicates that an overwrite policy is not
+// supported.
+type unknownOverwritePolicyError struct {
+	Policy string
+}
+
+func (err *unknownOverwritePolicyError) Error() string {
+	return fmt.Sprintf("unknown overwrite policy '%s' (want %s, %s, %s or %s)", err.Policy,
+		overwritePolicySkip, overwritePolicyOverwrite, overwritePolicyError, overwritePolicyBackup)
+}
+
+// validOverwritePolicy returns an error if policy is not a supported
+// overwrite policy. The empty string is equivalent to
+// overwritePolicyOverwrite.
+func validOverwritePolicy(policy string) error {
+	switch policy {
+	case "", overwritePolicyOverwrite, overwritePolicySkip, overwritePolicyError, overwritePolicyBackup:
+		return nil
+	}
+	return &unknownOverwritePolicyError{Policy: policy}
+}
+
+// fileExistsError indicates that a file could not be written because it
+// already exists and the overwrite policy is overwritePolicyError.
+type fileExistsError struct {
+	path string
+}
+
+func (err *fileExistsError) Error() string {
+	return fmt.Sprintf("filesystem: '%s' already exists", err.path)
+}
+
 // filesystemHSDSStorer is an implementation of the DomainStorer and
 // ObjectStorer interfaces that uses the local filesystem as its underlying
-// storage.
+// storage. It also implements the DomainLoader interface for domains it has
+// stored.
 type filesystemHSDSStorer struct {
 	// Root is the storer's root directory. All domains and domain objects
 	// stored by the storer will reside in this directory.
 	Root string
+	// CompressDomainThreshold is the size in bytes above which domain files
+	// are stored gzip-compressed as .domain.json.gz. Domain files are never
+	// compressed if it is zero.
+	CompressDomainThreshold int
+	// Indent is the number of spaces domain files are indented with per
+	// level. Domain files are written in compact form if it is zero.
+	Indent int
+	// Manifest records all files written by the storer, if it is not nil.
+	Manifest *dumpManifest
+	// ManifestFile is the file Finalize writes the manifest to. No manifest
+	// is written if it is empty.
+	ManifestFile string
+	// Index makes Finalize write the index of all files recorded in the
+	// manifest to indexFile in the root directory.
+	Index bool
+	// OverwritePolicy determines how existing domain and object files are
+	// handled. Existing files are overwritten if it is empty.
+	OverwritePolicy string
+	// ResumeManifest is the manifest written by a previous run into the same
+	// root directory. If it is set, files that already exist are only
+	// skipped by the overwrite policy skip if their checksum matches the one
+	// recorded in it, and are written again otherwise.
+	ResumeManifest *dumpManifest
+	// CanonicalizeIDs stores objects under their keys with all embedded IDs
+	// re-encoded in canonical lowercase form, so keys written by producers
+	// using different cases end up in the same files.
+	CanonicalizeIDs bool
+	// WriteTimeout is the time after which opening, writing and closing a
+	// domain or object file is aborted. Writes never time out if it is zero.
+	WriteTimeout time.Duration
+
+	// TempDir is the directory files are written to before they are renamed
+	// to their final names. If it is empty, files are written next to their
+	// final names, which guarantees that renaming them is atomic.
+	TempDir string
+
+	// openFile creates the file name for writing. If it is nil,
+	// createExclusive is used.
+	openFile func(name string) (io.WriteCloser, error)
+
+	// mu guards dirs, the directories files have been written to, which
+	// are synced by Finalize.
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+// renameFile is the function used to rename files. It is a variable, so tests
+// can simulate renames across filesystems.
+var renameFile = os.Rename
+
+// tempFileCounter makes the names of temporary files unique within a process.
+var tempFileCounter uint64
+
+// tempFileName returns a unique name for a temporary file in dir that is
+// renamed to a file named base when it is complete.
+func tempFileName(dir, base string) string {
+	n := atomic.AddUint64(&tempFileCounter, 1)
+	return filepath.Join(dir, fmt.Sprintf(".%s.%d-%d.tmp", base, os.Getpid(), n))
+}
+
+func createExclusive(name string) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+}
+
+// moveFile renames src to dst. If that fails, e.g. because src is on a
+// different filesystem, src is copied to a temporary file next to dst, which
+// is renamed to dst instead, so dst is still replaced atomically.
+func moveFile(src, dst string) error {
+	err := renameFile(src, dst)
+	if err == nil {
+		return nil
+	}
+	defer os.Remove(src)
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := tempFileName(filepath.Dir(dst), filepath.Base(dst))
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// warnTempDir warns if files written to tempDir cannot be renamed to files
+// below root, usually because they are on different filesystems. In that
+// case, every file has to be copied once it is complete. If root does not
+// exist yet, its nearest existing parent directory is checked instead.
+func warnTempDir(tempDir, root string) error {
+	dir, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	for {
+		_, err = os.Stat(dir)
+		if err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	probe := tempFileName(tempDir, "probe")
+	f, err := createExclusive(probe)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(probe)
+		return err
+	}
+	target := tempFileName(dir, "probe")
+	err = renameFile(probe, target)
+	if err != nil {
+		os.Remove(probe)
+		warn("temporary directory %s is on a different filesystem than %s, files are copied instead of renamed: %v", tempDir, root, err)
+		return nil
+	}
+	return os.Remove(target)
+}
+
+// localName returns the name relative to the storer's root under which the
+// object identified by name is stored.
+func (s *filesystemHSDSStorer) localName(name string) string {
+	if s.CanonicalizeIDs {
+		return canonicalKey(name)
+	}
+	return name
+}
+
+// writeTimeoutError indicates that writing a file took longer than the
+// storer's write timeout.
+type writeTimeoutError struct {
+	path    string
+	timeout time.Duration
+}
+
+func (err *writeTimeoutError) Error() string {
+	return fmt.Sprintf("filesystem: writing '%s' timed out after %s", err.path, err.timeout)
+}
+
+// Timeout reports that err is a timeout.
+func (err *writeTimeoutError) Timeout() bool {
+	return true
+}
+
+// writeFile writes data to a temporary file in the storer's temporary
+// directory and renames it to the file name relative to the storer's root
+// once it is complete. If writing takes longer than the storer's write
+// timeout, a writeTimeoutError is returned and the temporary file is removed
+// once the pending write returns, leaving the existing file untouched.
+func (s *filesystemHSDSStorer) writeFile(name string, data []byte) error {
+	fileName, err := sanitizePath(s.Root, name)
+	if err != nil {
+		return err
+	}
+	dir := s.TempDir
+	if dir == "" {
+		dir = filepath.Dir(fileName)
+	}
+	tempName := tempFileName(dir, filepath.Base(fileName))
+	open := s.openFile
+	if open == nil {
+		open = createExclusive
+	}
+	write := func() error {
+		f, err := open(tempName)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if err != nil {
+			f.Close()
+			os.Remove(tempName)
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			os.Remove(tempName)
+		}
+		return err
+	}
+	if s.WriteTimeout <= 0 {
+		err = write()
+		if err != nil {
+			return err
+		}
+		return s.moveFile(tempName, fileName)
+	}
+
+	done := make(chan error)
+	timedOut := make(chan struct{})
+	go func() {
+		err := write()
+		select {
+		case done <- err:
+		case <-timedOut:
+			os.Remove(tempName)
+		}
+	}()
+
+	timer := time.NewTimer(s.WriteTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		return s.moveFile(tempName, fileName)
+	case <-timer.C:
+		close(timedOut)
+		return &writeTimeoutError{path: fileName, timeout: s.WriteTimeout}
+	}
+}
+
+// moveFile moves the complete temporary file tempName to fileName and
+// remembers the directory of fileName for Finalize.
+func (s *filesystemHSDSStorer) moveFile(tempName, fileName string) error {
+	err := moveFile(tempName, fileName)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirs == nil {
+		s.dirs = map[string]bool{}
+	}
+	s.dirs[filepath.Dir(fileName)] = true
+	return nil
+}
+
+// Finalize writes the manifest to ManifestFile and the index to the root
+// directory, if requested, and syncs all directories files have been written
+// to, so that the renames of the files are durable.
+func (s *filesystemHSDSStorer) Finalize(ctx context.Context) error {
+	if s.ManifestFile != "" {
+		err := s.Manifest.WriteFile(s.ManifestFile)
+		if err != nil {
+			return err
+		}
+	}
+	if s.Index {
+		err := s.writeIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	dirs := make([]string, 0, len(s.dirs))
+	for dir := range s.dirs {
+		dirs = append(dirs, dir)
+	}
+	s.mu.Unlock()
+	for _, dir := range dirs {
+		err := syncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIndex writes the index of all files recorded in the storer's manifest
+// to indexFile in the root directory.
+func (s *filesystemHSDSStorer) writeIndex() error {
+	f, err := os.Create(filepath.Join(s.Root, indexFile))
+	if err != nil {
+		return err
+	}
+	err = s.Manifest.WriteIndex(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the entries of the directory dir to disk. Windows does not
+// support syncing directories, where it does nothing.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mayWrite applies the storer's overwrite policy to the file name relative to
+// the storer's root, which is written for the S3 key, and reports whether the
+// file should be written.
+func (s *filesystemHSDSStorer) mayWrite(key, name string) (bool, error) {
+	fileName, err := sanitizePath(s.Root, name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Lstat(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch s.OverwritePolicy {
+	case overwritePolicySkip:
+		if s.ResumeManifest == nil {
+			return false, nil
+		}
+		return !s.verifySkipped(key, name, fileName), nil
+	case overwritePolicyError:
+		return false, &fileExistsError{path: fileName}
+	case overwritePolicyBackup:
+		err = os.Rename(fileName, fileName+".bak")
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// verifySkipped reports whether the existing file fileName, which is stored
+// under name for key, matches the entry recorded for key in the storer's
+// resume manifest. Matching entries are carried over to the storer's
+// manifest.
+func (s *filesystemHSDSStorer) verifySkipped(key, name, fileName string) bool {
+	entry := s.ResumeManifest.Entry(key)
+	if entry == nil || entry.Path != filepath.ToSlash(name) || entry.SHA256 == "" {
+		warn("%s is not recorded in the manifest, writing it again", fileName)
+		return false
+	}
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		warn("%s cannot be verified, writing it again: %v", fileName, err)
+		return false
+	}
+	if sha256Hex(b) != entry.SHA256 {
+		warn("%s does not match its checksum in the manifest, writing it again", fileName)
+		return false
+	}
+	if s.Manifest != nil {
+		s.Manifest.Add(key, entry)
+	}
+	return true
+}
+
+func (s *filesystemHSDSStorer) record(key, name string, size int, checksum, encoding string) {
+	if s.Manifest == nil {
+		return
+	}
+	s.Manifest.Add(key, &manifestEntry{
+		Path:     filepath.ToSlash(name),
+		Size:     int64(size),
+		SHA256:   checksum,
+		Encoding: encoding,
+	})
+}
+
+// sha256Hex returns the hex-encoded SHA-256 checksum of b.
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// normalizeKey converts backslashes in key to slashes and collapses repeated
+// slashes, as keys written by some clients contain either. Keys that are
+// ambiguous after normalization, i.e. empty or containing "." or ".."
+// segments, are rejected.
+func normalizeKey(key string) (string, error) {
+	key = strings.ReplaceAll(key, "\\", "/")
+	segments := strings.Split(key, "/")
+	n := 0
+	for _, s := range segments {
+		if s == "." || s == ".." {
+			return "", &pathError{path: key}
+		}
+		if s != "" {
+			segments[n] = s
+			n++
+		}
+	}
+	if n == 0 {
+		return "", &pathError{path: key}
+	}
+	return strings.Join(segments[:n], "/"), nil
 }
 
 func sanitizePath(root, name string) (string, error) {
+	name, err := normalizeKey(name)
+	if err != nil {
+		return "", err
+	}
 	name = filepath.Join("/", filepath.FromSlash(name))
 	if name == "/" {
 		return "", &pathError{path: name}
@@ -40,19 +510,23 @@ func sanitizePath(root, name string) (string, error) {
 	return name, nil
 }
 
-func openForWriting(root, name string) (io.WriteCloser, error) {
-	name, err := sanitizePath(root, name)
-	if err != nil {
-		return nil, err
+// marshalDomain encodes domain as a single line of JSON or, if indent is
+// positive, indented by indent spaces per level.
+func marshalDomain(domain *hsdsDomain, indent int) ([]byte, error) {
+	var b []byte
+	var err error
+	if indent > 0 {
+		b, err = json.MarshalIndent(domain, "", strings.Repeat(" ", indent))
+	} else {
+		b, err = json.Marshal(domain)
 	}
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return nil, err
 	}
-	return f, err
+	return append(b, '\n'), nil
 }
 
-func createParentDomains(root, name string, domain *hsdsDomain) error {
+func createParentDomains(root, name string, domain *hsdsDomain, indent int) error {
 	name = filepath.Clean(name)
 	if name == "." {
 		return nil
@@ -83,8 +557,10 @@ func createParentDomains(root, name string, domain *hsdsDomain) error {
 			return err
 		}
 
-		enc := json.NewEncoder(f)
-		err = enc.Encode(parent)
+		b, err := marshalDomain(&parent, indent)
+		if err == nil {
+			_, err = f.Write(b)
+		}
 		if err != nil {
 			f.Close()
 			return err
@@ -99,24 +575,77 @@ func createParentDomains(root, name string, domain *hsdsDomain) error {
 }
 
 func (s *filesystemHSDSStorer) StoreDomain(ctx context.Context, name string, domain *hsdsDomain) error {
-	err := createParentDomains(s.Root, name, domain)
+	err := createParentDomains(s.Root, name, domain, s.Indent)
 	if err != nil {
 		return err
 	}
 
+	b, err := marshalDomain(domain, s.Indent)
+	if err != nil {
+		return err
+	}
+	key := filepath.ToSlash(filepath.Join(name, ".domain.json"))
 	name = filepath.Join(name, ".domain.json")
-	f, err := openForWriting(s.Root, name)
-	enc := json.NewEncoder(f)
-	err = enc.Encode(domain)
+	encoding := ""
+	if s.CompressDomainThreshold > 0 && len(b) > s.CompressDomainThreshold {
+		b, err = gzipBytes(b)
+		if err != nil {
+			return err
+		}
+		name += ".gz"
+		encoding = "gzip"
+	}
+
+	write, err := s.mayWrite(key, name)
+	if err != nil || !write {
+		return err
+	}
+	err = s.writeFile(name, b)
 	if err != nil {
-		f.Close()
 		return err
 	}
-	return f.Close()
+	s.record(key, name, len(b), sha256Hex(b), encoding)
+	return nil
+}
+
+// LoadDomain loads a domain previously stored under name. Domain files that
+// have been compressed are decompressed transparently.
+func (s *filesystemHSDSStorer) LoadDomain(ctx context.Context, name string) (*hsdsDomain, error) {
+	fileName, err := sanitizePath(s.Root, filepath.Join(name, ".domain.json"))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fileName)
+	compressed := false
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(fileName + ".gz")
+		compressed = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	d := &hsdsDomain{}
+	err = json.NewDecoder(r).Decode(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
 }
 
 func (s *filesystemHSDSStorer) StoreObject(ctx context.Context, name string, data []byte) error {
-	dir, err := sanitizePath(s.Root, name)
+	local := s.localName(name)
+	dir, err := sanitizePath(s.Root, local)
 	if err != nil {
 		return err
 	}
@@ -126,18 +655,97 @@ func (s *filesystemHSDSStorer) StoreObject(ctx context.Context, name string, dat
 		return err
 	}
 
-	f, err := openForWriting(s.Root, name)
+	write, err := s.mayWrite(name, local)
+	if err != nil || !write {
+		return err
+	}
+	err = s.writeFile(local, data)
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(data)
+	s.record(name, local, len(data), sha256Hex(data), "")
+	return nil
+}
+
+func (s *filesystemHSDSStorer) ObjectModTime(ctx context.Context, name string) (time.Time, error) {
+	name, err := sanitizePath(s.Root, s.localName(name))
+	if err != nil {
+		return time.Time{}, err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (s *filesystemHSDSStorer) SetObjectModTime(ctx context.Context, name string, t time.Time) error {
+	name, err := sanitizePath(s.Root, s.localName(name))
 	if err != nil {
-		f.Close()
 		return err
 	}
-	err = f.Close()
+	return os.Chtimes(name, t, t)
+}
+
+func (s *filesystemHSDSStorer) ObjectSize(ctx context.Context, name string) (int64, error) {
+	name, err := sanitizePath(s.Root, s.localName(name))
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *filesystemHSDSStorer) StoreDirectory(ctx context.Context, name string) error {
+	dir, err := sanitizePath(s.Root, name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// LinkObject creates a hard link name pointing to the stored object target,
+// handling any existing file according to the overwrite policy. If the file
+// system does not support hard links, target is copied instead.
+func (s *filesystemHSDSStorer) LinkObject(ctx context.Context, target, name string) error {
+	oldname, err := sanitizePath(s.Root, s.localName(target))
 	if err != nil {
 		return err
 	}
+	local := s.localName(name)
+	newname, err := sanitizePath(s.Root, local)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	write, err := s.mayWrite(name, local)
+	if err != nil || !write {
+		return err
+	}
+	err = os.Remove(newname)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Link(oldname, newname)
+	if err != nil {
+		data, err := ioutil.ReadFile(oldname)
+		if err != nil {
+			return err
+		}
+		return s.StoreObject(ctx, name, data)
+	}
+	var checksum string
+	if s.Manifest != nil {
+		if entry := s.Manifest.Entry(target); entry != nil {
+			checksum = entry.SHA256
+		}
+	}
+	s.record(name, local, int(fi.Size()), checksum, "")
 	return nil
 }
@@ -0,0 +1,417 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilesystemHSDSStorer_CompressDomain(t *testing.T) {
+	acls := hsdsACL{}
+	for i := 0; i < 1000; i++ {
+		acls[fmt.Sprintf("user%04d", i)] = &hsdsPermissions{Read: true}
+	}
+	domain := &hsdsDomain{ACLs: acls, Root: &testRootID, Owner: "admin"}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{
+		Root:                    root,
+		CompressDomainThreshold: 4096,
+		Manifest:                newManifest(),
+	}
+	err := storer.StoreDomain(context.Background(), "home/user/domain.h5", domain)
+	if err != nil {
+		t.Fatalf("StoreDomain() err = %v (want nil)", err)
+	}
+
+	dir := filepath.Join(root, "home", "user", "domain.h5")
+	if _, err := os.Stat(filepath.Join(dir, ".domain.json")); err == nil {
+		t.Errorf("StoreDomain() wrote an uncompressed domain file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".domain.json.gz")); err != nil {
+		t.Errorf("StoreDomain() did not write a compressed domain file: %v", err)
+	}
+
+	entry := storer.Manifest.Entry("home/user/domain.h5/.domain.json")
+	if entry == nil {
+		t.Fatalf("manifest has no entry for the domain file")
+	}
+	if entry.Encoding != "gzip" || entry.Path != "home/user/domain.h5/.domain.json.gz" {
+		t.Errorf("manifest entry = %+v (want gzip-encoded .domain.json.gz)", entry)
+	}
+
+	got, err := storer.LoadDomain(context.Background(), "home/user/domain.h5")
+	if err != nil {
+		t.Fatalf("LoadDomain() err = %v (want nil)", err)
+	}
+	if len(got.ACLs) != len(acls) || got.Owner != "admin" || *got.Root != testRootID {
+		t.Errorf("LoadDomain() = %+v (want the stored domain)", got)
+	}
+}
+
+func TestFilesystemHSDSStorer_SmallDomainUncompressed(t *testing.T) {
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root, CompressDomainThreshold: 4096}
+	domain := &hsdsDomain{Root: &testRootID, Owner: "admin"}
+	err := storer.StoreDomain(context.Background(), "domain.h5", domain)
+	if err != nil {
+		t.Fatalf("StoreDomain() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "domain.h5", ".domain.json")); err != nil {
+		t.Errorf("StoreDomain() did not write an uncompressed domain file: %v", err)
+	}
+}
+
+type sanitizePathTestcase struct {
+	name    string
+	key     string
+	want    string
+	wantErr bool
+}
+
+func TestSanitizePath(t *testing.T) {
+	root := filepath.FromSlash("/var/db")
+	testCases := []sanitizePathTestcase{
+		{
+			name: "normal",
+			key:  testChunkKey,
+			want: filepath.Join(root, filepath.FromSlash(testChunkKey)),
+		},
+		{
+			name: "double-slash",
+			key:  "db//d12a20a5-6c27622f/.group.json",
+			want: filepath.Join(root, "db", "d12a20a5-6c27622f", ".group.json"),
+		},
+		{
+			name: "backslash",
+			key:  `db\d12a20a5-6c27622f\.group.json`,
+			want: filepath.Join(root, "db", "d12a20a5-6c27622f", ".group.json"),
+		},
+		{
+			name:    "parent",
+			key:     "db/../../etc/passwd",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			key:     `/\/`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := sanitizePath(root, tc.key)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: sanitizePath() = %q (want error)", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: sanitizePath() err = %v (want nil)", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: sanitizePath() = %q (want %q)", tc.name, got, tc.want)
+		}
+	}
+}
+
+type overwritePolicyTestcase struct {
+	policy  string
+	want    string
+	wantBak string
+	wantErr bool
+}
+
+func TestFilesystemHSDSStorer_OverwritePolicy(t *testing.T) {
+	testCases := []overwritePolicyTestcase{
+		{policy: "", want: "new"},
+		{policy: overwritePolicyOverwrite, want: "new"},
+		{policy: overwritePolicySkip, want: "old"},
+		{policy: overwritePolicyError, want: "old", wantErr: true},
+		{policy: overwritePolicyBackup, want: "new", wantBak: "old"},
+	}
+
+	for _, tc := range testCases {
+		root := t.TempDir()
+		storer := &filesystemHSDSStorer{Root: root, OverwritePolicy: tc.policy}
+		objectFile := filepath.Join(root, filepath.FromSlash(testChunkKey))
+		domainFile := filepath.Join(root, "domain.h5", ".domain.json")
+		for _, fn := range []string{objectFile, domainFile} {
+			err := os.MkdirAll(filepath.Dir(fn), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(fn, []byte("old"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := storer.StoreObject(context.Background(), testChunkKey, []byte("new"))
+		if tc.wantErr != (err != nil) {
+			t.Errorf("%s: StoreObject() err = %v (want error %v)", tc.policy, err, tc.wantErr)
+		}
+		err = storer.StoreDomain(context.Background(), "domain.h5", &hsdsDomain{Owner: "new"})
+		if tc.wantErr != (err != nil) {
+			t.Errorf("%s: StoreDomain() err = %v (want error %v)", tc.policy, err, tc.wantErr)
+		}
+
+		b, _ := ioutil.ReadFile(objectFile)
+		if string(b) != tc.want {
+			t.Errorf("%s: object file = %q (want %q)", tc.policy, b, tc.want)
+		}
+		b, _ = ioutil.ReadFile(domainFile)
+		if replaced := string(b) != "old"; replaced != (tc.want == "new") {
+			t.Errorf("%s: domain file = %q (want %s content)", tc.policy, b, tc.want)
+		}
+		b, _ = ioutil.ReadFile(objectFile + ".bak")
+		if string(b) != tc.wantBak {
+			t.Errorf("%s: object backup = %q (want %q)", tc.policy, b, tc.wantBak)
+		}
+		b, _ = ioutil.ReadFile(domainFile + ".bak")
+		if string(b) != tc.wantBak {
+			t.Errorf("%s: domain backup = %q (want %q)", tc.policy, b, tc.wantBak)
+		}
+	}
+}
+
+// slowWriteCloser is an io.WriteCloser whose writes block until Release is
+// closed.
+type slowWriteCloser struct {
+	io.WriteCloser
+	Release chan struct{}
+}
+
+func (w *slowWriteCloser) Write(b []byte) (int, error) {
+	<-w.Release
+	return w.WriteCloser.Write(b)
+}
+
+func TestFilesystemHSDSStorer_WriteTimeout(t *testing.T) {
+	root := t.TempDir()
+	release := make(chan struct{})
+	s := &filesystemHSDSStorer{
+		Root:         root,
+		WriteTimeout: 10 * time.Millisecond,
+		openFile: func(name string) (io.WriteCloser, error) {
+			f, err := createExclusive(name)
+			return &slowWriteCloser{WriteCloser: f, Release: release}, err
+		},
+	}
+
+	err := s.StoreObject(context.Background(), "db/object", []byte("data"))
+	var timeout *writeTimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("StoreObject() err = %v (want *writeTimeoutError)", err)
+	}
+
+	// The partially written file is removed once the write returns.
+	close(release)
+	dir := filepath.Join(root, "db")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("StoreObject() left %s behind after timing out", infos[0].Name())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s.openFile = nil
+	err = s.StoreObject(context.Background(), "db/object", []byte("data"))
+	if err != nil {
+		t.Errorf("StoreObject() err = %v (want nil)", err)
+	}
+}
+
+func TestFilesystemHSDSStorer_TempDir(t *testing.T) {
+	root, tempDir := t.TempDir(), t.TempDir()
+	var tempNames []string
+	s := &filesystemHSDSStorer{
+		Root:    root,
+		TempDir: tempDir,
+		openFile: func(name string) (io.WriteCloser, error) {
+			tempNames = append(tempNames, name)
+			return createExclusive(name)
+		},
+	}
+	err := s.StoreObject(context.Background(), "db/object", []byte("data"))
+	if err != nil {
+		t.Fatalf("StoreObject() err = %v (want nil)", err)
+	}
+
+	if len(tempNames) != 1 || filepath.Dir(tempNames[0]) != tempDir {
+		t.Errorf("StoreObject() wrote to %v (want a file in %s)", tempNames, tempDir)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, "db", "object"))
+	if err != nil || string(got) != "data" {
+		t.Errorf("StoreObject() stored %q, %v (want %q)", got, err, "data")
+	}
+	infos, err := ioutil.ReadDir(tempDir)
+	if err != nil || len(infos) != 0 {
+		t.Errorf("StoreObject() left %d files in %s, %v (want 0)", len(infos), tempDir, err)
+	}
+
+	// Without a temporary directory, files are written next to their final
+	// names.
+	tempNames = nil
+	s.TempDir = ""
+	err = s.StoreObject(context.Background(), "db/object", []byte("new data"))
+	if err != nil {
+		t.Fatalf("StoreObject() err = %v (want nil)", err)
+	}
+	if len(tempNames) != 1 || filepath.Dir(tempNames[0]) != filepath.Join(root, "db") {
+		t.Errorf("StoreObject() wrote to %v (want a file in %s)", tempNames, filepath.Join(root, "db"))
+	}
+}
+
+func TestFilesystemHSDSStorer_TempDirCrossDevice(t *testing.T) {
+	root, tempDir := t.TempDir(), t.TempDir()
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	err := warnTempDir(tempDir, root)
+	if err != nil || warnings.Len() != 0 {
+		t.Errorf("warnTempDir() err = %v, warnings %q (want nil, none)", err, warnings.String())
+	}
+
+	// Simulate a temporary directory on a different filesystem.
+	renameFile = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) == tempDir {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("invalid cross-device link")}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	defer func() { renameFile = os.Rename }()
+
+	err = warnTempDir(tempDir, root)
+	if err != nil || !strings.Contains(warnings.String(), "different filesystem") {
+		t.Errorf("warnTempDir() err = %v, warnings %q (want nil, different filesystem)", err, warnings.String())
+	}
+
+	// Files are copied instead.
+	s := &filesystemHSDSStorer{Root: root, TempDir: tempDir}
+	err = s.StoreObject(context.Background(), "db/object", []byte("data"))
+	if err != nil {
+		t.Fatalf("StoreObject() err = %v (want nil)", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, "db", "object"))
+	if err != nil || string(got) != "data" {
+		t.Errorf("StoreObject() stored %q, %v (want %q)", got, err, "data")
+	}
+	for _, dir := range []string{tempDir, filepath.Join(root, "db")} {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), ".tmp") {
+				t.Errorf("StoreObject() left %s in %s", info.Name(), dir)
+			}
+		}
+	}
+}
+
+func TestFilesystemHSDSStorer_CanonicalizeIDs(t *testing.T) {
+	root := t.TempDir()
+	s := &filesystemHSDSStorer{Root: root, CanonicalizeIDs: true, Manifest: newManifest()}
+	key := "db/D12A20A5-6C27622F/d/693E-302825-F8C087/0"
+	err := s.StoreObject(context.Background(), key, []byte("data"))
+	if err != nil {
+		t.Fatalf("StoreObject() err = %v (want nil)", err)
+	}
+
+	want := "db/d12a20a5-6c27622f/d/693e-302825-f8c087/0"
+	got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(want)))
+	if err != nil || string(got) != "data" {
+		t.Errorf("StoreObject() %s = %q, %v (want %q)", want, got, err, "data")
+	}
+	if entry := s.Manifest.Entry(key); entry == nil || entry.Path != want {
+		t.Errorf("manifest entry = %+v (want path %s)", entry, want)
+	}
+	if size, err := s.ObjectSize(context.Background(), key); err != nil || size != 4 {
+		t.Errorf("ObjectSize() = %d, %v (want 4)", size, err)
+	}
+}
+
+func TestFilesystemHSDSStorer_Finalize(t *testing.T) {
+	root := t.TempDir()
+	manifestFile := filepath.Join(t.TempDir(), "manifest.json")
+	s := &filesystemHSDSStorer{Root: root, Manifest: newManifest(), ManifestFile: manifestFile, Index: true}
+	err := s.StoreObject(context.Background(), testChunkKey, []byte("data"))
+	if err != nil {
+		t.Fatalf("StoreObject() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(manifestFile); err == nil {
+		t.Errorf("StoreObject() wrote the manifest before Finalize()")
+	}
+	s.Manifest.Annotate(testChunkKey, func(e *manifestEntry) {
+		e.Domain = "home/user/domain.h5"
+	})
+
+	err = s.Finalize(context.Background())
+	if err != nil {
+		t.Fatalf("Finalize() err = %v (want nil)", err)
+	}
+	manifest, err := readManifest(manifestFile)
+	if err != nil {
+		t.Fatalf("readManifest() err = %v (want nil)", err)
+	}
+	if manifest.Entry(testChunkKey) == nil {
+		t.Errorf("Finalize() did not record %s in the manifest", testChunkKey)
+	}
+	index, err := ioutil.ReadFile(filepath.Join(root, indexFile))
+	if err != nil || !strings.Contains(string(index), testChunkKey) {
+		t.Errorf("Finalize() wrote index %q, %v (want entry for %s)", index, err, testChunkKey)
+	}
+}
+
+func TestFilesystemHSDSStorer_Indent(t *testing.T) {
+	domain := &hsdsDomain{Root: &testRootID, Owner: "admin"}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root, Indent: 2}
+	err := storer.StoreDomain(context.Background(), "home/user/domain.h5", domain)
+	if err != nil {
+		t.Fatalf("StoreDomain() err = %v (want nil)", err)
+	}
+
+	for _, name := range []string{"home/user/.domain.json", "home/user/domain.h5/.domain.json"} {
+		b, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !strings.Contains(string(b), "{\n  \"") {
+			t.Errorf("%s = %s (want indentation by 2 spaces)", name, b)
+		}
+	}
+
+	got, err := storer.LoadDomain(context.Background(), "home/user/domain.h5")
+	if err != nil {
+		t.Fatalf("LoadDomain() err = %v (want nil)", err)
+	}
+	if got.Owner != "admin" || *got.Root != testRootID {
+		t.Errorf("LoadDomain() = %+v (want the stored domain)", got)
+	}
+}
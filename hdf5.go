@@ -0,0 +1,333 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// This file implements a minimal writer for the HDF5 file format. It writes
+// version 2 superblocks and object headers as introduced with HDF5 1.8, which
+// allow groups to store their links directly in their object headers. Only
+// groups and datasets with contiguous layouts of fixed-point or floating-point
+// elements are supported, attributes are not.
+
+// hdf5Signature is the signature at the start of every HDF5 file.
+var hdf5Signature = []byte{0x89, 'H', 'D', 'F', '\r', '\n', 0x1a, '\n'}
+
+// hdf5UndefinedAddress is the address used for objects that do not exist.
+const hdf5UndefinedAddress = ^uint64(0)
+
+// Object header message types.
+const (
+	hdf5MessageDataspace = 0x01
+	hdf5MessageLinkInfo  = 0x02
+	hdf5MessageDatatype  = 0x03
+	hdf5MessageFillValue = 0x05
+	hdf5MessageLink      = 0x06
+	hdf5MessageLayout    = 0x08
+	hdf5MessageGroupInfo = 0x0a
+)
+
+// errHDF5Cycle indicates that a group links to one of its ancestors, which
+// cannot be written by hdf5Writer.
+var errHDF5Cycle = errors.New("hdf5: group hierarchy contains a cycle")
+
+// hdf5Datatype describes the elements of a dataset.
+type hdf5Datatype struct {
+	// Float indicates an IEEE floating-point type. Otherwise, the type is a
+	// fixed-point type.
+	Float bool
+	// Signed indicates a signed fixed-point type.
+	Signed bool
+	// Size is the size of an element in bytes. Floating-point types must be
+	// 4 or 8 bytes large.
+	Size int
+	// BigEndian indicates that elements are stored in big-endian byte order.
+	BigEndian bool
+}
+
+// hdf5Dataset is a dataset with a contiguous layout.
+type hdf5Dataset struct {
+	Type hdf5Datatype
+	// Dims are the dataset's dimensions. Datasets without dimensions are
+	// scalar.
+	Dims []uint64
+	// Data are the dataset's elements in row-major order.
+	Data []byte
+}
+
+// hdf5Link is a hard link from a group to either a group or a dataset.
+type hdf5Link struct {
+	Name    string
+	Group   *hdf5Group
+	Dataset *hdf5Dataset
+}
+
+// hdf5Group is a group whose links are stored in its object header.
+type hdf5Group struct {
+	Links []*hdf5Link
+}
+
+// hdf5Checksum computes the Jenkins lookup3 hash HDF5 uses as checksum of its
+// metadata.
+func hdf5Checksum(k []byte) uint32 {
+	a := 0xdeadbeef + uint32(len(k))
+	b, c := a, a
+	for len(k) > 12 {
+		a += binary.LittleEndian.Uint32(k[0:])
+		b += binary.LittleEndian.Uint32(k[4:])
+		c += binary.LittleEndian.Uint32(k[8:])
+		a -= c
+		a ^= bits.RotateLeft32(c, 4)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 6)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 8)
+		b += a
+		a -= c
+		a ^= bits.RotateLeft32(c, 16)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 19)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 4)
+		b += a
+		k = k[12:]
+	}
+	if len(k) == 0 {
+		return c
+	}
+	var tail [12]byte
+	copy(tail[:], k)
+	a += binary.LittleEndian.Uint32(tail[0:])
+	b += binary.LittleEndian.Uint32(tail[4:])
+	c += binary.LittleEndian.Uint32(tail[8:])
+	c ^= b
+	c -= bits.RotateLeft32(b, 14)
+	a ^= c
+	a -= bits.RotateLeft32(c, 11)
+	b ^= a
+	b -= bits.RotateLeft32(a, 25)
+	c ^= b
+	c -= bits.RotateLeft32(b, 16)
+	a ^= c
+	a -= bits.RotateLeft32(c, 4)
+	b ^= a
+	b -= bits.RotateLeft32(a, 14)
+	c ^= b
+	c -= bits.RotateLeft32(b, 24)
+	return c
+}
+
+// hdf5Writer lays out the objects of an HDF5 file in memory. Objects are
+// appended in post-order, so the addresses of all linked objects are known
+// when a group's object header is written.
+type hdf5Writer struct {
+	buf      bytes.Buffer
+	groups   map[*hdf5Group]uint64
+	datasets map[*hdf5Dataset]uint64
+	// visiting contains the groups whose object headers are being written.
+	visiting map[*hdf5Group]bool
+}
+
+// writeHDF5 writes an HDF5 file with the given root group to w.
+func writeHDF5(w io.Writer, root *hdf5Group) error {
+	hw := &hdf5Writer{
+		groups:   map[*hdf5Group]uint64{},
+		datasets: map[*hdf5Dataset]uint64{},
+		visiting: map[*hdf5Group]bool{},
+	}
+	// The superblock is filled in once the root group's address is known.
+	hw.buf.Write(make([]byte, 48))
+	rootAddr, err := hw.writeGroup(root)
+	if err != nil {
+		return err
+	}
+
+	b := hw.buf.Bytes()
+	sb := append([]byte(nil), hdf5Signature...)
+	// Superblock version, size of offsets, size of lengths and file
+	// consistency flags.
+	sb = append(sb, 2, 8, 8, 0)
+	// Base address, superblock extension address, end of file address and
+	// root group object header address.
+	sb = appendUint64(sb, 0)
+	sb = appendUint64(sb, hdf5UndefinedAddress)
+	sb = appendUint64(sb, uint64(len(b)))
+	sb = appendUint64(sb, rootAddr)
+	sb = appendUint32(sb, hdf5Checksum(sb))
+	copy(b, sb)
+
+	_, err = w.Write(b)
+	return err
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+// hdf5Message is a single message of an object header.
+type hdf5Message struct {
+	Type  byte
+	Flags byte
+	Data  []byte
+}
+
+// writeObjectHeader appends a version 2 object header consisting of msgs and
+// returns its address.
+func (hw *hdf5Writer) writeObjectHeader(msgs []hdf5Message) uint64 {
+	var body []byte
+	for _, m := range msgs {
+		body = append(body, m.Type)
+		body = appendUint16(body, uint16(len(m.Data)))
+		body = append(body, m.Flags)
+		body = append(body, m.Data...)
+	}
+
+	// The size of chunk #0 is stored in four bytes.
+	h := []byte{'O', 'H', 'D', 'R', 2, 0x02}
+	h = appendUint32(h, uint32(len(body)))
+	h = append(h, body...)
+	h = appendUint32(h, hdf5Checksum(h))
+
+	addr := uint64(hw.buf.Len())
+	hw.buf.Write(h)
+	return addr
+}
+
+func (hw *hdf5Writer) writeGroup(g *hdf5Group) (uint64, error) {
+	if addr, ok := hw.groups[g]; ok {
+		return addr, nil
+	}
+	if hw.visiting[g] {
+		return 0, errHDF5Cycle
+	}
+	hw.visiting[g] = true
+	defer delete(hw.visiting, g)
+
+	linkInfo := []byte{0, 0}
+	linkInfo = appendUint64(linkInfo, hdf5UndefinedAddress)
+	linkInfo = appendUint64(linkInfo, hdf5UndefinedAddress)
+	msgs := []hdf5Message{
+		{Type: hdf5MessageLinkInfo, Data: linkInfo},
+		{Type: hdf5MessageGroupInfo, Data: []byte{0, 0}},
+	}
+	for _, l := range g.Links {
+		var addr uint64
+		var err error
+		if l.Group != nil {
+			addr, err = hw.writeGroup(l.Group)
+		} else {
+			addr = hw.writeDataset(l.Dataset)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// Hard links with names of up to 255 bytes use a single byte to
+		// store the length of the name, longer ones two bytes.
+		link := []byte{1, 0}
+		if len(l.Name) > 0xff {
+			link[1] = 1
+			link = appendUint16(link, uint16(len(l.Name)))
+		} else {
+			link = append(link, byte(len(l.Name)))
+		}
+		link = append(link, l.Name...)
+		link = appendUint64(link, addr)
+		msgs = append(msgs, hdf5Message{Type: hdf5MessageLink, Data: link})
+	}
+
+	addr := hw.writeObjectHeader(msgs)
+	hw.groups[g] = addr
+	return addr, nil
+}
+
+func (hw *hdf5Writer) writeDataset(d *hdf5Dataset) uint64 {
+	if addr, ok := hw.datasets[d]; ok {
+		return addr
+	}
+
+	dataAddr := hdf5UndefinedAddress
+	if len(d.Data) > 0 {
+		dataAddr = uint64(hw.buf.Len())
+		hw.buf.Write(d.Data)
+	}
+
+	// Version 2 dataspaces are either scalar or simple.
+	dataspace := []byte{2, byte(len(d.Dims)), 0, 0}
+	if len(d.Dims) > 0 {
+		dataspace[3] = 1
+	}
+	for _, dim := range d.Dims {
+		dataspace = appendUint64(dataspace, dim)
+	}
+
+	var order byte
+	if d.Type.BigEndian {
+		order = 1
+	}
+	var datatype []byte
+	if d.Type.Float {
+		// Version 1 floating-point type with implied most significant
+		// mantissa bit.
+		datatype = []byte{0x11, 0x20 | order, byte(d.Type.Size*8 - 1), 0}
+		datatype = appendUint32(datatype, uint32(d.Type.Size))
+		datatype = appendUint16(datatype, 0)
+		datatype = appendUint16(datatype, uint16(d.Type.Size*8))
+		if d.Type.Size == 4 {
+			datatype = append(datatype, 23, 8, 0, 23)
+			datatype = appendUint32(datatype, 127)
+		} else {
+			datatype = append(datatype, 52, 11, 0, 52)
+			datatype = appendUint32(datatype, 1023)
+		}
+	} else {
+		// Version 1 fixed-point type.
+		flags := order
+		if d.Type.Signed {
+			flags |= 0x08
+		}
+		datatype = []byte{0x10, flags, 0, 0}
+		datatype = appendUint32(datatype, uint32(d.Type.Size))
+		datatype = appendUint16(datatype, 0)
+		datatype = appendUint16(datatype, uint16(d.Type.Size*8))
+	}
+
+	// Version 3 fill value with early space allocation and fill values
+	// only written if set, which they never are.
+	fillValue := []byte{3, 0x01 | 0x02<<2}
+
+	// Version 3 contiguous layout.
+	layout := []byte{3, 1}
+	layout = appendUint64(layout, dataAddr)
+	layout = appendUint64(layout, uint64(len(d.Data)))
+
+	addr := hw.writeObjectHeader([]hdf5Message{
+		{Type: hdf5MessageDataspace, Data: dataspace},
+		// The datatype message is constant.
+		{Type: hdf5MessageDatatype, Flags: 0x01, Data: datatype},
+		{Type: hdf5MessageFillValue, Flags: 0x01, Data: fillValue},
+		{Type: hdf5MessageLayout, Data: layout},
+	})
+	hw.datasets[d] = addr
+	return addr
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type hdf5ChecksumTestcase struct {
+	name string
+	data string
+	want uint32
+}
+
+func TestHDF5Checksum(t *testing.T) {
+	testCases := []hdf5ChecksumTestcase{
+		{name: "empty", data: "", want: 0xdeadbeef},
+		{name: "text", data: "Four score and seven years ago", want: 0x17770551},
+	}
+
+	for _, tc := range testCases {
+		got := hdf5Checksum([]byte(tc.data))
+		if got != tc.want {
+			t.Errorf("%s: hdf5Checksum() = %#x (want %#x)", tc.name, got, tc.want)
+		}
+	}
+}
+
+// readHDF5Header parses the version 2 object header at addr in the HDF5 file
+// b and returns its messages by type.
+func readHDF5Header(t *testing.T, b []byte, addr uint64) map[byte][][]byte {
+	t.Helper()
+	if addr+10 > uint64(len(b)) || string(b[addr:addr+4]) != "OHDR" || b[addr+5] != 0x02 {
+		t.Fatalf("no object header at %d", addr)
+	}
+	n := uint64(binary.LittleEndian.Uint32(b[addr+6:]))
+	end := addr + 10 + n
+	if got := binary.LittleEndian.Uint32(b[end:]); got != hdf5Checksum(b[addr:end]) {
+		t.Fatalf("object header at %d has invalid checksum %#x", addr, got)
+	}
+	msgs := map[byte][][]byte{}
+	for p := addr + 10; p < end; {
+		typ := b[p]
+		size := uint64(binary.LittleEndian.Uint16(b[p+1:]))
+		msgs[typ] = append(msgs[typ], b[p+4:p+4+size])
+		p += 4 + size
+	}
+	return msgs
+}
+
+// readHDF5Dataset follows the links named path from the root group of the
+// HDF5 file b and returns the dimensions and data of the dataset found.
+func readHDF5Dataset(t *testing.T, b []byte, path ...string) ([]uint64, []byte) {
+	t.Helper()
+	if !bytes.HasPrefix(b, hdf5Signature) || b[8] != 2 {
+		t.Fatalf("no version 2 superblock")
+	}
+	if got := binary.LittleEndian.Uint32(b[44:]); got != hdf5Checksum(b[:44]) {
+		t.Fatalf("superblock has invalid checksum %#x", got)
+	}
+	if eof := binary.LittleEndian.Uint64(b[28:]); eof != uint64(len(b)) {
+		t.Fatalf("end of file address = %d (want %d)", eof, len(b))
+	}
+
+	addr := binary.LittleEndian.Uint64(b[36:])
+	for _, name := range path {
+		msgs := readHDF5Header(t, b, addr)
+		found := false
+		for _, link := range msgs[hdf5MessageLink] {
+			n := int(link[2])
+			if string(link[3:3+n]) == name {
+				addr = binary.LittleEndian.Uint64(link[3+n:])
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("no link %q", name)
+		}
+	}
+
+	msgs := readHDF5Header(t, b, addr)
+	if len(msgs[hdf5MessageDataspace]) != 1 || len(msgs[hdf5MessageLayout]) != 1 || len(msgs[hdf5MessageDatatype]) != 1 {
+		t.Fatalf("object %v is not a dataset", path)
+	}
+	space := msgs[hdf5MessageDataspace][0]
+	dims := make([]uint64, space[1])
+	for i := range dims {
+		dims[i] = binary.LittleEndian.Uint64(space[4+8*i:])
+	}
+	layout := msgs[hdf5MessageLayout][0]
+	if layout[1] != 1 {
+		t.Fatalf("dataset %v layout class = %d (want contiguous)", path, layout[1])
+	}
+	dataAddr := binary.LittleEndian.Uint64(layout[2:])
+	size := binary.LittleEndian.Uint64(layout[10:])
+	return dims, b[dataAddr : dataAddr+size]
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path"
+	"time"
+)
+
+// versionsDir is the directory below which all versions of objects are
+// stored if all versions are replicated. It is separate from the HSDS
+// directory layout, so the dump can still be served by HSDS.
+const versionsDir = ".versions"
+
+// latestVersionName is the name of the link pointing to an object's selected
+// version among its stored versions.
+const latestVersionName = "latest"
+
+// versionPath returns the path under which the given version of the object
+// identified by key is stored if all versions are replicated.
+func versionPath(key, version string) string {
+	return path.Join(versionsDir, key, url.PathEscape(version))
+}
+
+// hsdsObjectLinker is the interface wrapping the LinkObject method.
+//
+// LinkObject makes the object stored under target available under name as
+// well, e.g. by creating a hard link. Storers that do not support links may
+// copy the object instead.
+type hsdsObjectLinker interface {
+	LinkObject(ctx context.Context, target, name string) error
+}
+
+// storeVersionHistory downloads all versions listed in plan.History from
+// loader and stores each of them under its versionPath in storer. If
+// opts.HardlinkLatest is true, a link to the selected version is created
+// alongside them.
+func storeVersionHistory(ctx context.Context, loader hsdsObjectLoader, storer hsdsStorer, plan *domainPlan, opts *runOptions) error {
+	for key, versions := range plan.History {
+		opts.Progress.AddTotal(len(versions))
+		for _, version := range versions {
+			name := versionPath(key, version.ID)
+			opts.objectStarted(name)
+			start := time.Now()
+			data, err := loadObjectVersion(ctx, loader, key, version, time.Time{})
+			opts.warnSlowObject(name, start)
+			if err != nil {
+				return err
+			}
+			err = storer.StoreObject(ctx, name, data)
+			if err != nil {
+				return err
+			}
+			opts.objectDone(name, len(data))
+			if opts.Manifest != nil {
+				opts.Manifest.Annotate(name, func(e *manifestEntry) {
+					e.Version = version.ID
+				})
+			}
+		}
+
+		selected, ok := plan.Objects[key]
+		if !opts.HardlinkLatest || !ok {
+			continue
+		}
+		linker, ok := storer.(hsdsObjectLinker)
+		if !ok {
+			return errors.New("storer does not support linking objects")
+		}
+		target := versionPath(key, selected.ID)
+		name := path.Join(versionsDir, key, latestVersionName)
+		err := linker.LinkObject(ctx, target, name)
+		if err != nil {
+			return err
+		}
+		if opts.Manifest != nil {
+			opts.Manifest.Annotate(name, func(e *manifestEntry) {
+				e.Version = selected.ID
+				e.LinkTarget = target
+			})
+		}
+	}
+	return nil
+}
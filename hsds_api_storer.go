@@ -0,0 +1,622 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// hsdsAPIStorer is an implementation of the hsdsStorer interface that
+// restores domains into a running HSDS service through its REST API instead
+// of writing storage objects. Groups, datasets and committed datatypes are
+// created with POST requests, and links, attributes, chunk values and ACLs
+// are written with PUT requests.
+//
+// The service assigns new IDs to all objects, so links can only be restored
+// once all objects of a domain are known. Like a streamHSDSStorer, it
+// therefore buffers everything in memory until it is finalized. Domains must
+// not exist in the service yet, but their parent folders must.
+//
+// Chunks can only be restored for datasets of predefined integer and
+// floating-point types whose chunks are not filtered, e.g. compressed.
+type hsdsAPIStorer struct {
+	// Endpoint is the base URL of the HSDS service, e.g.
+	// http://hsds.example.com:5101.
+	Endpoint string
+	// Username and Password authenticate all requests with HTTP basic
+	// authentication, if Username is not empty.
+	Username string
+	Password string
+	// Client sends the requests. http.DefaultClient is used if it is nil.
+	Client *http.Client
+
+	mu      sync.Mutex
+	domains []*hsdsAPIDomain
+	objects map[string][]byte
+}
+
+// hsdsAPIDomain is a domain stored by an hsdsAPIStorer.
+type hsdsAPIDomain struct {
+	Name   string
+	Domain *hsdsDomain
+}
+
+// hsdsAPIError indicates that the HSDS service rejected a request.
+type hsdsAPIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (err *hsdsAPIError) Error() string {
+	return fmt.Sprintf("hsds api: %s %s: %d %s", err.Method, err.Path, err.StatusCode, err.Message)
+}
+
+func (s *hsdsAPIStorer) StoreDomain(ctx context.Context, name string, domain *hsdsDomain) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.domains {
+		if d.Name == name {
+			d.Domain = domain
+			return nil
+		}
+	}
+	s.domains = append(s.domains, &hsdsAPIDomain{Name: name, Domain: domain})
+	return nil
+}
+
+func (s *hsdsAPIStorer) StoreObject(ctx context.Context, name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects == nil {
+		s.objects = map[string][]byte{}
+	}
+	s.objects[name] = data
+	return nil
+}
+
+// Finalize restores all stored domains in the order in which they have been
+// stored. Objects that do not belong to any of them, e.g. the versions
+// stored with -all-versions, are skipped with a warning.
+func (s *hsdsAPIStorer) Finalize(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored := map[string]bool{}
+	for _, d := range s.domains {
+		r := &hsdsAPIRestore{
+			s:       s,
+			domain:  "/" + strings.TrimPrefix(d.Name, "/"),
+			ids:     map[hsdsID]string{},
+			objects: map[hsdsID]*hsdsAPIObject{},
+			chunks:  map[hsdsID]map[string][]byte{},
+		}
+		if d.Domain.Root != nil {
+			prefix := d.Domain.DatabasePrefix() + "/"
+			for key, data := range s.objects {
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				err := r.add(key, data)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				restored[key] = true
+			}
+		}
+		err := r.restore(ctx, d.Domain)
+		if err != nil {
+			return fmt.Errorf("domain %q: %w", d.Name, err)
+		}
+	}
+	for key := range s.objects {
+		if !restored[key] {
+			warn("skipping %s: not an object of a restored domain", key)
+		}
+	}
+	return nil
+}
+
+// request sends a request with the given method for the domain to the path
+// below s.Endpoint. If body is a []byte, it is sent as binary data, otherwise
+// it is encoded as JSON. If out is not nil, the JSON response is decoded into
+// it.
+func (s *hsdsAPIStorer) request(ctx context.Context, method, path, domain string, query url.Values, body, out interface{}) error {
+	var b []byte
+	contentType := "application/octet-stream"
+	switch body := body.(type) {
+	case []byte:
+		b = body
+	default:
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("domain", domain)
+	u := strings.TrimSuffix(s.Endpoint, "/") + path + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return &hsdsAPIError{Method: method, Path: path, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// hsdsAPIObject is the subset of the metadata of an HSDS group, dataset or
+// committed datatype that is restored through the REST API.
+type hsdsAPIObject struct {
+	ID                 hsdsID                       `json:"id"`
+	Type               json.RawMessage              `json:"type"`
+	Shape              *hsdsDatasetShape            `json:"shape"`
+	Layout             json.RawMessage              `json:"layout"`
+	CreationProperties map[string]json.RawMessage   `json:"creationProperties"`
+	Links              map[string]*hsdsLink         `json:"links"`
+	Attributes         map[string]*hsdsAPIAttribute `json:"attributes"`
+}
+
+// hsdsAPIAttribute is an attribute of an HSDS object.
+type hsdsAPIAttribute struct {
+	Type  json.RawMessage   `json:"type"`
+	Shape *hsdsDatasetShape `json:"shape"`
+	Value json.RawMessage   `json:"value"`
+}
+
+// hsdsAPIRestore restores a single domain through the HSDS REST API.
+type hsdsAPIRestore struct {
+	s *hsdsAPIStorer
+	// domain is the name of the domain in the service.
+	domain string
+	// ids maps the IDs of the domain's objects to the IDs the service has
+	// assigned to them.
+	ids     map[hsdsID]string
+	objects map[hsdsID]*hsdsAPIObject
+	// chunks maps the IDs of datasets to their chunks by chunk index.
+	chunks map[hsdsID]map[string][]byte
+}
+
+// add adds the object stored under key to the objects to be restored.
+func (r *hsdsAPIRestore) add(key string, data []byte) error {
+	k, err := parseObjectKey(key)
+	if err != nil {
+		return err
+	}
+	if k.IsChunk() {
+		id := datasetIDForKey(k)
+		if r.chunks[id] == nil {
+			r.chunks[id] = map[string][]byte{}
+		}
+		r.chunks[id][k.Chunk] = data
+		return nil
+	}
+	o := &hsdsAPIObject{}
+	err = json.Unmarshal(data, o)
+	if err != nil {
+		return err
+	}
+	r.objects[o.ID] = o
+	return nil
+}
+
+// datasetIDForKey returns the ID of the dataset the chunk identified by k
+// belongs to.
+func datasetIDForKey(k *hsdsObjectKey) hsdsID {
+	id := hsdsID{byte(entityTypeDataset)}
+	copy(id[1:9], k.Prefix[:])
+	copy(id[9:], k.Suffix[:])
+	return id
+}
+
+// sortedIDs returns the IDs of the objects of the given type in a stable
+// order.
+func (r *hsdsAPIRestore) sortedIDs(t hsdsEntityType) []hsdsID {
+	var ids []hsdsID
+	for id := range r.objects {
+		if id.Type() == t {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	return ids
+}
+
+// collection returns the path of the collection of objects of type t.
+func collection(t hsdsEntityType) string {
+	switch t {
+	case entityTypeDataset:
+		return "/datasets"
+	case entityTypeCommittedType:
+		return "/datatypes"
+	default:
+		return "/groups"
+	}
+}
+
+func (r *hsdsAPIRestore) restore(ctx context.Context, domain *hsdsDomain) error {
+	if domain.DomainClass() == domainClassFolder {
+		err := r.s.request(ctx, http.MethodPut, "/", r.domain, nil, map[string]interface{}{"folder": true}, nil)
+		if err != nil {
+			return err
+		}
+		return r.restoreACLs(ctx, domain.ACLs)
+	}
+
+	var created struct {
+		Root string `json:"root"`
+	}
+	err := r.s.request(ctx, http.MethodPut, "/", r.domain, nil, map[string]interface{}{}, &created)
+	if err != nil {
+		return err
+	}
+	if domain.Root != nil {
+		r.ids[*domain.Root] = created.Root
+	}
+
+	// Committed datatypes are created first, as datasets may refer to them.
+	for _, t := range []hsdsEntityType{entityTypeCommittedType, entityTypeGroup, entityTypeDataset} {
+		for _, id := range r.sortedIDs(t) {
+			if _, ok := r.ids[id]; ok {
+				continue
+			}
+			err = r.create(ctx, r.objects[id])
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+	}
+	for _, t := range []hsdsEntityType{entityTypeCommittedType, entityTypeGroup, entityTypeDataset} {
+		for _, id := range r.sortedIDs(t) {
+			err = r.restoreAttributes(ctx, r.objects[id])
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+	}
+	for _, id := range r.sortedIDs(entityTypeGroup) {
+		err = r.restoreLinks(ctx, r.objects[id])
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	}
+	for _, id := range r.sortedIDs(entityTypeDataset) {
+		err = r.restoreChunks(ctx, r.objects[id])
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	}
+	return r.restoreACLs(ctx, domain.ACLs)
+}
+
+// create creates the group, dataset or committed datatype o.
+func (r *hsdsAPIRestore) create(ctx context.Context, o *hsdsAPIObject) error {
+	body := map[string]interface{}{}
+	switch o.ID.Type() {
+	case entityTypeCommittedType:
+		body["type"] = o.Type
+	case entityTypeDataset:
+		t, err := r.restoreType(o.Type)
+		if err != nil {
+			return err
+		}
+		body["type"] = t
+		setShape(body, o.Shape)
+		cp := map[string]json.RawMessage{}
+		for name, v := range o.CreationProperties {
+			cp[name] = v
+		}
+		if _, ok := cp["layout"]; !ok && o.Layout != nil {
+			cp["layout"] = o.Layout
+		}
+		if len(cp) > 0 {
+			body["creationProperties"] = cp
+		}
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	err := r.s.request(ctx, http.MethodPost, collection(o.ID.Type()), r.domain, nil, body, &created)
+	if err != nil {
+		return err
+	}
+	r.ids[o.ID] = created.ID
+	return nil
+}
+
+// setShape adds shape to the body of a request creating a dataset or an
+// attribute. Scalar dataspaces are the default and therefore left out.
+func setShape(body map[string]interface{}, shape *hsdsDatasetShape) {
+	if shape == nil {
+		return
+	}
+	switch shape.Class {
+	case "H5S_NULL":
+		body["shape"] = shape.Class
+	case "H5S_SIMPLE":
+		body["shape"] = shape.Dims
+		if shape.MaxDims != nil {
+			body["maxdims"] = shape.MaxDims
+		}
+	}
+}
+
+// restoreType returns the type t of a dataset or attribute with a reference
+// to a committed datatype replaced by the ID it has been restored under.
+func (r *hsdsAPIRestore) restoreType(t json.RawMessage) (interface{}, error) {
+	var ref struct {
+		ID *hsdsID `json:"id"`
+	}
+	var id hsdsID
+	if json.Unmarshal(t, &id) == nil {
+		ref.ID = &id
+	} else if json.Unmarshal(t, &ref) != nil {
+		return t, nil
+	}
+	if ref.ID == nil {
+		return t, nil
+	}
+	newID, ok := r.ids[*ref.ID]
+	if !ok {
+		return nil, fmt.Errorf("committed datatype %s has not been restored", ref.ID)
+	}
+	return newID, nil
+}
+
+func (r *hsdsAPIRestore) restoreAttributes(ctx context.Context, o *hsdsAPIObject) error {
+	names := make([]string, 0, len(o.Attributes))
+	for name := range o.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := o.Attributes[name]
+		t, err := r.restoreType(a.Type)
+		if err != nil {
+			return err
+		}
+		body := map[string]interface{}{"type": t}
+		setShape(body, a.Shape)
+		if a.Value != nil {
+			body["value"] = a.Value
+		}
+		p := collection(o.ID.Type()) + "/" + r.ids[o.ID] + "/attributes/" + url.PathEscape(name)
+		err = r.s.request(ctx, http.MethodPut, p, r.domain, nil, body, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreLinks restores the links of the group o. Hard links to objects that
+// have not been dumped, e.g. because of -types, are skipped with a warning.
+func (r *hsdsAPIRestore) restoreLinks(ctx context.Context, o *hsdsAPIObject) error {
+	names := make([]string, 0, len(o.Links))
+	for name := range o.Links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		link := o.Links[name]
+		body := map[string]interface{}{}
+		switch link.Class {
+		case hsdsLinkClassHard:
+			if link.ID == nil {
+				continue
+			}
+			id, ok := r.ids[*link.ID]
+			if !ok {
+				warn("skipping link %s of group %s: %s has not been dumped", name, o.ID, link.ID)
+				continue
+			}
+			body["id"] = id
+		case hsdsLinkClassSoft:
+			body["h5path"] = link.H5Path
+		case hsdsLinkClassExternal:
+			body["h5path"] = link.H5Path
+			body["h5domain"] = link.H5Domain
+		default:
+			warn("skipping link %s of group %s: unsupported class %s", name, o.ID, link.Class)
+			continue
+		}
+		p := "/groups/" + r.ids[o.ID] + "/links/" + url.PathEscape(name)
+		err := r.s.request(ctx, http.MethodPut, p, r.domain, nil, body, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreChunks writes the values of the chunks of the dataset o, each
+// clipped to the dataset's extent.
+func (r *hsdsAPIRestore) restoreChunks(ctx context.Context, o *hsdsAPIObject) error {
+	chunks := r.chunks[o.ID]
+	if len(chunks) == 0 {
+		return nil
+	}
+	if len(o.CreationProperties["filters"]) > 0 && string(o.CreationProperties["filters"]) != "[]" {
+		return fmt.Errorf("chunks of filtered datasets cannot be restored")
+	}
+	size, err := r.elementSize(o.Type)
+	if err != nil {
+		return err
+	}
+	var dims []uint64
+	if o.Shape != nil {
+		dims = o.Shape.Dims
+	}
+	chunkDims := dims
+	var layout hsdsDatasetLayout
+	if o.Layout != nil && json.Unmarshal(o.Layout, &layout) == nil && layout.Dims != nil {
+		chunkDims = layout.Dims
+	}
+
+	indices := make([]string, 0, len(chunks))
+	for index := range chunks {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	for _, index := range indices {
+		sel, data, err := clipChunk(chunks[index], index, dims, chunkDims, size)
+		if err != nil {
+			return err
+		}
+		var query url.Values
+		if sel != "" {
+			query = url.Values{"select": {sel}}
+		}
+		err = r.s.request(ctx, http.MethodPut, "/datasets/"+r.ids[o.ID]+"/value", r.domain, query, data, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// elementSize returns the size in bytes of the elements of type t, which
+// must be a predefined integer or floating-point type, or a committed
+// datatype of one.
+func (r *hsdsAPIRestore) elementSize(t json.RawMessage) (uint64, error) {
+	var id hsdsID
+	if json.Unmarshal(t, &id) == nil {
+		ct, ok := r.objects[id]
+		if !ok {
+			return 0, fmt.Errorf("committed datatype %s has not been dumped", id)
+		}
+		t = ct.Type
+	}
+	var dt hsdsDatasetType
+	err := json.Unmarshal(t, &dt)
+	if err != nil {
+		return 0, err
+	}
+	ht, ok := hdf5TypeForBase(dt.Base)
+	if !ok {
+		return 0, fmt.Errorf("chunks of type %s %s cannot be restored", dt.Class, dt.Base)
+	}
+	return uint64(ht.Size), nil
+}
+
+// clipChunk returns the selection of the chunk with the given index of a
+// dataset of shape dims, which is split into chunks of chunkDims elements of
+// size bytes, e.g. "[4:6]", and the chunk's data clipped to the dataset's
+// extent. The selection is empty for scalar datasets.
+func clipChunk(data []byte, index string, dims, chunkDims []uint64, size uint64) (string, []byte, error) {
+	if len(dims) == 0 {
+		return "", data, nil
+	}
+	idx, err := parseChunkIndex(index)
+	if err != nil || len(idx) != len(dims) || len(chunkDims) != len(dims) {
+		return "", nil, fmt.Errorf("invalid chunk index %s", index)
+	}
+	n := uint64(1)
+	for _, d := range chunkDims {
+		n *= d
+	}
+	if uint64(len(data)) != n*size {
+		return "", nil, fmt.Errorf("chunk %s has %d bytes (want %d)", index, len(data), n*size)
+	}
+
+	extent := make([]uint64, len(dims))
+	ranges := make([]string, len(dims))
+	clipped := false
+	for i := range dims {
+		origin := uint64(idx[i]) * chunkDims[i]
+		if origin >= dims[i] {
+			return "", nil, fmt.Errorf("chunk %s is out of bounds", index)
+		}
+		extent[i] = chunkDims[i]
+		if origin+extent[i] > dims[i] {
+			extent[i] = dims[i] - origin
+			clipped = true
+		}
+		ranges[i] = fmt.Sprintf("%d:%d", origin, origin+extent[i])
+	}
+	sel := "[" + strings.Join(ranges, ",") + "]"
+	if !clipped {
+		return sel, data, nil
+	}
+
+	// Elements are copied row by row, i.e. along the last dimension.
+	last := len(dims) - 1
+	var out []byte
+	pos := make([]uint64, len(dims))
+	for {
+		var src uint64
+		for i := range dims {
+			src = src*chunkDims[i] + pos[i]
+		}
+		out = append(out, data[src*size:(src+extent[last])*size]...)
+
+		i := last - 1
+		for ; i >= 0; i-- {
+			pos[i]++
+			if pos[i] < extent[i] {
+				break
+			}
+			pos[i] = 0
+		}
+		if i < 0 {
+			break
+		}
+	}
+	return sel, out, nil
+}
+
+// restoreACLs restores the ACL entries of a domain, in the order of their
+// user names.
+func (r *hsdsAPIRestore) restoreACLs(ctx context.Context, acls hsdsACL) error {
+	users := make([]string, 0, len(acls))
+	for user := range acls {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		err := r.s.request(ctx, http.MethodPut, "/acls/"+url.PathEscape(user), r.domain, nil, acls[user], nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
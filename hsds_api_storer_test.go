@@ -0,0 +1,200 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeHSDSService records the requests sent to an HSDS service and assigns
+// new IDs to the objects created.
+type fakeHSDSService struct {
+	Requests []string
+	Bodies   map[string]string
+	// Fail is the request that is rejected, if set.
+	Fail string
+	n    int
+}
+
+func (s *fakeHSDSService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	req := r.Method + " " + r.URL.EscapedPath()
+	if sel := r.URL.Query().Get("select"); sel != "" {
+		req += " select=" + sel
+	}
+	req += " " + r.URL.Query().Get("domain")
+	s.Requests = append(s.Requests, req)
+	s.Bodies[req] = string(body)
+	if user, password, _ := r.BasicAuth(); user != "admin" || password != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req == s.Fail {
+		http.Error(w, "conflict", http.StatusConflict)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/":
+		fmt.Fprint(w, `{"root": "g-new-root"}`)
+	case r.Method == http.MethodPost:
+		s.n++
+		fmt.Fprintf(w, `{"id": "%c-new-%d"}`, r.URL.Path[1], s.n)
+	default:
+		fmt.Fprint(w, `{}`)
+	}
+}
+
+const (
+	testAPIGroupKey   = "db/d12a20a5-6c27622f/g/0000-000000-000001/.group.json"
+	testAPIDatasetKey = "db/d12a20a5-6c27622f/d/693e-302825-f8c087/.dataset.json"
+)
+
+// newTestAPIStorer returns an hsdsAPIStorer for the service s, with a domain
+// consisting of a root group linking to a group and a dataset of six bytes
+// split into two chunks, the second of which is clipped.
+func newTestAPIStorer(t *testing.T, s *fakeHSDSService) (*hsdsAPIStorer, func()) {
+	server := httptest.NewServer(s)
+	storer := &hsdsAPIStorer{Endpoint: server.URL + "/", Username: "admin", Password: "secret"}
+	domain := &hsdsDomain{
+		Root:  &testRootID,
+		Owner: "user",
+		ACLs:  hsdsACL{"user": {Read: true, Update: true}},
+	}
+	objects := map[string]string{
+		testGroupKey: `{"id": "g-d12a20a5-6c27622f-59a2-a82de4-afeaa7", "root": "g-d12a20a5-6c27622f-59a2-a82de4-afeaa7",
+			"links": {
+				"data": {"class": "H5L_TYPE_HARD", "id": "d-d12a20a5-6c27622f-693e-302825-f8c087"},
+				"group": {"class": "H5L_TYPE_HARD", "id": "g-d12a20a5-6c27622f-0000-000000-000001"},
+				"lost": {"class": "H5L_TYPE_HARD", "id": "g-d12a20a5-6c27622f-0000-000000-000002"},
+				"soft": {"class": "H5L_TYPE_SOFT", "h5path": "/group"}
+			},
+			"attributes": {
+				"title": {"type": {"class": "H5T_STRING", "charSet": "H5T_CSET_ASCII", "length": 4}, "shape": {"class": "H5S_SCALAR"}, "value": "test"}
+			}}`,
+		testAPIGroupKey: `{"id": "g-d12a20a5-6c27622f-0000-000000-000001", "links": {}, "attributes": {}}`,
+		testAPIDatasetKey: `{"id": "d-d12a20a5-6c27622f-693e-302825-f8c087",
+			"type": {"class": "H5T_INTEGER", "base": "H5T_STD_U8LE"},
+			"shape": {"class": "H5S_SIMPLE", "dims": [6]},
+			"layout": {"class": "H5D_CHUNKED", "dims": [4]},
+			"creationProperties": {"fillValue": 0},
+			"attributes": {}}`,
+		testChunkKey: "\x01\x02\x03\x04",
+		"db/d12a20a5-6c27622f/d/693e-302825-f8c087/1": "\x05\x06\x00\x00",
+	}
+	err := storer.StoreDomain(nil, "home/user/domain.h5", domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range objects {
+		err = storer.StoreObject(nil, key, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storer, server.Close
+}
+
+func TestHSDSAPIStorer_Finalize(t *testing.T) {
+	s := &fakeHSDSService{Bodies: map[string]string{}}
+	storer, stop := newTestAPIStorer(t, s)
+	defer stop()
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	err := storer.Finalize(context.Background())
+	if err != nil {
+		t.Fatalf("Finalize() err = %v (want nil)", err)
+	}
+
+	const domain = "/home/user/domain.h5"
+	want := []string{
+		"PUT / " + domain,
+		"POST /groups " + domain,
+		"POST /datasets " + domain,
+		"PUT /groups/g-new-root/attributes/title " + domain,
+		"PUT /groups/g-new-root/links/data " + domain,
+		"PUT /groups/g-new-root/links/group " + domain,
+		"PUT /groups/g-new-root/links/soft " + domain,
+		"PUT /datasets/d-new-2/value select=[0:4] " + domain,
+		"PUT /datasets/d-new-2/value select=[4:6] " + domain,
+		"PUT /acls/user " + domain,
+	}
+	if !reflect.DeepEqual(s.Requests, want) {
+		t.Errorf("Finalize() requests = %q (want %q)", s.Requests, want)
+	}
+
+	bodies := map[string]string{
+		"POST /datasets " + domain:                           `{"creationProperties":{"fillValue":0,"layout":{"class":"H5D_CHUNKED","dims":[4]}},"shape":[6],"type":{"class":"H5T_INTEGER","base":"H5T_STD_U8LE"}}`,
+		"PUT /groups/g-new-root/links/data " + domain:        `{"id":"d-new-2"}`,
+		"PUT /groups/g-new-root/links/group " + domain:       `{"id":"g-new-1"}`,
+		"PUT /groups/g-new-root/links/soft " + domain:        `{"h5path":"/group"}`,
+		"PUT /datasets/d-new-2/value select=[0:4] " + domain: "\x01\x02\x03\x04",
+		"PUT /datasets/d-new-2/value select=[4:6] " + domain: "\x05\x06",
+		"PUT /acls/user " + domain:                           `{"create":false,"read":true,"update":true,"delete":false,"readACL":false,"updateACL":false}`,
+		"PUT /groups/g-new-root/attributes/title " + domain:  `{"type":{"class":"H5T_STRING","charSet":"H5T_CSET_ASCII","length":4},"value":"test"}`,
+	}
+	for req, body := range bodies {
+		if got := s.Bodies[req]; got != body {
+			t.Errorf("Finalize() %s body = %q (want %q)", req, got, body)
+		}
+	}
+	if !strings.Contains(warnings.String(), "skipping link lost") {
+		t.Errorf("Finalize() warnings = %q (want warning about link lost)", warnings.String())
+	}
+}
+
+func TestHSDSAPIStorer_FinalizeError(t *testing.T) {
+	s := &fakeHSDSService{Bodies: map[string]string{}, Fail: "POST /datasets /home/user/domain.h5"}
+	storer, stop := newTestAPIStorer(t, s)
+	defer stop()
+
+	err := storer.Finalize(context.Background())
+	var apiErr *hsdsAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict || apiErr.Path != "/datasets" {
+		t.Errorf("Finalize() err = %v (want *hsdsAPIError for POST /datasets)", err)
+	}
+}
+
+type clipChunkTestcase struct {
+	index     string
+	dims      []uint64
+	chunkDims []uint64
+	wantSel   string
+	want      []byte
+}
+
+func TestClipChunk(t *testing.T) {
+	// A 4x4 chunk of one byte elements.
+	chunk := []byte{
+		1, 2, 3, 4,
+		5, 6, 7, 8,
+		9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	testCases := []clipChunkTestcase{
+		{index: "0_0", dims: []uint64{8, 8}, chunkDims: []uint64{4, 4}, wantSel: "[0:4,0:4]", want: chunk},
+		{index: "1_1", dims: []uint64{6, 7}, chunkDims: []uint64{4, 4}, wantSel: "[4:6,4:7]", want: []byte{1, 2, 3, 5, 6, 7}},
+		{index: "0_1", dims: []uint64{4, 5}, chunkDims: []uint64{4, 4}, wantSel: "[0:4,4:5]", want: []byte{1, 5, 9, 13}},
+		{index: "0", dims: nil, chunkDims: nil, want: chunk},
+	}
+
+	for _, tc := range testCases {
+		sel, got, err := clipChunk(chunk, tc.index, tc.dims, tc.chunkDims, 1)
+		if err != nil || sel != tc.wantSel || !bytes.Equal(got, tc.want) {
+			t.Errorf("%s %v: clipChunk() = %q, %v, %v (want %q, %v)", tc.index, tc.dims, sel, got, err, tc.wantSel, tc.want)
+		}
+	}
+}
@@ -6,7 +6,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"path"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -23,15 +27,88 @@ type hsdsPermissions struct {
 	UpdateACL bool `json:"updateACL"`
 }
 
+// invalidACLError indicates that an ACL contains malformed entries, e.g. an
+// empty user name or a user without permissions.
+type invalidACLError struct {
+	// Users are the user names of the malformed entries, in sorted order.
+	Users []string
+}
+
+func (err *invalidACLError) Error() string {
+	users := make([]string, len(err.Users))
+	for i, u := range err.Users {
+		users[i] = fmt.Sprintf("'%s'", u)
+	}
+	return fmt.Sprintf("hsds: malformed ACL entries for users %s", strings.Join(users, ", "))
+}
+
+// Validate returns an *invalidACLError if acl contains entries with an empty
+// user name or without permissions. Such entries are not created by HSDS and
+// hint at a corrupt domain file.
+func (acl hsdsACL) Validate() error {
+	var users []string
+	for user, perms := range acl {
+		if user == "" || perms == nil {
+			users = append(users, user)
+		}
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	sort.Strings(users)
+	return &invalidACLError{Users: users}
+}
+
 // hsdsDomain is roughly the equivalent of an HDF5 file in an S3 bucket.
 type hsdsDomain struct {
 	ACLs         hsdsACL `json:"acls"`
 	Root         *hsdsID `json:"root,omitempty"`
 	Owner        string  `json:"owner"`
+	Class        string  `json:"class,omitempty"`
 	Created      float64 `json:"created,omitempty"`
 	LastModified float64 `json:"lastModified,omitempty"`
 }
 
+// Classes of domains.
+const (
+	// domainClassDomain is the class of domains containing HDF5 objects.
+	domainClassDomain = "domain"
+	// domainClassFolder is the class of domains that only hold other
+	// domains.
+	domainClassFolder = "folder"
+)
+
+// unknownDomainClassError indicates that a domain class is not supported.
+type unknownDomainClassError struct {
+	Class string
+}
+
+func (err *unknownDomainClassError) Error() string {
+	return fmt.Sprintf("unknown domain class '%s' (want %s or %s)", err.Class, domainClassDomain, domainClassFolder)
+}
+
+// validDomainClass returns an error if class is neither domainClassDomain
+// nor domainClassFolder. The empty string matches all domains.
+func validDomainClass(class string) error {
+	switch class {
+	case "", domainClassDomain, domainClassFolder:
+		return nil
+	}
+	return &unknownDomainClassError{Class: class}
+}
+
+// DomainClass returns d's class. Domain files written by older HSDS versions
+// have no class, in which case domains without a root group are folders.
+func (d *hsdsDomain) DomainClass() string {
+	if d.Class != "" {
+		return d.Class
+	}
+	if d.Root == nil {
+		return domainClassFolder
+	}
+	return domainClassDomain
+}
+
 // Prefix returns d's root group's ID prefix.
 func (d *hsdsDomain) Prefix() hsdsPrefix {
 	return d.Root.Prefix()
@@ -48,14 +125,32 @@ func (d *hsdsDomain) DatabasePrefix() string {
 	return path.Join("db", d.Prefix().String())
 }
 
+// domainNotFoundError indicates that a domain does not exist.
+type domainNotFoundError struct {
+	Name string
+}
+
+func (err *domainNotFoundError) Error() string {
+	return fmt.Sprintf("hsds: domain %q does not exist", err.Name)
+}
+
 // hsdsDomainLoader is the interface implementing the LoadDomain method.
 //
 // LoadDomain loads the domain identified by name in the loaders's persistent
-// storage.
+// storage. If the domain does not exist, a *domainNotFoundError is returned.
 type hsdsDomainLoader interface {
 	LoadDomain(ctx context.Context, name string) (*hsdsDomain, error)
 }
 
+// hsdsDomainFileLoader is the interface wrapping the LoadDomainFile method.
+//
+// LoadDomainFile loads the unmodified domain file of the domain identified by
+// name from the loader's persistent storage. It returns the file's key and
+// content.
+type hsdsDomainFileLoader interface {
+	LoadDomainFile(ctx context.Context, name string) (string, []byte, error)
+}
+
 // hsdsDomainStorer is the interface implementing the StoreDomain method.
 //
 // StoreDomain stores domain under the given name in the storer's persistent
@@ -73,9 +168,18 @@ type hsdsDomainLoadStorer interface {
 
 // hsdsVersion is the type representing a specific version of a domain object.
 type hsdsVersion struct {
-	ID           string
-	LastModified time.Time
-	Size         int64
+	ID           string    `json:"id"`
+	LastModified time.Time `json:"lastModified"`
+	Size         int64     `json:"size"`
+	// ETag is the entity tag of the version's content, without the quotes
+	// S3 wraps around it. Versions with the same ETag have identical content.
+	ETag string `json:"etag,omitempty"`
+	// StorageClass is the S3 storage class of the version, e.g. STANDARD or
+	// GLACIER. It is empty if it is unknown.
+	StorageClass string `json:"storageClass,omitempty"`
+	// DeleteMarker indicates that the object has been deleted at
+	// LastModified. Delete markers have no content.
+	DeleteMarker bool `json:"deleteMarker,omitempty"`
 }
 
 // hsdsDomainVersionLoader wraps the LoadDomainVersions method.
@@ -86,7 +190,16 @@ type hsdsVersion struct {
 // identifying the domain object and the respective object's versions. Otherwise,
 // nil and an error is returned.
 type hsdsDomainVersionLoader interface {
-	LoadDomainVersions(ctx context.Context, domain *hsdsDomain) map[string][]*hsdsVersion
+	LoadDomainVersions(ctx context.Context, domain *hsdsDomain) (map[string][]*hsdsVersion, error)
+}
+
+// hsdsPrefixVersionLoader is the interface wrapping the LoadPrefixVersions
+// method.
+//
+// LoadPrefixVersions loads the versions of all objects whose key starts with
+// prefix, like LoadDomainVersions does for all objects of a domain.
+type hsdsPrefixVersionLoader interface {
+	LoadPrefixVersions(ctx context.Context, prefix string) (map[string][]*hsdsVersion, error)
 }
 
 // hsdsObjectLoader is the interface wrapping the LoadObject method.
@@ -100,6 +213,200 @@ type hsdsObjectLoader interface {
 	LoadObject(ctx context.Context, name, version string) ([]byte, error)
 }
 
+// hsdsLoader is the combination of the hsdsDomainLoader,
+// hsdsDomainVersionLoader and hsdsObjectLoader interfaces.
+type hsdsLoader interface {
+	hsdsDomainLoader
+	hsdsDomainVersionLoader
+	hsdsObjectLoader
+}
+
+// hsdsObjectModTimer is the interface that groups the ObjectModTime and
+// SetObjectModTime methods.
+//
+// ObjectModTime returns the time at which the object stored under name has
+// last been modified in the storer's underlying persistent storage. If no
+// such object exists, an error satisfying errors.Is(err, os.ErrNotExist) is
+// returned.
+//
+// SetObjectModTime sets the modification time of the object stored under
+// name to t.
+type hsdsObjectModTimer interface {
+	ObjectModTime(ctx context.Context, name string) (time.Time, error)
+	SetObjectModTime(ctx context.Context, name string, t time.Time) error
+}
+
+// hsdsObjectSizer is the interface wrapping the ObjectSize method.
+//
+// ObjectSize returns the size in bytes of the object stored under name in the
+// storer's underlying persistent storage. If no such object exists, an error
+// satisfying errors.Is(err, os.ErrNotExist) is returned.
+type hsdsObjectSizer interface {
+	ObjectSize(ctx context.Context, name string) (int64, error)
+}
+
+// hsdsDirectoryStorer is the interface wrapping the StoreDirectory method.
+//
+// StoreDirectory creates the directory identified by name in the storer's
+// underlying persistent storage, even if no objects are stored in it.
+type hsdsDirectoryStorer interface {
+	StoreDirectory(ctx context.Context, name string) error
+}
+
+// hsdsStorer is the combination of the hsdsDomainStorer and hsdsObjectStorer
+// interfaces.
+type hsdsStorer interface {
+	hsdsDomainStorer
+	hsdsObjectStorer
+}
+
+// finalizableStorer is the interface wrapping the Finalize method.
+//
+// Finalize completes a dump once all objects have been stored, e.g. by
+// flushing buffered data and writing metadata that covers all stored objects.
+// No objects are stored after Finalize has been called.
+type finalizableStorer interface {
+	Finalize(ctx context.Context) error
+}
+
+// sizeMismatchError indicates that the number of bytes read for a domain
+// object does not match the size recorded for its version.
+type sizeMismatchError struct {
+	Name     string
+	Expected int64
+	Actual   int64
+}
+
+func (err *sizeMismatchError) Error() string {
+	return fmt.Sprintf("hsds: size mismatch for '%s': got %d bytes, want %d",
+		err.Name, err.Actual, err.Expected)
+}
+
+// Temporary reports whether the error is transient. A size mismatch is
+// usually caused by a truncated or garbled transfer, so retrying the download
+// may succeed.
+func (err *sizeMismatchError) Temporary() bool {
+	return true
+}
+
+// isRetryable reports whether err indicates a transient failure.
+func isRetryable(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// maxLoadAttempts is the number of times loadObjectVersion tries to load an
+// object before giving up.
+const maxLoadAttempts = 3
+
+// loadObjectVersion loads the given version of the domain object identified
+// by name and verifies that the number of bytes read matches the version's
+// recorded size. Retryable errors cause the download to be repeated up to
+// maxLoadAttempts times. Versions of size zero, e.g. placeholder chunks, are
+// valid and loaded as empty, non-nil data, so they are stored as empty files.
+//
+// If since is not the zero value and loader implements the
+// hsdsConditionalObjectLoader interface, errNotModified is returned if the
+// version has not been modified after since.
+func loadObjectVersion(ctx context.Context, loader hsdsObjectLoader, name string, version *hsdsVersion, since time.Time) ([]byte, error) {
+	var cl hsdsConditionalObjectLoader
+	conditional := !since.IsZero() && findLoader(loader, func(l interface{}) (ok bool) {
+		cl, ok = l.(hsdsConditionalObjectLoader)
+		return ok
+	})
+	var err error
+	for attempt := 0; attempt < maxLoadAttempts; attempt++ {
+		var data []byte
+		if conditional {
+			data, err = cl.LoadObjectIfModified(ctx, name, version.ID, since)
+		} else {
+			data, err = loader.LoadObject(ctx, name, version.ID)
+		}
+		if err == nil && int64(len(data)) != version.Size {
+			err = &sizeMismatchError{Name: name, Expected: version.Size, Actual: int64(len(data))}
+		}
+		if err == nil {
+			if data == nil {
+				data = []byte{}
+			}
+			return data, nil
+		}
+		if !isRetryable(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// hsdsObjectChecker is the interface wrapping the ObjectExists method.
+//
+// ObjectExists reports whether the given version of the domain object
+// identified by name is still available, without downloading it.
+type hsdsObjectChecker interface {
+	ObjectExists(ctx context.Context, name, version string) (bool, error)
+}
+
+// objectVersionExists reports whether the given version of the domain object
+// identified by name can still be loaded from loader. Retryable errors cause
+// the check to be repeated up to maxLoadAttempts times. If loader does not
+// implement the hsdsObjectChecker interface, the version is assumed to exist.
+func objectVersionExists(ctx context.Context, loader hsdsObjectLoader, name string, version *hsdsVersion) (bool, error) {
+	var checker hsdsObjectChecker
+	ok := findLoader(loader, func(l interface{}) (ok bool) {
+		checker, ok = l.(hsdsObjectChecker)
+		return ok
+	})
+	if !ok {
+		return true, nil
+	}
+	var err error
+	for attempt := 0; attempt < maxLoadAttempts; attempt++ {
+		var exists bool
+		exists, err = checker.ObjectExists(ctx, name, version.ID)
+		if err == nil {
+			return exists, nil
+		}
+		if !isRetryable(err) {
+			return false, err
+		}
+	}
+	return false, err
+}
+
+// errNotModified indicates that an object has not been modified since a given
+// time.
+var errNotModified = errors.New("hsds: object not modified")
+
+// errObjectUnavailable indicates that a listed object version can no longer
+// be loaded, e.g. because it has expired due to a lifecycle rule or has been
+// archived.
+var errObjectUnavailable = errors.New("hsds: object version unavailable")
+
+// hsdsConditionalObjectLoader is the interface wrapping the
+// LoadObjectIfModified method.
+//
+// LoadObjectIfModified is like LoadObject, but returns errNotModified if the
+// given version of the domain object has not been modified after since.
+type hsdsConditionalObjectLoader interface {
+	LoadObjectIfModified(ctx context.Context, name, version string, since time.Time) ([]byte, error)
+}
+
+// hsdsObjectTagLoader is the interface wrapping the LoadObjectTags method.
+//
+// LoadObjectTags loads the tags of the given version of the domain object
+// identified by name. Objects without tags have an empty tag set.
+type hsdsObjectTagLoader interface {
+	LoadObjectTags(ctx context.Context, name, version string) (map[string]string, error)
+}
+
+// hsdsObjectTagStorer is the interface wrapping the StoreObjectTags method.
+//
+// StoreObjectTags replaces the tags of the object previously stored under
+// name with tags.
+type hsdsObjectTagStorer interface {
+	StoreObjectTags(ctx context.Context, name string, tags map[string]string) error
+}
+
 // hsdsObjectStorer is the interface wrapping the StoreObjects method.
 //
 // StoreObject stores data under the given path in the storer's underlying
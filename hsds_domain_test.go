@@ -0,0 +1,153 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeObjectLoader is an hsdsObjectLoader returning the next entry of Bodies
+// on each call to LoadObject. Once all bodies have been returned, the last one
+// is repeated.
+type fakeObjectLoader struct {
+	Bodies [][]byte
+	Calls  int
+}
+
+func (l *fakeObjectLoader) LoadObject(ctx context.Context, name, version string) ([]byte, error) {
+	i := l.Calls
+	if i >= len(l.Bodies) {
+		i = len(l.Bodies) - 1
+	}
+	l.Calls++
+	return l.Bodies[i], nil
+}
+
+type loadObjectVersionTestcase struct {
+	name      string
+	bodies    [][]byte
+	size      int64
+	want      []byte
+	wantCalls int
+	wantErr   error
+}
+
+func TestLoadObjectVersion(t *testing.T) {
+	testCases := []loadObjectVersionTestcase{
+		{
+			name:      "complete-body",
+			bodies:    [][]byte{[]byte("chunk")},
+			size:      5,
+			want:      []byte("chunk"),
+			wantCalls: 1,
+		},
+		{
+			name:      "short-body-retried",
+			bodies:    [][]byte{[]byte("chu"), []byte("chunk")},
+			size:      5,
+			want:      []byte("chunk"),
+			wantCalls: 2,
+		},
+		{
+			name:      "short-body",
+			bodies:    [][]byte{[]byte("chu")},
+			size:      5,
+			wantCalls: maxLoadAttempts,
+			wantErr:   &sizeMismatchError{Name: "key", Expected: 5, Actual: 3},
+		},
+		{
+			name:      "long-body",
+			bodies:    [][]byte{[]byte("chunk!!")},
+			size:      5,
+			wantCalls: maxLoadAttempts,
+			wantErr:   &sizeMismatchError{Name: "key", Expected: 5, Actual: 7},
+		},
+		{
+			name:      "empty-body",
+			bodies:    [][]byte{nil},
+			size:      0,
+			want:      []byte{},
+			wantCalls: 1,
+		},
+		{
+			name:      "missing-body",
+			bodies:    [][]byte{nil},
+			size:      5,
+			wantCalls: maxLoadAttempts,
+			wantErr:   &sizeMismatchError{Name: "key", Expected: 5, Actual: 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		loader := &fakeObjectLoader{Bodies: tc.bodies}
+		version := &hsdsVersion{ID: "v1", Size: tc.size}
+		got, err := loadObjectVersion(context.Background(), loader, "key", version, time.Time{})
+		if loader.Calls != tc.wantCalls {
+			t.Errorf("%s: loadObjectVersion() calls = %d (want %d)", tc.name, loader.Calls, tc.wantCalls)
+		}
+		if tc.wantErr != nil {
+			var sme *sizeMismatchError
+			if !errors.As(err, &sme) || *sme != *tc.wantErr.(*sizeMismatchError) {
+				t.Errorf("%s: loadObjectVersion() err = %v (want %v)", tc.name, err, tc.wantErr)
+			}
+			if !isRetryable(err) {
+				t.Errorf("%s: isRetryable(%v) = false (want true)", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: loadObjectVersion() err = %v (want nil)", tc.name, err)
+			continue
+		}
+		if got == nil || !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: loadObjectVersion() = %#v (want %q)", tc.name, got, tc.want)
+		}
+	}
+}
+
+type aclValidateTestcase struct {
+	name      string
+	acl       hsdsACL
+	wantUsers []string
+}
+
+func TestHSDSACL_Validate(t *testing.T) {
+	perms := &hsdsPermissions{Read: true}
+	testCases := []aclValidateTestcase{
+		{
+			name: "valid",
+			acl:  hsdsACL{"default": &hsdsPermissions{}, "alice": perms},
+		},
+		{
+			name:      "nil-permissions",
+			acl:       hsdsACL{"alice": perms, "bob": nil},
+			wantUsers: []string{"bob"},
+		},
+		{
+			name:      "empty-user",
+			acl:       hsdsACL{"": perms, "bob": nil},
+			wantUsers: []string{"", "bob"},
+		},
+	}
+
+	for _, tc := range testCases {
+		err := tc.acl.Validate()
+		if tc.wantUsers == nil {
+			if err != nil {
+				t.Errorf("%s: Validate() err = %v (want nil)", tc.name, err)
+			}
+			continue
+		}
+		var iae *invalidACLError
+		if !errors.As(err, &iae) || !reflect.DeepEqual(iae.Users, tc.wantUsers) {
+			t.Errorf("%s: Validate() err = %v (want invalid entries for %q)", tc.name, err, tc.wantUsers)
+		}
+	}
+}
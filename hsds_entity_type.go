@@ -4,7 +4,10 @@
 
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // hsdsEntityType is a representation of HSDS object types.
 type hsdsEntityType byte
@@ -37,3 +40,24 @@ func (err *unknownEntityTypeError) Is(other error) bool {
 	}
 	return x.Type == err.Type
 }
+
+// entityTypeSet is a set of entity types.
+type entityTypeSet map[hsdsEntityType]bool
+
+// parseEntityTypes parses s, which is a comma-separated list of entity type
+// letters, e.g. "g,t" for groups and committed types.
+func parseEntityTypes(s string) (entityTypeSet, error) {
+	types := entityTypeSet{}
+	for _, letter := range strings.Split(s, ",") {
+		letter = strings.TrimSpace(letter)
+		if len(letter) != 1 {
+			return nil, fmt.Errorf("invalid entity type '%s' (want g, d or t)", letter)
+		}
+		t := hsdsEntityType(letter[0])
+		if !t.Valid() {
+			return nil, &unknownEntityTypeError{Type: t}
+		}
+		types[t] = true
+	}
+	return types, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+type parseEntityTypesTestcase struct {
+	s     string
+	want  entityTypeSet
+	valid bool
+}
+
+func TestParseEntityTypes(t *testing.T) {
+	testCases := []parseEntityTypesTestcase{
+		{s: "g", want: entityTypeSet{entityTypeGroup: true}, valid: true},
+		{s: "g,t", want: entityTypeSet{entityTypeGroup: true, entityTypeCommittedType: true}, valid: true},
+		{s: "d, g ,d", want: entityTypeSet{entityTypeDataset: true, entityTypeGroup: true}, valid: true},
+		{s: ""},
+		{s: "x"},
+		{s: "g,,t"},
+		{s: "gd"},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseEntityTypes(tc.s)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%q: parseEntityTypes() err = nil (want error)", tc.s)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: parseEntityTypes() = %v, %v (want %v)", tc.s, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+)
+
+// hsdsLinkClassHard is the class of hard links to objects within a domain.
+const hsdsLinkClassHard = "H5L_TYPE_HARD"
+
+// hsdsLinkClassSoft is the class of links to paths within a domain.
+const hsdsLinkClassSoft = "H5L_TYPE_SOFT"
+
+// hsdsLinkClassExternal is the class of links to objects in other domains.
+const hsdsLinkClassExternal = "H5L_TYPE_EXTERNAL"
+
+// hsdsLink is a link from a group to another HDF5 object.
+type hsdsLink struct {
+	Class string `json:"class"`
+	// ID is the ID of the linked object. It is only set for hard links.
+	ID *hsdsID `json:"id,omitempty"`
+	// H5Path is the path of the linked object. It is only set for soft and
+	// external links.
+	H5Path string `json:"h5path,omitempty"`
+	// H5Domain is the name of the linked domain. It is only set for external
+	// links.
+	H5Domain string `json:"h5domain,omitempty"`
+}
+
+// hsdsGroup is the subset of an HSDS group's metadata that is required to
+// traverse a domain's group hierarchy.
+type hsdsGroup struct {
+	ID    hsdsID               `json:"id"`
+	Links map[string]*hsdsLink `json:"links"`
+}
+
+// entityDir returns the directory in which the objects belonging to the
+// entity identified by id are stored. root is the ID of the domain's root
+// group.
+func entityDir(id, root hsdsID) string {
+	prefix := path.Join("db", id.Prefix().String())
+	if id == root {
+		return prefix
+	}
+	return path.Join(prefix, string(id.Type()), id.Suffix().String())
+}
+
+// groupDirectories returns the directories of all groups of domain, based on
+// the group metadata objects contained in objects. This includes groups that
+// are linked to, but whose metadata is not contained in objects.
+func groupDirectories(domain *hsdsDomain, objects map[string][]byte) ([]string, error) {
+	dirs := map[string]bool{}
+	if domain.Root != nil {
+		dirs[entityDir(*domain.Root, *domain.Root)] = true
+	}
+	for key, data := range objects {
+		k, err := parseObjectKey(key)
+		if err != nil || k.Type != entityTypeGroup || k.IsChunk() {
+			continue
+		}
+		group := &hsdsGroup{}
+		err = json.Unmarshal(data, group)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range group.Links {
+			if link.Class != hsdsLinkClassHard || link.ID == nil || link.ID.Type() != entityTypeGroup {
+				continue
+			}
+			dirs[entityDir(*link.ID, *domain.Root)] = true
+		}
+	}
+
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	return names, nil
+}
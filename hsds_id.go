@@ -122,6 +122,22 @@ func (p hsdsPrefix) String() string {
 	return string(b)
 }
 
+// errInvalidPrefix indicates that a text-encoded prefix is malformed.
+var errInvalidPrefix = errors.New("hsds: invalid HSDS prefix format")
+
+func (p *hsdsPrefix) UnmarshalText(b []byte) error {
+	if len(b) != prefixLen || b[8] != '-' {
+		return errInvalidPrefix
+	}
+	if _, err := hex.Decode(p[:4], b[:8]); err != nil {
+		return errInvalidPrefix
+	}
+	if _, err := hex.Decode(p[4:], b[9:]); err != nil {
+		return errInvalidPrefix
+	}
+	return nil
+}
+
 // hsdsSuffix is the type representing the id suffix for an ID. It consists of the
 // last eight bytes of the ID's UUID.
 type hsdsSuffix [8]byte
@@ -146,6 +162,25 @@ func (s hsdsSuffix) String() string {
 	return string(b)
 }
 
+// errInvalidSuffix indicates that a text-encoded suffix is malformed.
+var errInvalidSuffix = errors.New("hsds: invalid HSDS suffix format")
+
+func (s *hsdsSuffix) UnmarshalText(b []byte) error {
+	if len(b) != suffixLen || b[4] != '-' || b[11] != '-' {
+		return errInvalidSuffix
+	}
+	if _, err := hex.Decode(s[:2], b[:4]); err != nil {
+		return errInvalidSuffix
+	}
+	if _, err := hex.Decode(s[2:5], b[5:11]); err != nil {
+		return errInvalidSuffix
+	}
+	if _, err := hex.Decode(s[5:], b[12:]); err != nil {
+		return errInvalidSuffix
+	}
+	return nil
+}
+
 // hsdsUUID is the type representing an IDs hsdsUUID portion. It consists of all
 // bytes except the first.
 type hsdsUUID [16]byte
@@ -0,0 +1,170 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// errInvalidObjectKey indicates that a key does not follow the naming scheme
+// HSDS uses for domain objects.
+var errInvalidObjectKey = errors.New("hsds: invalid HSDS object key")
+
+// hsdsObjectKey is the parsed representation of the key of a domain object.
+//
+// HSDS stores domain objects under keys of the following forms:
+//
+//	db/<prefix>/.group.json                  (root group)
+//	db/<prefix>/<type>/<suffix>/.<name>.json (groups, datasets, types)
+//	db/<prefix>/d/<suffix>/<chunk index>     (chunks, e.g. 0_1_2)
+type hsdsObjectKey struct {
+	Prefix hsdsPrefix
+	Type   hsdsEntityType
+	// Suffix is the entity's ID suffix. It is the zero value for the root
+	// group, which is stored directly below the domain's prefix.
+	Suffix hsdsSuffix
+	// Root indicates whether the key belongs to the domain's root group.
+	Root bool
+	// Chunk is the chunk index of a dataset chunk, e.g. "0_1_2". It is empty
+	// for all metadata objects.
+	Chunk string
+}
+
+// IsChunk returns whether k identifies a dataset chunk.
+func (k *hsdsObjectKey) IsChunk() bool {
+	return k.Chunk != ""
+}
+
+// parseObjectKey parses key, which must be a key of an HSDS domain object.
+//
+// On success the parsed key is returned. Otherwise, nil and
+// errInvalidObjectKey or an error indicating an invalid ID part is returned.
+func parseObjectKey(key string) (*hsdsObjectKey, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 || parts[0] != "db" {
+		return nil, errInvalidObjectKey
+	}
+
+	k := &hsdsObjectKey{}
+	err := k.Prefix.UnmarshalText([]byte(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(parts) {
+	case 3:
+		if parts[2] != ".group.json" {
+			return nil, errInvalidObjectKey
+		}
+		k.Type = entityTypeGroup
+		k.Root = true
+	case 5:
+		if len(parts[2]) != 1 {
+			return nil, errInvalidObjectKey
+		}
+		k.Type = hsdsEntityType(parts[2][0])
+		if !k.Type.Valid() {
+			return nil, &unknownEntityTypeError{Type: k.Type}
+		}
+		err = k.Suffix.UnmarshalText([]byte(parts[3]))
+		if err != nil {
+			return nil, err
+		}
+		name := parts[4]
+		if name == "" {
+			return nil, errInvalidObjectKey
+		}
+		if !strings.HasPrefix(name, ".") {
+			if k.Type != entityTypeDataset {
+				return nil, errInvalidObjectKey
+			}
+			k.Chunk = name
+		}
+	default:
+		return nil, errInvalidObjectKey
+	}
+
+	return k, nil
+}
+
+// canonicalKey returns key with the ID prefix and suffix it embeds re-encoded
+// in canonical lowercase form, e.g. "db/d12a20a5-6c27622f/.group.json" for
+// "db/D12A20A5-6c27622F/.group.json". This also applies to the keys of stored
+// object versions below versionsDir. Keys that are not keys of domain objects
+// are returned unchanged.
+func canonicalKey(key string) string {
+	if strings.HasPrefix(key, versionsDir+"/") {
+		dir, version := path.Split(strings.TrimPrefix(key, versionsDir+"/"))
+		return path.Join(versionsDir, canonicalKey(strings.TrimSuffix(dir, "/")), version)
+	}
+	k, err := parseObjectKey(key)
+	if err != nil {
+		return key
+	}
+	parts := strings.Split(key, "/")
+	parts[1] = k.Prefix.String()
+	if !k.Root {
+		parts[3] = k.Suffix.String()
+	}
+	return strings.Join(parts, "/")
+}
+
+// isStrayKey reports whether key lies in the directory of domain's prefix
+// but is not the key of a domain object, e.g. the key of a .DS_Store file or
+// of a log file uploaded along with the domain's objects.
+func isStrayKey(domain *hsdsDomain, key string) bool {
+	if domain.Root == nil || !strings.HasPrefix(key, domain.DatabasePrefix()+"/") {
+		return false
+	}
+	_, err := parseObjectKey(key)
+	return err != nil
+}
+
+// strayObjectsError indicates that the directory of a domain's prefix
+// contains objects that are not domain objects.
+type strayObjectsError struct {
+	// Keys are the keys of the stray objects, in sorted order.
+	Keys []string
+}
+
+func (err *strayObjectsError) Error() string {
+	return fmt.Sprintf("hsds: %d objects are not HSDS domain objects: %s",
+		len(err.Keys), strings.Join(err.Keys, ", "))
+}
+
+// prefixMismatchError indicates that objects listed for a domain do not
+// belong to it, because their keys do not embed the domain's prefix.
+type prefixMismatchError struct {
+	Prefix hsdsPrefix
+	// Keys are the offending keys, in sorted order.
+	Keys []string
+}
+
+func (err *prefixMismatchError) Error() string {
+	return fmt.Sprintf("hsds: %d objects do not match domain prefix '%s': %s",
+		len(err.Keys), err.Prefix, strings.Join(err.Keys, ", "))
+}
+
+// checkPrefixes verifies that all keys are valid object keys embedding
+// prefix. Otherwise, a *prefixMismatchError listing the offending keys is
+// returned.
+func checkPrefixes(prefix hsdsPrefix, keys []string) error {
+	var mismatches []string
+	for _, key := range keys {
+		k, err := parseObjectKey(key)
+		if err != nil || k.Prefix != prefix {
+			mismatches = append(mismatches, key)
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	sort.Strings(mismatches)
+	return &prefixMismatchError{Prefix: prefix, Keys: mismatches}
+}
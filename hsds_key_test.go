@@ -0,0 +1,139 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+type parseObjectKeyTestcase struct {
+	name    string
+	key     string
+	want    *hsdsObjectKey
+	wantErr error
+}
+
+func TestParseObjectKey(t *testing.T) {
+	prefix := validGroupID.Prefix()
+	suffix := validGroupID.Suffix()
+	testCases := []parseObjectKeyTestcase{
+		{
+			name: "root-group",
+			key:  "db/d12a20a5-6c27622f/.group.json",
+			want: &hsdsObjectKey{Prefix: prefix, Type: entityTypeGroup, Root: true},
+		},
+		{
+			name: "group",
+			key:  "db/d12a20a5-6c27622f/g/59a2-a82de4-afeaa7/.group.json",
+			want: &hsdsObjectKey{Prefix: prefix, Type: entityTypeGroup, Suffix: suffix},
+		},
+		{
+			name: "dataset",
+			key:  "db/d12a20a5-6c27622f/d/59a2-a82de4-afeaa7/.dataset.json",
+			want: &hsdsObjectKey{Prefix: prefix, Type: entityTypeDataset, Suffix: suffix},
+		},
+		{
+			name: "chunk",
+			key:  "db/d12a20a5-6c27622f/d/59a2-a82de4-afeaa7/0_1_2",
+			want: &hsdsObjectKey{Prefix: prefix, Type: entityTypeDataset, Suffix: suffix, Chunk: "0_1_2"},
+		},
+		{
+			name:    "invalid-entity-type",
+			key:     "db/d12a20a5-6c27622f/x/59a2-a82de4-afeaa7/.group.json",
+			wantErr: &unknownEntityTypeError{Type: invalidEntityType},
+		},
+		{
+			name:    "invalid-prefix",
+			key:     "db/d12a20a5/.group.json",
+			wantErr: errInvalidPrefix,
+		},
+		{
+			name:    "no-database-key",
+			key:     "home/user/domain.h5/.domain.json",
+			wantErr: errInvalidObjectKey,
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseObjectKey(tc.key)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: parseObjectKey() err = %v (want %v)", tc.name, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr != nil {
+			continue
+		}
+		if *got != *tc.want {
+			t.Errorf("%s: parseObjectKey() = %+v (want %+v)", tc.name, got, tc.want)
+		}
+	}
+}
+
+type canonicalKeyTestcase struct {
+	name string
+	key  string
+	want string
+}
+
+func TestCanonicalKey(t *testing.T) {
+	testCases := []canonicalKeyTestcase{
+		{
+			name: "root-group",
+			key:  "db/D12A20A5-6c27622F/.group.json",
+			want: "db/d12a20a5-6c27622f/.group.json",
+		},
+		{
+			name: "chunk",
+			key:  "db/d12A20a5-6C27622f/d/59A2-a82DE4-AFEAA7/0_1_2",
+			want: "db/d12a20a5-6c27622f/d/59a2-a82de4-afeaa7/0_1_2",
+		},
+		{
+			name: "version",
+			key:  ".versions/db/D12A20A5-6C27622F/g/59A2-A82DE4-AFEAA7/.group.json/Version-ID",
+			want: ".versions/db/d12a20a5-6c27622f/g/59a2-a82de4-afeaa7/.group.json/Version-ID",
+		},
+		{
+			name: "canonical",
+			key:  "db/d12a20a5-6c27622f/.group.json",
+			want: "db/d12a20a5-6c27622f/.group.json",
+		},
+		{
+			name: "no-database-key",
+			key:  "home/User/domain.h5/.domain.json",
+			want: "home/User/domain.h5/.domain.json",
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := canonicalKey(tc.key); got != tc.want {
+			t.Errorf("%s: canonicalKey() = %s (want %s)", tc.name, got, tc.want)
+		}
+	}
+}
+
+type isStrayKeyTestcase struct {
+	name string
+	key  string
+	want bool
+}
+
+func TestIsStrayKey(t *testing.T) {
+	testCases := []isStrayKeyTestcase{
+		{name: "root-group", key: "db/d12a20a5-6c27622f/.group.json"},
+		{name: "chunk", key: "db/d12a20a5-6c27622f/d/59a2-a82de4-afeaa7/0_1_2"},
+		{name: "ds-store", key: "db/d12a20a5-6c27622f/.DS_Store", want: true},
+		{name: "log", key: "db/d12a20a5-6c27622f/logs/upload.log", want: true},
+		{name: "foreign-prefix", key: "db/d12a20a5-6c27622f-old/.DS_Store"},
+	}
+
+	domain := &hsdsDomain{Root: &testRootID}
+	for _, tc := range testCases {
+		got := isStrayKey(domain, tc.key)
+		if got != tc.want {
+			t.Errorf("%s: isStrayKey() = %v (want %v)", tc.name, got, tc.want)
+		}
+	}
+}
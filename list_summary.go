@@ -0,0 +1,77 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Categories of objects aggregated by listSummary, in the order they are
+// written.
+var listSummaryCategories = []string{"groups", "datasets", "committed types", "chunks", "other"}
+
+// listSummaryTotal is the number of objects of a single category and the
+// total size of all of their listed versions.
+type listSummaryTotal struct {
+	Objects int
+	Bytes   int64
+}
+
+// listSummary aggregates the objects of a domain listing by entity type.
+type listSummary map[string]*listSummaryTotal
+
+// objectCategory returns the category of the object identified by key. Keys
+// that cannot be parsed are categorized as other.
+func objectCategory(key string) string {
+	k, err := parseObjectKey(key)
+	if err != nil {
+		return "other"
+	}
+	switch {
+	case k.IsChunk():
+		return "chunks"
+	case k.Type == entityTypeGroup:
+		return "groups"
+	case k.Type == entityTypeDataset:
+		return "datasets"
+	case k.Type == entityTypeCommittedType:
+		return "committed types"
+	}
+	return "other"
+}
+
+// Add adds the object identified by key with the given versions to s. Delete
+// markers do not count towards the total size.
+func (s listSummary) Add(key string, versions []*hsdsVersion) {
+	category := objectCategory(key)
+	total, ok := s[category]
+	if !ok {
+		total = &listSummaryTotal{}
+		s[category] = total
+	}
+	total.Objects++
+	for _, version := range versions {
+		if !version.DeleteMarker {
+			total.Bytes += version.Size
+		}
+	}
+}
+
+// Write writes a line for each category to w. Other objects are only
+// included if s contains any.
+func (s listSummary) Write(w io.Writer) {
+	fmt.Fprintf(w, "    summary:\n")
+	for _, category := range listSummaryCategories {
+		total, ok := s[category]
+		if !ok {
+			if category == "other" {
+				continue
+			}
+			total = &listSummaryTotal{}
+		}
+		fmt.Fprintf(w, "        %-16s%6d objects\t%d Bytes\n", category+":", total.Objects, total.Bytes)
+	}
+}
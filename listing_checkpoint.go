@@ -0,0 +1,145 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// listingCheckpoint is the state of an interrupted version listing of a
+// single prefix. Listing resumes after the version identified by KeyMarker
+// and VersionIDMarker.
+type listingCheckpoint struct {
+	KeyMarker       string                    `json:"keyMarker"`
+	VersionIDMarker string                    `json:"versionIdMarker"`
+	Versions        map[string][]*hsdsVersion `json:"versions"`
+}
+
+// listingCheckpointRecord is a line of a listing checkpoint file. Each page
+// of a listing appends a record holding only the versions listed on that
+// page, so recording a page costs the same, however many pages have been
+// listed before.
+type listingCheckpointRecord struct {
+	// Listing identifies the listing by bucket and prefix.
+	Listing string `json:"listing"`
+	listingCheckpoint
+	// Done marks the listing as complete, which discards its earlier
+	// records.
+	Done bool `json:"done,omitempty"`
+}
+
+// readListingCheckpoints replays the records of the listing checkpoint file
+// at path and returns the checkpoints of the listings that have not been
+// completed, keyed by bucket and prefix. Records that cannot be decoded,
+// because a run was interrupted while writing them, are ignored. The listing
+// was resumed from the record before them.
+func readListingCheckpoints(path string) (map[string]*listingCheckpoint, error) {
+	listings := map[string]*listingCheckpoint{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return listings, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		var r listingCheckpointRecord
+		if json.Unmarshal(line, &r) == nil {
+			replayListingCheckpoint(listings, &r)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return listings, nil
+}
+
+// replayListingCheckpoint applies r to the checkpoints in listings.
+func replayListingCheckpoint(listings map[string]*listingCheckpoint, r *listingCheckpointRecord) {
+	if r.Done {
+		delete(listings, r.Listing)
+		return
+	}
+	cp, ok := listings[r.Listing]
+	if !ok {
+		cp = &listingCheckpoint{Versions: map[string][]*hsdsVersion{}}
+		listings[r.Listing] = cp
+	}
+	cp.KeyMarker = r.KeyMarker
+	cp.VersionIDMarker = r.VersionIDMarker
+	for key, vv := range r.Versions {
+		cp.Versions[key] = append(cp.Versions[key], vv...)
+	}
+}
+
+// appendListingCheckpoint appends cp, the markers and versions of a single
+// page, to the checkpoint of the listing identified by key in the file at
+// path.
+func appendListingCheckpoint(path, key string, cp *listingCheckpoint) error {
+	return appendListingCheckpointRecord(path, &listingCheckpointRecord{Listing: key, listingCheckpoint: *cp})
+}
+
+// completeListingCheckpoint discards the checkpoint of the listing identified
+// by key in the file at path. The file is removed once it holds no
+// checkpoints anymore.
+func completeListingCheckpoint(path, key string) error {
+	listings, err := readListingCheckpoints(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := listings[key]; !ok {
+		return nil
+	}
+	if len(listings) == 1 {
+		return os.Remove(path)
+	}
+	return appendListingCheckpointRecord(path, &listingCheckpointRecord{Listing: key, Done: true})
+}
+
+// appendListingCheckpointRecord appends r as a line to the file at path. If
+// the file does not end with a newline, because a run was interrupted while
+// writing a record, the record starts on a new line.
+func appendListingCheckpointRecord(path string, r *listingCheckpointRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if size := fi.Size(); size > 0 {
+		last := make([]byte, 1)
+		_, err = f.ReadAt(last, size-1)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if last[0] != '\n' {
+			b = append([]byte{'\n'}, b...)
+		}
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListingCheckpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	pages := []struct {
+		key string
+		cp  *listingCheckpoint
+	}{
+		{"bucket/a/", &listingCheckpoint{KeyMarker: "a/1", VersionIDMarker: "v1", Versions: map[string][]*hsdsVersion{"a/1": {{ID: "v2"}, {ID: "v1"}}}}},
+		{"bucket/b/", &listingCheckpoint{KeyMarker: "b/1", VersionIDMarker: "v1", Versions: map[string][]*hsdsVersion{"b/1": {{ID: "v1"}}}}},
+		{"bucket/a/", &listingCheckpoint{KeyMarker: "a/2", VersionIDMarker: "v1", Versions: map[string][]*hsdsVersion{"a/1": {{ID: "v0"}}, "a/2": {{ID: "v1"}}}}},
+	}
+	for _, p := range pages {
+		err := appendListingCheckpoint(path, p.key, p.cp)
+		if err != nil {
+			t.Fatalf("appendListingCheckpoint() err = %v (want nil)", err)
+		}
+	}
+	// The run was interrupted while writing a record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(`{"listing": "bucket/a/", "keyMarker": "a/3", "vers`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listings, err := readListingCheckpoints(path)
+	if err != nil {
+		t.Fatalf("readListingCheckpoints() err = %v (want nil)", err)
+	}
+	if a := listings["bucket/a/"]; a == nil || a.KeyMarker != "a/2" {
+		t.Errorf("readListingCheckpoints() bucket/a/ = %+v (want position a/2)", a)
+	}
+
+	// The resumed listing records the page again.
+	err = appendListingCheckpoint(path, "bucket/a/", &listingCheckpoint{KeyMarker: "a/3", VersionIDMarker: "v1", Versions: map[string][]*hsdsVersion{"a/3": {{ID: "v1"}}}})
+	if err != nil {
+		t.Fatalf("appendListingCheckpoint() err = %v (want nil)", err)
+	}
+	listings, err = readListingCheckpoints(path)
+	if err != nil {
+		t.Fatalf("readListingCheckpoints() err = %v (want nil)", err)
+	}
+	a := listings["bucket/a/"]
+	if a == nil || a.KeyMarker != "a/3" || len(a.Versions["a/1"]) != 3 || len(a.Versions["a/2"]) != 1 || len(a.Versions["a/3"]) != 1 {
+		t.Errorf("readListingCheckpoints() bucket/a/ = %+v (want 5 versions up to a/3)", a)
+	}
+	if b := listings["bucket/b/"]; b == nil || b.KeyMarker != "b/1" || len(b.Versions["b/1"]) != 1 {
+		t.Errorf("readListingCheckpoints() bucket/b/ = %+v (want 1 version up to b/1)", b)
+	}
+
+	err = completeListingCheckpoint(path, "bucket/a/")
+	if err != nil {
+		t.Fatalf("completeListingCheckpoint() err = %v (want nil)", err)
+	}
+	listings, err = readListingCheckpoints(path)
+	if _, ok := listings["bucket/a/"]; err != nil || ok || len(listings) != 1 {
+		t.Errorf("readListingCheckpoints() = %v, %v (want only bucket/b/)", listings, err)
+	}
+	err = completeListingCheckpoint(path, "bucket/b/")
+	if err != nil {
+		t.Fatalf("completeListingCheckpoint() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint file exists after all listings completed: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// hsdsLoaderWrapper is the interface wrapping the Unwrap method.
+//
+// Unwrap returns the loader wrapped by a loader that overrides some of its
+// methods, e.g. to cache their results.
+type hsdsLoaderWrapper interface {
+	Unwrap() hsdsLoader
+}
+
+// findLoader calls match with loader and each loader it wraps, outermost
+// first, until match reports true, and reports whether it did. Optional
+// interfaces of loaders are looked up with it, so wrappers do not hide the
+// methods they do not override.
+func findLoader(loader interface{}, match func(l interface{}) bool) bool {
+	for loader != nil {
+		if match(loader) {
+			return true
+		}
+		w, ok := loader.(hsdsLoaderWrapper)
+		if !ok {
+			return false
+		}
+		loader = w.Unwrap()
+	}
+	return false
+}
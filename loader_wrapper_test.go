@@ -0,0 +1,223 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// loaderWrapperTestcase wraps a loader the way main does when the flag name
+// is set.
+type loaderWrapperTestcase struct {
+	name string
+	wrap func(t *testing.T, loader hsdsLoader) hsdsLoader
+}
+
+// loaderWrappers returns the wrappers that must not hide the optional
+// interfaces of the loaders they wrap.
+func loaderWrappers() []loaderWrapperTestcase {
+	return []loaderWrapperTestcase{
+		{"-cache-dir", func(t *testing.T, loader hsdsLoader) hsdsLoader {
+			return &cachedObjectLoader{hsdsLoader: loader, Dir: t.TempDir(), Bucket: "bucket"}
+		}},
+		{"-version-cache", func(t *testing.T, loader hsdsLoader) hsdsLoader {
+			return &cachedVersionLoader{hsdsLoader: loader, Path: filepath.Join(t.TempDir(), "versions.json"), TTL: time.Hour, Bucket: "bucket"}
+		}},
+		{"multiple -b", func(t *testing.T, loader hsdsLoader) hsdsLoader {
+			return &memoVersionLoader{hsdsLoader: loader}
+		}},
+	}
+}
+
+// testObjectPlan returns a plan replicating chunk-v1 of testChunkKey.
+func testObjectPlan() *replicationPlan {
+	return &replicationPlan{
+		Bucket: "bucket",
+		Domains: []*domainPlan{{
+			Name:    "home/user/domain.h5",
+			Domain:  &hsdsDomain{Root: &testRootID},
+			Objects: map[string]*hsdsVersion{testChunkKey: {ID: "chunk-v1", LastModified: testTimestamp, Size: 4}},
+		}},
+	}
+}
+
+func TestLoaderWrappers_HeadBeforeGet(t *testing.T) {
+	for _, tc := range loaderWrappers() {
+		client := &fakeS3Client{
+			Objects: []*fakeS3Object{
+				{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			},
+		}
+		loader := tc.wrap(t, &s3HSDSDomainLoader{Client: client, Bucket: "bucket"})
+		err := executePlan(loader, &filesystemHSDSStorer{Root: t.TempDir()}, testObjectPlan(), &runOptions{HeadBeforeGet: true})
+		if err != nil {
+			t.Fatalf("%s: executePlan() err = %v (want nil)", tc.name, err)
+		}
+		if client.HeadCalls != 1 {
+			t.Errorf("%s: executePlan() head calls = %d (want 1)", tc.name, client.HeadCalls)
+		}
+	}
+}
+
+func TestLoaderWrappers_IfModified(t *testing.T) {
+	for _, tc := range loaderWrappers() {
+		client := &fakeS3Client{
+			Objects: []*fakeS3Object{
+				{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			},
+		}
+		loader := tc.wrap(t, &s3HSDSDomainLoader{Client: client, Bucket: "bucket"})
+		version := &hsdsVersion{ID: "chunk-v1", LastModified: testTimestamp, Size: 4}
+		_, err := loadObjectVersion(context.Background(), loader, testChunkKey, version, testTimestamp.Add(time.Hour))
+		if !errors.Is(err, errNotModified) {
+			t.Errorf("%s: loadObjectVersion() err = %v (want %v)", tc.name, err, errNotModified)
+		}
+	}
+}
+
+func TestLoaderWrappers_CaptureTags(t *testing.T) {
+	tags := map[string]string{"project": "hsds"}
+	for _, tc := range loaderWrappers() {
+		client := &fakeS3Client{
+			Objects: []*fakeS3Object{
+				{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data"), Tags: tags},
+			},
+		}
+		loader := tc.wrap(t, &s3HSDSDomainLoader{Client: client, Bucket: "bucket"})
+		storer := &filesystemHSDSStorer{Root: t.TempDir(), Manifest: newManifest()}
+		err := executePlan(loader, storer, testObjectPlan(), &runOptions{CaptureTags: true, Manifest: storer.Manifest})
+		if err != nil {
+			t.Fatalf("%s: executePlan() err = %v (want nil)", tc.name, err)
+		}
+		if entry := storer.Manifest.Entry(testChunkKey); entry == nil || !reflect.DeepEqual(entry.Tags, tags) {
+			t.Errorf("%s: manifest entry = %+v (want tags %v)", tc.name, entry, tags)
+		}
+	}
+}
+
+func TestLoaderWrappers_CaptureObjectACLs(t *testing.T) {
+	grant := types.Grant{
+		Grantee:    &types.Grantee{Type: types.TypeCanonicalUser, ID: aws.String("reader-id")},
+		Permission: types.PermissionRead,
+	}
+	for _, tc := range loaderWrappers() {
+		client := &fakeS3Client{
+			Objects: []*fakeS3Object{
+				{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data"), Grants: []types.Grant{grant}},
+			},
+		}
+		loader := tc.wrap(t, &s3HSDSDomainLoader{Client: client, Bucket: "bucket"})
+		storer := &filesystemHSDSStorer{Root: t.TempDir(), Manifest: newManifest()}
+		err := executePlan(loader, storer, testObjectPlan(), &runOptions{CaptureObjectACLs: true, Manifest: storer.Manifest})
+		if err != nil {
+			t.Fatalf("%s: executePlan() err = %v (want nil)", tc.name, err)
+		}
+		if entry := storer.Manifest.Entry(testChunkKey); entry == nil || entry.ACL == nil || len(entry.ACL.Grants) != 1 {
+			t.Errorf("%s: manifest entry = %+v (want ACL with 1 grant)", tc.name, entry)
+		}
+	}
+}
+
+func TestLoaderWrappers_Consistent(t *testing.T) {
+	domainFile, err := domainKey(nameEncodingPath, "domain.h5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range loaderWrappers() {
+		// The chunk has been modified after the current version of the
+		// domain file, whose lastModified time is not recorded.
+		client := &fakeS3Client{
+			Objects: []*fakeS3Object{
+				{Key: domainFile, VersionID: "domain-v1", LastModified: testTimestamp},
+				{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new data")},
+				{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp.Add(-time.Hour), Data: []byte("data")},
+			},
+		}
+		loader := tc.wrap(t, &fakeDomainS3Loader{
+			s3HSDSDomainLoader: s3HSDSDomainLoader{Client: client, Bucket: "bucket"},
+			Domain:             &hsdsDomain{Root: &testRootID},
+		})
+		plan, err := resolveDomain(context.Background(), loader, "domain.h5", &runOptions{Consistent: true})
+		if err != nil {
+			t.Fatalf("%s: resolveDomain() err = %v (want nil)", tc.name, err)
+		}
+		if v := plan.Objects[testChunkKey]; v == nil || v.ID != "chunk-v1" {
+			t.Errorf("%s: resolveDomain() selected %+v (want chunk-v1)", tc.name, v)
+		}
+	}
+}
+
+// fakePrefixLoader is a fakeHSDSLoader that lists the versions of prefixes.
+type fakePrefixLoader struct {
+	*fakeHSDSLoader
+	// Prefixes records the listed prefixes.
+	Prefixes []string
+}
+
+func (l *fakePrefixLoader) LoadPrefixVersions(ctx context.Context, prefix string) (map[string][]*hsdsVersion, error) {
+	l.Prefixes = append(l.Prefixes, prefix)
+	return l.LoadDomainVersions(ctx, &hsdsDomain{Root: &testRootID})
+}
+
+func TestLoaderWrappers_Group(t *testing.T) {
+	for _, tc := range loaderWrappers() {
+		fake := &fakePrefixLoader{fakeHSDSLoader: newTestLoader()}
+		loader := tc.wrap(t, fake)
+		_, err := resolveDomain(context.Background(), loader, "home/user/domain.h5", &runOptions{Group: &testRootID})
+		if err != nil {
+			t.Fatalf("%s: resolveDomain() err = %v (want nil)", tc.name, err)
+		}
+		if len(fake.Prefixes) != 1 {
+			t.Errorf("%s: resolveDomain() listed prefixes %q (want the group's prefix)", tc.name, fake.Prefixes)
+		}
+	}
+}
+
+func TestLoaderWrappers_UseS3Select(t *testing.T) {
+	group := `{"id": "` + testRootID.String() + `", "links": {}}`
+	for _, tc := range loaderWrappers() {
+		fake := &fakeSelectLoader{fakeHSDSLoader: &fakeHSDSLoader{
+			Domains:  map[string]*hsdsDomain{"home/user/domain.h5": {Root: &testRootID}},
+			Versions: map[string][]*hsdsVersion{testGroupKey: {{ID: "group-v1", LastModified: testTimestamp, Size: int64(len(group))}}},
+			Objects:  map[string][]byte{"group-v1": []byte(group)},
+		}}
+		loader := tc.wrap(t, fake)
+		err := reassemble(loader, t.TempDir(), []string{"home/user/domain.h5"}, &runOptions{UseS3Select: true})
+		if err != nil {
+			t.Fatalf("%s: reassemble() err = %v (want nil)", tc.name, err)
+		}
+		if want := []string{testGroupKey}; !reflect.DeepEqual(fake.Selected, want) {
+			t.Errorf("%s: reassemble() selected %q (want %q)", tc.name, fake.Selected, want)
+		}
+	}
+}
+
+func TestLoaderWrappers_ServerSideCopy(t *testing.T) {
+	for _, tc := range loaderWrappers() {
+		source := &fakeS3Client{
+			Objects: []*fakeS3Object{
+				{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			},
+		}
+		loader := tc.wrap(t, &s3HSDSDomainLoader{Client: source, Bucket: "bucket", Region: "eu-central-1"})
+		client := &fakeS3StorerClient{}
+		storer := &s3HSDSStorer{Client: client, Bucket: "archive", Region: "eu-central-1"}
+		err := executePlan(loader, storer, testObjectPlan(), &runOptions{})
+		if err != nil {
+			t.Fatalf("%s: executePlan() err = %v (want nil)", tc.name, err)
+		}
+		if len(client.Copies) != 1 || len(source.GetObjectInputs) != 0 {
+			t.Errorf("%s: executePlan() copied %d objects, downloaded %d (want 1 copy)", tc.name, len(client.Copies), len(source.GetObjectInputs))
+		}
+	}
+}
@@ -10,31 +10,98 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 func usage() {
 
 	fmt.Fprintf(os.Stderr, `usage: %s [OPTIONS] BUCKET DOMAIN...
+       %s -plan FILE [OPTIONS] BUCKET DOMAIN...
+       %s -execute FILE [OPTIONS]
+       %s -object KEY [-version ID] [-o FILE] BUCKET
+       %s -list-versions-for KEY [-o FILE] BUCKET
+       %s -list-prefixes BUCKET
+       %s -probe BUCKET DOMAIN
 
 Hss3dump downloads one or more HSDS domains from an S3 bucket, storing them on
 the local filesystem in such a way that the target directory can be used as the
-root directory for a local HSDS deployment.
+root directory for a local HSDS deployment. BUCKET is either the name of a
+bucket, an S3 URL like s3://bucket/folder or the ARN of an S3 access point or
+an S3 on Outposts access point. DOMAIN and KEY arguments are relative to the
+folder of an S3 URL.
 
 It can restore different states of the target domain based on the versions
 available in the S3 bucket. If an RFC3339 timestamp is supplied with the -b
 flag, hss3dump will download the most recent versions of a domain's files that
 are older or equal to the supplied time.
 
+Downloads can be split into two phases: With -plan, hss3dump only selects the
+object versions to download and writes them to a plan file, which can be
+reviewed before running hss3dump with -execute to download them.
+
+With -discover, the DOMAIN arguments are folders and all domains below them
+are processed. Domains can be restricted to those of a single user with -owner.
+
+With -object, hss3dump downloads a single object identified by its full key
+and writes it to standard output or the file given with -o. Listings and
+reports are written to the file given with -o as well. Output files ending in
+.gz are gzip-compressed.
+
+With -list-owners, hss3dump discovers all domains below the DOMAIN folders and
+outputs the number of domains and their total object bytes per owner.
+
+With -verify-sizes, hss3dump compares the sizes of the files below the root
+directory against the versions selected from a fresh listing and reports
+mismatches, without downloading any objects.
+
+With -measure-only, hss3dump times HEAD requests for a random sample of each
+domain's objects and reports their latency, without downloading any objects.
+
+With -measure-cost, hss3dump estimates the cost of downloading each domain
+from its version listing, using the prices given with -cost-request and
+-cost-gb, without downloading any objects.
+
+With -restore-from-archive, hss3dump requests the selected versions of each
+domain's objects that are in the GLACIER or DEEP_ARCHIVE storage classes to be
+restored, with the retrieval tier given with -restore-tier, and reports when
+they are expected to be available for a dump.
+
+With -chunk-reassembly, hss3dump writes each domain as a single HDF5 file
+instead of storing its objects. This is experimental and limited to datasets
+of integers or floating-point numbers without filters.
+
+With -list-versions-for, hss3dump lists the ID, size, modification time and
+ETag of each version of a single object identified by its full key, newest
+first.
+
+With -list-prefixes, hss3dump lists the db/<prefix> data roots in the bucket,
+which shows the raw data layout independent of the domains referencing it.
+
+With -probe, hss3dump validates the setup of a dump without running it: it
+retrieves credentials, accesses the bucket, loads the domain, lists some of
+its object versions and downloads one of them, reporting each step.
+
+Each flag that is not set on the command line defaults to the value of the
+environment variable HSS3DUMP_<FLAG>, e.g. HSS3DUMP_VERSION_CACHE for
+-version-cache, or HSS3DUMP_ROOT for -r. If HSS3DUMP_BUCKET is set, it is used
+as the BUCKET argument, which must then be omitted.
+
 Options:
-`, os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	flag.PrintDefaults()
 	os.Exit(1)
 }
@@ -44,131 +111,857 @@ func die(err error) {
 	os.Exit(1)
 }
 
-func newS3Client() *s3.Client {
+// warnOutput is the writer warnings are written to.
+var warnOutput io.Writer = os.Stderr
+
+func warn(format string, args ...interface{}) {
+	fmt.Fprintf(warnOutput, "warning: "+format+"\n", args...)
+}
+
+// debugOutput is the writer debug messages are written to. They are discarded
+// unless -debug is set.
+var debugOutput io.Writer = ioutil.Discard
+
+func debug(format string, args ...interface{}) {
+	fmt.Fprintf(debugOutput, "debug: "+format+"\n", args...)
+}
+
+// warnEmptyDomain warns that domain has no objects, which is either the case
+// for genuinely empty domains or hints at a domain with a wrong root prefix.
+func warnEmptyDomain(name string, domain *hsdsDomain) {
+	warn("domain %q has no objects under prefix %q", name, domain.DatabasePrefix())
+}
+
+// versioningChecker is the interface wrapping the VersioningEnabled method.
+//
+// VersioningEnabled reports whether the underlying storage keeps previous
+// versions of objects.
+type versioningChecker interface {
+	VersioningEnabled(ctx context.Context) (bool, error)
+}
+
+// warnUnversioned warns if point-in-time selection of object versions is not
+// possible, because versioning is not enabled for the source bucket. It is
+// meant to be called once per run rather than once per domain.
+func warnUnversioned(ctx context.Context, c versioningChecker) {
+	enabled, err := c.VersioningEnabled(ctx)
+	if err != nil {
+		warn("cannot determine bucket versioning status: %v", err)
+		return
+	}
+	if !enabled {
+		warn("bucket versioning is not enabled, point-in-time selection is unavailable and the latest versions are used")
+	}
+}
+
+func newS3Client(co s3ClientOptions) s3API {
 	conf, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		die(err)
 	}
-	client := s3.NewFromConfig(conf)
-	return client
+	return newRefreshingS3Client(conf, co.apply)
 }
 
-func list(bucket string, domains []string) {
-	client := newS3Client()
-	loader := &s3HSDSDomainLoader{
-		Client: client,
-		Bucket: bucket,
+// newS3StorerClient returns an S3 client for storing dumps in a bucket. Like
+// the client returned by newS3Client, it refreshes expired credentials.
+func newS3StorerClient(co s3ClientOptions) s3StorerAPI {
+	conf, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		die(err)
 	}
-	for _, name := range domains {
-		domain, err := loader.LoadDomain(context.Background(), name)
+	return newRefreshingS3Client(conf, co.apply)
+}
+
+// newS3Loader returns a loader for bucket, which is either a bucket name or
+// the ARN of an access point.
+func newS3Loader(bucket string, co s3ClientOptions) *s3HSDSDomainLoader {
+	if isBucketARN(bucket) {
+		_, err := parseBucketARN(bucket)
 		if err != nil {
 			die(err)
 		}
-		versions, err := loader.LoadDomainVersions(context.Background(), domain)
+		if co.PathStyle {
+			die(errors.New("-path-style cannot be used with access point ARNs"))
+		}
+		co.UseARNRegion = true
+	}
+	return &s3HSDSDomainLoader{
+		Client: newS3Client(co),
+		Bucket: bucket,
+	}
+}
+
+// newS3Selector returns an s3Selector that sends its requests with client,
+// so they share its credentials.
+func newS3Selector(client s3API) s3Selector {
+	s, ok := client.(s3Selector)
+	if !ok {
+		die(errors.New("-use-s3-select: client does not support S3 Select"))
+	}
+	return s
+}
+
+// list writes all available versions of each domain's objects to w. If a
+// point in time is selected for a domain, the version that would be replicated
+// is highlighted. Listings are separated by a single blank line. The listing
+// of each domain is written to w with a single Write call, together with its
+// separator, so listings of concurrent calls sharing a syncWriter do not
+// interleave.
+func list(w io.Writer, loader hsdsLoader, domains []string, opts *runOptions) error {
+	for i, name := range domains {
+		var buf bytes.Buffer
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		err := listDomain(&buf, loader, name, opts)
 		if err != nil {
-			die(err)
+			return err
+		}
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		fmt.Printf("%s:\n", name)
-		objects := map[string][]byte{}
-		for key, objectVersions := range versions {
-			fmt.Printf("    %s\n", key)
-			for _, version := range objectVersions {
-				fmt.Printf("        %s\t%d Bytes\t%s\t\n",
-					version.ID, version.Size, version.LastModified.Local().Format(time.RFC3339))
-			}
+// listDomain writes all available versions of the objects of the domain
+// identified by name to w, sorted by their keys. If opts.ListSummary is set,
+// the number of objects and the total size of their versions by entity type
+// follow.
+func listDomain(w io.Writer, loader hsdsLoader, name string, opts *runOptions) error {
+	c := opts.Color
+	domain, err := loader.LoadDomain(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	versions, err := loader.LoadDomainVersions(context.Background(), domain)
+	if err != nil {
+		return err
+	}
 
-			data, err := loader.LoadObject(context.Background(), key, "")
-			if err != nil {
-				die(err)
+	if len(versions) == 0 {
+		warnEmptyDomain(name, domain)
+	}
+
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	summary := listSummary{}
+	fmt.Fprintf(w, "%s:\n", name)
+	for _, key := range keys {
+		objectVersions := versions[key]
+		summary.Add(key, objectVersions)
+		fmt.Fprintf(w, "    %s\n", c.Key(key))
+		var selected *hsdsVersion
+		if notAfter := opts.notAfter(name, domain); !notAfter.IsZero() {
+			selected = selectVersion(objectVersions, notAfter, opts.SelectionPolicy)
+		}
+		for _, version := range objectVersions {
+			size := fmt.Sprintf("%d Bytes", version.Size)
+			if version.DeleteMarker {
+				size = "delete marker"
+			}
+			line := fmt.Sprintf("%s\t%s\t%s",
+				version.ID, size, version.LastModified.Local().Format(time.RFC3339))
+			if version == selected {
+				line = c.Bold(line)
 			}
-			objects[key] = data
+			fmt.Fprintf(w, "        %s\n", line)
+		}
+
+		_, err := loader.LoadObject(context.Background(), key, "")
+		if err != nil {
+			return err
+		}
+	}
+	if opts.ListSummary {
+		summary.Write(w)
+	}
+	return nil
+}
+
+// dumpObject writes the given version of the object identified by key to w.
+// If version is empty, the latest version is written.
+func dumpObject(ctx context.Context, loader hsdsObjectLoader, key, version string, w io.Writer) error {
+	data, err := loader.LoadObject(ctx, key, version)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// listObjectVersions writes all versions of the object identified by key to
+// w, newest first. Objects whose keys merely start with key are left out.
+func listObjectVersions(ctx context.Context, w io.Writer, loader hsdsPrefixVersionLoader, key string) error {
+	versions, err := loader.LoadPrefixVersions(ctx, key)
+	if err != nil {
+		return err
+	}
+	objectVersions := versions[key]
+	if len(objectVersions) == 0 {
+		return fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	sort.SliceStable(objectVersions, func(i, j int) bool {
+		return objectVersions[i].LastModified.After(objectVersions[j].LastModified)
+	})
+
+	fmt.Fprintf(w, "%s:\n", key)
+	for _, version := range objectVersions {
+		size := fmt.Sprintf("%d Bytes", version.Size)
+		if version.DeleteMarker {
+			size = "delete marker"
+		}
+		_, err = fmt.Fprintf(w, "    %s\t%s\t%s\t%s\n",
+			version.ID, size, version.LastModified.Local().Format(time.RFC3339), version.ETag)
+		if err != nil {
+			return err
 		}
-		fmt.Println()
 	}
+	return nil
 }
 
-// versionBefore returns the ID of the first version that is older than
+// versionBefore returns the first version that is older than
 // notAfter. It assumes that availableVersions is sorted by the versions'
 // last modification time in descending order.
 //
 // If no version satisfies this condition the oldest version is returned.
 // If not after is the zero value, the latest version is returned.
-func versionBefore(availableVersions []*hsdsVersion, notAfter time.Time) string {
+func versionBefore(availableVersions []*hsdsVersion, notAfter time.Time) *hsdsVersion {
 	if len(availableVersions) == 0 {
 		panic("versionBefore: no versions available")
 	}
 	if notAfter.IsZero() {
-		return availableVersions[0].ID
+		return availableVersions[0]
 	}
 
 	for _, version := range availableVersions {
 		lm := version.LastModified.Local()
 		if lm.Equal(notAfter) || lm.Before(notAfter) {
-			return version.ID
+			return version
 		}
 	}
 
-	return availableVersions[len(availableVersions)-1].ID
+	return availableVersions[len(availableVersions)-1]
 }
 
-func replicate(bucket, root string, domains []string, notAfter time.Time) {
-	client := newS3Client()
-	loader := &s3HSDSDomainLoader{
-		Client: client,
-		Bucket: bucket,
+// Policies selecting an object version relative to a point in time.
+const (
+	// selectionPolicyBefore selects the most recent version not after the
+	// point in time.
+	selectionPolicyBefore = "before"
+	// selectionPolicyNearest selects the version modified closest to the
+	// point in time, preferring the older one on ties.
+	selectionPolicyNearest = "nearest"
+	// selectionPolicyAfter selects the oldest version not before the point
+	// in time.
+	selectionPolicyAfter = "after"
+)
+
+// unknownSelectionPolicyError indicates that a version selection policy is
+// not supported.
+type unknownSelectionPolicyError struct {
+	Policy string
+}
+
+func (err *unknownSelectionPolicyError) Error() string {
+	return fmt.Sprintf("unknown version selection policy '%s' (want %s, %s or %s)",
+		err.Policy, selectionPolicyBefore, selectionPolicyNearest, selectionPolicyAfter)
+}
+
+// validSelectionPolicy returns an error if policy is not a supported version
+// selection policy. The empty string is equivalent to selectionPolicyBefore.
+func validSelectionPolicy(policy string) error {
+	switch policy {
+	case "", selectionPolicyBefore, selectionPolicyNearest, selectionPolicyAfter:
+		return nil
+	}
+	return &unknownSelectionPolicyError{Policy: policy}
+}
+
+// selectVersion returns the version in availableVersions selected for t
+// according to policy. It assumes that availableVersions is sorted by the
+// versions' last modification time in descending order.
+//
+// If no version is before t, selectionPolicyBefore selects the oldest
+// version, and if no version is after t, selectionPolicyAfter selects the
+// latest version. If t is the zero value, the latest version is returned.
+func selectVersion(availableVersions []*hsdsVersion, t time.Time, policy string) *hsdsVersion {
+	if len(availableVersions) == 0 {
+		panic("selectVersion: no versions available")
 	}
-	storer := &filesystemHSDSStorer{
-		Root: root,
+	if t.IsZero() {
+		return availableVersions[0]
 	}
-	for _, name := range domains {
-		domain, err := loader.LoadDomain(context.Background(), name)
-		if err != nil {
-			die(err)
+
+	switch policy {
+	case selectionPolicyAfter:
+		for i := len(availableVersions) - 1; i >= 0; i-- {
+			if !availableVersions[i].LastModified.Before(t) {
+				return availableVersions[i]
+			}
 		}
-		ovs, err := loader.LoadDomainVersions(context.Background(), domain)
-		if err != nil {
-			die(err)
+		return availableVersions[0]
+	case selectionPolicyNearest:
+		nearest := availableVersions[0]
+		distance := absDuration(nearest.LastModified.Sub(t))
+		for _, version := range availableVersions[1:] {
+			// Versions are visited from newest to oldest, so older versions
+			// win ties.
+			if d := absDuration(version.LastModified.Sub(t)); d <= distance {
+				nearest, distance = version, d
+			}
 		}
-		objectVersions := map[string]string{}
-		for name, vv := range ovs {
-			objectVersions[name] = versionBefore(vv, notAfter)
+		return nearest
+	}
+	return versionBefore(availableVersions, t)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// versionAt returns the version in availableVersions that has been modified
+// exactly at t. If no such version exists, nil is returned.
+func versionAt(availableVersions []*hsdsVersion, t time.Time) *hsdsVersion {
+	for _, version := range availableVersions {
+		if version.LastModified.Equal(t) {
+			return version
 		}
+	}
+	return nil
+}
 
-		objects := map[string][]byte{}
-		for name, version := range objectVersions {
-			data, err := loader.LoadObject(context.Background(), name, version)
-			if err != nil {
-				die(err)
+// replicate loads the domains identified by domains from loader and stores
+// them, along with the object versions selected according to opts, in storer.
+// Afterwards, storer is finalized.
+func replicate(loader hsdsLoader, storer hsdsStorer, domains []string, opts *runOptions) error {
+	ctx, cancel := opts.runContext()
+	defer cancel()
+	queue := newDomainQueue(domains, opts.MaxDomains)
+	for i := 0; i < len(queue.Names); i++ {
+		name := queue.Names[i]
+		if opts.SkipUnchangedDomains && domainUnchanged(ctx, loader, storer, name) {
+			debug("skipping domain %q: not modified since it has been stored", name)
+			continue
+		}
+		opts.domainStarted(name)
+		plan, err := resolveDomain(ctx, loader, name, opts)
+		var notFound *domainNotFoundError
+		// Dangling external links are not uncommon, so missing linked
+		// domains never abort a run.
+		if errors.As(err, &notFound) && (opts.BestEffort && !opts.RequireAllDomains || queue.Linked(name)) {
+			warn("skipping domain %q: %v", name, err)
+			opts.domainFinished(err)
+			continue
+		}
+		if err == nil {
+			err = executeDomainPlan(ctx, loader, storer, plan, opts)
+		}
+		if err == nil && opts.FollowDomainLinks > 0 {
+			err = queue.Follow(ctx, loader, plan, opts.FollowDomainLinks)
+		}
+		if err == nil && opts.ConsistencyCheck {
+			err = checkConsistency(ctx, loader, plan)
+			var modified *domainModifiedError
+			if errors.As(err, &modified) && !opts.Strict {
+				warn("%v", err)
+				err = nil
 			}
-			objects[name] = data
 		}
+		err = deadlineError(ctx, err)
+		opts.domainFinished(err)
+		if err != nil {
+			return finalizeStorer(storer, err)
+		}
+	}
+	return finalizeStorer(storer, nil)
+}
 
-		err = storer.StoreDomain(context.Background(), name, domain)
+// domainUnchanged reports whether the domain identified by name has not been
+// modified in loader since it has been stored in storer, according to the
+// lastModified times of both domain files. Domains that cannot be loaded from
+// either or lack a modification time are considered changed.
+func domainUnchanged(ctx context.Context, loader hsdsDomainLoader, storer hsdsStorer, name string) bool {
+	dl, ok := storer.(hsdsDomainLoader)
+	if !ok {
+		return false
+	}
+	stored, err := dl.LoadDomain(ctx, name)
+	if err != nil {
+		return false
+	}
+	domain, err := loader.LoadDomain(ctx, name)
+	if err != nil {
+		return false
+	}
+	// Both times are rounded, as the stored one may have been normalized.
+	return domain.LastModified > 0 && roundHSDSTime(domain.LastModified) <= roundHSDSTime(stored.LastModified)
+}
+
+// finalizeStorer finalizes storer, if it supports it, once a run has ended
+// with err. Runs stopped by their deadline are finalized as well, so the
+// objects stored so far are complete. Failed runs are not finalized.
+func finalizeStorer(storer hsdsStorer, err error) error {
+	if err != nil && !errors.Is(err, errRuntimeExceeded) {
+		return err
+	}
+	f, ok := storer.(finalizableStorer)
+	if !ok {
+		return err
+	}
+	// The run's context may have expired already.
+	ferr := f.Finalize(context.Background())
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// makePlan resolves the object versions of all domains identified by domains
+// without downloading them.
+func makePlan(loader hsdsLoader, bucket string, domains []string, opts *runOptions) (*replicationPlan, error) {
+	plan := &replicationPlan{Bucket: bucket}
+	for _, name := range domains {
+		dp, err := resolveDomain(context.Background(), loader, name, opts)
 		if err != nil {
-			die(err)
+			return nil, err
 		}
-		for name, b := range objects {
-			err = storer.StoreObject(context.Background(), name, b)
-			if err != nil {
-				die(err)
-			}
+		plan.Domains = append(plan.Domains, dp)
+	}
+	return plan, nil
+}
+
+// executePlan downloads all object versions selected in plan from loader and
+// stores them in storer. Afterwards, storer is finalized.
+func executePlan(loader hsdsObjectLoader, storer hsdsStorer, plan *replicationPlan, opts *runOptions) error {
+	ctx, cancel := opts.runContext()
+	defer cancel()
+	for _, dp := range plan.Domains {
+		opts.domainStarted(dp.Name)
+		err := executeDomainPlan(ctx, loader, storer, dp, opts)
+		err = deadlineError(ctx, err)
+		opts.domainFinished(err)
+		if err != nil {
+			return finalizeStorer(storer, err)
+		}
+	}
+	return finalizeStorer(storer, nil)
+}
+
+func storeGroupDirectories(storer hsdsStorer, domain *hsdsDomain, objects map[string][]byte) error {
+	ds, ok := storer.(hsdsDirectoryStorer)
+	if !ok {
+		return errors.New("storer does not support storing empty directories")
+	}
+	dirs, err := groupDirectories(domain, objects)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		err = ds.StoreDirectory(context.Background(), dir)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func cmdObject(bucket, key, version, output string, co s3ClientOptions) {
+	w, err := createOutput(output)
+	if err != nil {
+		die(err)
+	}
+	err = dumpObject(context.Background(), newS3Loader(bucket, co), key, version, w)
+	if err != nil {
+		w.Close()
+		die(err)
+	}
+	err = w.Close()
+	if err != nil {
+		die(err)
+	}
+}
+
+func cmdListVersionsFor(bucket, key, output string, co s3ClientOptions) {
+	w, err := createOutput(output)
+	if err != nil {
+		die(err)
+	}
+	err = listObjectVersions(context.Background(), w, newS3Loader(bucket, co), key)
+	if err != nil {
+		w.Close()
+		die(err)
+	}
+	err = w.Close()
+	if err != nil {
+		die(err)
+	}
+}
+
+func cmdProbe(bucket, name, nameEncoding string, co s3ClientOptions) {
+	conf, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		die(err)
+	}
+	l := newS3Loader(bucket, co)
+	l.NameEncoding = nameEncoding
+	err = probeSetup(context.Background(), os.Stdout, conf.Credentials, l, name)
+	if err != nil {
+		die(err)
+	}
+}
+
+func cmdListPrefixes(bucket, output string, co s3ClientOptions) {
+	prefixes, err := newS3Loader(bucket, co).ListDatabasePrefixes(context.Background())
+	if err != nil {
+		die(err)
+	}
+	w, err := createOutput(output)
+	if err != nil {
+		die(err)
+	}
+	for _, prefix := range prefixes {
+		fmt.Fprintln(w, prefix)
+	}
+	err = w.Close()
+	if err != nil {
+		die(err)
+	}
+}
+
+// exitRuntimeExceeded is the exit code of dumps stopped by -max-runtime.
+const exitRuntimeExceeded = 3
+
+// finishDump exits if a dump has ended with err. Dumps stopped by
+// -max-runtime have still written the manifest and the index of the objects
+// stored so far when their storer was finalized, and exit with
+// exitRuntimeExceeded.
+func finishDump(err error) {
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, errRuntimeExceeded) {
+		die(err)
+	}
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+	os.Exit(exitRuntimeExceeded)
+}
+
+// indexFile is the name of the index written to the root directory with
+// -index.
+const indexFile = "index.tsv"
+
+func cmdExecute(planFile string, storer hsdsStorer, opts *runOptions, co s3ClientOptions) error {
+	plan, err := readPlan(planFile)
+	if err != nil {
+		die(err)
+	}
+	stop := notifyProgress(opts.Progress, os.Stderr)
+	err = executePlan(newS3Loader(plan.Bucket, co), storer, plan, opts)
+	stop()
+	return err
+}
+
+// writeSummary writes the run summary of opts to path, if path is not empty.
+func writeSummary(opts *runOptions, path string) {
+	if path == "" {
+		return
+	}
+	err := opts.Summary.WriteFile(path)
+	if err != nil {
+		die(err)
+	}
+}
+
+// setFlags returns the values of all flags that have been set on the command
+// line.
+func setFlags() map[string]string {
+	m := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		m[f.Name] = f.Value.String()
+	})
+	return m
 }
 
 func main() {
+	start := time.Now()
 	flag.Usage = usage
 
 	var root string
 	flag.StringVar(&root, "r", ".",
 		"Choose the root directory of the local HSDS filesystem.")
-	var before string
-	flag.StringVar(&before, "b", "",
-		"Return the first version of the domain before the given RFC3339 timestamp.")
+	var destURL string
+	flag.StringVar(&destURL, "dest", "",
+		"Store the dump at the given `url`, either a local directory, file:///DIR, s3://BUCKET/PREFIX, the http(s):// endpoint of an HSDS service to restore the domains into or - for a single stream on stdout, instead of the directory given with -r.")
+	var before beforeValue
+	flag.Var(&before, "b",
+		"Return the first version of the domain before the given RFC3339 or Unix epoch `timestamp`, or before the domain's own lastModified time with domain-DURATION, e.g. domain-1h. Repeat to dump one snapshot directory per timestamp.")
+	var selectionPolicy string
+	flag.StringVar(&selectionPolicy, "b-policy", selectionPolicyBefore,
+		"Select the version of each object relative to the time given with -b according to `policy`: before, nearest or after.")
+	var minVersionAge time.Duration
+	flag.DurationVar(&minVersionAge, "min-version-age", 0,
+		"Ignore object versions modified less than the given `duration` ago, e.g. 5m.")
+	var exactTime bool
+	flag.BoolVar(&exactTime, "exact-time", false,
+		"Require every object to have a version modified exactly at the time given with -b instead of selecting the most recent one before it.")
+	var bMap string
+	flag.StringVar(&bMap, "b-map", "",
+		"Read a JSON `file` mapping domain names to RFC3339 timestamps, overriding -b for those domains.")
+	var versionCache string
+	flag.StringVar(&versionCache, "version-cache", "",
+		"Cache the version listings of domains in the given file.")
+	var versionCacheTTL time.Duration
+	flag.DurationVar(&versionCacheTTL, "version-cache-ttl", time.Hour,
+		"Reuse cached version listings that are younger than the given duration.")
+	var cacheDir string
+	flag.StringVar(&cacheDir, "cache-dir", "",
+		"Cache downloaded object versions in the given `directory`, so later runs selecting the same versions, e.g. with other -b timestamps, do not download them again.")
+	var cacheSize int64
+	flag.Int64Var(&cacheSize, "cache-size", 1<<30,
+		"Evict the least recently used object versions from -cache-dir once it holds more than the given number of `bytes`.")
+	var listCheckpoint string
+	flag.StringVar(&listCheckpoint, "list-checkpoint", "",
+		"Record the progress of version listings in the given `file` and resume interrupted listings from it.")
+	var urlEncodeKeys bool
+	flag.BoolVar(&urlEncodeKeys, "url-encode-keys", false,
+		"Request URL-encoded keys when listing object versions, for keys containing characters that cannot be represented in XML.")
+	var objectKey string
+	flag.StringVar(&objectKey, "object", "",
+		"Download the single object identified by the given key.")
+	var objectVersion string
+	flag.StringVar(&objectVersion, "version", "",
+		"Download the given version of the object selected with -object.")
+	var listVersionsFor string
+	flag.StringVar(&listVersionsFor, "list-versions-for", "",
+		"Output all versions of the single object identified by the given `key`, newest first.")
+	var output string
+	flag.StringVar(&output, "o", "",
+		"Write the output of -object, -list-versions-for, -l, -acl-history, -list-owners, -verify-sizes, -measure-only, -measure-cost, -restore-from-archive or -list-prefixes to the given `file` instead of stdout, gzip-compressed if it ends in .gz.")
+	var chunkFilter string
+	flag.StringVar(&chunkFilter, "chunk-range", "",
+		"Only download chunks within the given comma-separated chunk index slices, e.g. \"0:2,:,5\".")
+	var types string
+	flag.StringVar(&types, "types", "",
+		"Only download objects of the given comma-separated entity `types`: g for groups, d for datasets and their chunks, t for committed types.")
+	var group string
+	flag.StringVar(&group, "group", "",
+		"Only download the objects stored below the group with the given `id`, e.g. \"g-...\".")
+	var excludePrefixes stringList
+	flag.Var(&excludePrefixes, "exclude-prefix",
+		"Skip all objects whose key below db/<prefix>/ starts with the given `prefix`, e.g. \"d/<suffix>/\". Repeatable.")
+	var includeDeleted bool
+	flag.BoolVar(&includeDeleted, "include-deleted", false,
+		"Restore the last content version of objects that had been deleted at the selected time.")
+	var conditional bool
+	flag.BoolVar(&conditional, "if-modified", false,
+		"Only download objects whose local copy is not of the selected version.")
+	var bestEffort bool
+	flag.BoolVar(&bestEffort, "best-effort", false,
+		"Skip domains that do not exist and object versions that can no longer be downloaded instead of aborting.")
+	var requireAllDomains bool
+	flag.BoolVar(&requireAllDomains, "require-all-domains", false,
+		"Abort if any domain does not exist, even with -best-effort.")
+	var maxFailureRate float64
+	flag.Float64Var(&maxFailureRate, "max-failure-rate", 0,
+		"With -best-effort, abort once more than the given `fraction` of the downloads within the -failure-window have been skipped.")
+	var failureWindow int
+	flag.IntVar(&failureWindow, "failure-window", 100,
+		"Consider the given `number` of most recent downloads for -max-failure-rate.")
+	var headBeforeGet bool
+	flag.BoolVar(&headBeforeGet, "head-before-get", false,
+		"Check that each selected version still exists before downloading it and skip it otherwise.")
+	var consistent bool
+	flag.BoolVar(&consistent, "consistent", false,
+		"Without -b, select the most recent object versions not after the current version of each domain's domain file instead of the latest ones.")
+	var consistencyCheck bool
+	flag.BoolVar(&consistencyCheck, "consistency-check", false,
+		"Reload each domain after dumping it and warn if it has been modified during the dump.")
+	var strict bool
+	flag.BoolVar(&strict, "strict", false,
+		"Fail instead of warning if -consistency-check detects a modified domain, and fail on objects below a domain's prefix that are not HSDS objects instead of storing them verbatim.")
+	var debugMessages bool
+	flag.BoolVar(&debugMessages, "debug", false,
+		"Write debug messages, e.g. about skipped objects, to stderr.")
+	var detectCompression bool
+	flag.BoolVar(&detectCompression, "detect-compression", false,
+		"Decompress objects recognized as gzip or zlib compressed by their magic bytes before storing them.")
+	var validatePrefix bool
+	flag.BoolVar(&validatePrefix, "validate-prefix", false,
+		"Refuse to replicate domains with objects whose key does not embed the domain's prefix.")
+	var validateACLs bool
+	flag.BoolVar(&validateACLs, "validate-acls", false,
+		"Refuse to store domains whose ACL contains empty user names or users without permissions.")
+	var slowObjectThreshold time.Duration
+	flag.DurationVar(&slowObjectThreshold, "slow-object-threshold", 0,
+		"Warn about objects whose download takes longer than the given duration.")
+	var preserveEmptyGroups bool
+	flag.BoolVar(&preserveEmptyGroups, "preserve-empty-groups", false,
+		"Create directories for all groups of a domain, even if they contain no objects.")
+	var allVersions bool
+	flag.BoolVar(&allVersions, "all-versions", false,
+		"Additionally store all versions of each object below the .versions directory.")
+	var dedupeVersions bool
+	flag.BoolVar(&dedupeVersions, "dedupe-versions", false,
+		"Skip versions with the same content as the next newer version when used with -all-versions.")
+	var hardlinkLatest bool
+	flag.BoolVar(&hardlinkLatest, "hardlink-latest", false,
+		"Link the selected version of each object as .versions/<key>/latest when used with -all-versions.")
+	var planFile string
+	flag.StringVar(&planFile, "plan", "",
+		"Write the selected object versions to the given plan file instead of downloading them.")
+	var executeFile string
+	flag.StringVar(&executeFile, "execute", "",
+		"Download the object versions selected in the given plan file.")
+	var chunkReassembly bool
+	flag.BoolVar(&chunkReassembly, "chunk-reassembly", false,
+		"Experimental: assemble each domain into a single HDF5 file below the root directory instead of storing its objects.")
+	var followDomainLinks int
+	flag.IntVar(&followDomainLinks, "follow-domain-links", 0,
+		"Also dump the domains referenced by external links of the dumped domains, following links up to the given depth.")
+	var maxDomains int
+	flag.IntVar(&maxDomains, "max-domains", 0,
+		"With -follow-domain-links, stop following links once the given number of domains is to be dumped.")
+	var progressObjectThreshold int64
+	flag.Int64Var(&progressObjectThreshold, "progress-object-threshold", 0,
+		"Report the progress of downloading each object of at least the given number of `bytes` to stderr after every tenth of it.")
+	var useS3Select bool
+	flag.BoolVar(&useS3Select, "use-s3-select", false,
+		"With -chunk-reassembly, load only the required fields of the current versions of group and dataset metadata objects with S3 Select.")
+	var compressDomainJSON int
+	flag.IntVar(&compressDomainJSON, "compress-domain-json", 0,
+		"Store domain files larger than the given number of bytes gzip-compressed as .domain.json.gz.")
+	var skipUnchangedDomains bool
+	flag.BoolVar(&skipUnchangedDomains, "skip-unchanged-domains", false,
+		"Skip domains whose .domain.json has not been modified since it has been stored below the root directory, without listing their versions.")
+	var normalizeTimestamps bool
+	flag.BoolVar(&normalizeTimestamps, "normalize-timestamps", false,
+		"Round the created and lastModified times of stored domain files to whole microseconds, so repeated dumps produce identical files.")
+	var indent int
+	flag.IntVar(&indent, "indent", 0,
+		"Pretty-print domain files with the given number of spaces per level instead of writing them in compact form.")
+	var overwritePolicy string
+	flag.StringVar(&overwritePolicy, "overwrite-policy", overwritePolicyOverwrite,
+		"Handle files that already exist according to the given `policy`: skip, overwrite, error or backup.")
+	var resumeVerify bool
+	flag.BoolVar(&resumeVerify, "resume-verify", false,
+		"With -overwrite-policy skip, only skip existing files whose checksum matches the manifest of the previous run and write the others again.")
+	var canonicalizeIDs bool
+	flag.BoolVar(&canonicalizeIDs, "canonicalize-ids", false,
+		"Store objects under their keys with all embedded IDs in canonical lowercase form.")
+	var verbatim bool
+	flag.BoolVar(&verbatim, "verbatim", false,
+		"Store every object, including the unmodified .domain.json, at a path equal to its S3 key, without creating domain files for parent folders.")
+	var maxRuntime time.Duration
+	flag.DurationVar(&maxRuntime, "max-runtime", 0,
+		"Stop the dump once it has run for the given `duration`, write the manifest of the objects stored so far and exit with code 3.")
+	var writeTimeout time.Duration
+	flag.DurationVar(&writeTimeout, "write-timeout", 0,
+		"Abort if writing a single file takes longer than the given `duration`, e.g. on a hanging network mount.")
+	var forceUnlock bool
+	flag.BoolVar(&forceUnlock, "force-unlock", false,
+		"Remove a stale lock left in the root directory by an aborted dump before acquiring it.")
+	var tempDir string
+	flag.StringVar(&tempDir, "temp-dir", "",
+		"Write files to the given `directory` before renaming them to their final names. By default, files are written next to their final names.")
+	var manifestFile string
+	flag.StringVar(&manifestFile, "manifest", "",
+		"Write a manifest of all files written during the dump to the given file.")
+	var index bool
+	flag.BoolVar(&index, "index", false,
+		"Write an index of all dumped objects of all domains to "+indexFile+" in the root directory.")
+	var captureTags bool
+	flag.BoolVar(&captureTags, "capture-tags", false,
+		"Record the S3 tags of each object in the manifest and restore them when storing to S3.")
+	var captureObjectACLs bool
+	flag.BoolVar(&captureObjectACLs, "capture-object-acls", false,
+		"Record the S3 ACL of each object in the manifest and restore it when storing to S3. Skipped for buckets enforcing bucket owner ownership.")
+	var sinceManifest string
+	flag.StringVar(&sinceManifest, "since-manifest", "",
+		"Only dump objects modified after the newest object recorded in the given manifest `file`, into a delta directory below the root directory.")
+	var nameEncoding string
+	flag.StringVar(&nameEncoding, "name-encoding", nameEncodingPath,
+		"Map domain names to S3 keys using the given `encoding`: path, dns or percent.")
+	var validateSchema bool
+	flag.BoolVar(&validateSchema, "validate-schema", false,
+		"Validate each domain's .domain.json against the expected schema before using it.")
+	var discover bool
+	flag.BoolVar(&discover, "discover", false,
+		"Treat the DOMAIN arguments as folders and process all domains below them.")
+	var owner string
+	flag.StringVar(&owner, "owner", "",
+		"Only process domains owned by the given user.")
+	var class string
+	flag.StringVar(&class, "class", "",
+		"Only process domains of the given `class`: domain or folder. With -discover, folders are otherwise skipped.")
+	var listOwners bool
+	flag.BoolVar(&listOwners, "list-owners", false,
+		"Output the number of domains and their total object bytes per owner for all domains below the DOMAIN folders.")
+	var aclHistory bool
+	flag.BoolVar(&aclHistory, "acl-history", false,
+		"Output the ACLs of each version of the domain files and mark the changes between them.")
+	var redact bool
+	flag.BoolVar(&redact, "redact", false,
+		"Replace the user names in the output of -acl-history and -list-owners with stable pseudonyms, so it can be shared.")
+	var listPrefixes bool
+	flag.BoolVar(&listPrefixes, "list-prefixes", false,
+		"Output the distinct db/<prefix> data roots present in the bucket.")
+	var probe bool
+	flag.BoolVar(&probe, "probe", false,
+		"Validate credentials, bucket access, loading the domain, listing versions and downloading an object, without dumping anything.")
+	var checkPerms bool
+	flag.BoolVar(&checkPerms, "check-permissions", false,
+		"Check that listing object versions and getting objects is permitted before starting and name the missing permissions.")
+	var pathStyle bool
+	flag.BoolVar(&pathStyle, "path-style", false,
+		"Address the bucket with path-style URLs, e.g. for bucket names containing dots.")
+	var workers int
+	flag.IntVar(&workers, "j", 1,
+		"Verify the sizes of up to `n` local copies concurrently with -verify-sizes.")
+	var cmdVerifySizes bool
+	flag.BoolVar(&cmdVerifySizes, "verify-sizes", false,
+		"Compare the sizes of the local copies against the selected versions instead of downloading them.")
+	var measureOnly int
+	flag.IntVar(&measureOnly, "measure-only", 0,
+		"Time HEAD requests for a random sample of `n` objects per domain and report their latency instead of downloading.")
+	var measureCostOnly bool
+	flag.BoolVar(&measureCostOnly, "measure-cost", false,
+		"Estimate the request and data transfer cost of dumping each domain from its version listing, without downloading any objects.")
+	var costRequest float64
+	flag.Float64Var(&costRequest, "cost-request", defaultCostRequest,
+		"Estimate the cost with the given `price` per GET request.")
+	var costGB float64
+	flag.Float64Var(&costGB, "cost-gb", defaultCostGB,
+		"Estimate the cost with the given `price` per GB transferred.")
+	var restoreFromArchive bool
+	flag.BoolVar(&restoreFromArchive, "restore-from-archive", false,
+		"Request the selected versions in the GLACIER and DEEP_ARCHIVE storage classes to be restored instead of downloading them.")
+	var restoreTier string
+	flag.StringVar(&restoreTier, "restore-tier", restoreTierStandard,
+		"Restore archived objects with the given retrieval `tier`: Expedited, Standard or Bulk.")
+	var restoreDays int
+	flag.IntVar(&restoreDays, "restore-days", 7,
+		"Keep restored copies of archived objects for the given number of `days`.")
+	var summaryFile string
+	flag.StringVar(&summaryFile, "summary-json", "",
+		"Write a JSON summary of the run's outcome to the given `file`, or to stdout if it is \"-\".")
+	var events bool
+	flag.BoolVar(&events, "events", false,
+		"Stream the progress of the dump to stdout as newline-delimited JSON events.")
 	var cmdList bool
 	flag.BoolVar(&cmdList, "l", false,
 		"Output a list with all available file versions of each domain's files.")
+	var cmdListSummary bool
+	flag.BoolVar(&cmdListSummary, "summary", false,
+		"Follow the list of each domain with the number of objects and the total size of their versions by entity type.")
 	var help bool
 	flag.BoolVar(&help, "h", false,
 		"Print this command information.")
@@ -178,25 +971,504 @@ func main() {
 		flag.Usage()
 		return
 	}
-	if flag.NArg() < 2 {
+	err := applyEnvDefaults(flag.CommandLine, os.LookupEnv)
+	if err != nil {
+		die(err)
+	}
+	var dest *destination
+	if destURL != "" {
+		dest, err = parseDestination(destURL)
+		if err != nil {
+			die(err)
+		}
+	}
+	set := setFlags()
+	err = validateFlags(set, flagRules)
+	if err == nil {
+		err = validateFlagValues(set, &before, dest)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitUsage)
+	}
+	befores := before.Times
+	if debugMessages {
+		debugOutput = os.Stderr
+	}
+	args := flag.Args()
+	if bucket := os.Getenv(envBucket); bucket != "" {
+		args = append([]string{bucket}, args...)
+	}
+	if len(args) > 0 {
+		var prefix string
+		args[0], prefix, err = parseBucketArg(args[0])
+		if err != nil {
+			die(err)
+		}
+		// The path of a bucket URL is the folder that domain names and
+		// object keys are relative to.
+		if prefix != "" {
+			for i := 1; i < len(args); i++ {
+				args[i] = path.Join(prefix, args[i])
+			}
+			if objectKey != "" {
+				objectKey = path.Join(prefix, objectKey)
+			}
+			if listVersionsFor != "" {
+				listVersionsFor = path.Join(prefix, listVersionsFor)
+			}
+			if listPrefixes {
+				warn("-list-prefixes lists the whole bucket, ignoring prefix %s", prefix)
+			}
+		}
+	}
+	co := s3ClientOptions{PathStyle: pathStyle}
+	err = validNameEncoding(nameEncoding)
+	if err != nil {
+		die(err)
+	}
+	err = validOverwritePolicy(overwritePolicy)
+	if err != nil {
+		die(err)
+	}
+	err = validSelectionPolicy(selectionPolicy)
+	if err != nil {
+		die(err)
+	}
+	err = validDomainClass(class)
+	if err != nil {
+		die(err)
+	}
+	if objectKey != "" {
+		if len(args) != 1 {
+			flag.Usage()
+			return
+		}
+		cmdObject(args[0], objectKey, objectVersion, output, co)
+		return
+	}
+	if listVersionsFor != "" {
+		if len(args) != 1 {
+			flag.Usage()
+			return
+		}
+		cmdListVersionsFor(args[0], listVersionsFor, output, co)
+		return
+	}
+	if listPrefixes {
+		if len(args) != 1 {
+			flag.Usage()
+			return
+		}
+		cmdListPrefixes(args[0], output, co)
+		return
+	}
+	if probe {
+		if len(args) != 2 {
+			flag.Usage()
+			return
+		}
+		cmdProbe(args[0], args[1], nameEncoding, co)
+		return
+	}
+	opts := &runOptions{
+		Discover:             discover || listOwners,
+		Owner:                owner,
+		Class:                class,
+		ExcludePrefixes:      excludePrefixes,
+		IncludeDeleted:       includeDeleted,
+		ExactTime:            exactTime,
+		MinVersionAge:        minVersionAge,
+		SelectionPolicy:      selectionPolicy,
+		CaptureTags:          captureTags,
+		CaptureObjectACLs:    captureObjectACLs,
+		Conditional:          conditional,
+		BestEffort:           bestEffort,
+		RequireAllDomains:    requireAllDomains,
+		FollowDomainLinks:    followDomainLinks,
+		MaxDomains:           maxDomains,
+		HeadBeforeGet:        headBeforeGet,
+		Consistent:           consistent,
+		ConsistencyCheck:     consistencyCheck,
+		Strict:               strict,
+		DetectCompression:    detectCompression,
+		ValidatePrefix:       validatePrefix,
+		ValidateACLs:         validateACLs,
+		SlowObjectThreshold:  slowObjectThreshold,
+		PreserveEmptyGroups:  preserveEmptyGroups,
+		AllVersions:          allVersions,
+		UseS3Select:          useS3Select,
+		HardlinkLatest:       hardlinkLatest,
+		DedupeVersions:       dedupeVersions,
+		Verbatim:             verbatim,
+		NormalizeTimestamps:  normalizeTimestamps,
+		SkipUnchangedDomains: skipUnchangedDomains,
+		Color:                colorizer{Enabled: output == "" && colorEnabled(os.Stdout)},
+		ListSummary:          cmdListSummary,
+		Workers:              workers,
+		Progress:             newProgress(),
+		Manifest:             newManifest(),
+		Summary:              newRunSummary(setFlags()),
+	}
+	if events {
+		opts.Events = newEventStream(os.Stdout)
+	}
+	if maxRuntime > 0 {
+		opts.Deadline = start.Add(maxRuntime)
+	}
+	if maxFailureRate > 0 {
+		if maxFailureRate >= 1 || failureWindow <= 0 {
+			die(errors.New("-max-failure-rate must be below 1 and -failure-window positive"))
+		}
+		opts.Breaker = &circuitBreaker{Window: failureWindow, Threshold: maxFailureRate}
+	}
+	if before.DomainOffset != nil {
+		opts.DomainOffset = before.DomainOffset
+	}
+	if len(befores) == 1 {
+		opts.NotAfter = befores[0]
+	}
+	if bMap != "" {
+		opts.DomainNotAfter, err = readTimestampMap(bMap)
+		if err != nil {
+			die(err)
+		}
+	}
+	if chunkFilter != "" {
+		opts.Chunks, err = parseChunkRange(chunkFilter)
+		if err != nil {
+			die(err)
+		}
+	}
+	if types != "" {
+		opts.Types, err = parseEntityTypes(types)
+		if err != nil {
+			die(err)
+		}
+	}
+	if group != "" {
+		id, err := ParseID(group)
+		if err != nil {
+			die(err)
+		}
+		if id.Type() != entityTypeGroup {
+			die(fmt.Errorf("-group: %s is not a group ID", group))
+		}
+		opts.Group = &id
+	}
+	if dest != nil && dest.Local() {
+		root = dest.Path
+	}
+	if sinceManifest != "" {
+		baseline, err := readManifest(sinceManifest)
+		if err != nil {
+			die(err)
+		}
+		opts.ModifiedAfter = baseline.Newest()
+		if opts.ModifiedAfter.IsZero() {
+			die(fmt.Errorf("%s: manifest records no modification times", sinceManifest))
+		}
+		root = filepath.Join(root, deltaDir(opts.ModifiedAfter))
+	}
+	var resumeManifest *dumpManifest
+	if resumeVerify {
+		// The first run has not written a manifest yet, so all existing
+		// files are written again.
+		resumeManifest, err = readManifest(manifestFile)
+		if errors.Is(err, os.ErrNotExist) {
+			resumeManifest = newManifest()
+		} else if err != nil {
+			die(err)
+		}
+	}
+	// newFilesystemStorer returns a storer for dumps into dir, which is the
+	// root directory, or the directory of a snapshot below it with multiple
+	// -b timestamps.
+	newFilesystemStorer := func(dir string) *filesystemHSDSStorer {
+		return &filesystemHSDSStorer{
+			Root:                    dir,
+			CompressDomainThreshold: compressDomainJSON,
+			Indent:                  indent,
+			Manifest:                opts.Manifest,
+			ManifestFile:            manifestFile,
+			Index:                   index,
+			ResumeManifest:          resumeManifest,
+			OverwritePolicy:         overwritePolicy,
+			WriteTimeout:            writeTimeout,
+			TempDir:                 tempDir,
+			CanonicalizeIDs:         canonicalizeIDs,
+		}
+	}
+	storer := newFilesystemStorer(root)
+	if tempDir != "" {
+		err := warnTempDir(tempDir, root)
+		if err != nil {
+			die(err)
+		}
+	}
+	var target hsdsStorer = storer
+	if dest != nil {
+		target = dest.Storer(storer, func() s3StorerAPI { return newS3StorerClient(co) })
+	}
+	if s, ok := target.(*s3HSDSStorer); ok {
+		s.Region, err = newS3Loader(s.Bucket, co).BucketRegion(context.Background())
+		if err != nil {
+			warn("cannot determine region of bucket %s, objects are uploaded: %v", s.Bucket, err)
+		}
+	}
+	// Dumps into the local root directory lock it, so that concurrent runs
+	// do not corrupt each other's files.
+	lockLocalRoot := func() *rootLock {
+		if dest != nil && !dest.Local() {
+			return nil
+		}
+		lock, err := lockRoot(root, forceUnlock)
+		if err != nil {
+			die(err)
+		}
+		return lock
+	}
+	unlock := func(lock *rootLock) {
+		err := lock.Unlock()
+		if err != nil {
+			warn("cannot release lock: %v", err)
+		}
+	}
+	if executeFile != "" {
+		if flag.NArg() != 0 {
+			flag.Usage()
+			return
+		}
+		lock := lockLocalRoot()
+		err := cmdExecute(executeFile, target, opts, co)
+		unlock(lock)
+		writeSummary(opts, summaryFile)
+		finishDump(err)
+		return
+	}
+	if len(args) < 2 {
 		flag.Usage()
 		return
 	}
 
-	args := flag.Args()
 	bucket := args[0]
-	domains := args[1:]
+	s3Loader := newS3Loader(bucket, co)
+	s3Loader.NameEncoding = nameEncoding
+	s3Loader.ValidateSchema = validateSchema
+	s3Loader.ListCheckpoint = listCheckpoint
+	s3Loader.URLEncodeKeys = urlEncodeKeys
+	if useS3Select {
+		s3Loader.Selector = newS3Selector(s3Loader.Client)
+	}
+	if progressObjectThreshold > 0 {
+		s3Loader.ObjectProgress = objectProgressPrinter(os.Stderr)
+		s3Loader.ObjectProgressThreshold = progressObjectThreshold
+	}
+	if checkPerms {
+		err = checkPermissions(context.Background(), s3Loader, args[1])
+		if err != nil {
+			die(err)
+		}
+	}
+	if opts.CaptureObjectACLs {
+		enabled, err := s3Loader.ObjectACLsEnabled(context.Background())
+		if err != nil {
+			warn("cannot determine object ownership of bucket %s: %v", bucket, err)
+		} else if !enabled {
+			warn("bucket %s enforces bucket owner ownership, object ACLs are disabled and not captured", bucket)
+			opts.CaptureObjectACLs = false
+		}
+	}
+	domains, err := selectDomains(context.Background(), s3Loader, args[1:], opts)
+	if err != nil {
+		die(err)
+	}
+	warnUnknownMapDomains(opts.DomainNotAfter, domains)
+	if len(befores) > 0 || len(opts.DomainNotAfter) > 0 || opts.DomainOffset != nil {
+		warnUnversioned(context.Background(), s3Loader)
+	}
+	var loader hsdsLoader = s3Loader
+	var cachedVersions *cachedVersionLoader
+	if versionCache != "" {
+		cachedVersions = &cachedVersionLoader{
+			hsdsLoader: loader,
+			Path:       versionCache,
+			TTL:        versionCacheTTL,
+			Bucket:     bucket,
+		}
+		loader = cachedVersions
+	}
+	if cacheDir != "" {
+		loader = &cachedObjectLoader{
+			hsdsLoader: loader,
+			Dir:        cacheDir,
+			MaxSize:    cacheSize,
+			Bucket:     bucket,
+		}
+	}
 	if cmdList {
-		list(bucket, domains)
-	} else {
-		var t time.Time
-		var err error
-		if before != "" {
-			t, err = time.ParseInLocation(time.RFC3339, before, time.Local)
+		w, err := createOutput(output)
+		if err != nil {
+			die(err)
+		}
+		err = list(&syncWriter{w: w}, loader, domains, opts)
+		if err != nil {
+			w.Close()
+			die(err)
+		}
+		err = w.Close()
+		if err != nil {
+			die(err)
+		}
+	} else if aclHistory {
+		w, err := createOutput(output)
+		if err != nil {
+			die(err)
+		}
+		for _, name := range domains {
+			history, err := loadACLHistory(context.Background(), s3Loader, name)
 			if err != nil {
+				w.Close()
 				die(err)
 			}
+			if redact {
+				history = redactACLHistory(history)
+			}
+			writeACLHistory(w, name, history)
+		}
+		err = w.Close()
+		if err != nil {
+			die(err)
+		}
+	} else if listOwners {
+		stats, err := aggregateOwners(context.Background(), loader, domains, opts)
+		if err != nil {
+			die(err)
+		}
+		w, err := createOutput(output)
+		if err != nil {
+			die(err)
+		}
+		if redact {
+			stats = redactOwners(stats)
+		}
+		writeOwners(w, stats)
+		err = w.Close()
+		if err != nil {
+			die(err)
+		}
+	} else if measureOnly > 0 {
+		w, err := createOutput(output)
+		if err != nil {
+			die(err)
+		}
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		err = measureLatency(context.Background(), w, loader, s3Loader, domains, measureOnly, rnd, opts)
+		if err != nil {
+			w.Close()
+			die(err)
 		}
-		replicate(bucket, root, domains, t)
+		err = w.Close()
+		if err != nil {
+			die(err)
+		}
+	} else if restoreFromArchive {
+		tier, err := parseRestoreTier(restoreTier)
+		if err != nil {
+			die(err)
+		}
+		if restoreDays < 1 {
+			die(errors.New("-restore-days must be positive"))
+		}
+		w, err := createOutput(output)
+		if err != nil {
+			die(err)
+		}
+		r := &archiveRestore{Tier: tier, Days: restoreDays}
+		err = restoreArchived(context.Background(), w, loader, s3Loader, domains, r, opts)
+		if err != nil {
+			w.Close()
+			die(err)
+		}
+		err = w.Close()
+		if err != nil {
+			die(err)
+		}
+	} else if measureCostOnly {
+		w, err := createOutput(output)
+		if err != nil {
+			die(err)
+		}
+		rates := costRates{Request: costRequest, GB: costGB}
+		err = measureCost(context.Background(), w, loader, domains, rates, opts)
+		if err != nil {
+			w.Close()
+			die(err)
+		}
+		err = w.Close()
+		if err != nil {
+			die(err)
+		}
+	} else if cmdVerifySizes {
+		w, err := createOutput(output)
+		if err != nil {
+			die(err)
+		}
+		r, err := verifySizes(context.Background(), w, loader, storer, domains, opts)
+		if err != nil {
+			w.Close()
+			die(err)
+		}
+		err = w.Close()
+		if err != nil {
+			die(err)
+		}
+		if r.Mismatches > 0 {
+			os.Exit(1)
+		}
+	} else if planFile != "" {
+		plan, err := makePlan(loader, bucket, domains, opts)
+		if err != nil {
+			die(err)
+		}
+		err = writePlan(planFile, plan)
+		if err != nil {
+			die(err)
+		}
+	} else if chunkReassembly {
+		lock := lockLocalRoot()
+		err = reassemble(loader, root, domains, opts)
+		unlock(lock)
+		if err != nil {
+			die(err)
+		}
+	} else {
+		lock := lockLocalRoot()
+		stop := notifyProgress(opts.Progress, os.Stderr)
+		if len(befores) > 1 {
+			newStorer := func(dir string) hsdsStorer {
+				return newFilesystemStorer(filepath.Join(root, dir))
+			}
+			err = replicateSnapshots(loader, newStorer, domains, befores, opts)
+		} else {
+			err = replicate(loader, target, domains, opts)
+		}
+		stop()
+		unlock(lock)
+		writeSummary(opts, summaryFile)
+		saveVersionCache(cachedVersions)
+		finishDump(err)
+		return
+	}
+	saveVersionCache(cachedVersions)
+}
+
+// saveVersionCache saves the listings added to l during a run. A cache that
+// cannot be saved only makes the next run list the versions again, so it is
+// not fatal.
+func saveVersionCache(l *cachedVersionLoader) {
+	err := l.Save()
+	if err != nil {
+		warn("cannot save version cache %s: %v", l.Path, err)
 	}
 }
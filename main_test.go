@@ -0,0 +1,550 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeHSDSLoader is an in-memory implementation of the hsdsLoader interface.
+type fakeHSDSLoader struct {
+	// Domains maps domain names to domains.
+	Domains map[string]*hsdsDomain
+	// Versions maps object keys to their versions, sorted newest first.
+	Versions map[string][]*hsdsVersion
+	// Objects maps version IDs to the data of the respective version.
+	Objects map[string][]byte
+	// VersionCalls counts the calls to LoadDomainVersions.
+	VersionCalls int
+	// Reloaded maps domain names to the domains returned from the second
+	// call to LoadDomain on, if they differ from Domains.
+	Reloaded map[string]*hsdsDomain
+	// DomainCalls counts the calls to LoadDomain per domain name.
+	DomainCalls map[string]int
+}
+
+func (l *fakeHSDSLoader) LoadDomain(ctx context.Context, name string) (*hsdsDomain, error) {
+	if l.DomainCalls == nil {
+		l.DomainCalls = map[string]int{}
+	}
+	l.DomainCalls[name]++
+	if d, ok := l.Reloaded[name]; ok && l.DomainCalls[name] > 1 {
+		return d, nil
+	}
+	d, ok := l.Domains[name]
+	if !ok {
+		return nil, &domainNotFoundError{Name: name}
+	}
+	return d, nil
+}
+
+func (l *fakeHSDSLoader) LoadDomainVersions(ctx context.Context, domain *hsdsDomain) (map[string][]*hsdsVersion, error) {
+	l.VersionCalls++
+	versions := map[string][]*hsdsVersion{}
+	for key, vv := range l.Versions {
+		if strings.HasPrefix(key, domain.DatabasePrefix()) {
+			versions[key] = vv
+		}
+	}
+	return versions, nil
+}
+
+func (l *fakeHSDSLoader) LoadObject(ctx context.Context, name, version string) ([]byte, error) {
+	if version == "" {
+		version = l.Versions[name][0].ID
+	}
+	data, ok := l.Objects[version]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+// update makes golden file tests rewrite their golden files in testdata
+// instead of comparing against them.
+var update = flag.Bool("update", false, "update golden files")
+
+var (
+	testRootID    = MustParseID("g-d12a20a5-6c27622f-59a2-a82de4-afeaa7")
+	testGroupKey  = "db/d12a20a5-6c27622f/.group.json"
+	testChunkKey  = "db/d12a20a5-6c27622f/d/693e-302825-f8c087/0"
+	testTimestamp = time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC)
+)
+
+// newTestLoader returns a loader serving a single domain named
+// "home/user/domain.h5" with a root group and a chunk that has two versions.
+func newTestLoader() *fakeHSDSLoader {
+	return &fakeHSDSLoader{
+		Domains: map[string]*hsdsDomain{
+			"home/user/domain.h5": {Root: &testRootID, Owner: "user"},
+		},
+		Versions: map[string][]*hsdsVersion{
+			testGroupKey: {
+				{ID: "group-v1", LastModified: testTimestamp.Add(-time.Hour), Size: 5},
+			},
+			testChunkKey: {
+				{ID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Size: 0},
+				{ID: "chunk-v1", LastModified: testTimestamp.Add(-time.Hour), Size: 4},
+			},
+		},
+		Objects: map[string][]byte{
+			"group-v1": []byte("group"),
+			"chunk-v2": {},
+			"chunk-v1": []byte("data"),
+		},
+	}
+}
+
+func TestList_NoColorWithoutTerminal(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	c := colorizer{Enabled: colorEnabled(f)}
+	if c.Enabled {
+		t.Errorf("colorEnabled(%s) = true (want false)", f.Name())
+	}
+	err = list(f, newTestLoader(), []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp, Color: c})
+	if err != nil {
+		t.Fatalf("list() err = %v (want nil)", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Clean(f.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got, []byte("\x1b[")) {
+		t.Errorf("list() output contains color codes: %q", got)
+	}
+	if !bytes.Contains(got, []byte(testChunkKey)) {
+		t.Errorf("list() output = %q (want it to contain %q)", got, testChunkKey)
+	}
+}
+
+func TestList_Color(t *testing.T) {
+	var buf bytes.Buffer
+	err := list(&buf, newTestLoader(), []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp, Color: colorizer{Enabled: true}})
+	if err != nil {
+		t.Fatalf("list() err = %v (want nil)", err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{ansiYellow + testChunkKey, ansiBlue + testGroupKey, ansiBold + "chunk-v1"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("list() output = %q (want it to contain %q)", got, want)
+		}
+	}
+	if strings.Contains(got, ansiBold+"chunk-v2") {
+		t.Errorf("list() output = %q (want chunk-v2 not to be highlighted)", got)
+	}
+}
+
+func TestList_Concurrent(t *testing.T) {
+	domains := []string{"home/user/domain.h5", "home/user/other.h5", "home/user/third.h5"}
+	newLoader := func() *fakeHSDSLoader {
+		loader := newTestLoader()
+		for _, name := range domains {
+			loader.Domains[name] = &hsdsDomain{Root: &testRootID}
+		}
+		return loader
+	}
+	want := map[string]bool{}
+	for _, name := range domains {
+		var buf bytes.Buffer
+		err := list(&buf, newLoader(), []string{name}, &runOptions{})
+		if err != nil {
+			t.Fatalf("list() err = %v (want nil)", err)
+		}
+		want[buf.String()] = true
+	}
+
+	var out bytes.Buffer
+	w := &syncWriter{w: &out}
+	const workers = 8
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- list(w, newLoader(), domains, &runOptions{})
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("list() err = %v (want nil)", err)
+		}
+	}
+
+	// Each listing is written with its separator, if any, in a single Write
+	// call, so the output must consist of whole listings.
+	got := out.String()
+	var blocks int
+	for got != "" {
+		got = strings.TrimPrefix(got, "\n")
+		var found bool
+		for block := range want {
+			if strings.HasPrefix(got, block) {
+				got = strings.TrimPrefix(got, block)
+				blocks++
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("list() wrote interleaved block at %q", got)
+		}
+	}
+	if blocks != workers*len(domains) {
+		t.Errorf("list() wrote %d blocks (want %d)", blocks, workers*len(domains))
+	}
+}
+
+func TestList_Golden(t *testing.T) {
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+
+	loader := newTestLoader()
+	loader.Domains["home/user/other.h5"] = &hsdsDomain{Root: &testRootID}
+	var buf bytes.Buffer
+	err := list(&buf, loader, []string{"home/user/domain.h5", "home/user/other.h5"}, &runOptions{ListSummary: true})
+	if err != nil {
+		t.Fatalf("list() err = %v (want nil)", err)
+	}
+
+	golden := filepath.Join("testdata", "list.golden")
+	if *update {
+		err = ioutil.WriteFile(golden, buf.Bytes(), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != string(want) {
+		t.Errorf("list() output = %q (want %q)", got, want)
+	}
+}
+
+type selectVersionTestcase struct {
+	name   string
+	t      time.Time
+	policy string
+	want   string
+}
+
+func TestSelectVersion(t *testing.T) {
+	base := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	versions := []*hsdsVersion{
+		{ID: "v3", LastModified: base.Add(2 * time.Hour)},
+		{ID: "v2", LastModified: base.Add(time.Hour)},
+		{ID: "v1", LastModified: base.Add(-time.Hour)},
+	}
+
+	testcases := []selectVersionTestcase{
+		{"before exact", base.Add(time.Hour), selectionPolicyBefore, "v2"},
+		{"before between", base.Add(90 * time.Minute), selectionPolicyBefore, "v2"},
+		{"before too early", base.Add(-2 * time.Hour), selectionPolicyBefore, "v1"},
+		{"default", base.Add(90 * time.Minute), "", "v2"},
+		{"nearest newer", base.Add(50 * time.Minute), selectionPolicyNearest, "v2"},
+		{"nearest older", base.Add(-50 * time.Minute), selectionPolicyNearest, "v1"},
+		{"nearest tie", base, selectionPolicyNearest, "v1"},
+		{"nearest too late", base.Add(5 * time.Hour), selectionPolicyNearest, "v3"},
+		{"after exact", base.Add(time.Hour), selectionPolicyAfter, "v2"},
+		{"after between", base, selectionPolicyAfter, "v2"},
+		{"after too late", base.Add(3 * time.Hour), selectionPolicyAfter, "v3"},
+		{"zero time", time.Time{}, selectionPolicyAfter, "v3"},
+	}
+
+	for _, tc := range testcases {
+		got := selectVersion(versions, tc.t, tc.policy)
+		if got.ID != tc.want {
+			t.Errorf("%s: selectVersion() = %s (want %s)", tc.name, got.ID, tc.want)
+		}
+	}
+}
+
+func TestValidSelectionPolicy(t *testing.T) {
+	for _, policy := range []string{"", selectionPolicyBefore, selectionPolicyNearest, selectionPolicyAfter} {
+		if err := validSelectionPolicy(policy); err != nil {
+			t.Errorf("validSelectionPolicy(%q) = %v (want nil)", policy, err)
+		}
+	}
+	if err := validSelectionPolicy("closest"); err == nil {
+		t.Errorf("validSelectionPolicy(\"closest\") = nil (want error)")
+	}
+}
+
+func TestDumpObject(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour)},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+
+	var buf bytes.Buffer
+	err := dumpObject(context.Background(), loader, testChunkKey, "chunk-v1", &buf)
+	if err != nil {
+		t.Fatalf("dumpObject() err = %v (want nil)", err)
+	}
+	if buf.String() != "data" {
+		t.Errorf("dumpObject() wrote %q (want %q)", buf.String(), "data")
+	}
+	if len(client.GetObjectInputs) != 1 {
+		t.Fatalf("GetObject calls = %d (want 1)", len(client.GetObjectInputs))
+	}
+	if v := aws.ToString(client.GetObjectInputs[0].VersionId); v != "chunk-v1" {
+		t.Errorf("GetObject version = %q (want %q)", v, "chunk-v1")
+	}
+}
+
+func TestListObjectVersions(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data"), ETag: `"8d777f385d3dfec8815d20f7496026dc"`},
+			{Key: testChunkKey + "_1", VersionID: "other", LastModified: testTimestamp},
+			{Key: testChunkKey, VersionID: "chunk-v3", LastModified: testTimestamp.Add(2 * time.Hour), DeleteMarker: true},
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new data"), ETag: `"a5a3fbc4a8ab4bd3b5a1d0cdd9c8d1b0"`},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+
+	var buf bytes.Buffer
+	err := listObjectVersions(context.Background(), &buf, loader, testChunkKey)
+	if err != nil {
+		t.Fatalf("listObjectVersions() err = %v (want nil)", err)
+	}
+	want := testChunkKey + ":\n" +
+		"    chunk-v3\tdelete marker\t" + testTimestamp.Add(2*time.Hour).Local().Format(time.RFC3339) + "\t\n" +
+		"    chunk-v2\t8 Bytes\t" + testTimestamp.Add(time.Hour).Local().Format(time.RFC3339) + "\ta5a3fbc4a8ab4bd3b5a1d0cdd9c8d1b0\n" +
+		"    chunk-v1\t4 Bytes\t" + testTimestamp.Local().Format(time.RFC3339) + "\t8d777f385d3dfec8815d20f7496026dc\n"
+	if buf.String() != want {
+		t.Errorf("listObjectVersions() wrote %q (want %q)", buf.String(), want)
+	}
+
+	err = listObjectVersions(context.Background(), &buf, loader, testChunkKey+"_2")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("listObjectVersions() err = %v (want %v)", err, os.ErrNotExist)
+	}
+}
+
+func TestReplicate_EmptyDomain(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	loader := newTestLoader()
+	loader.Versions = nil
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, &runOptions{})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	want := `domain "home/user/domain.h5" has no objects under prefix "db/d12a20a5-6c27622f"`
+	if !strings.Contains(warnings.String(), want) {
+		t.Errorf("replicate() warnings = %q (want it to contain %q)", warnings.String(), want)
+	}
+	_, err = os.Stat(filepath.Join(root, "home", "user", "domain.h5", ".domain.json"))
+	if err != nil {
+		t.Errorf("replicate() did not store the domain: %v", err)
+	}
+}
+
+func TestReplicate_PreserveEmptyGroups(t *testing.T) {
+	loader := newTestLoader()
+	loader.Objects["group-v1"] = []byte(`{
+		"id": "g-d12a20a5-6c27622f-59a2-a82de4-afeaa7",
+		"links": {
+			"empty": {"class": "H5L_TYPE_HARD", "id": "g-d12a20a5-6c27622f-40c5-5e41ac-92006c"},
+			"data": {"class": "H5L_TYPE_HARD", "id": "d-d12a20a5-6c27622f-693e-302825-f8c087"},
+			"soft": {"class": "H5L_TYPE_SOFT", "h5path": "/empty"}
+		}
+	}`)
+	loader.Versions[testGroupKey][0].Size = int64(len(loader.Objects["group-v1"]))
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, &runOptions{PreserveEmptyGroups: true})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	dir := filepath.Join(root, "db", "d12a20a5-6c27622f", "g", "40c5-5e41ac-92006c")
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		t.Errorf("replicate() did not create empty group directory %s: %v", dir, err)
+	}
+}
+
+func TestWarnUnversioned(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	loader := &s3HSDSDomainLoader{
+		Client: &fakeS3Client{VersioningStatus: types.BucketVersioningStatusSuspended},
+		Bucket: "bucket",
+	}
+	warnUnversioned(context.Background(), loader)
+	want := "point-in-time selection is unavailable"
+	if !strings.Contains(warnings.String(), want) {
+		t.Errorf("warnUnversioned() warnings = %q (want it to contain %q)", warnings.String(), want)
+	}
+
+	warnings.Reset()
+	loader.Client = &fakeS3Client{VersioningStatus: types.BucketVersioningStatusEnabled}
+	warnUnversioned(context.Background(), loader)
+	if warnings.Len() != 0 {
+		t.Errorf("warnUnversioned() warnings = %q (want none)", warnings.String())
+	}
+}
+
+func TestReplicate_Options(t *testing.T) {
+	loader := newTestLoader()
+	root := t.TempDir()
+	opts := &runOptions{
+		NotAfter: testTimestamp,
+		Progress: newProgress(),
+		Manifest: newManifest(),
+	}
+	storer := &filesystemHSDSStorer{Root: root, Manifest: opts.Manifest}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(testChunkKey)))
+	if err != nil || string(got) != "data" {
+		t.Errorf("replicate() chunk = %q, %v (want %q)", got, err, "data")
+	}
+	if entry := opts.Manifest.Entry(testChunkKey); entry == nil || entry.Version != "chunk-v1" {
+		t.Errorf("manifest entry = %+v (want version chunk-v1)", entry)
+	}
+	want := "progress: 2/2 objects, 9 bytes"
+	if snapshot := opts.Progress.Snapshot(); !strings.HasPrefix(snapshot, want) {
+		t.Errorf("progress = %q (want prefix %q)", snapshot, want)
+	}
+}
+
+func TestReplicate_ConsistencyCheck(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	name := "home/user/domain.h5"
+	for _, strict := range []bool{false, true} {
+		loader := newTestLoader()
+		loader.Domains[name].LastModified = 1665360000
+		loader.Reloaded = map[string]*hsdsDomain{
+			name: {Root: &testRootID, Owner: "user", LastModified: 1665360060},
+		}
+		warnings.Reset()
+		opts := &runOptions{ConsistencyCheck: true, Strict: strict}
+		storer := &filesystemHSDSStorer{Root: t.TempDir()}
+		err := replicate(loader, storer, []string{name}, opts)
+
+		var modified *domainModifiedError
+		if strict {
+			if !errors.As(err, &modified) {
+				t.Errorf("strict: replicate() err = %v (want *domainModifiedError)", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("replicate() err = %v (want nil)", err)
+		}
+		if !strings.Contains(warnings.String(), "modified during the dump") {
+			t.Errorf("warnings = %q (want domain modified warning)", warnings.String())
+		}
+		if loader.DomainCalls[name] != 2 {
+			t.Errorf("LoadDomain() calls = %d (want 2)", loader.DomainCalls[name])
+		}
+	}
+}
+
+func TestReplicate_ConsistencyCheckUnmodified(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	loader := newTestLoader()
+	opts := &runOptions{ConsistencyCheck: true, Strict: true}
+	storer := &filesystemHSDSStorer{Root: t.TempDir()}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Errorf("replicate() err = %v (want nil)", err)
+	}
+	if warnings.Len() != 0 {
+		t.Errorf("warnings = %q (want none)", warnings.String())
+	}
+}
+
+func TestList_Summary(t *testing.T) {
+	loader := newTestLoader()
+	loader.Versions["db/d12a20a5-6c27622f/g/693e-302825-f8c086/.group.json"] = []*hsdsVersion{
+		{ID: "subgroup-v1", LastModified: testTimestamp, Size: 7},
+	}
+	loader.Versions["db/d12a20a5-6c27622f/d/693e-302825-f8c087/.dataset.json"] = []*hsdsVersion{
+		{ID: "dataset-v2", LastModified: testTimestamp, Size: 11},
+		{ID: "dataset-v1", LastModified: testTimestamp.Add(-time.Hour), Size: 10},
+	}
+	loader.Versions["db/d12a20a5-6c27622f/d/693e-302825-f8c087/1"] = []*hsdsVersion{
+		{ID: "chunk1-v2", LastModified: testTimestamp, DeleteMarker: true},
+		{ID: "chunk1-v1", LastModified: testTimestamp.Add(-time.Hour), Size: 16},
+	}
+	loader.Versions["db/d12a20a5-6c27622f/t/693e-302825-f8c088/.datatype.json"] = []*hsdsVersion{
+		{ID: "type-v1", LastModified: testTimestamp, Size: 3},
+	}
+	for _, id := range []string{"subgroup-v1", "dataset-v2", "chunk1-v2", "type-v1"} {
+		loader.Objects[id] = []byte{}
+	}
+
+	var buf bytes.Buffer
+	err := list(&buf, loader, []string{"home/user/domain.h5"}, &runOptions{ListSummary: true})
+	if err != nil {
+		t.Fatalf("list() err = %v (want nil)", err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"    summary:\n",
+		"        groups:              2 objects\t12 Bytes\n",
+		"        datasets:            1 objects\t21 Bytes\n",
+		"        committed types:     1 objects\t3 Bytes\n",
+		"        chunks:              2 objects\t20 Bytes\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("list() output = %q (want it to contain %q)", got, want)
+		}
+	}
+	if strings.Contains(got, "other:") {
+		t.Errorf("list() output = %q (want no other objects)", got)
+	}
+
+	buf.Reset()
+	err = list(&buf, loader, []string{"home/user/domain.h5"}, &runOptions{})
+	if err != nil {
+		t.Fatalf("list() err = %v (want nil)", err)
+	}
+	if strings.Contains(buf.String(), "summary:") {
+		t.Errorf("list() output = %q (want no summary without ListSummary)", buf.String())
+	}
+}
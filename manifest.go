@@ -0,0 +1,163 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// manifestEntry describes a single file written during a dump.
+type manifestEntry struct {
+	// Path is the path of the file relative to the dump's root directory.
+	Path string `json:"path"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex-encoded SHA-256 checksum of the file's content.
+	SHA256 string `json:"sha256,omitempty"`
+	// Encoding is the encoding applied to the file's content, e.g. "gzip".
+	// It is empty if the content has been stored as is.
+	Encoding string `json:"encoding,omitempty"`
+	// SourceEncoding is the compression format the object has been stored in
+	// S3 with, if it has been decompressed before writing the file.
+	SourceEncoding string `json:"sourceEncoding,omitempty"`
+	// Domain is the name of the domain the object belongs to. It is only
+	// set for the selected versions of a domain's objects.
+	Domain string `json:"domain,omitempty"`
+	// Version is the ID of the object version the file was written for.
+	Version string `json:"version,omitempty"`
+	// LastModified is the last modification time of the object version the
+	// file was written for.
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	// Deleted indicates that the object had been deleted at the selected
+	// point in time and its last content version has been restored.
+	Deleted bool `json:"deleted,omitempty"`
+	// LinkTarget is the path of the file this file is a link to. It is empty
+	// for regular files.
+	LinkTarget string `json:"linkTarget,omitempty"`
+	// Tags are the S3 tags of the object version, if they have been
+	// captured.
+	Tags map[string]string `json:"tags,omitempty"`
+	// ACL is the S3 ACL of the object version, if it has been captured.
+	ACL *objectACL `json:"acl,omitempty"`
+	// StorageClass is the S3 storage class of the object version, if it has
+	// been listed.
+	StorageClass string `json:"storageClass,omitempty"`
+	// Unavailable indicates that the selected version could not be loaded
+	// and no file has been written for it.
+	Unavailable bool `json:"unavailable,omitempty"`
+}
+
+// dumpManifest records the files written during a dump, keyed by the S3 key
+// of the domain or object they were written for. It is safe for concurrent
+// use.
+type dumpManifest struct {
+	mu      sync.Mutex
+	Objects map[string]*manifestEntry `json:"objects"`
+}
+
+func newManifest() *dumpManifest {
+	return &dumpManifest{Objects: map[string]*manifestEntry{}}
+}
+
+// Add records that entry has been written for the given key.
+func (m *dumpManifest) Add(key string, entry *manifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Objects[key] = entry
+}
+
+// Annotate calls fn with the entry recorded for key, if it exists.
+func (m *dumpManifest) Annotate(key string, fn func(entry *manifestEntry)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.Objects[key]; ok {
+		fn(entry)
+	}
+}
+
+// Entry returns the entry recorded for key or nil, if no entry exists.
+func (m *dumpManifest) Entry(key string) *manifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Objects[key]
+}
+
+// Newest returns the most recent last modification time of all object
+// versions recorded in m. It returns the zero value if m records none.
+func (m *dumpManifest) Newest() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var newest time.Time
+	for _, entry := range m.Objects {
+		if entry.LastModified != nil && entry.LastModified.After(newest) {
+			newest = *entry.LastModified
+		}
+	}
+	return newest
+}
+
+// WriteFile writes m to the file at path.
+func (m *dumpManifest) WriteFile(path string) error {
+	m.mu.Lock()
+	b, err := json.MarshalIndent(m, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// readManifest reads the manifest stored in the file at path.
+func readManifest(path string) (*dumpManifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := newManifest()
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WriteIndex writes a tab-separated index of all selected object versions
+// recorded in m to w, sorted by domain and key. Each line contains the domain
+// name, the object's key, the path of its file, the version ID, the file size
+// and the file's SHA-256 checksum.
+func (m *dumpManifest) WriteIndex(w io.Writer) error {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.Objects))
+	for key, entry := range m.Objects {
+		if entry.Domain != "" && !entry.Unavailable {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		di, dj := m.Objects[keys[i]].Domain, m.Objects[keys[j]].Domain
+		if di != dj {
+			return di < dj
+		}
+		return keys[i] < keys[j]
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "domain\tkey\tpath\tversion\tsize\tsha256")
+	for _, key := range keys {
+		e := m.Objects[key]
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\t%d\t%s\n", e.Domain, key, e.Path, e.Version, e.Size, e.SHA256)
+	}
+	m.mu.Unlock()
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpManifest_WriteIndex(t *testing.T) {
+	otherRoot := MustParseID("g-0000aaaa-bbbbcccc-59a2-a82de4-afeaa7")
+	otherKey := "db/0000aaaa-bbbbcccc/.group.json"
+	loader := newTestLoader()
+	loader.Domains["home/user/other.h5"] = &hsdsDomain{Root: &otherRoot}
+	loader.Versions[otherKey] = []*hsdsVersion{{ID: "other-v1", LastModified: testTimestamp, Size: 5}}
+	loader.Objects["other-v1"] = []byte("other")
+
+	opts := &runOptions{NotAfter: testTimestamp, Manifest: newManifest()}
+	storer := &filesystemHSDSStorer{Root: t.TempDir(), Manifest: opts.Manifest}
+	err := replicate(loader, storer, []string{"home/user/other.h5", "home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	var buf bytes.Buffer
+	err = opts.Manifest.WriteIndex(&buf)
+	if err != nil {
+		t.Fatalf("WriteIndex() err = %v (want nil)", err)
+	}
+	want := []string{
+		"domain\tkey\tpath\tversion\tsize\tsha256",
+		"home/user/domain.h5\t" + testGroupKey + "\t" + testGroupKey + "\tgroup-v1\t5\t" + sha256Hex([]byte("group")),
+		"home/user/domain.h5\t" + testChunkKey + "\t" + testChunkKey + "\tchunk-v1\t4\t" + sha256Hex([]byte("data")),
+		"home/user/other.h5\t" + otherKey + "\t" + otherKey + "\tother-v1\t5\t" + sha256Hex([]byte("other")),
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("WriteIndex() =\n%s\n(want\n%s)", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
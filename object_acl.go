@@ -0,0 +1,172 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectGrant is a single grant of an S3 object ACL.
+type objectGrant struct {
+	// GranteeType is CanonicalUser, AmazonCustomerByEmail or Group.
+	GranteeType  string `json:"granteeType"`
+	ID           string `json:"id,omitempty"`
+	DisplayName  string `json:"displayName,omitempty"`
+	EmailAddress string `json:"emailAddress,omitempty"`
+	URI          string `json:"uri,omitempty"`
+	// Permission is FULL_CONTROL, WRITE, WRITE_ACP, READ or READ_ACP.
+	Permission string `json:"permission"`
+}
+
+// objectACL is the ACL of an S3 object version, which is distinct from the
+// ACL of the HSDS domain the object belongs to.
+type objectACL struct {
+	OwnerID          string         `json:"ownerId,omitempty"`
+	OwnerDisplayName string         `json:"ownerDisplayName,omitempty"`
+	Grants           []*objectGrant `json:"grants"`
+}
+
+// hsdsObjectACLLoader is the interface wrapping the LoadObjectACL method.
+//
+// LoadObjectACL loads the ACL of the given version of the domain object
+// identified by name.
+type hsdsObjectACLLoader interface {
+	LoadObjectACL(ctx context.Context, name, version string) (*objectACL, error)
+}
+
+// hsdsObjectACLStorer is the interface wrapping the StoreObjectACL method.
+//
+// StoreObjectACL replaces the ACL of the object stored under name with acl.
+type hsdsObjectACLStorer interface {
+	StoreObjectACL(ctx context.Context, name string, acl *objectACL) error
+}
+
+// LoadObjectACL loads the ACL of the given version of the object identified
+// by name.
+func (l *s3HSDSDomainLoader) LoadObjectACL(ctx context.Context, name, version string) (*objectACL, error) {
+	input := &s3.GetObjectAclInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(name),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	output, err := l.Client.GetObjectAcl(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	acl := &objectACL{Grants: make([]*objectGrant, 0, len(output.Grants))}
+	if output.Owner != nil {
+		acl.OwnerID = aws.ToString(output.Owner.ID)
+		acl.OwnerDisplayName = aws.ToString(output.Owner.DisplayName)
+	}
+	for _, g := range output.Grants {
+		grant := &objectGrant{Permission: string(g.Permission)}
+		if g.Grantee != nil {
+			grant.GranteeType = string(g.Grantee.Type)
+			grant.ID = aws.ToString(g.Grantee.ID)
+			grant.DisplayName = aws.ToString(g.Grantee.DisplayName)
+			grant.EmailAddress = aws.ToString(g.Grantee.EmailAddress)
+			grant.URI = aws.ToString(g.Grantee.URI)
+		}
+		acl.Grants = append(acl.Grants, grant)
+	}
+	return acl, nil
+}
+
+// ObjectACLsEnabled reports whether the objects of the loader's bucket can
+// have ACLs. Buckets whose object ownership is BucketOwnerEnforced ignore
+// object ACLs.
+func (l *s3HSDSDomainLoader) ObjectACLsEnabled(ctx context.Context) (bool, error) {
+	output, err := l.Client.GetBucketOwnershipControls(ctx, &s3.GetBucketOwnershipControlsInput{
+		Bucket: aws.String(l.Bucket),
+	})
+	var ae interface{ ErrorCode() string }
+	if errors.As(err, &ae) && ae.ErrorCode() == "OwnershipControlsNotFoundError" {
+		// Buckets without ownership controls predate them and use ACLs.
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if output.OwnershipControls != nil {
+		for _, rule := range output.OwnershipControls.Rules {
+			if rule.ObjectOwnership == types.ObjectOwnershipBucketOwnerEnforced {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// StoreObjectACL replaces the ACL of the object stored under name with acl.
+func (s *s3HSDSStorer) StoreObjectACL(ctx context.Context, name string, acl *objectACL) error {
+	policy := &types.AccessControlPolicy{Grants: make([]types.Grant, len(acl.Grants))}
+	if acl.OwnerID != "" {
+		policy.Owner = &types.Owner{ID: aws.String(acl.OwnerID)}
+		if acl.OwnerDisplayName != "" {
+			policy.Owner.DisplayName = aws.String(acl.OwnerDisplayName)
+		}
+	}
+	for i, g := range acl.Grants {
+		grantee := &types.Grantee{Type: types.Type(g.GranteeType)}
+		if g.ID != "" {
+			grantee.ID = aws.String(g.ID)
+		}
+		if g.DisplayName != "" {
+			grantee.DisplayName = aws.String(g.DisplayName)
+		}
+		if g.EmailAddress != "" {
+			grantee.EmailAddress = aws.String(g.EmailAddress)
+		}
+		if g.URI != "" {
+			grantee.URI = aws.String(g.URI)
+		}
+		policy.Grants[i] = types.Grant{Grantee: grantee, Permission: types.Permission(g.Permission)}
+	}
+	_, err := s.Client.PutObjectAcl(ctx, &s3.PutObjectAclInput{
+		Bucket:              aws.String(s.Bucket),
+		Key:                 aws.String(s.key(name)),
+		AccessControlPolicy: policy,
+	})
+	return err
+}
+
+// captureObjectACL loads the ACL of the given version of the object
+// identified by name from loader, records it in the manifest and stores it in
+// storer, if loader and storer support object ACLs. Failures are reported as
+// warnings only, like those of captureTags.
+func captureObjectACL(ctx context.Context, loader hsdsObjectLoader, storer hsdsStorer, name string, version *hsdsVersion, opts *runOptions) {
+	var al hsdsObjectACLLoader
+	ok := findLoader(loader, func(l interface{}) (ok bool) {
+		al, ok = l.(hsdsObjectACLLoader)
+		return ok
+	})
+	if !ok {
+		return
+	}
+	acl, err := al.LoadObjectACL(ctx, name, version.ID)
+	if err != nil {
+		warn("cannot load ACL of %s: %v", name, err)
+		return
+	}
+	if opts.Manifest != nil {
+		opts.Manifest.Annotate(name, func(e *manifestEntry) {
+			e.ACL = acl
+		})
+	}
+	as, ok := storer.(hsdsObjectACLStorer)
+	if !ok {
+		return
+	}
+	err = as.StoreObjectACL(ctx, name, acl)
+	if err != nil {
+		warn("cannot store ACL of %s: %v", name, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestExecutePlan_CaptureObjectACLs(t *testing.T) {
+	grant := types.Grant{
+		Grantee: &types.Grantee{
+			Type:        types.TypeCanonicalUser,
+			ID:          aws.String("reader-id"),
+			DisplayName: aws.String("reader"),
+		},
+		Permission: types.PermissionRead,
+	}
+	source := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data"), Grants: []types.Grant{grant}},
+		},
+	}
+	plan := &replicationPlan{
+		Bucket: "bucket",
+		Domains: []*domainPlan{{
+			Name:    "home/user/domain.h5",
+			Domain:  &hsdsDomain{Root: &testRootID},
+			Objects: map[string]*hsdsVersion{testChunkKey: {ID: "chunk-v1", LastModified: testTimestamp, Size: 4}},
+		}},
+	}
+	loader := &s3HSDSDomainLoader{Client: source, Bucket: "bucket"}
+
+	fsStorer := &filesystemHSDSStorer{Root: t.TempDir(), Manifest: newManifest()}
+	err := executePlan(loader, fsStorer, plan, &runOptions{CaptureObjectACLs: true, Manifest: fsStorer.Manifest})
+	if err != nil {
+		t.Fatalf("executePlan() err = %v (want nil)", err)
+	}
+	want := &objectACL{
+		OwnerID: "owner-id",
+		Grants: []*objectGrant{
+			{GranteeType: "CanonicalUser", ID: "reader-id", DisplayName: "reader", Permission: "READ"},
+		},
+	}
+	if entry := fsStorer.Manifest.Entry(testChunkKey); entry == nil || !reflect.DeepEqual(entry.ACL, want) {
+		t.Errorf("manifest entry = %+v (want ACL %+v)", entry, want)
+	}
+
+	client := &fakeS3StorerClient{}
+	s3Storer := &s3HSDSStorer{Client: client, Bucket: "archive", Prefix: "restore"}
+	err = executePlan(loader, s3Storer, plan, &runOptions{CaptureObjectACLs: true})
+	if err != nil {
+		t.Fatalf("executePlan() err = %v (want nil)", err)
+	}
+	policy := client.ACLs["restore/"+testChunkKey]
+	if policy == nil || aws.ToString(policy.Owner.ID) != "owner-id" || !reflect.DeepEqual(policy.Grants, []types.Grant{grant}) {
+		t.Errorf("PutObjectAcl() policy = %+v (want grants %+v)", policy, []types.Grant{grant})
+	}
+}
+
+type objectACLsEnabledTestcase struct {
+	ownership types.ObjectOwnership
+	want      bool
+}
+
+func TestS3HSDSDomainLoader_ObjectACLsEnabled(t *testing.T) {
+	testCases := []objectACLsEnabledTestcase{
+		{ownership: "", want: true},
+		{ownership: types.ObjectOwnershipObjectWriter, want: true},
+		{ownership: types.ObjectOwnershipBucketOwnerPreferred, want: true},
+		{ownership: types.ObjectOwnershipBucketOwnerEnforced, want: false},
+	}
+
+	for _, tc := range testCases {
+		loader := &s3HSDSDomainLoader{Client: &fakeS3Client{ObjectOwnership: tc.ownership}, Bucket: "bucket"}
+		got, err := loader.ObjectACLsEnabled(context.Background())
+		if err != nil || got != tc.want {
+			t.Errorf("%q: ObjectACLsEnabled() = %v, %v (want %v)", tc.ownership, got, err, tc.want)
+		}
+	}
+}
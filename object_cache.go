@@ -0,0 +1,174 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedObjectLoader is an hsdsLoader that keeps the object versions loaded
+// by the underlying loader's LoadObject method in a local staging directory,
+// so selecting the same version again, e.g. in a later run with a different
+// -b timestamp, does not download it again. Current versions, which are
+// requested without a version ID, are not cached. The optional interfaces of
+// the underlying loader are found through Unwrap.
+type cachedObjectLoader struct {
+	hsdsLoader
+	// Dir is the directory cached versions are stored in.
+	Dir string
+	// MaxSize is the total size in bytes of the cached versions above which
+	// the least recently used versions are evicted. The cache is unbounded
+	// if it is zero.
+	MaxSize int64
+	// Bucket is the bucket the underlying loader retrieves objects from.
+	Bucket string
+
+	// mu serializes evictions.
+	mu sync.Mutex
+}
+
+// cacheFile returns the name of the file the given version of the object
+// identified by name is cached in.
+func (l *cachedObjectLoader) cacheFile(name, version string) string {
+	sum := sha256.Sum256([]byte(l.Bucket + "\x00" + name + "\x00" + version))
+	return filepath.Join(l.Dir, hex.EncodeToString(sum[:]))
+}
+
+func (l *cachedObjectLoader) LoadObject(ctx context.Context, name, version string) ([]byte, error) {
+	if version == "" {
+		return l.hsdsLoader.LoadObject(ctx, name, version)
+	}
+	file := l.cacheFile(name, version)
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		touch(file)
+		return data, nil
+	}
+
+	data, err = l.hsdsLoader.LoadObject(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+	err = l.store(file, data)
+	if err != nil {
+		warn("cannot cache %s version %s: %v", name, version, err)
+	}
+	return data, nil
+}
+
+// LoadObjectIfModified returns cached versions without checking whether they
+// have been modified, as versions never change. Other versions are loaded
+// conditionally by the underlying loader, if it supports it, and cached.
+func (l *cachedObjectLoader) LoadObjectIfModified(ctx context.Context, name, version string, since time.Time) ([]byte, error) {
+	var cl hsdsConditionalObjectLoader
+	ok := findLoader(l.hsdsLoader, func(ul interface{}) (ok bool) {
+		cl, ok = ul.(hsdsConditionalObjectLoader)
+		return ok
+	})
+	if !ok || version == "" {
+		return l.LoadObject(ctx, name, version)
+	}
+	file := l.cacheFile(name, version)
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		touch(file)
+		return data, nil
+	}
+
+	data, err = cl.LoadObjectIfModified(ctx, name, version, since)
+	if err != nil {
+		return nil, err
+	}
+	err = l.store(file, data)
+	if err != nil {
+		warn("cannot cache %s version %s: %v", name, version, err)
+	}
+	return data, nil
+}
+
+func (l *cachedObjectLoader) Unwrap() hsdsLoader {
+	return l.hsdsLoader
+}
+
+// store writes data to file and evicts the least recently used versions if
+// the cache has grown too large. Versions larger than the cache are not
+// stored.
+func (l *cachedObjectLoader) store(file string, data []byte) error {
+	if l.MaxSize > 0 && int64(len(data)) > l.MaxSize {
+		return nil
+	}
+	err := os.MkdirAll(l.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp := tempFileName(l.Dir, filepath.Base(file))
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	touch(file)
+	return l.evict()
+}
+
+// touch records the use of the cached version in file in its modification
+// time. The time is set explicitly, as the timestamps filesystems assign to
+// written files may be coarser than the clock.
+func touch(file string) {
+	now := time.Now()
+	os.Chtimes(file, now, now)
+}
+
+// evict removes the least recently used versions from the cache until their
+// total size does not exceed MaxSize.
+func (l *cachedObjectLoader) evict() error {
+	if l.MaxSize <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fis, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, fi := range fis {
+		// Temporary files of pending writes start with a dot.
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if total <= l.MaxSize {
+			break
+		}
+		err = os.Remove(filepath.Join(l.Dir, fi.Name()))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= fi.Size()
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCachedObjectLoader(t *testing.T) {
+	fake := newTestLoader()
+	loader := &cachedObjectLoader{hsdsLoader: fake, Dir: t.TempDir(), Bucket: "bucket"}
+	data, err := loader.LoadObject(context.Background(), testChunkKey, "chunk-v1")
+	if err != nil || string(data) != "data" {
+		t.Fatalf("LoadObject() = %q, %v (want %q)", data, err, "data")
+	}
+
+	// The second fetch is served from the cache.
+	delete(fake.Objects, "chunk-v1")
+	data, err = loader.LoadObject(context.Background(), testChunkKey, "chunk-v1")
+	if err != nil || string(data) != "data" {
+		t.Errorf("LoadObject() = %q, %v (want cached %q)", data, err, "data")
+	}
+
+	// Current versions are not cached.
+	_, err = loader.LoadObject(context.Background(), testGroupKey, "")
+	if err != nil {
+		t.Fatalf("LoadObject() err = %v (want nil)", err)
+	}
+	fis, err := ioutil.ReadDir(loader.Dir)
+	if err != nil || len(fis) != 1 {
+		t.Errorf("cache holds %d files, %v (want 1)", len(fis), err)
+	}
+}
+
+func TestCachedObjectLoader_Evict(t *testing.T) {
+	fake := newTestLoader()
+	fake.Objects["chunk-v3"] = []byte("more")
+	loader := &cachedObjectLoader{hsdsLoader: fake, Dir: t.TempDir(), MaxSize: 10, Bucket: "bucket"}
+
+	// chunk-v1 is used again after group-v1 has been cached, so group-v1 is
+	// the least recently used version once chunk-v3 exceeds the cache size.
+	for _, version := range []string{"group-v1", "chunk-v1", "chunk-v1", "chunk-v3"} {
+		_, err := loader.LoadObject(context.Background(), testChunkKey, version)
+		if err != nil {
+			t.Fatalf("LoadObject(%s) err = %v (want nil)", version, err)
+		}
+	}
+
+	for version, cached := range map[string]bool{"group-v1": false, "chunk-v1": true, "chunk-v3": true} {
+		_, err := ioutil.ReadFile(loader.cacheFile(testChunkKey, version))
+		if (err == nil) != cached {
+			t.Errorf("%s cached = %v (want %v)", version, err == nil, cached)
+		}
+	}
+}
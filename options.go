@@ -0,0 +1,402 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// runOptions are the options controlling how domains are listed and
+// replicated. They are populated once from the command-line flags.
+type runOptions struct {
+	// Discover treats the domain arguments as folders and processes all
+	// domains below them.
+	Discover bool
+	// Owner restricts the processed domains to those owned by the given
+	// user, if it is not empty.
+	Owner string
+	// Class restricts the processed domains to those of the given class,
+	// i.e. domainClassDomain or domainClassFolder. All domains are
+	// processed if it is empty.
+	Class string
+	// NotAfter selects the most recent object versions not after the given
+	// time. If it is the zero value, the latest versions are selected.
+	NotAfter time.Time
+	// DomainNotAfter overrides NotAfter for the domains it contains.
+	DomainNotAfter map[string]time.Time
+	// DomainOffset, if not nil, selects for each domain the most recent
+	// object versions not after its lastModified time minus the given
+	// duration instead of NotAfter.
+	DomainOffset *time.Duration
+	// Deadline is the point in time at which a dump is stopped. No further
+	// downloads are started and pending ones are cancelled once it has been
+	// reached. There is no deadline if it is the zero time.
+	Deadline time.Time
+	// Consistent selects the most recent object versions not after the last
+	// modification of each domain's domain file for domains without a
+	// point in time selected by NotAfter or DomainNotAfter.
+	Consistent bool
+	// CaptureTags loads the tags of each replicated object version, records
+	// them in the manifest and stores them along with the object if the
+	// storer supports tags.
+	CaptureTags bool
+	// CaptureObjectACLs loads the S3 ACL of each replicated object version,
+	// records it in the manifest and stores it along with the object if the
+	// storer supports object ACLs.
+	CaptureObjectACLs bool
+	// SelectionPolicy determines which version is selected relative to the
+	// selected point in time. The empty string is equivalent to
+	// selectionPolicyBefore.
+	SelectionPolicy string
+	// ExactTime requires each object to have a version modified exactly at
+	// the selected point in time instead of selecting the most recent version
+	// before it.
+	ExactTime bool
+	// MinVersionAge ignores all versions that have been modified less than
+	// the given duration ago, e.g. to avoid capturing in-flight writes. No
+	// versions are ignored if it is zero.
+	MinVersionAge time.Duration
+	// ModifiedAfter drops all objects whose selected version has not been
+	// modified after the given time, if it is not the zero value.
+	ModifiedAfter time.Time
+	// Group restricts the selected objects to those stored below the
+	// directory of the given group, if it is not nil.
+	Group *hsdsID
+	// Chunks restricts the replicated dataset chunks to those it matches. All
+	// chunks are replicated if it is nil.
+	Chunks chunkRange
+	// Types restricts the selected objects to those whose key encodes one of
+	// the given entity types. Chunks are of type entityTypeDataset. All
+	// objects are selected if it is nil.
+	Types entityTypeSet
+	// ExcludePrefixes drops all objects whose key, relative to the domain's
+	// database prefix, starts with any of the given prefixes.
+	ExcludePrefixes []string
+	// IncludeDeleted restores the last content version of objects that had
+	// been deleted at the selected point in time.
+	IncludeDeleted bool
+	// Conditional skips downloading objects whose stored copy is of the
+	// selected version. Stored objects get the last modification time of
+	// their version, by which it is recognized.
+	Conditional bool
+	// BestEffort skips domains that do not exist and object versions that
+	// can no longer be loaded instead of aborting the run.
+	BestEffort bool
+	// RequireAllDomains aborts the run if a domain does not exist, even if
+	// BestEffort is true.
+	RequireAllDomains bool
+	// FollowDomainLinks additionally processes the domains referenced by
+	// external links, following links up to the given depth. No links are
+	// followed if it is zero.
+	FollowDomainLinks int
+	// MaxDomains limits the number of domains processed by a run including
+	// those reached by following external links. Domains given explicitly
+	// are always processed. It is unlimited if it is zero.
+	MaxDomains int
+	// Breaker aborts a run once too many of the most recent downloads have
+	// failed. Successful downloads and failures skipped due to BestEffort are
+	// recorded, as all other failures abort a run anyway.
+	Breaker *circuitBreaker
+	// HeadBeforeGet checks that each selected version still exists before
+	// downloading it and skips versions that do not.
+	HeadBeforeGet bool
+	// DetectCompression decompresses objects recognized as gzip or zlib
+	// compressed by their magic bytes before storing them.
+	DetectCompression bool
+	// ValidatePrefix refuses to replicate domains with objects whose keys do
+	// not embed the domain's prefix.
+	ValidatePrefix bool
+	// ValidateACLs refuses to store domains with malformed ACL entries.
+	ValidateACLs bool
+	// SlowObjectThreshold warns about objects whose download takes longer
+	// than the given duration. No warnings are issued if it is zero.
+	SlowObjectThreshold time.Duration
+	// ConsistencyCheck reloads each domain after it has been replicated and
+	// warns if it has been modified in the meantime.
+	ConsistencyCheck bool
+	// Strict turns the warnings of ConsistencyCheck into errors and rejects
+	// domains with stray objects that are not domain objects.
+	Strict bool
+	// PreserveEmptyGroups creates directories for all groups of a domain,
+	// even those without any objects.
+	PreserveEmptyGroups bool
+	// AllVersions additionally stores every version of the selected objects
+	// below the .versions directory.
+	AllVersions bool
+	// UseS3Select loads only the fields of group and dataset metadata objects
+	// that are needed to reassemble domains with S3 Select, if the selected
+	// version of the object is its current version and the loader supports
+	// it.
+	UseS3Select bool
+	// DedupeVersions leaves out versions from the history that have the same
+	// content as the adjacent newer version. The selected version is always
+	// kept.
+	DedupeVersions bool
+	// HardlinkLatest links the selected version of each object among its
+	// stored versions. It only has an effect if AllVersions is true.
+	HardlinkLatest bool
+	// Verbatim stores the unmodified domain file under its key instead of
+	// rewriting it below the domain's name, so that every stored path equals
+	// the key of its object.
+	Verbatim bool
+	// NormalizeTimestamps rounds the created and lastModified times of
+	// stored domain files to whole microseconds, so repeated dumps of the
+	// same domain produce identical files.
+	NormalizeTimestamps bool
+	// SkipUnchangedDomains skips domains whose domain file has not been
+	// modified since it has been stored, which saves listing their versions.
+	SkipUnchangedDomains bool
+
+	// Workers is the number of local copies whose sizes are verified
+	// concurrently. Sizes are verified one after another if it is zero.
+	Workers int
+
+	// Color highlights list output.
+	Color colorizer
+	// ListSummary appends a summary of each domain's objects by entity type
+	// to list output.
+	ListSummary bool
+	// Progress tracks the number of replicated objects and bytes, if it is
+	// not nil.
+	Progress *progress
+	// ProgressFunc is called before and after each object is replicated, if
+	// it is not nil. Running totals are only reported if Progress is not nil.
+	ProgressFunc func(progressEvent)
+	// Manifest records the selected object versions, if it is not nil.
+	Manifest *dumpManifest
+	// Summary records the outcome of the run, if it is not nil.
+	Summary *runSummary
+	// Events streams the progress of the run, if it is not nil.
+	Events *eventStream
+
+	// now returns the current time. If it is nil, time.Now is used.
+	now func() time.Time
+}
+
+// currentTime returns the current time according to opts.now.
+func (opts *runOptions) currentTime() time.Time {
+	if opts.now != nil {
+		return opts.now()
+	}
+	return time.Now()
+}
+
+// runContext returns the context of a dump, which is cancelled once
+// opts.Deadline has been reached.
+func (opts *runOptions) runContext() (context.Context, context.CancelFunc) {
+	if opts.Deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), opts.Deadline)
+}
+
+// notAfter returns the point in time selected for domain, which is identified
+// by name.
+func (opts *runOptions) notAfter(name string, domain *hsdsDomain) time.Time {
+	if t, ok := opts.DomainNotAfter[name]; ok {
+		return t
+	}
+	if opts.DomainOffset != nil {
+		if domain.LastModified == 0 {
+			warn("domain %q records no lastModified time, selecting the latest versions", name)
+			return time.Time{}
+		}
+		return hsdsTime(domain.LastModified).Add(-*opts.DomainOffset)
+	}
+	return opts.NotAfter
+}
+
+// warnSlowObject warns if the download of the object identified by key,
+// started at start, has exceeded opts.SlowObjectThreshold.
+func (opts *runOptions) warnSlowObject(key string, start time.Time) {
+	if opts.SlowObjectThreshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed > opts.SlowObjectThreshold {
+		warn("slow object %s: download took %s", key, elapsed.Round(time.Millisecond))
+	}
+}
+
+// domainStarted reports that the replication of the domain identified by
+// name is about to start.
+func (opts *runOptions) domainStarted(name string) {
+	opts.Summary.StartDomain(name)
+	opts.Events.StartDomain(name)
+}
+
+// domainFinished reports that the replication of the current domain has
+// finished. err is the error that aborted it or nil.
+func (opts *runOptions) domainFinished(err error) {
+	opts.Summary.FinishDomain(err)
+	opts.Events.FinishDomain(err)
+}
+
+// objectStarted reports that the object identified by key is about to be
+// replicated.
+func (opts *runOptions) objectStarted(key string) {
+	if opts.ProgressFunc != nil {
+		opts.ProgressFunc(opts.Progress.event(progressObjectStarted, key, 0))
+	}
+}
+
+// objectDone records that size bytes have been stored for the object
+// identified by key.
+func (opts *runOptions) objectDone(key string, size int) {
+	opts.objectStored(key, size)
+	opts.progressDone(key, size)
+}
+
+// objectStored records that size bytes have been stored for the object
+// identified by key, without reporting progress. It is used for objects whose
+// progress has been reported when they were loaded.
+func (opts *runOptions) objectStored(key string, size int) {
+	opts.Summary.ObjectDone(size)
+	opts.Events.Object(key, size, eventStatusStored, nil)
+}
+
+// objectSkipped records that the object identified by key has been skipped.
+func (opts *runOptions) objectSkipped(key string) {
+	opts.Summary.ObjectSkipped()
+	opts.Events.Object(key, 0, eventStatusSkipped, nil)
+	opts.progressDone(key, 0)
+}
+
+// objectFailed records that the object identified by key failed with err.
+func (opts *runOptions) objectFailed(key string, err error) {
+	opts.Summary.ObjectFailed(key, err)
+	opts.Events.Object(key, 0, eventStatusFailed, err)
+}
+
+// progressDone reports the progress of a run once the object identified by
+// key has been loaded or skipped.
+func (opts *runOptions) progressDone(key string, size int) {
+	opts.Progress.Done(size)
+	if opts.ProgressFunc != nil {
+		opts.ProgressFunc(opts.Progress.event(progressObjectDone, key, size))
+	}
+}
+
+// s3ClientOptions are the options used to configure the S3 client, in
+// addition to the default AWS configuration.
+type s3ClientOptions struct {
+	// PathStyle addresses buckets with path-style URLs instead of virtual
+	// hosted-style URLs. This is required for bucket names containing dots,
+	// which do not match the wildcard certificates used for HTTPS.
+	PathStyle bool
+	// UseARNRegion sends requests for access point ARNs to the region in the
+	// ARN instead of the configured region.
+	UseARNRegion bool
+}
+
+func (o s3ClientOptions) apply(so *s3.Options) {
+	if o.PathStyle {
+		so.UsePathStyle = true
+	}
+	if o.UseARNRegion {
+		so.UseARNRegion = true
+	}
+}
+
+// stringList is a flag.Value collecting the values of repeated uses of the
+// same flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// typeSelected reports whether the object identified by key is of one of the
+// entity types in opts.Types. Keys that do not encode an entity type are only
+// selected if opts.Types is nil.
+func (opts *runOptions) typeSelected(key string) bool {
+	if opts.Types == nil {
+		return true
+	}
+	k, err := parseObjectKey(key)
+	return err == nil && opts.Types[k.Type]
+}
+
+// excluded reports whether the object identified by key is excluded by
+// opts.ExcludePrefixes. Prefixes are matched against the key relative to
+// domain's database prefix, e.g. "d/<suffix>/" for all chunks of a dataset.
+func (opts *runOptions) excluded(domain *hsdsDomain, key string) bool {
+	if len(opts.ExcludePrefixes) == 0 {
+		return false
+	}
+	rel := strings.TrimPrefix(key, domain.DatabasePrefix()+"/")
+	for _, prefix := range opts.ExcludePrefixes {
+		if strings.HasPrefix(rel, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// envPrefix is the prefix of the environment variables that provide defaults
+// for flags.
+const envPrefix = "HSS3DUMP_"
+
+// envBucket is the environment variable that provides the BUCKET argument.
+const envBucket = envPrefix + "BUCKET"
+
+// envAliases maps the names of flags whose names are too short to be
+// recognizable to the names used for their environment variables.
+var envAliases = map[string]string{
+	"b": "BEFORE",
+	"l": "LIST",
+	"o": "OUTPUT",
+	"r": "ROOT",
+}
+
+// envVar returns the name of the environment variable that provides the
+// default for the flag with the given name, e.g. HSS3DUMP_VERSION_CACHE for
+// -version-cache.
+func envVar(name string) string {
+	if alias, ok := envAliases[name]; ok {
+		return envPrefix + alias
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvDefaults sets each flag in fs that has not been set on the command
+// line to the value of its environment variable, as returned by lookup, if
+// that is set and not empty. Flags set on the command line always take
+// precedence. It must be called after fs has been parsed.
+func applyEnvDefaults(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := envVar(f.Name)
+		value, ok := lookup(name)
+		if !ok || value == "" {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("invalid value %q for environment variable %s: %v", value, name, e)
+		}
+	})
+	return err
+}
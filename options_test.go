@@ -0,0 +1,75 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestS3ClientOptions_PathStyle(t *testing.T) {
+	for _, pathStyle := range []bool{false, true} {
+		so := s3.Options{}
+		s3ClientOptions{PathStyle: pathStyle}.apply(&so)
+		if so.UsePathStyle != pathStyle {
+			t.Errorf("apply() UsePathStyle = %v (want %v)", so.UsePathStyle, pathStyle)
+		}
+	}
+}
+
+func TestS3ClientOptions_UseARNRegion(t *testing.T) {
+	for _, useARNRegion := range []bool{false, true} {
+		so := s3.Options{}
+		s3ClientOptions{UseARNRegion: useARNRegion}.apply(&so)
+		if so.UseARNRegion != useARNRegion {
+			t.Errorf("apply() UseARNRegion = %v (want %v)", so.UseARNRegion, useARNRegion)
+		}
+	}
+}
+
+func TestApplyEnvDefaults(t *testing.T) {
+	fs := flag.NewFlagSet("hss3dump", flag.ContinueOnError)
+	root := fs.String("r", ".", "")
+	cache := fs.String("version-cache", "", "")
+	index := fs.Bool("index", false, "")
+	owner := fs.String("owner", "", "")
+	env := map[string]string{
+		"HSS3DUMP_ROOT":          "/var/db/env",
+		"HSS3DUMP_VERSION_CACHE": "versions.json",
+		"HSS3DUMP_INDEX":         "true",
+		"HSS3DUMP_OWNER":         "",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	err := fs.Parse([]string{"-r", "/var/db/flag"})
+	if err != nil {
+		t.Fatalf("Parse() err = %v (want nil)", err)
+	}
+	err = applyEnvDefaults(fs, lookup)
+	if err != nil {
+		t.Fatalf("applyEnvDefaults() err = %v (want nil)", err)
+	}
+	if *root != "/var/db/flag" {
+		t.Errorf("applyEnvDefaults() -r = %q (want flag value %q)", *root, "/var/db/flag")
+	}
+	if *cache != "versions.json" || !*index {
+		t.Errorf("applyEnvDefaults() -version-cache = %q, -index = %v (want environment values)", *cache, *index)
+	}
+	if *owner != "" {
+		t.Errorf("applyEnvDefaults() -owner = %q (want empty)", *owner)
+	}
+
+	env["HSS3DUMP_INDEX"] = "maybe"
+	fs = flag.NewFlagSet("hss3dump", flag.ContinueOnError)
+	fs.Bool("index", false, "")
+	if err := applyEnvDefaults(fs, lookup); err == nil {
+		t.Errorf("applyEnvDefaults() err = nil (want invalid value error)")
+	}
+}
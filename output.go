@@ -0,0 +1,69 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// gzipFile is a gzip-compressing writer whose Close method also closes the
+// underlying file.
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Writer.Close()
+	if err != nil {
+		g.f.Close()
+		return err
+	}
+	return g.f.Close()
+}
+
+// stdoutCloser writes to standard output and leaves it open on Close.
+type stdoutCloser struct {
+	io.Writer
+}
+
+func (stdoutCloser) Close() error {
+	return nil
+}
+
+// createOutput creates the output file at path. Output written to it is
+// gzip-compressed if path ends in ".gz". If path is empty, output goes to
+// standard output.
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return stdoutCloser{os.Stdout}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(path, ".gz") {
+		return &gzipFile{Writer: gzip.NewWriter(f), f: f}, nil
+	}
+	return f, nil
+}
+
+// syncWriter serializes the writes to the underlying writer, so the data of
+// each Write call appears contiguously when it is shared by several
+// goroutines.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
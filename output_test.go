@@ -0,0 +1,56 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateOutput(t *testing.T) {
+	dir := t.TempDir()
+	const want = "home/user/domain.h5\n"
+	for _, name := range []string{"listing.txt", "listing.txt.gz"} {
+		path := filepath.Join(dir, name)
+		w, err := createOutput(path)
+		if err != nil {
+			t.Fatalf("%s: createOutput() err = %v (want nil)", name, err)
+		}
+		fmt.Fprint(w, want)
+		err = w.Close()
+		if err != nil {
+			t.Fatalf("%s: Close() err = %v (want nil)", name, err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var b []byte
+		if filepath.Ext(name) == ".gz" {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("%s: gzip.NewReader() err = %v (want nil)", name, err)
+			}
+			b, err = ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("%s: invalid gzip content: %v", name, err)
+			}
+		} else {
+			b, err = ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(b) != want {
+			t.Errorf("%s: content = %q (want %q)", name, b, want)
+		}
+	}
+}
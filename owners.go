@@ -0,0 +1,67 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ownerStats aggregates the domains of a single owner.
+type ownerStats struct {
+	Owner string
+	// Domains is the number of domains owned by Owner.
+	Domains int
+	// Bytes is the total size of the selected object versions of all
+	// domains owned by Owner.
+	Bytes int64
+}
+
+// aggregateOwners resolves the object versions of all domains identified by
+// domains and aggregates them by the domains' owners. The result is sorted by
+// the owners' total bytes in descending order.
+func aggregateOwners(ctx context.Context, loader hsdsLoader, domains []string, opts *runOptions) ([]*ownerStats, error) {
+	byOwner := map[string]*ownerStats{}
+	for _, name := range domains {
+		plan, err := resolveDomain(ctx, loader, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := byOwner[plan.Domain.Owner]
+		if !ok {
+			s = &ownerStats{Owner: plan.Domain.Owner}
+			byOwner[s.Owner] = s
+		}
+		s.Domains++
+		for _, v := range plan.Objects {
+			s.Bytes += v.Size
+		}
+	}
+
+	stats := make([]*ownerStats, 0, len(byOwner))
+	for _, s := range byOwner {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Bytes != stats[j].Bytes {
+			return stats[i].Bytes > stats[j].Bytes
+		}
+		return stats[i].Owner < stats[j].Owner
+	})
+	return stats, nil
+}
+
+// writeOwners writes one line per owner in stats to w.
+func writeOwners(w io.Writer, stats []*ownerStats) {
+	for _, s := range stats {
+		owner := s.Owner
+		if owner == "" {
+			owner = "(no owner)"
+		}
+		fmt.Fprintf(w, "%s\t%d domains\t%d Bytes\n", owner, s.Domains, s.Bytes)
+	}
+}
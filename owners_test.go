@@ -0,0 +1,53 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAggregateOwners(t *testing.T) {
+	otherRootID := MustParseID("g-00000000-00000000-59a2-a82de4-afeaa7")
+	loader := newTestLoader()
+	loader.Domains = map[string]*hsdsDomain{
+		"home/alice/a.h5": {Root: &testRootID, Owner: "alice"},
+		"home/alice/b.h5": {Root: &otherRootID, Owner: "alice"},
+		"home/bob/big.h5": {Root: &testRootID, Owner: "bob"},
+		"home/bob/c.h5":   {Root: &testRootID, Owner: "bob"},
+	}
+	loader.Versions["db/00000000-00000000/.group.json"] = []*hsdsVersion{
+		{ID: "other-v1", LastModified: testTimestamp, Size: 100},
+	}
+
+	domains := []string{"home/alice/a.h5", "home/alice/b.h5", "home/bob/big.h5", "home/bob/c.h5"}
+	stats, err := aggregateOwners(context.Background(), loader, domains, &runOptions{NotAfter: testTimestamp.Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("aggregateOwners() err = %v (want nil)", err)
+	}
+
+	// Each domain with the test root has a 5 byte group and a 4 byte chunk.
+	want := []ownerStats{
+		{Owner: "alice", Domains: 2, Bytes: 109},
+		{Owner: "bob", Domains: 2, Bytes: 18},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("aggregateOwners() = %d owners (want %d)", len(stats), len(want))
+	}
+	for i := range want {
+		if *stats[i] != want[i] {
+			t.Errorf("aggregateOwners()[%d] = %+v (want %+v)", i, *stats[i], want[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	writeOwners(&buf, stats)
+	wantOut := "alice\t2 domains\t109 Bytes\nbob\t2 domains\t18 Bytes\n"
+	if buf.String() != wantOut {
+		t.Errorf("writeOwners() = %q (want %q)", buf.String(), wantOut)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// missingPermissionsError indicates that the caller lacks S3 permissions
+// required for a dump.
+type missingPermissionsError struct {
+	Bucket string
+	// Permissions are the names of the missing IAM permissions, e.g.
+	// "s3:GetObject".
+	Permissions []string
+}
+
+func (err *missingPermissionsError) Error() string {
+	return fmt.Sprintf("missing permissions on bucket %s: %s", err.Bucket, strings.Join(err.Permissions, ", "))
+}
+
+// checkPermissions probes whether the caller may list object versions and get
+// objects in the bucket of l and returns a *missingPermissionsError naming the
+// missing permissions otherwise. The object probed is the first one listed
+// below the db/ prefix or, if none could be listed, the domain file of the
+// domain identified by name. Probes failing for other reasons than denied
+// access are not reported, as they are going to fail the dump anyway.
+func checkPermissions(ctx context.Context, l *s3HSDSDomainLoader, name string) error {
+	var missing []string
+	key, err := domainKey(l.NameEncoding, name)
+	if err != nil {
+		return err
+	}
+
+	output, err := l.Client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+		Bucket:  aws.String(l.Bucket),
+		Prefix:  aws.String("db/"),
+		MaxKeys: 1,
+	})
+	if isAccessDenied(err) {
+		missing = append(missing, "s3:ListBucketVersions")
+	} else if err == nil && len(output.Versions) > 0 {
+		key = aws.ToString(output.Versions[0].Key)
+	}
+
+	obj, err := l.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String("bytes=0-0"),
+	})
+	if isAccessDenied(err) {
+		missing = append(missing, "s3:GetObject")
+	} else if err == nil {
+		obj.Body.Close()
+	}
+
+	if len(missing) > 0 {
+		return &missingPermissionsError{Bucket: l.Bucket, Permissions: missing}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type checkPermissionsTestcase struct {
+	name    string
+	client  *fakeS3Client
+	want    []string
+	wantKey string
+}
+
+func TestCheckPermissions(t *testing.T) {
+	objects := []*fakeS3Object{
+		{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+	}
+	testCases := []checkPermissionsTestcase{
+		{
+			name:    "permitted",
+			client:  &fakeS3Client{Objects: objects},
+			wantKey: testGroupKey,
+		},
+		{
+			name:    "list-denied",
+			client:  &fakeS3Client{Objects: objects, DenyListVersions: true},
+			want:    []string{"s3:ListBucketVersions"},
+			wantKey: "home/user/domain.h5/.domain.json",
+		},
+		{
+			name:    "all-denied",
+			client:  &fakeS3Client{Objects: objects, DenyListVersions: true, DenyGetObject: true},
+			want:    []string{"s3:ListBucketVersions", "s3:GetObject"},
+			wantKey: "home/user/domain.h5/.domain.json",
+		},
+	}
+
+	for _, tc := range testCases {
+		loader := &s3HSDSDomainLoader{Client: tc.client, Bucket: "bucket"}
+		err := checkPermissions(context.Background(), loader, "home/user/domain.h5")
+		var missing *missingPermissionsError
+		switch {
+		case tc.want == nil && err != nil:
+			t.Errorf("%s: checkPermissions() err = %v (want nil)", tc.name, err)
+		case tc.want != nil && !errors.As(err, &missing):
+			t.Errorf("%s: checkPermissions() err = %v (want *missingPermissionsError)", tc.name, err)
+		case tc.want != nil && !reflect.DeepEqual(missing.Permissions, tc.want):
+			t.Errorf("%s: checkPermissions() missing = %v (want %v)", tc.name, missing.Permissions, tc.want)
+		}
+		if n := len(tc.client.GetObjectInputs); n != 1 || aws.ToString(tc.client.GetObjectInputs[0].Key) != tc.wantKey {
+			t.Errorf("%s: checkPermissions() probed %d objects (want %s)", tc.name, n, tc.wantKey)
+		}
+	}
+
+	err := &missingPermissionsError{Bucket: "bucket", Permissions: []string{"s3:ListBucketVersions"}}
+	if want := "missing permissions on bucket bucket: s3:ListBucketVersions"; err.Error() != want {
+		t.Errorf("Error() = %q (want %q)", err.Error(), want)
+	}
+}
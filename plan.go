@@ -0,0 +1,647 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// domainPlan is the set of object versions selected for replicating a single
+// domain.
+type domainPlan struct {
+	Name    string                  `json:"name"`
+	Domain  *hsdsDomain             `json:"domain"`
+	Objects map[string]*hsdsVersion `json:"objects"`
+	// Deleted contains the keys of objects that had been deleted at the
+	// selected point in time, but whose last content version is restored.
+	Deleted map[string]bool `json:"deleted,omitempty"`
+	// History contains all content versions of the selected objects. It is
+	// only populated if all versions are replicated.
+	History map[string][]*hsdsVersion `json:"history,omitempty"`
+	// Current contains the keys of objects whose selected version is their
+	// current version. It is only populated if S3 Select is used.
+	Current map[string]bool `json:"current,omitempty"`
+}
+
+// replicationPlan describes which object versions of which domains are
+// replicated from a bucket. It allows separating the listing of versions from
+// downloading them.
+type replicationPlan struct {
+	Bucket  string        `json:"bucket"`
+	Domains []*domainPlan `json:"domains"`
+}
+
+// noExactVersionError indicates that an object has no version modified
+// exactly at the selected point in time.
+type noExactVersionError struct {
+	Key  string
+	Time time.Time
+}
+
+func (err *noExactVersionError) Error() string {
+	return fmt.Sprintf("%s: no version modified exactly at %s", err.Key, err.Time.Format(time.RFC3339Nano))
+}
+
+// domainModifiedError indicates that a domain has been modified while it was
+// being replicated.
+type domainModifiedError struct {
+	Name          string
+	Before, After float64
+}
+
+func (err *domainModifiedError) Error() string {
+	return fmt.Sprintf("domain %q was modified during the dump (last modified %s, now %s)",
+		err.Name, hsdsTime(err.Before).Format(time.RFC3339), hsdsTime(err.After).Format(time.RFC3339))
+}
+
+// hsdsTime converts the seconds since the epoch HSDS uses for timestamps to a
+// time.Time.
+func hsdsTime(t float64) time.Time {
+	sec := math.Floor(t)
+	return time.Unix(int64(sec), int64((t-sec)*1e9))
+}
+
+// roundHSDSTime rounds the HSDS timestamp t to whole microseconds, so that
+// timestamps differing only in their least significant bits are encoded
+// identically.
+func roundHSDSTime(t float64) float64 {
+	return math.Round(t*1e6) / 1e6
+}
+
+// snapshotTime returns the point in time at which the domain identified by
+// name is consistent: the last modification time of the version of its
+// domain file that is current after its objects have been listed. If loader
+// cannot list the versions of domain files, the lastModified time recorded in
+// domain is used instead. The zero time is returned if neither is available.
+func snapshotTime(ctx context.Context, loader hsdsDomainLoader, name string, domain *hsdsDomain) (time.Time, error) {
+	var fl hsdsDomainFileVersionLoader
+	ok := findLoader(loader, func(l interface{}) (ok bool) {
+		fl, ok = l.(hsdsDomainFileVersionLoader)
+		return ok
+	})
+	if ok {
+		_, versions, err := fl.LoadDomainFileVersions(ctx, name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(versions) > 0 && !versions[0].DeleteMarker {
+			return versions[0].LastModified, nil
+		}
+	}
+	if domain.LastModified == 0 {
+		return time.Time{}, nil
+	}
+	return hsdsTime(domain.LastModified), nil
+}
+
+// errRuntimeExceeded indicates that a run has been stopped because it has
+// reached the deadline set by runOptions.Deadline.
+var errRuntimeExceeded = errors.New("runtime budget exceeded")
+
+// deadlineError returns errRuntimeExceeded if err has occurred after ctx has
+// exceeded its deadline, and err otherwise.
+func deadlineError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errRuntimeExceeded
+	}
+	return err
+}
+
+// checkConsistency reloads the domain of plan from loader and returns a
+// domainModifiedError if its last modification time differs from the one of
+// the domain loaded when plan was resolved.
+func checkConsistency(ctx context.Context, loader hsdsDomainLoader, plan *domainPlan) error {
+	domain, err := loader.LoadDomain(ctx, plan.Name)
+	if err != nil {
+		return err
+	}
+	if domain.LastModified != plan.Domain.LastModified {
+		return &domainModifiedError{
+			Name:   plan.Name,
+			Before: plan.Domain.LastModified,
+			After:  domain.LastModified,
+		}
+	}
+	return nil
+}
+
+// foreignGroupError indicates that a group does not belong to a domain.
+type foreignGroupError struct {
+	Group  hsdsID
+	Prefix hsdsPrefix
+}
+
+func (err *foreignGroupError) Error() string {
+	return fmt.Sprintf("group %s does not belong to the domain with prefix %s", err.Group, err.Prefix)
+}
+
+// loadVersions loads the versions of domain's objects from loader. If
+// opts.Group is not nil, only the versions of objects below the group's
+// directory are loaded. Loaders implementing hsdsPrefixVersionLoader are
+// asked to list only that directory, all others list the whole domain.
+func loadVersions(ctx context.Context, loader hsdsDomainVersionLoader, domain *hsdsDomain, opts *runOptions) (map[string][]*hsdsVersion, error) {
+	if opts.Group == nil {
+		return loader.LoadDomainVersions(ctx, domain)
+	}
+	if domain.Root == nil || opts.Group.Prefix() != domain.Prefix() {
+		return nil, &foreignGroupError{Group: *opts.Group, Prefix: domain.Prefix()}
+	}
+
+	prefix := entityDir(*opts.Group, *domain.Root) + "/"
+	var pl hsdsPrefixVersionLoader
+	ok := findLoader(loader, func(l interface{}) (ok bool) {
+		pl, ok = l.(hsdsPrefixVersionLoader)
+		return ok
+	})
+	if ok {
+		return pl.LoadPrefixVersions(ctx, prefix)
+	}
+	ovs, err := loader.LoadDomainVersions(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string][]*hsdsVersion{}
+	for key, vv := range ovs {
+		if strings.HasPrefix(key, prefix) {
+			selected[key] = vv
+		}
+	}
+	return selected, nil
+}
+
+// resolveDomain loads the domain identified by name from loader and selects
+// the most recent version not after opts.notAfter(name, domain) of each of
+// its objects. If opts.Chunks is not nil, only the dataset chunks it matches
+// are selected. If opts.Types is not nil, only the objects of its entity types
+// are selected. Objects matching opts.ExcludePrefixes are never selected. If
+// opts.ValidatePrefix is true, domains with objects not embedding the
+// domain's prefix in their key are rejected.
+//
+// If no point in time is selected for the domain and opts.Consistent is true,
+// the most recent versions not after the domain's snapshotTime are selected.
+//
+// Stray objects in the directory of the domain's prefix whose keys are not
+// keys of domain objects are selected and stored verbatim, unless opts.Strict
+// is true. In that case, domains with stray objects are rejected.
+//
+// If opts.AllVersions is true, all content versions of the selected objects
+// are recorded in the plan's history as well.
+//
+// Objects that had been deleted at the selected point in time are skipped,
+// unless opts.IncludeDeleted is true. In that case, their last content version
+// before the deletion is selected.
+func resolveDomain(ctx context.Context, loader hsdsLoader, name string, opts *runOptions) (*domainPlan, error) {
+	domain, err := loader.LoadDomain(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// Folders have no objects, only their domain file is stored.
+	if domain.Root == nil {
+		return &domainPlan{Name: name, Domain: domain, Objects: map[string]*hsdsVersion{}, Deleted: map[string]bool{}}, nil
+	}
+	ovs, err := loadVersions(ctx, loader, domain, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(ovs) == 0 && opts.Group == nil {
+		warnEmptyDomain(name, domain)
+	}
+	var strays []string
+	for key := range ovs {
+		if isStrayKey(domain, key) {
+			debug("domain %q: %s is not an HSDS object key", name, key)
+			strays = append(strays, key)
+		}
+	}
+	if len(strays) > 0 && opts.Strict {
+		sort.Strings(strays)
+		return nil, fmt.Errorf("domain %q: %w", name, &strayObjectsError{Keys: strays})
+	}
+	if opts.ValidatePrefix {
+		keys := make([]string, 0, len(ovs))
+		for key := range ovs {
+			if !isStrayKey(domain, key) {
+				keys = append(keys, key)
+			}
+		}
+		err = checkPrefixes(domain.Prefix(), keys)
+		if err != nil {
+			return nil, fmt.Errorf("domain %q: %w", name, err)
+		}
+	}
+
+	plan := &domainPlan{
+		Name:    name,
+		Domain:  domain,
+		Objects: map[string]*hsdsVersion{},
+		Deleted: map[string]bool{},
+	}
+	notAfter := opts.notAfter(name, domain)
+	if notAfter.IsZero() && opts.Consistent {
+		notAfter, err = snapshotTime(ctx, loader, name, domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var cutoff time.Time
+	if opts.MinVersionAge > 0 {
+		cutoff = opts.currentTime().Add(-opts.MinVersionAge)
+	}
+	for key, vv := range ovs {
+		if opts.excluded(domain, key) || !opts.typeSelected(key) {
+			continue
+		}
+		if opts.Chunks != nil && !opts.Chunks.Match(key) {
+			continue
+		}
+		current := vv[0]
+		if !cutoff.IsZero() {
+			vv = versionsNotAfter(vv, cutoff)
+			if len(vv) == 0 {
+				continue
+			}
+		}
+		var v *hsdsVersion
+		if opts.ExactTime && !notAfter.IsZero() {
+			v = versionAt(vv, notAfter)
+			if v == nil {
+				return nil, &noExactVersionError{Key: key, Time: notAfter}
+			}
+		} else {
+			v = selectVersion(vv, notAfter, opts.SelectionPolicy)
+		}
+		if !opts.ModifiedAfter.IsZero() && !v.LastModified.After(opts.ModifiedAfter) {
+			continue
+		}
+		if v.DeleteMarker {
+			if !opts.IncludeDeleted {
+				continue
+			}
+			v = contentVersionBefore(vv, v)
+			if v == nil {
+				continue
+			}
+			plan.Deleted[key] = true
+		}
+		plan.Objects[key] = v
+		if opts.UseS3Select && v == current {
+			if plan.Current == nil {
+				plan.Current = map[string]bool{}
+			}
+			plan.Current[key] = true
+		}
+		if opts.AllVersions {
+			if plan.History == nil {
+				plan.History = map[string][]*hsdsVersion{}
+			}
+			var newer *hsdsVersion
+			for _, hv := range vv {
+				if hv.DeleteMarker {
+					continue
+				}
+				duplicate := newer != nil && hv.ETag != "" && hv.ETag == newer.ETag
+				newer = hv
+				if opts.DedupeVersions && duplicate && hv != v {
+					continue
+				}
+				plan.History[key] = append(plan.History[key], hv)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// versionsNotAfter returns the versions in availableVersions that have not
+// been modified after t. It assumes that availableVersions is sorted by the
+// versions' last modification time in descending order.
+func versionsNotAfter(availableVersions []*hsdsVersion, t time.Time) []*hsdsVersion {
+	for i, v := range availableVersions {
+		if !v.LastModified.After(t) {
+			return availableVersions[i:]
+		}
+	}
+	return nil
+}
+
+// contentVersionBefore returns the most recent version in availableVersions
+// that is older than marker and is not a delete marker itself. It assumes
+// that availableVersions is sorted by the versions' last modification time in
+// descending order. If no such version exists, nil is returned.
+func contentVersionBefore(availableVersions []*hsdsVersion, marker *hsdsVersion) *hsdsVersion {
+	found := false
+	for _, v := range availableVersions {
+		if v == marker {
+			found = true
+			continue
+		}
+		if found && !v.DeleteMarker {
+			return v
+		}
+	}
+	return nil
+}
+
+// executeDomainPlan downloads the object versions selected in plan from
+// loader and stores them, along with the plan's domain, in storer. If the
+// plan has a history, all versions recorded in it are stored as well. Objects
+// are copied server-side if loader and storer are buckets in the same region.
+//
+// If opts.ValidateACLs is true, domains with malformed ACL entries are
+// rejected before anything is downloaded. If opts.HeadBeforeGet is true,
+// versions that no longer exist are skipped. If opts.BestEffort is true,
+// versions that fail to load because they are unavailable are skipped and
+// recorded as such in the manifest. If opts.DetectCompression is true,
+// compressed objects are decompressed before storing them.
+func executeDomainPlan(ctx context.Context, loader hsdsObjectLoader, storer hsdsStorer, plan *domainPlan, opts *runOptions) error {
+	if opts.ValidateACLs {
+		err := plan.Domain.ACLs.Validate()
+		if err != nil {
+			return fmt.Errorf("domain %q: %w", plan.Name, err)
+		}
+	}
+	opts.Events.SetPlan(plan)
+	opts.Progress.AddTotal(len(plan.Objects))
+	warnArchivedObjects(plan)
+
+	// Objects are copied server-side if possible, unless their content is
+	// needed to decompress them.
+	var copyObject func(ctx context.Context, name, version string) error
+	if !opts.DetectCompression {
+		copyObject = serverSideCopier(ctx, loader, storer)
+	}
+
+	objects := map[string][]byte{}
+	formats := map[string]string{}
+	for name, version := range plan.Objects {
+		// No further downloads are started once the run has been cancelled,
+		// e.g. because its deadline has been reached.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		opts.objectStarted(name)
+		if opts.HeadBeforeGet {
+			exists, err := objectVersionExists(ctx, loader, name, version)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				warn("skipping %s: version %s no longer exists", name, version.ID)
+				opts.objectSkipped(name)
+				continue
+			}
+		}
+		if copyObject != nil {
+			err := copyObject(ctx, name, version.ID)
+			if err != nil {
+				opts.objectFailed(name, err)
+				return err
+			}
+			err = opts.Breaker.Record(false)
+			if err != nil {
+				return err
+			}
+			opts.objectDone(name, int(version.Size))
+			if opts.CaptureTags {
+				captureTags(ctx, loader, storer, name, version, opts)
+			}
+			if opts.CaptureObjectACLs {
+				captureObjectACL(ctx, loader, storer, name, version, opts)
+			}
+			continue
+		}
+		var since time.Time
+		if opts.Conditional {
+			since = conditionalSince(ctx, storer, name, version)
+		}
+		start := time.Now()
+		data, err := loadObjectVersion(ctx, loader, name, version, since)
+		opts.warnSlowObject(name, start)
+		if errors.Is(err, errNotModified) {
+			opts.objectSkipped(name)
+			continue
+		} else if opts.BestEffort && errors.Is(err, errObjectUnavailable) {
+			warn("skipping %s: %v", name, err)
+			opts.objectSkipped(name)
+			if opts.Manifest != nil {
+				opts.Manifest.Add(name, &manifestEntry{Version: version.ID, StorageClass: version.StorageClass, Unavailable: true})
+			}
+			err = opts.Breaker.Record(true)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			opts.objectFailed(name, err)
+			return err
+		}
+		err = opts.Breaker.Record(false)
+		if err != nil {
+			return err
+		}
+		if opts.DetectCompression {
+			var format string
+			data, format = decompressDetected(data)
+			if format != "" {
+				formats[name] = format
+			}
+		}
+		objects[name] = data
+		// All objects of a domain are loaded before any of them is stored,
+		// so progress is reported as they are loaded.
+		opts.progressDone(name, len(data))
+	}
+
+	err := storeDomain(ctx, loader, storer, plan, opts)
+	if err != nil {
+		return err
+	}
+	for name, b := range objects {
+		err = storer.StoreObject(ctx, name, b)
+		if err != nil {
+			opts.objectFailed(name, err)
+			return err
+		}
+		opts.objectStored(name, len(b))
+		if opts.Conditional {
+			setStoredModTime(ctx, storer, name, plan.Objects[name].LastModified)
+		}
+		if opts.Manifest != nil {
+			version := plan.Objects[name]
+			opts.Manifest.Annotate(name, func(e *manifestEntry) {
+				e.Domain = plan.Name
+				e.Version = version.ID
+				if !version.LastModified.IsZero() {
+					lastModified := version.LastModified
+					e.LastModified = &lastModified
+				}
+				e.Deleted = plan.Deleted[name]
+				e.SourceEncoding = formats[name]
+				e.StorageClass = version.StorageClass
+			})
+		}
+		if opts.CaptureTags {
+			captureTags(ctx, loader, storer, name, plan.Objects[name], opts)
+		}
+		if opts.CaptureObjectACLs {
+			captureObjectACL(ctx, loader, storer, name, plan.Objects[name], opts)
+		}
+	}
+	if opts.PreserveEmptyGroups {
+		err = storeGroupDirectories(storer, plan.Domain, objects)
+		if err != nil {
+			return err
+		}
+	}
+	return storeVersionHistory(ctx, loader, storer, plan, opts)
+}
+
+// loadDomainFile loads the unmodified domain file of the domain identified by
+// name from loader, if loader supports it.
+func loadDomainFile(ctx context.Context, loader interface{}, name string) (string, []byte, error) {
+	var fl hsdsDomainFileLoader
+	ok := findLoader(loader, func(l interface{}) (ok bool) {
+		fl, ok = l.(hsdsDomainFileLoader)
+		return ok
+	})
+	if !ok {
+		return "", nil, errors.New("loader does not support loading domain files verbatim")
+	}
+	return fl.LoadDomainFile(ctx, name)
+}
+
+// storeDomain stores the domain file of plan in storer. If opts.Verbatim is
+// true, the domain file is copied byte for byte to its key, and no domain
+// files are created for the domain's parent folders.
+func storeDomain(ctx context.Context, loader hsdsObjectLoader, storer hsdsStorer, plan *domainPlan, opts *runOptions) error {
+	if !opts.Verbatim {
+		domain := plan.Domain
+		if opts.NormalizeTimestamps {
+			normalized := *domain
+			normalized.Created = roundHSDSTime(domain.Created)
+			normalized.LastModified = roundHSDSTime(domain.LastModified)
+			domain = &normalized
+		}
+		return storer.StoreDomain(ctx, plan.Name, domain)
+	}
+	key, b, err := loadDomainFile(ctx, loader, plan.Name)
+	if err != nil {
+		return err
+	}
+	return storer.StoreObject(ctx, key, b)
+}
+
+// captureTags loads the tags of the given version of the object identified by
+// name from loader, records them in the manifest and stores them in storer,
+// if loader and storer support tags. Failures are reported as warnings only,
+// as tags are not required to use the stored object.
+func captureTags(ctx context.Context, loader hsdsObjectLoader, storer hsdsStorer, name string, version *hsdsVersion, opts *runOptions) {
+	var tl hsdsObjectTagLoader
+	ok := findLoader(loader, func(l interface{}) (ok bool) {
+		tl, ok = l.(hsdsObjectTagLoader)
+		return ok
+	})
+	if !ok {
+		return
+	}
+	tags, err := tl.LoadObjectTags(ctx, name, version.ID)
+	if err != nil {
+		warn("cannot load tags of %s: %v", name, err)
+		return
+	}
+	if len(tags) == 0 {
+		return
+	}
+	if opts.Manifest != nil {
+		opts.Manifest.Annotate(name, func(e *manifestEntry) {
+			e.Tags = tags
+		})
+	}
+	ts, ok := storer.(hsdsObjectTagStorer)
+	if !ok {
+		return
+	}
+	err = ts.StoreObjectTags(ctx, name, tags)
+	if err != nil {
+		warn("cannot store tags of %s: %v", name, err)
+	}
+}
+
+// storedModTime returns the modification time of the object stored in storer
+// under name. The zero value is returned if the storer does not implement the
+// hsdsObjectModTimer interface or the object cannot be found.
+func storedModTime(ctx context.Context, storer hsdsStorer, name string) time.Time {
+	mt, ok := storer.(hsdsObjectModTimer)
+	if !ok {
+		return time.Time{}
+	}
+	t, err := mt.ObjectModTime(ctx, name)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// conditionalSince returns the time to load the given version of the object
+// name if modified since with opts.Conditional. Objects stored with it have
+// the last modification time of their version, see setStoredModTime. If the
+// stored copy is not of the given version, e.g. because an earlier version
+// has been selected or the source has been rolled back, a conditional
+// request would be answered with 304 Not Modified, as the stored version is
+// more recent. The zero value is returned then, so the object is loaded
+// unconditionally.
+func conditionalSince(ctx context.Context, storer hsdsStorer, name string, version *hsdsVersion) time.Time {
+	t := storedModTime(ctx, storer, name)
+	if version.LastModified.IsZero() || !t.Equal(version.LastModified) {
+		return time.Time{}
+	}
+	return t
+}
+
+// setStoredModTime sets the modification time of the object stored in storer
+// under name to the last modification time t of the version it has been
+// loaded from, if the storer implements the hsdsObjectModTimer interface.
+// Failures only cause the object to be loaded again by the next run, so they
+// are reported as warnings.
+func setStoredModTime(ctx context.Context, storer hsdsStorer, name string, t time.Time) {
+	mt, ok := storer.(hsdsObjectModTimer)
+	if !ok || t.IsZero() {
+		return
+	}
+	err := mt.SetObjectModTime(ctx, name, t)
+	if err != nil {
+		warn("cannot set modification time of %s: %v", name, err)
+	}
+}
+
+// writePlan writes plan to the file at path.
+func writePlan(path string, plan *replicationPlan) error {
+	b, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// readPlan reads the plan stored in the file at path.
+func readPlan(path string) (*replicationPlan, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &replicationPlan{}
+	err = json.Unmarshal(b, plan)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
@@ -0,0 +1,1218 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestMakePlan(t *testing.T) {
+	loader := newTestLoader()
+	plan, err := makePlan(loader, "bucket", []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp})
+	if err != nil {
+		t.Fatalf("makePlan() err = %v (want nil)", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "plan.json")
+	err = writePlan(path, plan)
+	if err != nil {
+		t.Fatalf("writePlan() err = %v (want nil)", err)
+	}
+	got, err := readPlan(path)
+	if err != nil {
+		t.Fatalf("readPlan() err = %v (want nil)", err)
+	}
+
+	if got.Bucket != "bucket" || len(got.Domains) != 1 {
+		t.Fatalf("readPlan() = %+v (want one domain of bucket %q)", got, "bucket")
+	}
+	dp := got.Domains[0]
+	if dp.Name != "home/user/domain.h5" || *dp.Domain.Root != testRootID {
+		t.Errorf("readPlan() domain = %q, root %v (want %q, root %v)", dp.Name, dp.Domain.Root, "home/user/domain.h5", testRootID)
+	}
+	want := map[string]string{
+		testGroupKey: "group-v1",
+		testChunkKey: "chunk-v1",
+	}
+	if len(dp.Objects) != len(want) {
+		t.Errorf("readPlan() objects = %d (want %d)", len(dp.Objects), len(want))
+	}
+	for key, id := range want {
+		if v, ok := dp.Objects[key]; !ok || v.ID != id {
+			t.Errorf("readPlan() version of %s = %+v (want %s)", key, v, id)
+		}
+	}
+	if loader.VersionCalls != 1 {
+		t.Errorf("makePlan() list calls = %d (want 1)", loader.VersionCalls)
+	}
+}
+
+func TestExecutePlan(t *testing.T) {
+	loader := newTestLoader()
+	plan := &replicationPlan{
+		Bucket: "bucket",
+		Domains: []*domainPlan{{
+			Name:   "home/user/domain.h5",
+			Domain: loader.Domains["home/user/domain.h5"],
+			Objects: map[string]*hsdsVersion{
+				testChunkKey: loader.Versions[testChunkKey][1],
+			},
+		}},
+	}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	err := executePlan(loader, storer, plan, &runOptions{})
+	if err != nil {
+		t.Fatalf("executePlan() err = %v (want nil)", err)
+	}
+	if loader.VersionCalls != 0 {
+		t.Errorf("executePlan() list calls = %d (want 0)", loader.VersionCalls)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(testChunkKey)))
+	if err != nil {
+		t.Fatalf("executePlan() did not store %s: %v", testChunkKey, err)
+	}
+	if string(got) != "data" {
+		t.Errorf("executePlan() stored %q (want %q)", got, "data")
+	}
+	_, err = ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(testGroupKey)))
+	if err == nil {
+		t.Errorf("executePlan() stored %s, which is not part of the plan", testGroupKey)
+	}
+}
+
+type executePlanConditionalTestcase struct {
+	name string
+	// mtime is the modification time of the local copy of the chunk.
+	mtime time.Time
+	// want is the chunk's content after executing the plan.
+	want string
+	// wantSince is the time sent with the request for the chunk.
+	wantSince time.Time
+}
+
+func TestExecutePlan_Conditional(t *testing.T) {
+	testCases := []executePlanConditionalTestcase{
+		{
+			name:      "selected version",
+			mtime:     testTimestamp,
+			want:      "local",
+			wantSince: testTimestamp,
+		},
+		{
+			// The local copy is of a more recent version, e.g. because an
+			// earlier state is restored or the source has been rolled back.
+			name:  "other version",
+			mtime: testTimestamp.Add(time.Hour),
+			want:  "data",
+		},
+	}
+
+	for _, tc := range testCases {
+		client := &fakeS3Client{
+			Objects: []*fakeS3Object{
+				{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+				{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			},
+		}
+		loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+		plan := &replicationPlan{
+			Bucket: "bucket",
+			Domains: []*domainPlan{{
+				Name:   "home/user/domain.h5",
+				Domain: &hsdsDomain{Root: &testRootID},
+				Objects: map[string]*hsdsVersion{
+					testGroupKey: {ID: "group-v1", LastModified: testTimestamp, Size: 5},
+					testChunkKey: {ID: "chunk-v1", LastModified: testTimestamp, Size: 4},
+				},
+			}},
+		}
+
+		root := t.TempDir()
+		chunkFile := filepath.Join(root, filepath.FromSlash(testChunkKey))
+		err := os.MkdirAll(filepath.Dir(chunkFile), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(chunkFile, []byte("local"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(chunkFile, tc.mtime, tc.mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		storer := &filesystemHSDSStorer{Root: root}
+		err = executePlan(loader, storer, plan, &runOptions{Conditional: true})
+		if err != nil {
+			t.Fatalf("%s: executePlan() err = %v (want nil)", tc.name, err)
+		}
+
+		got, err := ioutil.ReadFile(chunkFile)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%s: executePlan() chunk = %q, %v (want %q)", tc.name, got, err, tc.want)
+		}
+		for _, input := range client.GetObjectInputs {
+			if *input.Key != testChunkKey {
+				continue
+			}
+			since := aws.ToTime(input.IfModifiedSince)
+			if !since.Equal(tc.wantSince) {
+				t.Errorf("%s: GetObject(%s) IfModifiedSince = %v (want %v)", tc.name, testChunkKey, since, tc.wantSince)
+			}
+		}
+
+		// Stored objects are recognized by the time of their version.
+		groupFile := filepath.Join(root, filepath.FromSlash(testGroupKey))
+		got, err = ioutil.ReadFile(groupFile)
+		if err != nil || string(got) != "group" {
+			t.Errorf("%s: executePlan() group = %q, %v (want %q)", tc.name, got, err, "group")
+		}
+		fi, err := os.Stat(groupFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(testTimestamp) {
+			t.Errorf("%s: group modification time = %v (want %v)", tc.name, fi.ModTime(), testTimestamp)
+		}
+	}
+}
+
+func TestReplicate_IncludeDeleted(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), DeleteMarker: true},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	loader := &fakeDomainS3Loader{
+		s3HSDSDomainLoader: s3HSDSDomainLoader{Client: client, Bucket: "bucket"},
+		Domain:             &hsdsDomain{Root: &testRootID},
+	}
+	chunkFile := filepath.FromSlash(testChunkKey)
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root, Manifest: newManifest()}
+	err := replicate(loader, storer, []string{"domain.h5"}, &runOptions{Manifest: storer.Manifest})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, chunkFile)); err == nil {
+		t.Errorf("replicate() restored deleted object %s without -include-deleted", testChunkKey)
+	}
+
+	root = t.TempDir()
+	storer = &filesystemHSDSStorer{Root: root, Manifest: newManifest()}
+	err = replicate(loader, storer, []string{"domain.h5"}, &runOptions{IncludeDeleted: true, Manifest: storer.Manifest})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, chunkFile))
+	if err != nil || string(got) != "data" {
+		t.Errorf("replicate() restored %q, %v (want %q)", got, err, "data")
+	}
+	entry := storer.Manifest.Entry(testChunkKey)
+	if entry == nil || !entry.Deleted || entry.Version != "chunk-v1" {
+		t.Errorf("manifest entry = %+v (want deleted chunk-v1)", entry)
+	}
+	entry = storer.Manifest.Entry(testGroupKey)
+	if entry == nil || entry.Deleted {
+		t.Errorf("manifest entry = %+v (want group not to be deleted)", entry)
+	}
+}
+
+func TestReplicate_HardlinkLatest(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new")},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	loader := &fakeDomainS3Loader{
+		s3HSDSDomainLoader: s3HSDSDomainLoader{Client: client, Bucket: "bucket"},
+		Domain:             &hsdsDomain{Root: &testRootID},
+	}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root, Manifest: newManifest()}
+	opts := &runOptions{
+		NotAfter:       testTimestamp,
+		AllVersions:    true,
+		HardlinkLatest: true,
+		Manifest:       storer.Manifest,
+	}
+	err := replicate(loader, storer, []string{"domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	for _, id := range []string{"chunk-v1", "chunk-v2"} {
+		name := filepath.Join(root, filepath.FromSlash(versionPath(testChunkKey, id)))
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("replicate() did not store version %s: %v", id, err)
+		}
+	}
+	latest := path.Join(versionsDir, testChunkKey, latestVersionName)
+	got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(latest)))
+	if err != nil || string(got) != "data" {
+		t.Errorf("replicate() linked %q, %v (want %q)", got, err, "data")
+	}
+	entry := storer.Manifest.Entry(latest)
+	want := versionPath(testChunkKey, "chunk-v1")
+	if entry == nil || entry.LinkTarget != want || entry.Version != "chunk-v1" {
+		t.Errorf("manifest entry = %+v (want link to %s)", entry, want)
+	}
+}
+
+func TestExecutePlan_HeadBeforeGet(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	// The chunk version has expired between listing and downloading.
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	plan := &replicationPlan{
+		Bucket: "bucket",
+		Domains: []*domainPlan{{
+			Name:   "home/user/domain.h5",
+			Domain: &hsdsDomain{Root: &testRootID},
+			Objects: map[string]*hsdsVersion{
+				testGroupKey: {ID: "group-v1", LastModified: testTimestamp, Size: 5},
+				testChunkKey: {ID: "chunk-v1", LastModified: testTimestamp, Size: 4},
+			},
+		}},
+	}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	err := executePlan(loader, storer, plan, &runOptions{HeadBeforeGet: true})
+	if err != nil {
+		t.Fatalf("executePlan() err = %v (want nil)", err)
+	}
+	if client.HeadCalls != 2 {
+		t.Errorf("executePlan() head calls = %d (want 2)", client.HeadCalls)
+	}
+	if len(client.GetObjectInputs) != 1 {
+		t.Errorf("executePlan() get calls = %d (want 1)", len(client.GetObjectInputs))
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(testGroupKey))); err != nil {
+		t.Errorf("executePlan() did not store %s: %v", testGroupKey, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(testChunkKey))); err == nil {
+		t.Errorf("executePlan() stored expired object %s", testChunkKey)
+	}
+	if !strings.Contains(warnings.String(), testChunkKey) {
+		t.Errorf("executePlan() warnings = %q (want warning about %s)", warnings.String(), testChunkKey)
+	}
+}
+
+func TestExecutePlan_BestEffort(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	// The selected chunk version has expired between listing and
+	// downloading, only a newer version is left.
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new")},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	plan := &replicationPlan{
+		Bucket: "bucket",
+		Domains: []*domainPlan{{
+			Name:   "home/user/domain.h5",
+			Domain: &hsdsDomain{Root: &testRootID},
+			Objects: map[string]*hsdsVersion{
+				testGroupKey: {ID: "group-v1", LastModified: testTimestamp, Size: 5},
+				testChunkKey: {ID: "chunk-v1", LastModified: testTimestamp, Size: 4},
+			},
+		}},
+	}
+
+	storer := &filesystemHSDSStorer{Root: t.TempDir()}
+	err := executePlan(loader, storer, plan, &runOptions{})
+	if !errors.Is(err, errObjectUnavailable) {
+		t.Errorf("executePlan() err = %v (want %v)", err, errObjectUnavailable)
+	}
+
+	root := t.TempDir()
+	storer = &filesystemHSDSStorer{Root: root, Manifest: newManifest()}
+	err = executePlan(loader, storer, plan, &runOptions{BestEffort: true, Manifest: storer.Manifest})
+	if err != nil {
+		t.Fatalf("executePlan() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(testGroupKey))); err != nil {
+		t.Errorf("executePlan() did not store %s: %v", testGroupKey, err)
+	}
+	entry := storer.Manifest.Entry(testChunkKey)
+	if entry == nil || !entry.Unavailable || entry.Version != "chunk-v1" {
+		t.Errorf("manifest entry = %+v (want unavailable chunk-v1)", entry)
+	}
+	if !strings.Contains(warnings.String(), testChunkKey) {
+		t.Errorf("executePlan() warnings = %q (want warning about %s)", warnings.String(), testChunkKey)
+	}
+}
+
+type missingDomainTestcase struct {
+	bestEffort        bool
+	requireAllDomains bool
+	wantErr           bool
+}
+
+func TestReplicate_MissingDomain(t *testing.T) {
+	testCases := []missingDomainTestcase{
+		{wantErr: true},
+		{bestEffort: true},
+		{bestEffort: true, requireAllDomains: true, wantErr: true},
+		{requireAllDomains: true, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		root := t.TempDir()
+		storer := &filesystemHSDSStorer{Root: root}
+		opts := &runOptions{NotAfter: testTimestamp, BestEffort: tc.bestEffort, RequireAllDomains: tc.requireAllDomains}
+		err := replicate(newTestLoader(), storer, []string{"home/user/missing.h5", "home/user/domain.h5"}, opts)
+		var notFound *domainNotFoundError
+		if tc.wantErr != errors.As(err, &notFound) {
+			t.Errorf("%+v: replicate() err = %v (want *domainNotFoundError %v)", tc, err, tc.wantErr)
+		}
+		_, err = os.Stat(filepath.Join(root, filepath.FromSlash(testChunkKey)))
+		if stored := err == nil; stored == tc.wantErr {
+			t.Errorf("%+v: replicate() stored the existing domain = %v (want %v)", tc, stored, !tc.wantErr)
+		}
+	}
+}
+
+func TestExecutePlan_CircuitBreaker(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	// All chunk versions have expired, only the group is left.
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	objects := map[string]*hsdsVersion{
+		testGroupKey: {ID: "group-v1", LastModified: testTimestamp, Size: 5},
+	}
+	for i := 0; i < 10; i++ {
+		key := path.Join(path.Dir(testChunkKey), strconv.Itoa(i))
+		objects[key] = &hsdsVersion{ID: "chunk-v1", LastModified: testTimestamp, Size: 4}
+	}
+	plan := &replicationPlan{
+		Bucket: "bucket",
+		Domains: []*domainPlan{{
+			Name:    "home/user/domain.h5",
+			Domain:  &hsdsDomain{Root: &testRootID},
+			Objects: objects,
+		}},
+	}
+
+	storer := &filesystemHSDSStorer{Root: t.TempDir()}
+	opts := &runOptions{BestEffort: true, Breaker: &circuitBreaker{Window: 4, Threshold: 0.5}}
+	err := executePlan(loader, storer, plan, opts)
+	if !errors.Is(err, errTooManyFailures) {
+		t.Fatalf("executePlan() err = %v (want %v)", err, errTooManyFailures)
+	}
+	if n := len(client.GetObjectInputs); n > 4 {
+		t.Errorf("executePlan() made %d downloads (want at most 4)", n)
+	}
+}
+
+func TestReplicate_ExcludePrefixes(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	loader := &fakeDomainS3Loader{
+		s3HSDSDomainLoader: s3HSDSDomainLoader{Client: client, Bucket: "bucket"},
+		Domain:             &hsdsDomain{Root: &testRootID},
+	}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	opts := &runOptions{ExcludePrefixes: []string{"g/", "d/693e-302825-f8c087/"}}
+	err := replicate(loader, storer, []string{"domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	for _, input := range client.GetObjectInputs {
+		if key := aws.ToString(input.Key); key == testChunkKey {
+			t.Errorf("replicate() downloaded excluded object %s", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(testGroupKey))); err != nil {
+		t.Errorf("replicate() did not store %s: %v", testGroupKey, err)
+	}
+}
+
+func TestReplicate_Types(t *testing.T) {
+	datasetKey := "db/d12a20a5-6c27622f/d/693e-302825-f8c087/.dataset.json"
+	typeKey := "db/d12a20a5-6c27622f/t/693e-302825-f8c088/.datatype.json"
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+			{Key: datasetKey, VersionID: "dataset-v1", LastModified: testTimestamp, Data: []byte("dataset")},
+			{Key: typeKey, VersionID: "type-v1", LastModified: testTimestamp, Data: []byte("type")},
+		},
+	}
+	loader := &fakeDomainS3Loader{
+		s3HSDSDomainLoader: s3HSDSDomainLoader{Client: client, Bucket: "bucket"},
+		Domain:             &hsdsDomain{Root: &testRootID},
+	}
+	types, err := parseEntityTypes("g,t")
+	if err != nil {
+		t.Fatalf("parseEntityTypes() err = %v (want nil)", err)
+	}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	err = replicate(loader, storer, []string{"domain.h5"}, &runOptions{Types: types})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	for _, key := range []string{testGroupKey, typeKey, testChunkKey, datasetKey} {
+		_, err := os.Stat(filepath.Join(root, filepath.FromSlash(key)))
+		stored := err == nil
+		if want := key == testGroupKey || key == typeKey; stored != want {
+			t.Errorf("replicate() stored %s = %v (want %v)", key, stored, want)
+		}
+	}
+}
+
+func TestReplicate_ProgressFunc(t *testing.T) {
+	var events []progressEvent
+	opts := &runOptions{
+		NotAfter: testTimestamp,
+		Progress: newProgress(),
+		ProgressFunc: func(e progressEvent) {
+			events = append(events, e)
+		},
+	}
+	err := replicate(newTestLoader(), &filesystemHSDSStorer{Root: t.TempDir()}, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	started := map[string]bool{}
+	var last progressEvent
+	for _, e := range events {
+		switch e.Kind {
+		case progressObjectStarted:
+			started[e.Key] = true
+		case progressObjectDone:
+			if !started[e.Key] {
+				t.Errorf("progress event %+v without start event", e)
+			}
+			if e.Done <= last.Done || e.DoneBytes < last.DoneBytes {
+				t.Errorf("progress totals decreased from %+v to %+v", last, e)
+			}
+			last = e
+		}
+	}
+	if len(events) != 4 {
+		t.Errorf("replicate() reported %d events (want 4)", len(events))
+	}
+	if last.Done != 2 || last.Total != 2 || last.DoneBytes != 9 {
+		t.Errorf("last progress event = %+v (want 2/2 objects, 9 bytes)", last)
+	}
+}
+
+// snapshotStorer is an hsdsStorer recording a progress snapshot before each
+// object is stored.
+type snapshotStorer struct {
+	hsdsStorer
+	Progress  *progress
+	Snapshots []string
+}
+
+func (s *snapshotStorer) StoreObject(ctx context.Context, name string, data []byte) error {
+	s.Snapshots = append(s.Snapshots, s.Progress.Snapshot())
+	return s.hsdsStorer.StoreObject(ctx, name, data)
+}
+
+func TestReplicate_ProgressBeforeStore(t *testing.T) {
+	opts := &runOptions{NotAfter: testTimestamp, Progress: newProgress()}
+	storer := &snapshotStorer{hsdsStorer: &filesystemHSDSStorer{Root: t.TempDir()}, Progress: opts.Progress}
+	err := replicate(newTestLoader(), storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if len(storer.Snapshots) == 0 {
+		t.Fatalf("replicate() stored no objects")
+	}
+	if want := "progress: 2/2 objects, 9 bytes"; !strings.HasPrefix(storer.Snapshots[0], want) {
+		t.Errorf("progress snapshot before storing = %q (want %q)", storer.Snapshots[0], want)
+	}
+}
+
+// slowLoader is an hsdsLoader delaying the download of the object with the
+// given key.
+type slowLoader struct {
+	*fakeHSDSLoader
+	Key   string
+	Delay time.Duration
+}
+
+func (l *slowLoader) LoadObject(ctx context.Context, name, version string) ([]byte, error) {
+	if name == l.Key {
+		time.Sleep(l.Delay)
+	}
+	return l.fakeHSDSLoader.LoadObject(ctx, name, version)
+}
+
+func TestReplicate_SlowObjectThreshold(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	loader := &slowLoader{fakeHSDSLoader: newTestLoader(), Key: testChunkKey, Delay: 50 * time.Millisecond}
+	opts := &runOptions{NotAfter: testTimestamp, SlowObjectThreshold: 20 * time.Millisecond}
+	err := replicate(loader, &filesystemHSDSStorer{Root: t.TempDir()}, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if !strings.Contains(warnings.String(), "slow object "+testChunkKey) {
+		t.Errorf("replicate() warnings = %q (want warning about %s)", warnings.String(), testChunkKey)
+	}
+	if strings.Contains(warnings.String(), testGroupKey) {
+		t.Errorf("replicate() warnings = %q (want no warning about %s)", warnings.String(), testGroupKey)
+	}
+}
+
+func TestMakePlan_ValidatePrefix(t *testing.T) {
+	loader := newTestLoader()
+	opts := &runOptions{ValidatePrefix: true}
+	_, err := makePlan(loader, "bucket", []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("makePlan() err = %v (want nil)", err)
+	}
+
+	// A listing of the domain's prefix also returns keys of another prefix
+	// that starts with it.
+	foreignKey := "db/d12a20a5-6c27622f-old/.group.json"
+	loader.Versions[foreignKey] = loader.Versions[testGroupKey]
+	_, err = makePlan(loader, "bucket", []string{"home/user/domain.h5"}, opts)
+	var pme *prefixMismatchError
+	if !errors.As(err, &pme) || len(pme.Keys) != 1 || pme.Keys[0] != foreignKey {
+		t.Errorf("makePlan() err = %v (want prefix mismatch for %s)", err, foreignKey)
+	}
+}
+
+func TestReplicate_StrayObject(t *testing.T) {
+	var debugMessages bytes.Buffer
+	debugOutput = &debugMessages
+	defer func() { debugOutput = ioutil.Discard }()
+
+	strayKey := "db/d12a20a5-6c27622f/.DS_Store"
+	loader := newTestLoader()
+	loader.Versions[strayKey] = []*hsdsVersion{{ID: "stray-v1", LastModified: testTimestamp, Size: 5}}
+	loader.Objects["stray-v1"] = []byte("stray")
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, &runOptions{ValidatePrefix: true})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(strayKey)))
+	if err != nil || string(got) != "stray" {
+		t.Errorf("replicate() stored %q, %v (want %q)", got, err, "stray")
+	}
+	if !strings.Contains(debugMessages.String(), strayKey) {
+		t.Errorf("replicate() debug messages = %q (want mention of %s)", debugMessages.String(), strayKey)
+	}
+
+	err = replicate(loader, storer, []string{"home/user/domain.h5"}, &runOptions{Strict: true})
+	var soe *strayObjectsError
+	if !errors.As(err, &soe) || len(soe.Keys) != 1 || soe.Keys[0] != strayKey {
+		t.Errorf("replicate() err = %v (want stray object %s)", err, strayKey)
+	}
+}
+
+func TestReplicate_Verbatim(t *testing.T) {
+	domainFile, err := domainKey(nameEncodingPath, "home/user/domain.h5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := []*fakeS3Object{
+		{Key: domainFile, VersionID: "domain-v1", LastModified: testTimestamp, Data: []byte(`{"root":  "g-d12a20a5-6c27622f-59a2-a82de4-afeaa7"}`)},
+		{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+		{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+	}
+	loader := &fakeDomainS3Loader{
+		s3HSDSDomainLoader: s3HSDSDomainLoader{Client: &fakeS3Client{Objects: objects}, Bucket: "bucket"},
+		Domain:             &hsdsDomain{Root: &testRootID},
+	}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	err = replicate(loader, storer, []string{"home/user/domain.h5"}, &runOptions{Verbatim: true})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	want := map[string]string{}
+	for _, o := range objects {
+		want[o.Key] = string(o.Data)
+	}
+	got := map[string]string{}
+	err = filepath.Walk(root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(name)
+		got[filepath.ToSlash(rel)] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("replicate() stored %d files (want %d): %v", len(got), len(want), got)
+	}
+	for key, data := range want {
+		if got[key] != data {
+			t.Errorf("replicate() stored %q at %s (want %q)", got[key], key, data)
+		}
+	}
+}
+
+func TestResolveDomain_DomainOffset(t *testing.T) {
+	loader := newTestLoader()
+	loader.Domains = map[string]*hsdsDomain{
+		"home/user/early.h5": {Root: &testRootID, LastModified: float64(testTimestamp.Add(90 * time.Minute).Unix())},
+		"home/user/late.h5":  {Root: &testRootID, LastModified: float64(testTimestamp.Add(3 * time.Hour).Unix())},
+	}
+	offset := time.Hour
+	opts := &runOptions{DomainOffset: &offset}
+
+	want := map[string]string{
+		"home/user/early.h5": "chunk-v1",
+		"home/user/late.h5":  "chunk-v2",
+	}
+	for name, id := range want {
+		plan, err := resolveDomain(context.Background(), loader, name, opts)
+		if err != nil {
+			t.Fatalf("resolveDomain(%s) err = %v (want nil)", name, err)
+		}
+		if v := plan.Objects[testChunkKey]; v == nil || v.ID != id {
+			t.Errorf("resolveDomain(%s) selected %+v (want %s)", name, v, id)
+		}
+	}
+}
+
+func TestResolveDomain_Consistent(t *testing.T) {
+	domainFile, err := domainKey(nameEncodingPath, "domain.h5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: domainFile, VersionID: "domain-v1", LastModified: testTimestamp},
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new data")},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp.Add(-time.Hour), Data: []byte("data")},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp.Add(-time.Hour), Data: []byte("group")},
+		},
+	}
+	loader := &fakeDomainS3Loader{
+		s3HSDSDomainLoader: s3HSDSDomainLoader{Client: client, Bucket: "bucket"},
+		Domain:             &hsdsDomain{Root: &testRootID},
+	}
+
+	plan, err := resolveDomain(context.Background(), loader, "domain.h5", &runOptions{})
+	if err != nil {
+		t.Fatalf("resolveDomain() err = %v (want nil)", err)
+	}
+	if v := plan.Objects[testChunkKey]; v == nil || v.ID != "chunk-v2" {
+		t.Errorf("resolveDomain() selected %+v (want chunk-v2)", v)
+	}
+
+	// The chunk has been modified after the current version of the domain
+	// file.
+	plan, err = resolveDomain(context.Background(), loader, "domain.h5", &runOptions{Consistent: true})
+	if err != nil {
+		t.Fatalf("resolveDomain() err = %v (want nil)", err)
+	}
+	if v := plan.Objects[testChunkKey]; v == nil || v.ID != "chunk-v1" {
+		t.Errorf("resolveDomain() selected %+v (want chunk-v1)", v)
+	}
+	if v := plan.Objects[testGroupKey]; v == nil || v.ID != "group-v1" {
+		t.Errorf("resolveDomain() selected %+v (want group-v1)", v)
+	}
+
+	// Loaders that cannot list domain file versions fall back to the domain's
+	// lastModified time.
+	fake := newTestLoader()
+	fake.Domains["home/user/domain.h5"].LastModified = float64(testTimestamp.Unix())
+	plan, err = resolveDomain(context.Background(), fake, "home/user/domain.h5", &runOptions{Consistent: true})
+	if err != nil {
+		t.Fatalf("resolveDomain() err = %v (want nil)", err)
+	}
+	if v := plan.Objects[testChunkKey]; v == nil || v.ID != "chunk-v1" {
+		t.Errorf("resolveDomain() selected %+v (want chunk-v1)", v)
+	}
+}
+
+// blockingLoader is a fakeHSDSLoader whose downloads of the object
+// identified by Block only return once their context is cancelled.
+type blockingLoader struct {
+	*fakeHSDSLoader
+	Block string
+}
+
+func (l *blockingLoader) LoadObject(ctx context.Context, name, version string) ([]byte, error) {
+	if name == l.Block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return l.fakeHSDSLoader.LoadObject(ctx, name, version)
+}
+
+func TestReplicate_Deadline(t *testing.T) {
+	otherRootID := MustParseID("g-0a1b2c3d-4e5f6071-8293-a4b5c6-d7e8f9")
+	otherGroupKey := "db/0a1b2c3d-4e5f6071/.group.json"
+	fake := newTestLoader()
+	fake.Domains["home/user/other.h5"] = &hsdsDomain{Root: &otherRootID}
+	fake.Versions[otherGroupKey] = []*hsdsVersion{{ID: "other-v1", LastModified: testTimestamp, Size: 5}}
+	fake.Objects["other-v1"] = []byte("group")
+	loader := &blockingLoader{fakeHSDSLoader: fake, Block: otherGroupKey}
+
+	manifestFile := filepath.Join(t.TempDir(), "manifest.json")
+	storer := &filesystemHSDSStorer{Root: t.TempDir(), Manifest: newManifest(), ManifestFile: manifestFile}
+	opts := &runOptions{Manifest: storer.Manifest, Deadline: time.Now().Add(50 * time.Millisecond)}
+	err := replicate(loader, storer, []string{"home/user/domain.h5", "home/user/other.h5"}, opts)
+	if !errors.Is(err, errRuntimeExceeded) {
+		t.Fatalf("replicate() err = %v (want %v)", err, errRuntimeExceeded)
+	}
+
+	// The first domain has been stored before the deadline.
+	if storer.Manifest.Entry(testGroupKey) == nil {
+		t.Errorf("replicate() did not record %s in the manifest", testGroupKey)
+	}
+	if storer.Manifest.Entry(otherGroupKey) != nil {
+		t.Errorf("replicate() recorded %s in the manifest after the deadline", otherGroupKey)
+	}
+	if _, err := os.Stat(manifestFile); err != nil {
+		t.Errorf("replicate() did not write the manifest after the deadline: %v", err)
+	}
+
+	// No downloads are started after the deadline.
+	err = replicate(fake, storer, []string{"home/user/other.h5"}, &runOptions{Deadline: time.Now().Add(-time.Second)})
+	if !errors.Is(err, errRuntimeExceeded) {
+		t.Errorf("replicate() err = %v (want %v)", err, errRuntimeExceeded)
+	}
+	if _, err := os.Stat(filepath.Join(storer.Root, filepath.FromSlash(otherGroupKey))); err == nil {
+		t.Errorf("replicate() stored %s after the deadline", otherGroupKey)
+	}
+}
+
+// bufferingStorer is an hsdsStorer that keeps objects in memory until it is
+// finalized.
+type bufferingStorer struct {
+	*filesystemHSDSStorer
+
+	pending       map[string][]byte
+	finalizeCalls int
+}
+
+func (s *bufferingStorer) StoreObject(ctx context.Context, name string, data []byte) error {
+	if s.pending == nil {
+		s.pending = map[string][]byte{}
+	}
+	s.pending[name] = data
+	return nil
+}
+
+func (s *bufferingStorer) Finalize(ctx context.Context) error {
+	s.finalizeCalls++
+	for name, data := range s.pending {
+		err := s.filesystemHSDSStorer.StoreObject(ctx, name, data)
+		if err != nil {
+			return err
+		}
+	}
+	s.pending = nil
+	return s.filesystemHSDSStorer.Finalize(ctx)
+}
+
+func TestReplicate_Finalize(t *testing.T) {
+	root := t.TempDir()
+	manifestFile := filepath.Join(t.TempDir(), "manifest.json")
+	storer := &bufferingStorer{
+		filesystemHSDSStorer: &filesystemHSDSStorer{Root: root, Manifest: newManifest(), ManifestFile: manifestFile},
+	}
+	err := replicate(newTestLoader(), storer, []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if storer.finalizeCalls != 1 {
+		t.Errorf("replicate() called Finalize() %d times (want 1)", storer.finalizeCalls)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(testChunkKey)))
+	if err != nil || string(got) != "data" {
+		t.Errorf("Finalize() stored %q, %v (want %q)", got, err, "data")
+	}
+	manifest, err := readManifest(manifestFile)
+	if err != nil {
+		t.Fatalf("readManifest() err = %v (want nil)", err)
+	}
+	if manifest.Entry(testChunkKey) == nil {
+		t.Errorf("Finalize() did not record %s in the manifest", testChunkKey)
+	}
+
+	// Failed runs are not finalized.
+	storer.finalizeCalls = 0
+	err = replicate(newTestLoader(), storer, []string{"home/user/missing.h5"}, &runOptions{})
+	if err == nil {
+		t.Fatal("replicate() err = nil (want error)")
+	}
+	if storer.finalizeCalls != 0 {
+		t.Errorf("replicate() called Finalize() %d times after failing (want 0)", storer.finalizeCalls)
+	}
+}
+
+func TestReplicate_ResumeVerify(t *testing.T) {
+	root := t.TempDir()
+	manifestFile := filepath.Join(t.TempDir(), "manifest.json")
+	storer := &filesystemHSDSStorer{Root: root, Manifest: newManifest(), ManifestFile: manifestFile}
+	err := replicate(newTestLoader(), storer, []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	chunkFile := filepath.Join(root, filepath.FromSlash(testChunkKey))
+	err = ioutil.WriteFile(chunkFile, []byte("dat\x00"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume, err := readManifest(manifestFile)
+	if err != nil {
+		t.Fatalf("readManifest() err = %v (want nil)", err)
+	}
+
+	// Without verification, the corrupted file is skipped.
+	storer = &filesystemHSDSStorer{Root: root, OverwritePolicy: overwritePolicySkip}
+	err = replicate(newTestLoader(), storer, []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	got, _ := ioutil.ReadFile(chunkFile)
+	if string(got) != "dat\x00" {
+		t.Errorf("replicate() without -resume-verify stored %q (want the corrupted file)", got)
+	}
+
+	storer = &filesystemHSDSStorer{
+		Root:            root,
+		Manifest:        newManifest(),
+		ManifestFile:    manifestFile,
+		OverwritePolicy: overwritePolicySkip,
+		ResumeManifest:  resume,
+	}
+	err = replicate(newTestLoader(), storer, []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	got, _ = ioutil.ReadFile(chunkFile)
+	if string(got) != "data" {
+		t.Errorf("replicate() with -resume-verify stored %q (want %q)", got, "data")
+	}
+	// Verified files are skipped, but remain in the manifest.
+	manifest, err := readManifest(manifestFile)
+	if err != nil {
+		t.Fatalf("readManifest() err = %v (want nil)", err)
+	}
+	for _, key := range []string{testGroupKey, testChunkKey} {
+		if entry := manifest.Entry(key); entry == nil || entry.SHA256 != resume.Entry(key).SHA256 {
+			t.Errorf("manifest entry for %s = %+v (want %+v)", key, entry, resume.Entry(key))
+		}
+	}
+}
+
+func TestReplicate_NormalizeTimestamps(t *testing.T) {
+	var files [][]byte
+	for _, lastModified := range []float64{1665356400.1234567, 1665356400.1234568} {
+		loader := newTestLoader()
+		loader.Domains["home/user/domain.h5"].Created = 1665356400.0000002
+		loader.Domains["home/user/domain.h5"].LastModified = lastModified
+		root := t.TempDir()
+		err := replicate(loader, &filesystemHSDSStorer{Root: root}, []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp, NormalizeTimestamps: true})
+		if err != nil {
+			t.Fatalf("replicate() err = %v (want nil)", err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(root, "home", "user", "domain.h5", domainFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, b)
+	}
+
+	if !bytes.Equal(files[0], files[1]) {
+		t.Errorf("replicate() stored %s and %s (want identical domain files)", files[0], files[1])
+	}
+	for _, want := range []string{`"created":1665356400,`, `"lastModified":1665356400.123457`} {
+		if !bytes.Contains(files[0], []byte(want)) {
+			t.Errorf("replicate() stored %s (want it to contain %s)", files[0], want)
+		}
+	}
+}
+
+func TestReplicate_SkipUnchangedDomains(t *testing.T) {
+	loader := newTestLoader()
+	loader.Domains["home/user/domain.h5"].LastModified = 1665356400.5
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	opts := &runOptions{SkipUnchangedDomains: true}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	chunkFile := filepath.Join(root, filepath.FromSlash(testChunkKey))
+	if _, err := os.Stat(chunkFile); err != nil {
+		t.Fatalf("replicate() did not store a domain that has not been stored before: %v", err)
+	}
+
+	err = os.Remove(chunkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(chunkFile); err == nil {
+		t.Errorf("replicate() processed an unchanged domain")
+	}
+
+	loader.Domains["home/user/domain.h5"].LastModified = 1665356401.5
+	err = replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(chunkFile); err != nil {
+		t.Errorf("replicate() did not process a changed domain: %v", err)
+	}
+}
+
+func TestReplicate_ModifiedAfter(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new data")},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp.Add(-time.Hour), Data: []byte("data")},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp.Add(-time.Hour), Data: []byte("group")},
+		},
+	}
+	loader := &fakeDomainS3Loader{
+		s3HSDSDomainLoader: s3HSDSDomainLoader{Client: client, Bucket: "bucket"},
+		Domain:             &hsdsDomain{Root: &testRootID},
+	}
+
+	// The baseline dump is taken before the chunk has been modified.
+	storer := &filesystemHSDSStorer{Root: t.TempDir(), Manifest: newManifest()}
+	err := replicate(loader, storer, []string{"domain.h5"}, &runOptions{NotAfter: testTimestamp, Manifest: storer.Manifest})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	manifestFile := filepath.Join(t.TempDir(), "manifest.json")
+	err = storer.Manifest.WriteFile(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := readManifest(manifestFile)
+	if err != nil {
+		t.Fatalf("readManifest() err = %v (want nil)", err)
+	}
+	since := baseline.Newest()
+	if !since.Equal(testTimestamp.Add(-time.Hour)) {
+		t.Fatalf("Newest() = %v (want %v)", since, testTimestamp.Add(-time.Hour))
+	}
+
+	client.GetObjectInputs = nil
+	root := t.TempDir()
+	storer = &filesystemHSDSStorer{Root: root}
+	err = replicate(loader, storer, []string{"domain.h5"}, &runOptions{ModifiedAfter: since})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if len(client.GetObjectInputs) != 1 || aws.ToString(client.GetObjectInputs[0].VersionId) != "chunk-v2" {
+		t.Errorf("replicate() fetched %d objects (want only chunk-v2)", len(client.GetObjectInputs))
+	}
+	got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(testChunkKey)))
+	if err != nil || string(got) != "new data" {
+		t.Errorf("replicate() stored %q, %v (want %q)", got, err, "new data")
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(testGroupKey))); err == nil {
+		t.Errorf("replicate() stored unmodified object %s", testGroupKey)
+	}
+}
+
+func TestResolveDomain_ExactTime(t *testing.T) {
+	exact := testTimestamp.Add(-time.Hour)
+	plan, err := resolveDomain(context.Background(), newTestLoader(), "home/user/domain.h5", &runOptions{NotAfter: exact, ExactTime: true})
+	if err != nil {
+		t.Fatalf("resolveDomain() err = %v (want nil)", err)
+	}
+	if v := plan.Objects[testChunkKey]; v == nil || v.ID != "chunk-v1" {
+		t.Errorf("resolveDomain() selected %+v for %s (want chunk-v1)", v, testChunkKey)
+	}
+
+	_, err = resolveDomain(context.Background(), newTestLoader(), "home/user/domain.h5", &runOptions{NotAfter: testTimestamp, ExactTime: true})
+	var exactErr *noExactVersionError
+	if !errors.As(err, &exactErr) || !exactErr.Time.Equal(testTimestamp) {
+		t.Errorf("resolveDomain() err = %v (want noExactVersionError)", err)
+	}
+}
+
+type dedupeVersionsTestcase struct {
+	notAfter time.Time
+	want     []string
+}
+
+func TestResolveDomain_DedupeVersions(t *testing.T) {
+	loader := newTestLoader()
+	loader.Versions[testChunkKey] = []*hsdsVersion{
+		{ID: "chunk-v3", LastModified: testTimestamp.Add(2 * time.Hour), Size: 4, ETag: "b"},
+		{ID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Size: 4, ETag: "a"},
+		{ID: "chunk-v1", LastModified: testTimestamp.Add(-time.Hour), Size: 4, ETag: "a"},
+	}
+
+	testCases := []dedupeVersionsTestcase{
+		{want: []string{"chunk-v3", "chunk-v2"}},
+		// The selected version is kept, even though its content is the same
+		// as the newer one's.
+		{notAfter: testTimestamp, want: []string{"chunk-v3", "chunk-v2", "chunk-v1"}},
+	}
+	for _, tc := range testCases {
+		opts := &runOptions{NotAfter: tc.notAfter, AllVersions: true, DedupeVersions: true}
+		plan, err := resolveDomain(context.Background(), loader, "home/user/domain.h5", opts)
+		if err != nil {
+			t.Fatalf("resolveDomain() err = %v (want nil)", err)
+		}
+		var got []string
+		for _, v := range plan.History[testChunkKey] {
+			got = append(got, v.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%v: resolveDomain() history = %v (want %v)", tc.notAfter, got, tc.want)
+		}
+	}
+}
+
+func TestReplicate_Group(t *testing.T) {
+	subgroupKey := "db/d12a20a5-6c27622f/g/1234-567890-abcdef/.group.json"
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+			{Key: subgroupKey, VersionID: "subgroup-v1", LastModified: testTimestamp, Data: []byte("subgroup")},
+		},
+	}
+	loader := &fakeDomainS3Loader{
+		s3HSDSDomainLoader: s3HSDSDomainLoader{Client: client, Bucket: "bucket"},
+		Domain:             &hsdsDomain{Root: &testRootID},
+	}
+
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	group := MustParseID("g-d12a20a5-6c27622f-1234-567890-abcdef")
+	opts := &runOptions{Group: &group}
+	err := replicate(loader, storer, []string{"domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	if len(client.GetObjectInputs) != 1 || aws.ToString(client.GetObjectInputs[0].Key) != subgroupKey {
+		t.Errorf("replicate() downloaded %d objects (want only %s)", len(client.GetObjectInputs), subgroupKey)
+	}
+	for _, key := range []string{testChunkKey, testGroupKey} {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(key))); !os.IsNotExist(err) {
+			t.Errorf("replicate() stored %s outside the group: %v", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(subgroupKey))); err != nil {
+		t.Errorf("replicate() did not store %s: %v", subgroupKey, err)
+	}
+}
+
+func TestResolveDomain_Group(t *testing.T) {
+	loader := newTestLoader()
+	opts := &runOptions{Group: &testRootID}
+	plan, err := resolveDomain(context.Background(), loader, "home/user/domain.h5", opts)
+	if err != nil {
+		t.Fatalf("resolveDomain() err = %v (want nil)", err)
+	}
+	if len(plan.Objects) != 2 {
+		t.Errorf("resolveDomain() = %d objects (want all 2 objects below the root group)", len(plan.Objects))
+	}
+
+	foreign := MustParseID("g-00000000-00000000-1234-567890-abcdef")
+	opts.Group = &foreign
+	_, err = resolveDomain(context.Background(), loader, "home/user/domain.h5", opts)
+	var fg *foreignGroupError
+	if !errors.As(err, &fg) {
+		t.Errorf("resolveDomain() err = %v (want *foreignGroupError)", err)
+	}
+}
+
+func TestResolveDomain_MinVersionAge(t *testing.T) {
+	loader := newTestLoader()
+	// chunk-v2 has been modified 30 minutes ago, chunk-v1 two and a half
+	// hours ago.
+	opts := &runOptions{
+		MinVersionAge: time.Hour,
+		now:           func() time.Time { return testTimestamp.Add(90 * time.Minute) },
+	}
+	plan, err := resolveDomain(context.Background(), loader, "home/user/domain.h5", opts)
+	if err != nil {
+		t.Fatalf("resolveDomain() err = %v (want nil)", err)
+	}
+	if v := plan.Objects[testChunkKey]; v == nil || v.ID != "chunk-v1" {
+		t.Errorf("resolveDomain() selected %+v (want chunk-v1)", v)
+	}
+
+	// Objects without sufficiently old versions are not selected at all.
+	opts.MinVersionAge = 3 * time.Hour
+	plan, err = resolveDomain(context.Background(), loader, "home/user/domain.h5", opts)
+	if err != nil {
+		t.Fatalf("resolveDomain() err = %v (want nil)", err)
+	}
+	if len(plan.Objects) != 0 {
+		t.Errorf("resolveDomain() = %d objects (want 0)", len(plan.Objects))
+	}
+}
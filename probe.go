@@ -0,0 +1,82 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// latencyStats summarizes the latencies measured for a sample of requests.
+type latencyStats struct {
+	Samples int
+	Min     time.Duration
+	Median  time.Duration
+	P95     time.Duration
+}
+
+// newLatencyStats computes the statistics of the given latencies. The
+// percentiles are taken from the nearest rank.
+func newLatencyStats(latencies []time.Duration) latencyStats {
+	if len(latencies) == 0 {
+		return latencyStats{}
+	}
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(p int) time.Duration {
+		i := (p*len(sorted)+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return latencyStats{
+		Samples: len(sorted),
+		Min:     sorted[0],
+		Median:  rank(50),
+		P95:     rank(95),
+	}
+}
+
+// measureLatency resolves the object versions of all domains identified by
+// domains and times a HEAD request issued with checker for a random sample of
+// at most n objects per domain. The latency statistics of each domain are
+// reported to w. No object is downloaded.
+func measureLatency(ctx context.Context, w io.Writer, loader hsdsLoader, checker hsdsObjectChecker, domains []string, n int, rnd *rand.Rand, opts *runOptions) error {
+	for _, name := range domains {
+		plan, err := resolveDomain(ctx, loader, name, opts)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(plan.Objects))
+		for key := range plan.Objects {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		rnd.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		if len(keys) > n {
+			keys = keys[:n]
+		}
+
+		latencies := make([]time.Duration, 0, len(keys))
+		for _, key := range keys {
+			start := time.Now()
+			_, err := checker.ObjectExists(ctx, key, plan.Objects[key].ID)
+			if err != nil {
+				return err
+			}
+			latencies = append(latencies, time.Since(start))
+		}
+		s := newLatencyStats(latencies)
+		fmt.Fprintf(w, "%s: %d samples, min %v, median %v, p95 %v\n",
+			name, s.Samples, s.Min, s.Median, s.P95)
+	}
+	return nil
+}
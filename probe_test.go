@@ -0,0 +1,86 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+type latencyStatsTestcase struct {
+	name      string
+	latencies []time.Duration
+	want      latencyStats
+}
+
+func TestNewLatencyStats(t *testing.T) {
+	var hundred []time.Duration
+	for i := 100; i > 0; i-- {
+		hundred = append(hundred, time.Duration(i)*time.Millisecond)
+	}
+	testCases := []latencyStatsTestcase{
+		{
+			name: "empty",
+			want: latencyStats{},
+		},
+		{
+			name:      "single",
+			latencies: []time.Duration{time.Second},
+			want:      latencyStats{Samples: 1, Min: time.Second, Median: time.Second, P95: time.Second},
+		},
+		{
+			name:      "hundred",
+			latencies: hundred,
+			want:      latencyStats{Samples: 100, Min: time.Millisecond, Median: 50 * time.Millisecond, P95: 95 * time.Millisecond},
+		},
+	}
+
+	for _, tc := range testCases {
+		got := newLatencyStats(tc.latencies)
+		if got != tc.want {
+			t.Errorf("%s: newLatencyStats() = %+v (want %+v)", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMeasureLatency(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp},
+		},
+	}
+	checker := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	rnd := rand.New(rand.NewSource(1))
+
+	var out bytes.Buffer
+	err := measureLatency(context.Background(), &out, newTestLoader(), checker, []string{"home/user/domain.h5"}, 1, rnd, &runOptions{})
+	if err != nil {
+		t.Fatalf("measureLatency() err = %v (want nil)", err)
+	}
+	if client.HeadCalls != 1 {
+		t.Errorf("measureLatency() head calls = %d (want 1)", client.HeadCalls)
+	}
+	if len(client.GetObjectInputs) != 0 {
+		t.Errorf("measureLatency() get calls = %d (want 0)", len(client.GetObjectInputs))
+	}
+	want := "home/user/domain.h5: 1 samples, min "
+	if !strings.HasPrefix(out.String(), want) || !strings.Contains(out.String(), "p95") {
+		t.Errorf("measureLatency() output = %q (want stats starting with %q)", out.String(), want)
+	}
+
+	client.HeadCalls = 0
+	err = measureLatency(context.Background(), &out, newTestLoader(), checker, []string{"home/user/domain.h5"}, 10, rnd, &runOptions{})
+	if err != nil {
+		t.Fatalf("measureLatency() err = %v (want nil)", err)
+	}
+	if client.HeadCalls != 2 {
+		t.Errorf("measureLatency() head calls = %d (want all 2 objects)", client.HeadCalls)
+	}
+}
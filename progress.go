@@ -0,0 +1,133 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progress tracks the number of objects and bytes replicated during a run. It
+// is safe for concurrent use. All methods of a nil *progress are no-ops.
+type progress struct {
+	start time.Time
+	total int64
+	done  int64
+	bytes int64
+}
+
+func newProgress() *progress {
+	return &progress{start: time.Now()}
+}
+
+// AddTotal adds n objects to the number of objects that will be replicated.
+func (p *progress) AddTotal(n int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.total, int64(n))
+}
+
+// Done records that an object of the given size has been loaded, copied or
+// skipped.
+func (p *progress) Done(size int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.done, 1)
+	atomic.AddInt64(&p.bytes, int64(size))
+}
+
+// Snapshot returns a one-line summary of the current progress.
+func (p *progress) Snapshot() string {
+	return fmt.Sprintf("progress: %d/%d objects, %d bytes, %s elapsed",
+		atomic.LoadInt64(&p.done), atomic.LoadInt64(&p.total),
+		atomic.LoadInt64(&p.bytes), time.Since(p.start).Round(time.Second))
+}
+
+// progressEventKind distinguishes the events reported to a progress callback.
+type progressEventKind int
+
+const (
+	// progressObjectStarted is reported before an object is processed.
+	progressObjectStarted progressEventKind = iota
+	// progressObjectDone is reported once an object has been stored or
+	// skipped, or loaded if it is stored later.
+	progressObjectDone
+)
+
+// progressEvent describes the progress of a run after an object has been
+// started or completed.
+type progressEvent struct {
+	Kind progressEventKind
+	// Key is the key of the object the event refers to.
+	Key string
+	// Bytes is the number of bytes stored or loaded for the object. It is
+	// zero for started and skipped objects.
+	Bytes int64
+	// Done and Total are the number of completed and scheduled objects.
+	Done  int64
+	Total int64
+	// DoneBytes is the number of bytes stored or loaded so far.
+	DoneBytes int64
+}
+
+// event returns an event of the given kind for key, including the running
+// totals of p. The totals are zero if p is nil.
+func (p *progress) event(kind progressEventKind, key string, size int) progressEvent {
+	e := progressEvent{Kind: kind, Key: key, Bytes: int64(size)}
+	if p != nil {
+		e.Done = atomic.LoadInt64(&p.done)
+		e.Total = atomic.LoadInt64(&p.total)
+		e.DoneBytes = atomic.LoadInt64(&p.bytes)
+	}
+	return e
+}
+
+// objectProgressSteps is the number of equal parts of a single object after
+// each of which the progress of loading it is reported.
+const objectProgressSteps = 10
+
+// progressReader is an io.Reader reporting the number of bytes read from an
+// object of the given size each time another of objectProgressSteps parts of
+// it has been read.
+type progressReader struct {
+	r      io.Reader
+	size   int64
+	step   int64
+	read   int64
+	next   int64
+	report func(read int64)
+}
+
+func newProgressReader(r io.Reader, size int64, report func(read int64)) *progressReader {
+	step := size / objectProgressSteps
+	if step < 1 {
+		step = 1
+	}
+	return &progressReader{r: r, size: size, step: step, next: step, report: report}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if n > 0 && r.read >= r.next {
+		r.report(r.read)
+		for r.next <= r.read {
+			r.next += r.step
+		}
+	}
+	return n, err
+}
+
+// objectProgressPrinter returns a function writing the progress of loading
+// a single object to w.
+func objectProgressPrinter(w io.Writer) func(name string, read, size int64) {
+	return func(name string, read, size int64) {
+		fmt.Fprintf(w, "progress: %s: %d/%d bytes (%d%%)\n", name, read, size, read*100/size)
+	}
+}
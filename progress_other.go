@@ -0,0 +1,15 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "io"
+
+// notifyProgress is a no-op on platforms without SIGUSR1.
+func notifyProgress(p *progress, w io.Writer) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestProgressReader(t *testing.T) {
+	var reported []int64
+	body := bytes.Repeat([]byte("x"), 1000)
+	// Reading a byte at a time reports exactly at each tenth.
+	r := newProgressReader(iotest.OneByteReader(bytes.NewReader(body)), int64(len(body)), func(read int64) {
+		reported = append(reported, read)
+	})
+	data, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(data, body) {
+		t.Fatalf("ReadAll() = %d bytes, %v (want %d bytes, nil)", len(data), err, len(body))
+	}
+	want := []int64{100, 200, 300, 400, 500, 600, 700, 800, 900, 1000}
+	if !reflect.DeepEqual(reported, want) {
+		t.Errorf("progressReader reported %v (want %v)", reported, want)
+	}
+}
+
+func TestS3HSDSDomainLoader_ObjectProgress(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 1<<20)
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: large},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	var reported []int64
+	loader := &s3HSDSDomainLoader{
+		Client: client,
+		Bucket: "bucket",
+		ObjectProgress: func(name string, read, size int64) {
+			if name != testChunkKey || size != int64(len(large)) {
+				t.Errorf("ObjectProgress(%s, %d, %d) (want %s of size %d)", name, read, size, testChunkKey, len(large))
+			}
+			reported = append(reported, read)
+		},
+		ObjectProgressThreshold: 1 << 10,
+	}
+
+	data, err := loader.LoadObject(context.Background(), testChunkKey, "chunk-v1")
+	if err != nil || len(data) != len(large) {
+		t.Fatalf("LoadObject() = %d bytes, %v (want %d bytes, nil)", len(data), err, len(large))
+	}
+	if len(reported) == 0 || reported[len(reported)-1] != int64(len(large)) {
+		t.Errorf("ObjectProgress() reported %v (want progress up to %d bytes)", reported, len(large))
+	}
+	for i := 1; i < len(reported); i++ {
+		if reported[i] <= reported[i-1] {
+			t.Errorf("ObjectProgress() reported %v (want increasing progress)", reported)
+			break
+		}
+	}
+
+	// Objects below the threshold are loaded without progress reports.
+	reported = nil
+	_, err = loader.LoadObject(context.Background(), testGroupKey, "group-v1")
+	if err != nil {
+		t.Fatalf("LoadObject() err = %v (want nil)", err)
+	}
+	if len(reported) != 0 {
+		t.Errorf("ObjectProgress() reported %v for a small object (want nothing)", reported)
+	}
+}
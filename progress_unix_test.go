@@ -0,0 +1,48 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyProgress(t *testing.T) {
+	p := newProgress()
+	p.AddTotal(3)
+	p.Done(42)
+
+	r, w := io.Pipe()
+	stop := notifyProgress(p, w)
+	defer stop()
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		lines <- line
+	}()
+
+	err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-lines:
+		want := "progress: 1/3 objects, 42 bytes"
+		if !strings.HasPrefix(line, want) {
+			t.Errorf("snapshot = %q (want prefix %q)", line, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no progress snapshot received after SIGUSR1")
+	}
+}
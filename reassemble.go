@@ -0,0 +1,376 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hsdsDatasetType is the type of an HSDS dataset's elements.
+type hsdsDatasetType struct {
+	Class string `json:"class"`
+	Base  string `json:"base"`
+}
+
+// hsdsDatasetShape is the shape of an HSDS dataset.
+type hsdsDatasetShape struct {
+	Class string   `json:"class"`
+	Dims  []uint64 `json:"dims"`
+	// MaxDims is the maximum extent of the dataset. It is only set for
+	// resizable datasets.
+	MaxDims []uint64 `json:"maxdims,omitempty"`
+}
+
+// hsdsDatasetLayout describes how the elements of an HSDS dataset are split
+// into chunks.
+type hsdsDatasetLayout struct {
+	Class string   `json:"class"`
+	Dims  []uint64 `json:"dims"`
+}
+
+// hsdsDataset is the subset of an HSDS dataset's metadata that is required to
+// reassemble its elements from its chunks.
+type hsdsDataset struct {
+	ID                 hsdsID             `json:"-"`
+	Type               *hsdsDatasetType   `json:"type"`
+	Shape              *hsdsDatasetShape  `json:"shape"`
+	Layout             *hsdsDatasetLayout `json:"layout"`
+	CreationProperties struct {
+		Filters []json.RawMessage `json:"filters"`
+	} `json:"creationProperties"`
+}
+
+// unsupportedDatasetError indicates that a dataset cannot be reassembled.
+type unsupportedDatasetError struct {
+	ID     hsdsID
+	Reason string
+}
+
+func (err *unsupportedDatasetError) Error() string {
+	return fmt.Sprintf("reassemble: dataset %s: %s", err.ID, err.Reason)
+}
+
+// hdf5TypeForBase returns the HDF5 datatype of the predefined HDF5 type
+// named base, e.g. H5T_STD_I32LE or H5T_IEEE_F64BE.
+func hdf5TypeForBase(base string) (hdf5Datatype, bool) {
+	var t hdf5Datatype
+	var size string
+	switch {
+	case strings.HasPrefix(base, "H5T_IEEE_F"):
+		t.Float = true
+		size = strings.TrimPrefix(base, "H5T_IEEE_F")
+	case strings.HasPrefix(base, "H5T_STD_I"):
+		t.Signed = true
+		size = strings.TrimPrefix(base, "H5T_STD_I")
+	case strings.HasPrefix(base, "H5T_STD_U"):
+		size = strings.TrimPrefix(base, "H5T_STD_U")
+	default:
+		return t, false
+	}
+	switch {
+	case strings.HasSuffix(size, "BE"):
+		t.BigEndian = true
+	case !strings.HasSuffix(size, "LE"):
+		return t, false
+	}
+	bits, err := strconv.Atoi(size[:len(size)-2])
+	if err != nil {
+		return t, false
+	}
+	t.Size = bits / 8
+	switch {
+	case t.Float && (bits == 32 || bits == 64):
+	case !t.Float && (bits == 8 || bits == 16 || bits == 32 || bits == 64):
+	default:
+		return t, false
+	}
+	return t, true
+}
+
+// assembleDataset copies the elements of the chunks of ds, which are
+// identified by their chunk index, into a single buffer in row-major order.
+// Elements not covered by any chunk are zero.
+func assembleDataset(ds *hsdsDataset, t hdf5Datatype, chunks map[string][]byte) ([]byte, error) {
+	dims := ds.Shape.Dims
+	chunkDims := dims
+	if ds.Layout != nil && ds.Layout.Dims != nil {
+		chunkDims = ds.Layout.Dims
+	}
+	if len(chunkDims) != len(dims) {
+		return nil, &unsupportedDatasetError{ID: ds.ID, Reason: "chunk rank does not match dataset rank"}
+	}
+
+	size := uint64(t.Size)
+	n, chunkN := uint64(1), uint64(1)
+	for i := range dims {
+		n *= dims[i]
+		chunkN *= chunkDims[i]
+	}
+	data := make([]byte, n*size)
+	if n == 0 {
+		return data, nil
+	}
+	if len(dims) == 0 {
+		copy(data, chunks["0"])
+		return data, nil
+	}
+
+	last := len(dims) - 1
+	for s, chunk := range chunks {
+		index, err := parseChunkIndex(s)
+		if err != nil || len(index) != len(dims) {
+			return nil, &unsupportedDatasetError{ID: ds.ID, Reason: fmt.Sprintf("invalid chunk index %s", s)}
+		}
+		if uint64(len(chunk)) != chunkN*size {
+			return nil, &unsupportedDatasetError{ID: ds.ID, Reason: fmt.Sprintf("chunk %s has %d bytes (want %d)", s, len(chunk), chunkN*size)}
+		}
+		origin := make([]uint64, len(dims))
+		for i := range dims {
+			origin[i] = uint64(index[i]) * chunkDims[i]
+			if origin[i] >= dims[i] {
+				return nil, &unsupportedDatasetError{ID: ds.ID, Reason: fmt.Sprintf("chunk %s is out of bounds", s)}
+			}
+		}
+		// Elements are copied row by row, i.e. along the last dimension,
+		// leaving out the parts of edge chunks beyond the dataset's extent.
+		rowLen := chunkDims[last]
+		if origin[last]+rowLen > dims[last] {
+			rowLen = dims[last] - origin[last]
+		}
+		pos := make([]uint64, len(dims))
+		for {
+			var src, dst uint64
+			for i := range dims {
+				src = src*chunkDims[i] + pos[i]
+				dst = dst*dims[i] + origin[i] + pos[i]
+			}
+			copy(data[dst*size:(dst+rowLen)*size], chunk[src*size:])
+
+			i := last - 1
+			for ; i >= 0; i-- {
+				pos[i]++
+				if pos[i] < chunkDims[i] && origin[i]+pos[i] < dims[i] {
+					break
+				}
+				pos[i] = 0
+			}
+			if i < 0 {
+				break
+			}
+		}
+	}
+	return data, nil
+}
+
+// hdf5Assembler builds the HDF5 objects of a domain from the selected
+// versions of its objects.
+type hdf5Assembler struct {
+	ctx    context.Context
+	loader hsdsObjectLoader
+	// selector, if not nil, loads the fields of the current versions of
+	// metadata objects instead of loader.
+	selector hsdsObjectFieldSelector
+	plan     *domainPlan
+	root     hsdsID
+	groups   map[hsdsID]*hdf5Group
+	datasets map[hsdsID]*hdf5Dataset
+}
+
+// load decodes the selected version of the metadata object key into v, of
+// which only the given fields are used.
+func (a *hdf5Assembler) load(key string, v interface{}, fields ...string) error {
+	version, ok := a.plan.Objects[key]
+	if !ok {
+		return fmt.Errorf("reassemble: %s: %w", key, os.ErrNotExist)
+	}
+	var data []byte
+	var err error
+	if a.selector != nil && a.plan.Current[key] {
+		data, err = a.selector.SelectObjectFields(a.ctx, key, version.ID, fields)
+		if errors.Is(err, errCurrentVersionChanged) {
+			warn("reassemble: %v, loading the selected version", err)
+			data, err = loadObjectVersion(a.ctx, a.loader, key, version, time.Time{})
+		}
+	} else {
+		data, err = loadObjectVersion(a.ctx, a.loader, key, version, time.Time{})
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (a *hdf5Assembler) group(id hsdsID) (*hdf5Group, error) {
+	if g, ok := a.groups[id]; ok {
+		return g, nil
+	}
+	g := &hdf5Group{}
+	a.groups[id] = g
+
+	hg := &hsdsGroup{}
+	err := a.load(path.Join(entityDir(id, a.root), ".group.json"), hg, "links")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(hg.Links))
+	for name := range hg.Links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		link := hg.Links[name]
+		if link.Class != hsdsLinkClassHard || link.ID == nil {
+			warn("reassemble: skipping %s link %q", link.Class, name)
+			continue
+		}
+		l := &hdf5Link{Name: name}
+		switch link.ID.Type() {
+		case entityTypeGroup:
+			l.Group, err = a.group(*link.ID)
+		case entityTypeDataset:
+			l.Dataset, err = a.dataset(*link.ID)
+		default:
+			warn("reassemble: skipping link %q to committed type %s", name, link.ID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		g.Links = append(g.Links, l)
+	}
+	return g, nil
+}
+
+func (a *hdf5Assembler) dataset(id hsdsID) (*hdf5Dataset, error) {
+	if d, ok := a.datasets[id]; ok {
+		return d, nil
+	}
+	dir := entityDir(id, a.root)
+	ds := &hsdsDataset{}
+	err := a.load(path.Join(dir, ".dataset.json"), ds, "type", "shape", "layout", "creationProperties")
+	if err != nil {
+		return nil, err
+	}
+	ds.ID = id
+
+	if ds.Type == nil || ds.Shape == nil {
+		return nil, &unsupportedDatasetError{ID: id, Reason: "missing type or shape"}
+	}
+	t, ok := hdf5TypeForBase(ds.Type.Base)
+	if !ok {
+		return nil, &unsupportedDatasetError{ID: id, Reason: fmt.Sprintf("unsupported type %s %s", ds.Type.Class, ds.Type.Base)}
+	}
+	if ds.Shape.Class != "H5S_SIMPLE" && ds.Shape.Class != "H5S_SCALAR" {
+		return nil, &unsupportedDatasetError{ID: id, Reason: fmt.Sprintf("unsupported shape %s", ds.Shape.Class)}
+	}
+	if ds.Layout != nil && strings.HasSuffix(ds.Layout.Class, "_REF") {
+		return nil, &unsupportedDatasetError{ID: id, Reason: fmt.Sprintf("unsupported layout %s", ds.Layout.Class)}
+	}
+	if len(ds.CreationProperties.Filters) > 0 {
+		return nil, &unsupportedDatasetError{ID: id, Reason: "filtered datasets are not supported"}
+	}
+
+	chunks := map[string][]byte{}
+	for key, version := range a.plan.Objects {
+		k, err := parseObjectKey(key)
+		if err != nil || !k.IsChunk() || path.Dir(key) != dir {
+			continue
+		}
+		data, err := loadObjectVersion(a.ctx, a.loader, key, version, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		chunks[k.Chunk] = data
+	}
+	data, err := assembleDataset(ds, t, chunks)
+	if err != nil {
+		return nil, err
+	}
+	d := &hdf5Dataset{Type: t, Dims: ds.Shape.Dims, Data: data}
+	a.datasets[id] = d
+	return d, nil
+}
+
+// reassembleDomain builds the HDF5 group hierarchy of the domain described by
+// plan from the selected versions of its objects, which are loaded from
+// loader. Only hard links to groups and to datasets of fixed-point or
+// floating-point elements without filters are supported. Other links are
+// skipped, attributes are dropped. If selector is not nil, only the required
+// fields of the current versions of metadata objects are loaded from it.
+func reassembleDomain(ctx context.Context, loader hsdsObjectLoader, selector hsdsObjectFieldSelector, plan *domainPlan) (*hdf5Group, error) {
+	if plan.Domain.Root == nil {
+		return nil, fmt.Errorf("reassemble: domain %s has no root group", plan.Name)
+	}
+	a := &hdf5Assembler{
+		ctx:      ctx,
+		loader:   loader,
+		selector: selector,
+		plan:     plan,
+		root:     *plan.Domain.Root,
+		groups:   map[hsdsID]*hdf5Group{},
+		datasets: map[hsdsID]*hdf5Dataset{},
+	}
+	return a.group(a.root)
+}
+
+// reassemble writes each domain identified by domains as a single HDF5 file
+// to the path of the domain's name below root.
+func reassemble(loader hsdsLoader, root string, domains []string, opts *runOptions) error {
+	ctx := context.Background()
+	var selector hsdsObjectFieldSelector
+	if opts.UseS3Select {
+		ok := findLoader(loader, func(l interface{}) (ok bool) {
+			selector, ok = l.(hsdsObjectFieldSelector)
+			return ok
+		})
+		if !ok {
+			warn("reassemble: loader does not support S3 Select, loading whole objects")
+		}
+	}
+	for _, name := range domains {
+		plan, err := resolveDomain(ctx, loader, name, opts)
+		if err != nil {
+			return err
+		}
+		g, err := reassembleDomain(ctx, loader, selector, plan)
+		if err != nil {
+			return err
+		}
+
+		fileName, err := sanitizePath(root, name)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		err = writeHDF5(f, g)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReassemble(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	const (
+		datasetID = "d-d12a20a5-6c27622f-693e-302825-f8c087"
+		groupID   = "g-d12a20a5-6c27622f-40c5-5e41ac-92006c"
+		rows      = 5
+		cols      = 3
+	)
+	objects := map[string]string{
+		testGroupKey: `{"id": "` + testRootID.String() + `", "links": {
+			"data": {"class": "H5L_TYPE_HARD", "id": "` + datasetID + `"},
+			"sub": {"class": "H5L_TYPE_HARD", "id": "` + groupID + `"},
+			"ext": {"class": "H5L_TYPE_SOFT", "h5path": "/data"}}}`,
+		"db/d12a20a5-6c27622f/g/40c5-5e41ac-92006c/.group.json": `{"id": "` + groupID + `", "links": {
+			"same": {"class": "H5L_TYPE_HARD", "id": "` + datasetID + `"}}}`,
+		"db/d12a20a5-6c27622f/d/693e-302825-f8c087/.dataset.json": `{"id": "` + datasetID + `",
+			"type": {"class": "H5T_INTEGER", "base": "H5T_STD_I32LE"},
+			"shape": {"class": "H5S_SIMPLE", "dims": [5, 3]},
+			"layout": {"class": "H5D_CHUNKED", "dims": [2, 2]},
+			"creationProperties": {}}`,
+	}
+	// The dataset is split into 2x2 chunks, whose parts beyond the dataset's
+	// extent are padded. Chunk 2_1, which only contains the last element, is
+	// missing, so the element must be zero.
+	for ci := 0; ci < 3; ci++ {
+		for cj := 0; cj < 2; cj++ {
+			if ci == 2 && cj == 1 {
+				continue
+			}
+			chunk := make([]byte, 0, 16)
+			for a := 0; a < 2; a++ {
+				for b := 0; b < 2; b++ {
+					r, c := ci*2+a, cj*2+b
+					v := uint32(0xffffffff)
+					if r < rows && c < cols {
+						v = uint32(r*cols + c + 1)
+					}
+					chunk = append(chunk, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+				}
+			}
+			objects[fmt.Sprintf("db/d12a20a5-6c27622f/d/693e-302825-f8c087/%d_%d", ci, cj)] = string(chunk)
+		}
+	}
+	loader := &fakeHSDSLoader{
+		Domains:  map[string]*hsdsDomain{"home/user/domain.h5": {Root: &testRootID}},
+		Versions: map[string][]*hsdsVersion{},
+		Objects:  map[string][]byte{},
+	}
+	for key, data := range objects {
+		id := key + "-v1"
+		loader.Versions[key] = []*hsdsVersion{{ID: id, LastModified: testTimestamp, Size: int64(len(data))}}
+		loader.Objects[id] = []byte(data)
+	}
+
+	root := t.TempDir()
+	err := reassemble(loader, root, []string{"home/user/domain.h5"}, &runOptions{})
+	if err != nil {
+		t.Fatalf("reassemble() err = %v (want nil)", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(root, "home", "user", "domain.h5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, rows*cols*4)
+	for i := 0; i < rows*cols-1; i++ {
+		binary.LittleEndian.PutUint32(want[i*4:], uint32(i+1))
+	}
+	for _, path := range [][]string{{"data"}, {"sub", "same"}} {
+		dims, data := readHDF5Dataset(t, b, path...)
+		if !reflect.DeepEqual(dims, []uint64{rows, cols}) {
+			t.Errorf("%v: dims = %v (want [%d %d])", path, dims, rows, cols)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%v: data = %v (want %v)", path, data, want)
+		}
+	}
+	if !bytes.Contains(warnings.Bytes(), []byte(`"ext"`)) {
+		t.Errorf("reassemble() warnings = %q (want soft link to be skipped)", warnings.String())
+	}
+}
+
+type hdf5TypeForBaseTestcase struct {
+	base   string
+	want   hdf5Datatype
+	wantOK bool
+}
+
+func TestHDF5TypeForBase(t *testing.T) {
+	testCases := []hdf5TypeForBaseTestcase{
+		{base: "H5T_STD_I32LE", want: hdf5Datatype{Signed: true, Size: 4}, wantOK: true},
+		{base: "H5T_STD_U8BE", want: hdf5Datatype{Size: 1, BigEndian: true}, wantOK: true},
+		{base: "H5T_IEEE_F64LE", want: hdf5Datatype{Float: true, Size: 8}, wantOK: true},
+		{base: "H5T_IEEE_F16LE"},
+		{base: "H5T_C_S1"},
+	}
+
+	for _, tc := range testCases {
+		got, ok := hdf5TypeForBase(tc.base)
+		if ok != tc.wantOK || (ok && got != tc.want) {
+			t.Errorf("%s: hdf5TypeForBase() = %+v, %v (want %+v, %v)", tc.base, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+// fakeSelectLoader is a fakeHSDSLoader that implements the
+// hsdsObjectFieldSelector interface by returning the whole current version of
+// an object.
+type fakeSelectLoader struct {
+	*fakeHSDSLoader
+	// Selected records the names of the objects whose fields were selected.
+	Selected []string
+	// Overwritten maps the names of objects that were overwritten after
+	// they were listed to their new current version.
+	Overwritten map[string]string
+}
+
+func (l *fakeSelectLoader) SelectObjectFields(ctx context.Context, name, version string, fields []string) ([]byte, error) {
+	l.Selected = append(l.Selected, name)
+	current, ok := l.Overwritten[name]
+	if !ok {
+		current = l.Versions[name][0].ID
+	}
+	if current != version {
+		return nil, fmt.Errorf("%w: %s", errCurrentVersionChanged, name)
+	}
+	return l.Objects[current], nil
+}
+
+func TestReassemble_S3Select(t *testing.T) {
+	const (
+		datasetID  = "d-d12a20a5-6c27622f-693e-302825-f8c087"
+		datasetKey = "db/d12a20a5-6c27622f/d/693e-302825-f8c087/.dataset.json"
+		chunkKey   = "db/d12a20a5-6c27622f/d/693e-302825-f8c087/0"
+	)
+	group := `{"id": "` + testRootID.String() + `", "links": {
+		"data": {"class": "H5L_TYPE_HARD", "id": "` + datasetID + `"}}}`
+	dataset := func(n int) string {
+		return fmt.Sprintf(`{"id": "%s",
+			"type": {"class": "H5T_INTEGER", "base": "H5T_STD_U8LE"},
+			"shape": {"class": "H5S_SIMPLE", "dims": [%d]},
+			"layout": {"class": "H5D_CHUNKED", "dims": [4]}}`, datasetID, n)
+	}
+	later := testTimestamp.Add(time.Hour)
+	loader := &fakeSelectLoader{fakeHSDSLoader: &fakeHSDSLoader{
+		Domains: map[string]*hsdsDomain{"home/user/domain.h5": {Root: &testRootID}},
+		Versions: map[string][]*hsdsVersion{
+			testGroupKey: {{ID: "group-v1", LastModified: testTimestamp, Size: int64(len(group))}},
+			// The current version of the dataset is newer than the selected
+			// point in time, so it must not be selected.
+			datasetKey: {
+				{ID: "dataset-v2", LastModified: later, Size: int64(len(dataset(4)))},
+				{ID: "dataset-v1", LastModified: testTimestamp, Size: int64(len(dataset(2)))},
+			},
+			chunkKey: {{ID: "chunk-v1", LastModified: testTimestamp, Size: 4}},
+		},
+		Objects: map[string][]byte{
+			"group-v1":   []byte(group),
+			"dataset-v2": []byte(dataset(4)),
+			"dataset-v1": []byte(dataset(2)),
+			"chunk-v1":   {1, 2, 3, 4},
+		},
+	}}
+
+	root := t.TempDir()
+	opts := &runOptions{UseS3Select: true, NotAfter: testTimestamp.Add(time.Minute)}
+	err := reassemble(loader, root, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("reassemble() err = %v (want nil)", err)
+	}
+	if want := []string{testGroupKey}; !reflect.DeepEqual(loader.Selected, want) {
+		t.Errorf("reassemble() selected %q (want %q)", loader.Selected, want)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(root, "home", "user", "domain.h5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dims, data := readHDF5Dataset(t, b, "data")
+	if !reflect.DeepEqual(dims, []uint64{2}) || !bytes.Equal(data, []byte{1, 2}) {
+		t.Errorf("data = %v %v (want [2] [1 2])", dims, data)
+	}
+}
+
+func TestReassemble_S3SelectOverwritten(t *testing.T) {
+	group := `{"id": "` + testRootID.String() + `", "links": {}}`
+	loader := &fakeSelectLoader{
+		fakeHSDSLoader: &fakeHSDSLoader{
+			Domains: map[string]*hsdsDomain{"home/user/domain.h5": {Root: &testRootID}},
+			Versions: map[string][]*hsdsVersion{
+				testGroupKey: {{ID: "group-v1", LastModified: testTimestamp, Size: int64(len(group))}},
+			},
+			Objects: map[string][]byte{"group-v1": []byte(group)},
+		},
+		Overwritten: map[string]string{testGroupKey: "group-v2"},
+	}
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	root := t.TempDir()
+	opts := &runOptions{UseS3Select: true}
+	err := reassemble(loader, root, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("reassemble() err = %v (want nil)", err)
+	}
+	if !strings.Contains(warnings.String(), "current version changed") {
+		t.Errorf("reassemble() warnings = %q (want current version changed)", warnings.String())
+	}
+	_, err = os.Stat(filepath.Join(root, "home", "user", "domain.h5"))
+	if err != nil {
+		t.Errorf("reassemble() did not write the domain: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// aclDefaultUser is the ACL entry HSDS applies to all users without an entry
+// of their own.
+const aclDefaultUser = "default"
+
+// redactUser returns a pseudonym for the user name, which is derived from a
+// hash of name, so the same user is mapped to the same pseudonym in every
+// listing. The empty name and aclDefaultUser do not identify anyone and are
+// returned unchanged.
+func redactUser(name string) string {
+	if name == "" || name == aclDefaultUser {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "user-" + hex.EncodeToString(sum[:6])
+}
+
+// redactACL returns a copy of acls with all user names replaced by
+// redactUser.
+func redactACL(acls hsdsACL) hsdsACL {
+	if acls == nil {
+		return nil
+	}
+	redacted := make(hsdsACL, len(acls))
+	for user, perms := range acls {
+		redacted[redactUser(user)] = perms
+	}
+	return redacted
+}
+
+// redactACLHistory returns a copy of history with all user names replaced by
+// redactUser.
+func redactACLHistory(history []*aclVersion) []*aclVersion {
+	redacted := make([]*aclVersion, len(history))
+	for i, v := range history {
+		redacted[i] = &aclVersion{Version: v.Version, ACLs: redactACL(v.ACLs)}
+	}
+	return redacted
+}
+
+// redactOwners returns a copy of stats with all owners replaced by
+// redactUser.
+func redactOwners(stats []*ownerStats) []*ownerStats {
+	redacted := make([]*ownerStats, len(stats))
+	for i, s := range stats {
+		r := *s
+		r.Owner = redactUser(s.Owner)
+		redacted[i] = &r
+	}
+	return redacted
+}
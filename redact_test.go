@@ -0,0 +1,54 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactUser(t *testing.T) {
+	if got := redactUser("alice"); got != redactUser("alice") || got == redactUser("bob") || strings.Contains(got, "alice") {
+		t.Errorf("redactUser(%q) = %q (want stable pseudonym)", "alice", got)
+	}
+	for _, name := range []string{"", aclDefaultUser} {
+		if got := redactUser(name); got != name {
+			t.Errorf("redactUser(%q) = %q (want %q)", name, got, name)
+		}
+	}
+}
+
+func TestRedactedOutput(t *testing.T) {
+	history := []*aclVersion{
+		{
+			Version: &hsdsVersion{ID: "domain-v1", LastModified: testTimestamp},
+			ACLs:    hsdsACL{"alice": {Read: true}, "default": {Read: true}},
+		},
+		{
+			Version: &hsdsVersion{ID: "domain-v2", LastModified: testTimestamp},
+			ACLs:    hsdsACL{"alice": {Read: true, Update: true}, "bob": {Read: true}},
+		},
+	}
+	var buf bytes.Buffer
+	writeACLHistory(&buf, "home/shared/domain.h5", redactACLHistory(history))
+	writeOwners(&buf, redactOwners([]*ownerStats{{Owner: "alice", Domains: 1, Bytes: 4}}))
+
+	got := buf.String()
+	for _, name := range []string{"alice", "bob"} {
+		if strings.Contains(got, name) {
+			t.Errorf("redacted output contains %q:\n%s", name, got)
+		}
+		if !strings.Contains(got, redactUser(name)) {
+			t.Errorf("redacted output lacks pseudonym %s of %q:\n%s", redactUser(name), name, got)
+		}
+	}
+	if !strings.Contains(got, "default\tread") {
+		t.Errorf("redacted output lacks the default ACL:\n%s", got)
+	}
+	if history[0].ACLs["alice"] == nil {
+		t.Errorf("redactACLHistory() modified the original history")
+	}
+}
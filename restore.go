@@ -0,0 +1,130 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Retrieval tiers of restore requests, from fastest to cheapest.
+const (
+	restoreTierExpedited = "Expedited"
+	restoreTierStandard  = "Standard"
+	restoreTierBulk      = "Bulk"
+)
+
+// restoreDurations are the maximum times AWS documents for restoring archived
+// objects, by storage class and retrieval tier. Deep Archive does not support
+// expedited retrievals.
+var restoreDurations = map[string]map[string]time.Duration{
+	storageClassGlacier: {
+		restoreTierExpedited: 5 * time.Minute,
+		restoreTierStandard:  5 * time.Hour,
+		restoreTierBulk:      12 * time.Hour,
+	},
+	storageClassDeepArchive: {
+		restoreTierStandard: 12 * time.Hour,
+		restoreTierBulk:     48 * time.Hour,
+	},
+}
+
+// unknownRestoreTierError indicates that a retrieval tier is not one of
+// restoreTierExpedited, restoreTierStandard and restoreTierBulk.
+type unknownRestoreTierError struct {
+	Tier string
+}
+
+func (err *unknownRestoreTierError) Error() string {
+	return fmt.Sprintf("unknown restore tier %q (want %s, %s or %s)", err.Tier, restoreTierExpedited, restoreTierStandard, restoreTierBulk)
+}
+
+// parseRestoreTier returns the retrieval tier named s, ignoring case.
+func parseRestoreTier(s string) (string, error) {
+	for _, tier := range []string{restoreTierExpedited, restoreTierStandard, restoreTierBulk} {
+		if strings.EqualFold(s, tier) {
+			return tier, nil
+		}
+	}
+	return "", &unknownRestoreTierError{Tier: s}
+}
+
+// archiveRestore describes how archived objects are restored.
+type archiveRestore struct {
+	// Tier is the retrieval tier, e.g. restoreTierStandard.
+	Tier string
+	// Days is the number of days for which the restored copies are kept.
+	Days int
+}
+
+// hsdsObjectRestorer is the interface wrapping the RestoreObject method.
+//
+// RestoreObject requests the given version of the archived object name to be
+// restored as described by r. It reports false if a restore of the version is
+// in progress already.
+type hsdsObjectRestorer interface {
+	RestoreObject(ctx context.Context, name, version string, r *archiveRestore) (bool, error)
+}
+
+// formatRestoreDuration formats d in whole hours or, below an hour, in
+// minutes.
+func formatRestoreDuration(d time.Duration) string {
+	if d < time.Hour {
+		return fmt.Sprintf("%d minutes", int(d/time.Minute))
+	}
+	return fmt.Sprintf("%d hours", int(d/time.Hour))
+}
+
+// restoreArchived resolves the object versions of all domains identified by
+// domains and requests the selected versions that have been listed in an
+// archival storage class to be restored by restorer. Each request is reported
+// to w, followed by the number of requests and the time after which all
+// restored objects are expected to be available, so they can be dumped.
+func restoreArchived(ctx context.Context, w io.Writer, loader hsdsLoader, restorer hsdsObjectRestorer, domains []string, r *archiveRestore, opts *runOptions) error {
+	var requested, pending int
+	var wait time.Duration
+	for _, name := range domains {
+		plan, err := resolveDomain(ctx, loader, name, opts)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(plan.Objects))
+		for key, version := range plan.Objects {
+			if isArchivalStorageClass(version.StorageClass) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			version := plan.Objects[key]
+			started, err := restorer.RestoreObject(ctx, key, version.ID, r)
+			if err != nil {
+				return fmt.Errorf("restore %s version %s: %w", key, version.ID, err)
+			}
+			status := "requested"
+			if started {
+				requested++
+			} else {
+				status = "already in progress"
+				pending++
+			}
+			fmt.Fprintf(w, "%s %s: %s restore %s\n", key, version.ID, version.StorageClass, status)
+			if d := restoreDurations[version.StorageClass][r.Tier]; d > wait {
+				wait = d
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d restores requested, %d already in progress", requested, pending)
+	if requested+pending > 0 {
+		fmt.Fprintf(w, ", expected to be available within %s for %d days", formatRestoreDuration(wait), r.Days)
+	}
+	fmt.Fprintln(w)
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type parseRestoreTierTestcase struct {
+	s       string
+	want    string
+	wantErr bool
+}
+
+func TestParseRestoreTier(t *testing.T) {
+	testcases := []parseRestoreTierTestcase{
+		{s: "Standard", want: restoreTierStandard},
+		{s: "bulk", want: restoreTierBulk},
+		{s: "EXPEDITED", want: restoreTierExpedited},
+		{s: "fast", wantErr: true},
+		{s: "", wantErr: true},
+	}
+	for _, tc := range testcases {
+		got, err := parseRestoreTier(tc.s)
+		var unknown *unknownRestoreTierError
+		if tc.wantErr != errors.As(err, &unknown) {
+			t.Errorf("%q: parseRestoreTier() err = %v (want *unknownRestoreTierError %v)", tc.s, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("%q: parseRestoreTier() = %q (want %q)", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestRestoreArchived(t *testing.T) {
+	const otherChunkKey = "db/d12a20a5-6c27622f/d/693e-302825-f8c087/1"
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			domainObject(t, "home/user/domain.h5", &hsdsDomain{Root: &testRootID}),
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group"), StorageClass: "STANDARD"},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data"), StorageClass: storageClassGlacier},
+			{Key: otherChunkKey, VersionID: "other-v1", LastModified: testTimestamp, Data: []byte("data"), StorageClass: storageClassDeepArchive, RestoreInProgress: true},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+
+	var out bytes.Buffer
+	r := &archiveRestore{Tier: restoreTierBulk, Days: 3}
+	err := restoreArchived(context.Background(), &out, loader, loader, []string{"home/user/domain.h5"}, r, &runOptions{})
+	if err != nil {
+		t.Fatalf("restoreArchived() err = %v (want nil)", err)
+	}
+
+	want := []string{testChunkKey + "@chunk-v1", otherChunkKey + "@other-v1"}
+	var got []string
+	for _, input := range client.RestoreObjectInputs {
+		got = append(got, aws.ToString(input.Key)+"@"+aws.ToString(input.VersionId))
+		req := input.RestoreRequest
+		if req == nil || req.Days != 3 || req.GlacierJobParameters == nil || req.GlacierJobParameters.Tier != types.TierBulk {
+			t.Errorf("RestoreObject(%s) request = %+v (want 3 days, tier Bulk)", aws.ToString(input.Key), req)
+		}
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("restoreArchived() restored %q (want %q)", got, want)
+	}
+
+	wantOut := testChunkKey + " chunk-v1: GLACIER restore requested\n" +
+		otherChunkKey + " other-v1: DEEP_ARCHIVE restore already in progress\n" +
+		"1 restores requested, 1 already in progress, expected to be available within 48 hours for 3 days\n"
+	if out.String() != wantOut {
+		t.Errorf("restoreArchived() output = %q (want %q)", out.String(), wantOut)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// lockFileName is the name of the file in the root directory that marks a
+// dump into it as running.
+const lockFileName = ".hss3dump.lock"
+
+// rootLockedError indicates that another dump into the same root directory is
+// running, or has been aborted without releasing its lock.
+type rootLockedError struct {
+	path string
+}
+
+func (err *rootLockedError) Error() string {
+	return fmt.Sprintf("another hss3dump is running in this directory: '%s' exists (remove a stale lock with -force-unlock)", err.path)
+}
+
+// rootLock is a lock held on a root directory for the duration of a dump.
+type rootLock struct {
+	path string
+}
+
+// lockRoot creates the root directory, if necessary, and acquires its lock by
+// creating lockFileName in it exclusively. The lock file contains the ID of
+// the process holding the lock. If force is true, an existing lock is removed
+// first.
+func lockRoot(root string, force bool) (*rootLock, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(root, lockFileName)
+	if force {
+		err = os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil, &rootLockedError{path: name}
+	} else if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return &rootLock{path: name}, nil
+}
+
+// Unlock releases the lock. Unlocking a nil lock does nothing.
+func (l *rootLock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,56 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "dump")
+	lock, err := lockRoot(root, false)
+	if err != nil {
+		t.Fatalf("lockRoot() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, lockFileName)); err != nil {
+		t.Errorf("lockRoot() did not create the lock file: %v", err)
+	}
+
+	_, err = lockRoot(root, false)
+	var locked *rootLockedError
+	if !errors.As(err, &locked) {
+		t.Errorf("lockRoot() of a locked root err = %v (want *rootLockedError)", err)
+	}
+
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatalf("Unlock() err = %v (want nil)", err)
+	}
+	_, err = lockRoot(root, false)
+	if err != nil {
+		t.Fatalf("lockRoot() after Unlock() err = %v (want nil)", err)
+	}
+
+	// The lock of an aborted run is removed with force.
+	lock, err = lockRoot(root, true)
+	if err != nil {
+		t.Fatalf("lockRoot() with force err = %v (want nil)", err)
+	}
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatalf("Unlock() err = %v (want nil)", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, lockFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unlock() did not remove the lock file: %v", err)
+	}
+
+	var nilLock *rootLock
+	if err := nilLock.Unlock(); err != nil {
+		t.Errorf("Unlock() of a nil lock err = %v (want nil)", err)
+	}
+}
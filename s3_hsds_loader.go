@@ -5,24 +5,85 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"path"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// s3API is the subset of the AWS S3 API used by s3HSDSDomainLoader.
+type s3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	GetObjectAcl(ctx context.Context, params *s3.GetObjectAclInput, optFns ...func(*s3.Options)) (*s3.GetObjectAclOutput, error)
+	GetBucketOwnershipControls(ctx context.Context, params *s3.GetBucketOwnershipControlsInput, optFns ...func(*s3.Options)) (*s3.GetBucketOwnershipControlsOutput, error)
+	RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error)
+}
+
 // s3HSDSDomainLoader is an implementation of the HSDSDomainLoader,
 // HSDSDomainVersionsLoader, and the HSDSObjectLoader interfaces that uses an S3
 // bucket as its underlying storage.
 type s3HSDSDomainLoader struct {
 	// Client is the AWS S3 client used to send requests to the AWS S3 API.
-	Client *s3.Client
+	Client s3API
 	// Bucket is the bucket from which domains and domain objects are retrieved.
 	Bucket string
+	// Region is the region of Bucket. If it is empty, it is resolved on
+	// first use by BucketRegion.
+	Region string
+	// NameEncoding selects how domain names are mapped to the keys of their
+	// metadata objects. The empty string is equivalent to nameEncodingPath.
+	NameEncoding string
+	// ValidateSchema validates loaded domains against domainSchema before
+	// decoding them.
+	ValidateSchema bool
+	// ListCheckpoint is the path of a file in which the progress of version
+	// listings is recorded after each page. Interrupted listings resume from
+	// the recorded position. No progress is recorded if it is empty.
+	ListCheckpoint string
+	// URLEncodeKeys requests the keys in version listings URL-encoded, which
+	// allows listing keys containing characters that cannot be represented
+	// in XML responses. Listed keys are decoded before they are used.
+	URLEncodeKeys bool
+	// ObjectProgress is called repeatedly while objects of at least
+	// ObjectProgressThreshold bytes are loaded, with the number of bytes read
+	// so far and the size of the object. No progress is reported if it is
+	// nil.
+	ObjectProgress func(name string, read, size int64)
+	// ObjectProgressThreshold is the size in bytes from which on the progress
+	// of loading an object is reported to ObjectProgress.
+	ObjectProgressThreshold int64
+	// Selector sends the S3 Select requests of SelectObjectFields. Fields
+	// cannot be selected if it is nil.
+	Selector s3Selector
+
+	// regionMu guards resolving Region.
+	regionMu sync.Mutex
+	// checkpointMu guards the file at ListCheckpoint.
+	checkpointMu sync.Mutex
+	// deniedWarning makes sure that the fallback to listing current versions
+	// only is reported once.
+	deniedWarning sync.Once
 }
 
 func (l *s3HSDSDomainLoader) jsonForKey(ctx context.Context, key string, o interface{}) error {
@@ -34,8 +95,11 @@ func (l *s3HSDSDomainLoader) jsonForKey(ctx context.Context, key string, o inter
 		return err
 	}
 	defer obj.Body.Close()
+	return decodeJSON(obj.Body, o)
+}
 
-	dec := json.NewDecoder(obj.Body)
+func decodeJSON(r io.Reader, o interface{}) error {
+	dec := json.NewDecoder(r)
 	// For testing purposes, we fail on unknown fields. This should be removed
 	// once everything is tested sufficiently.
 	dec.DisallowUnknownFields()
@@ -43,40 +107,130 @@ func (l *s3HSDSDomainLoader) jsonForKey(ctx context.Context, key string, o inter
 }
 
 func (l *s3HSDSDomainLoader) LoadDomain(ctx context.Context, name string) (*hsdsDomain, error) {
-	p := path.Join(name, ".domain.json")
-	d := &hsdsDomain{}
-	err := l.jsonForKey(ctx, p, d)
+	p, err := domainKey(l.NameEncoding, name)
 	if err != nil {
 		return nil, err
 	}
+	if l.ValidateSchema {
+		b, err := l.LoadObject(ctx, p, "")
+		if errors.Is(err, errObjectUnavailable) {
+			return nil, &domainNotFoundError{Name: name}
+		} else if err != nil {
+			return nil, err
+		}
+		err = validateDomainSchema(b)
+		if err != nil {
+			return nil, fmt.Errorf("domain %q: %w", name, err)
+		}
+		d := &hsdsDomain{}
+		err = decodeJSON(bytes.NewReader(b), d)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	d := &hsdsDomain{}
+	err = l.jsonForKey(ctx, p, d)
+	if isNoSuchObject(err) {
+		return nil, &domainNotFoundError{Name: name}
+	} else if err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
+func (l *s3HSDSDomainLoader) LoadDomainFile(ctx context.Context, name string) (string, []byte, error) {
+	key, err := domainKey(l.NameEncoding, name)
+	if err != nil {
+		return "", nil, err
+	}
+	b, err := l.LoadObject(ctx, key, "")
+	if err != nil {
+		return "", nil, err
+	}
+	return key, b, nil
+}
+
 func (l *s3HSDSDomainLoader) LoadDomainVersions(ctx context.Context, domain *hsdsDomain) (map[string][]*hsdsVersion, error) {
-	prefix := domain.DatabasePrefix()
+	return l.LoadPrefixVersions(ctx, domain.DatabasePrefix())
+}
+
+// LoadPrefixVersions lists the versions of all objects whose key starts with
+// prefix. If l.ListCheckpoint is set, the listing resumes from the checkpoint
+// recorded for prefix, if any.
+func (l *s3HSDSDomainLoader) LoadPrefixVersions(ctx context.Context, prefix string) (map[string][]*hsdsVersion, error) {
 	input := &s3.ListObjectVersionsInput{
 		Bucket: aws.String(l.Bucket),
 		Prefix: aws.String(prefix),
 	}
-	output, err := l.Client.ListObjectVersions(ctx, input)
-	if err != nil {
-		return nil, err
+	if l.URLEncodeKeys {
+		input.EncodingType = types.EncodingTypeUrl
 	}
-
 	versions := map[string][]*hsdsVersion{}
-	for _, version := range output.Versions {
-		key := aws.ToString(version.Key)
-		vv, ok := versions[key]
-		if !ok {
-			vv = make([]*hsdsVersion, 0, 1)
+	checkpointKey := path.Join(l.Bucket, prefix)
+	if l.ListCheckpoint != "" {
+		l.checkpointMu.Lock()
+		listings, err := readListingCheckpoints(l.ListCheckpoint)
+		l.checkpointMu.Unlock()
+		if err != nil {
+			return nil, err
 		}
-		v := &hsdsVersion{
-			ID:           aws.ToString(version.VersionId),
-			LastModified: aws.ToTime(version.LastModified),
-			Size:         version.Size,
+		if cp, ok := listings[checkpointKey]; ok {
+			versions = cp.Versions
+			input.KeyMarker = aws.String(cp.KeyMarker)
+			input.VersionIdMarker = aws.String(cp.VersionIDMarker)
 		}
-		vv = append(vv, v)
-		versions[key] = vv
+	}
+
+	err := l.listVersionPages(ctx, input, func(output *s3.ListObjectVersionsOutput, keyMarker, versionIDMarker string) error {
+		page := map[string][]*hsdsVersion{}
+		for _, version := range output.Versions {
+			key, err := decodeListedKey(version.Key, output.EncodingType)
+			if err != nil {
+				return err
+			}
+			page[key] = append(page[key], &hsdsVersion{
+				ID:           aws.ToString(version.VersionId),
+				LastModified: aws.ToTime(version.LastModified),
+				Size:         version.Size,
+				ETag:         normalizeETag(aws.ToString(version.ETag)),
+				StorageClass: string(version.StorageClass),
+			})
+		}
+		for _, marker := range output.DeleteMarkers {
+			key, err := decodeListedKey(marker.Key, output.EncodingType)
+			if err != nil {
+				return err
+			}
+			page[key] = append(page[key], &hsdsVersion{
+				ID:           aws.ToString(marker.VersionId),
+				LastModified: aws.ToTime(marker.LastModified),
+				DeleteMarker: true,
+			})
+		}
+		for key, vv := range page {
+			versions[key] = append(versions[key], vv...)
+		}
+		if !output.IsTruncated {
+			return nil
+		}
+		return l.checkpoint(checkpointKey, &listingCheckpoint{
+			KeyMarker:       keyMarker,
+			VersionIDMarker: versionIDMarker,
+			Versions:        page,
+		})
+	})
+	if isAccessDenied(err) {
+		l.deniedWarning.Do(func() {
+			warn("listing object versions is denied, only the current versions can be dumped and -b is unavailable: %v", err)
+		})
+		return l.loadCurrentVersions(ctx, prefix)
+	} else if err != nil {
+		return nil, err
+	}
+	err = l.checkpoint(checkpointKey, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	// In theory, AWS should return the object versions sorted by their age
@@ -90,8 +244,262 @@ func (l *s3HSDSDomainLoader) LoadDomainVersions(ctx context.Context, domain *hsd
 	return versions, nil
 }
 
+// listVersionPages sends the version listing request input and calls fn with
+// each page of the response. Truncated pages are followed by requesting the
+// next page from the markers they return, until the listing is complete, as
+// S3 returns at most 1000 versions per page. fn is also passed the markers
+// from which the listing continues after the page, which are empty for the
+// last page.
+func (l *s3HSDSDomainLoader) listVersionPages(ctx context.Context, input *s3.ListObjectVersionsInput, fn func(output *s3.ListObjectVersionsOutput, keyMarker, versionIDMarker string) error) error {
+	params := *input
+	for {
+		output, err := l.Client.ListObjectVersions(ctx, &params)
+		if err != nil {
+			return err
+		}
+		var keyMarker, versionIDMarker string
+		if output.IsTruncated {
+			// Markers are sent unencoded, regardless of the encoding
+			// type.
+			keyMarker, err = decodeListedKey(output.NextKeyMarker, output.EncodingType)
+			if err != nil {
+				return err
+			}
+			versionIDMarker = aws.ToString(output.NextVersionIdMarker)
+		}
+		err = fn(output, keyMarker, versionIDMarker)
+		if err != nil || !output.IsTruncated {
+			return err
+		}
+		params.KeyMarker = aws.String(keyMarker)
+		params.VersionIdMarker = aws.String(versionIDMarker)
+	}
+}
+
+// decodeListedKey returns key as listed in a response with the given
+// encoding type, decoding it if it is URL-encoded.
+func decodeListedKey(key *string, encoding types.EncodingType) (string, error) {
+	if encoding != types.EncodingTypeUrl {
+		return aws.ToString(key), nil
+	}
+	decoded, err := url.QueryUnescape(aws.ToString(key))
+	if err != nil {
+		return "", fmt.Errorf("invalid URL-encoded key %q: %w", aws.ToString(key), err)
+	}
+	return decoded, nil
+}
+
+// checkpoint records cp, the markers and versions of a single page, as
+// progress of listing the prefix identified by key, if l.ListCheckpoint is
+// set. If cp is nil, the recorded progress is removed.
+func (l *s3HSDSDomainLoader) checkpoint(key string, cp *listingCheckpoint) error {
+	if l.ListCheckpoint == "" {
+		return nil
+	}
+	l.checkpointMu.Lock()
+	defer l.checkpointMu.Unlock()
+	if cp == nil {
+		return completeListingCheckpoint(l.ListCheckpoint, key)
+	}
+	return appendListingCheckpoint(l.ListCheckpoint, key, cp)
+}
+
+// LoadDomainFileVersions lists the versions of the domain file of the domain
+// identified by name.
+func (l *s3HSDSDomainLoader) LoadDomainFileVersions(ctx context.Context, name string) (string, []*hsdsVersion, error) {
+	key, err := domainKey(l.NameEncoding, name)
+	if err != nil {
+		return "", nil, err
+	}
+	versions, err := l.LoadPrefixVersions(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, versions[key], nil
+}
+
+// normalizeETag removes the quotes S3 wraps around ETags.
+func normalizeETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// loadCurrentVersions lists the current versions of all objects below prefix.
+// As the versions are listed without their IDs, loading them always yields the
+// latest version of an object.
+func (l *s3HSDSDomainLoader) loadCurrentVersions(ctx context.Context, prefix string) (map[string][]*hsdsVersion, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(l.Bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	versions := map[string][]*hsdsVersion{}
+	for {
+		output, err := l.Client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range output.Contents {
+			versions[aws.ToString(obj.Key)] = []*hsdsVersion{{
+				LastModified: aws.ToTime(obj.LastModified),
+				Size:         obj.Size,
+				ETag:         normalizeETag(aws.ToString(obj.ETag)),
+				StorageClass: string(obj.StorageClass),
+			}}
+		}
+		if !output.IsTruncated {
+			return versions, nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// LoadObjectTags loads the tag set of the given version of the object
+// identified by name.
+func (l *s3HSDSDomainLoader) LoadObjectTags(ctx context.Context, name, version string) (map[string]string, error) {
+	input := &s3.GetObjectTaggingInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(name),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	output, err := l.Client.GetObjectTagging(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
+
+// BucketRegion returns the region of the loader's bucket. It is resolved
+// only once per loader, so all domains of a run share the result. The region
+// of an access point is taken from its ARN.
+func (l *s3HSDSDomainLoader) BucketRegion(ctx context.Context) (string, error) {
+	l.regionMu.Lock()
+	defer l.regionMu.Unlock()
+	if l.Region != "" {
+		return l.Region, nil
+	}
+	if isBucketARN(l.Bucket) {
+		// Access points do not support GetBucketLocation, but their ARNs
+		// contain their region.
+		arn, err := parseBucketARN(l.Bucket)
+		if err != nil {
+			return "", err
+		}
+		l.Region = arn.Region
+		return l.Region, nil
+	}
+	output, err := l.Client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{
+		Bucket: aws.String(l.Bucket),
+	})
+	if err != nil {
+		return "", err
+	}
+	// Buckets in us-east-1 have no location constraint, and EU is a legacy
+	// name of eu-west-1.
+	switch output.LocationConstraint {
+	case "":
+		l.Region = "us-east-1"
+	case types.BucketLocationConstraintEu:
+		l.Region = "eu-west-1"
+	default:
+		l.Region = string(output.LocationConstraint)
+	}
+	return l.Region, nil
+}
+
+// isAccessDenied reports whether err has been caused by missing permissions.
+func isAccessDenied(err error) bool {
+	var ae interface{ ErrorCode() string }
+	return errors.As(err, &ae) && ae.ErrorCode() == "AccessDenied"
+}
+
 // ObjectForName loads the data associated with the object identified by key.
 func (l *s3HSDSDomainLoader) LoadObject(ctx context.Context, name, version string) ([]byte, error) {
+	return l.loadObject(ctx, name, version, time.Time{})
+}
+
+func (l *s3HSDSDomainLoader) LoadObjectIfModified(ctx context.Context, name, version string, since time.Time) ([]byte, error) {
+	return l.loadObject(ctx, name, version, since)
+}
+
+// isNotModified reports whether err has been caused by an HTTP 304 response.
+func isNotModified(err error) bool {
+	var re interface{ HTTPStatusCode() int }
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotModified
+}
+
+// isNotFound reports whether err has been caused by an HTTP 404 response.
+func isNotFound(err error) bool {
+	var nf *types.NotFound
+	if errors.As(err, &nf) {
+		return true
+	}
+	var re interface{ HTTPStatusCode() int }
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotFound
+}
+
+// isNoSuchObject reports whether err indicates that the requested key or
+// version does not exist.
+func isNoSuchObject(err error) bool {
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return true
+	}
+	var ae interface{ ErrorCode() string }
+	return errors.As(err, &ae) && ae.ErrorCode() == "NoSuchVersion"
+}
+
+// ObjectExists issues a HEAD request for the given version of the object
+// identified by name. Versions that have been removed since they were listed,
+// e.g. by a lifecycle rule, are reported as not existing.
+func (l *s3HSDSDomainLoader) ObjectExists(ctx context.Context, name, version string) (bool, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(name),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	_, err := l.Client.HeadObject(ctx, input)
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RestoreObject requests the given version of the archived object identified
+// by name to be restored as described by r. Restores that are in progress
+// already are reported as not started.
+func (l *s3HSDSDomainLoader) RestoreObject(ctx context.Context, name, version string, r *archiveRestore) (bool, error) {
+	input := &s3.RestoreObjectInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(name),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 int32(r.Days),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: types.Tier(r.Tier)},
+		},
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	_, err := l.Client.RestoreObject(ctx, input)
+	var ae interface{ ErrorCode() string }
+	if errors.As(err, &ae) && ae.ErrorCode() == "RestoreAlreadyInProgress" {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *s3HSDSDomainLoader) loadObject(ctx context.Context, name, version string, since time.Time) ([]byte, error) {
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(l.Bucket),
 		Key:    aws.String(name),
@@ -99,11 +507,100 @@ func (l *s3HSDSDomainLoader) LoadObject(ctx context.Context, name, version strin
 	if version != "" {
 		input.VersionId = aws.String(version)
 	}
+	if !since.IsZero() {
+		input.IfModifiedSince = aws.Time(since)
+	}
 
 	obj, err := l.Client.GetObject(ctx, input)
-	if err != nil {
+	var archived *types.InvalidObjectState
+	if isNotModified(err) {
+		return nil, errNotModified
+	} else if errors.As(err, &archived) {
+		return nil, &archivedObjectError{Name: name, Version: version, StorageClass: string(archived.StorageClass)}
+	} else if isNoSuchObject(err) {
+		return nil, fmt.Errorf("%w: %s: %v", errObjectUnavailable, name, err)
+	} else if err != nil {
 		return nil, err
 	}
 	defer obj.Body.Close()
-	return ioutil.ReadAll(obj.Body)
+	var body io.Reader = obj.Body
+	if l.ObjectProgress != nil && obj.ContentLength > 0 && obj.ContentLength >= l.ObjectProgressThreshold {
+		size := obj.ContentLength
+		body = newProgressReader(obj.Body, size, func(read int64) {
+			l.ObjectProgress(name, read, size)
+		})
+	}
+	return ioutil.ReadAll(body)
+}
+
+// VersioningEnabled reports whether versioning is enabled for the loader's
+// bucket. Buckets for which versioning has never been enabled or has been
+// suspended only provide the latest version of new objects.
+func (l *s3HSDSDomainLoader) VersioningEnabled(ctx context.Context) (bool, error) {
+	output, err := l.Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(l.Bucket),
+	})
+	if err != nil {
+		return false, err
+	}
+	return output.Status == types.BucketVersioningStatusEnabled, nil
+}
+
+// DiscoverDomains lists the bucket below folder and returns the names of all
+// domains and folders whose metadata is stored there. An empty folder
+// discovers all domains in the bucket.
+func (l *s3HSDSDomainLoader) DiscoverDomains(ctx context.Context, folder string) ([]string, error) {
+	prefix := ""
+	if folder != "" {
+		prefix = folder + "/"
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(l.Bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	var names []string
+	for {
+		output, err := l.Client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range output.Contents {
+			dir, file := path.Split(aws.ToString(obj.Key))
+			if file != domainFileName || dir == "" || dir == prefix {
+				continue
+			}
+			names = append(names, strings.TrimSuffix(dir, "/"))
+		}
+		if !output.IsTruncated {
+			return names, nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// ListDatabasePrefixes returns the distinct db/<prefix> key prefixes in the
+// bucket, each of which holds the objects of a domain's root group. Only
+// prefixes are listed, so no individual objects are enumerated.
+func (l *s3HSDSDomainLoader) ListDatabasePrefixes(ctx context.Context) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(l.Bucket),
+		Prefix:    aws.String("db/"),
+		Delimiter: aws.String("/"),
+	}
+
+	var prefixes []string
+	for {
+		output, err := l.Client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range output.CommonPrefixes {
+			prefixes = append(prefixes, strings.TrimSuffix(aws.ToString(p.Prefix), "/"))
+		}
+		if !output.IsTruncated {
+			return prefixes, nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
 }
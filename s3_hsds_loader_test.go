@@ -0,0 +1,590 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3Object is a single object version stored in a fakeS3Client.
+type fakeS3Object struct {
+	Key          string
+	VersionID    string
+	LastModified time.Time
+	Data         []byte
+	// DeleteMarker indicates that the version is a delete marker.
+	DeleteMarker bool
+	// Tags are the version's S3 tags.
+	Tags map[string]string
+	// Grants are the grants of the version's S3 ACL.
+	Grants []types.Grant
+	// ETag is the version's ETag as returned by S3, i.e. including quotes.
+	ETag string
+	// StorageClass is the version's storage class. Versions in archival
+	// storage classes cannot be downloaded.
+	StorageClass string
+	// RestoreInProgress indicates that a restore of the archived version has
+	// been requested already.
+	RestoreInProgress bool
+}
+
+// fakeAPIError is an error carrying an S3 error code, like the generic API
+// errors returned by the AWS SDK.
+type fakeAPIError struct {
+	Code string
+}
+
+func (e *fakeAPIError) Error() string {
+	return "api error " + e.Code
+}
+
+func (e *fakeAPIError) ErrorCode() string {
+	return e.Code
+}
+
+// fakeHTTPError is an error carrying an HTTP status code, like the response
+// errors returned by the AWS SDK.
+type fakeHTTPError struct {
+	StatusCode int
+}
+
+func (err *fakeHTTPError) Error() string {
+	return fmt.Sprintf("http response error StatusCode: %d", err.StatusCode)
+}
+
+func (err *fakeHTTPError) HTTPStatusCode() int {
+	return err.StatusCode
+}
+
+// fakeS3Client is an in-memory implementation of the s3API interface. Objects
+// are expected to be sorted by their last modification time in descending
+// order.
+type fakeS3Client struct {
+	Objects []*fakeS3Object
+	// VersioningStatus is the bucket's versioning status.
+	VersioningStatus types.BucketVersioningStatus
+	// DenyListVersions makes ListObjectVersions fail with AccessDenied.
+	DenyListVersions bool
+	// Location is the bucket's location constraint.
+	Location types.BucketLocationConstraint
+	// DenyGetObject makes GetObject fail with AccessDenied.
+	DenyGetObject bool
+	// DenyHeadBucket makes HeadBucket fail with AccessDenied.
+	DenyHeadBucket bool
+	// PageSize limits the number of versions and delete markers returned by
+	// ListObjectVersions per call, if it is not zero. Pages follow the order
+	// of Objects.
+	PageSize int
+	// FailListCall makes the ListObjectVersions call with the given number,
+	// counting from one, fail, if it is not zero.
+	FailListCall int
+	// ObjectOwnership is the bucket's object ownership. The bucket has no
+	// ownership controls if it is empty.
+	ObjectOwnership types.ObjectOwnership
+
+	// GetObjectInputs records the inputs of all GetObject calls.
+	GetObjectInputs []*s3.GetObjectInput
+	// RestoreObjectInputs records the inputs of all RestoreObject calls.
+	RestoreObjectInputs []*s3.RestoreObjectInput
+	// ListCalls counts the calls to ListObjectVersions.
+	ListCalls int
+	// HeadCalls counts the calls to HeadObject.
+	HeadCalls int
+	// HeadBucketCalls counts the calls to HeadBucket.
+	HeadBucketCalls int
+	// LocationCalls counts the calls to GetBucketLocation.
+	LocationCalls int
+}
+
+func (c *fakeS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	c.GetObjectInputs = append(c.GetObjectInputs, params)
+	if c.DenyGetObject {
+		return nil, &fakeAPIError{Code: "AccessDenied"}
+	}
+	key := aws.ToString(params.Key)
+	version := aws.ToString(params.VersionId)
+	for _, o := range c.Objects {
+		if o.Key != key || (version != "" && o.VersionID != version) {
+			continue
+		}
+		if o.DeleteMarker {
+			if version != "" {
+				return nil, &fakeHTTPError{StatusCode: http.StatusMethodNotAllowed}
+			}
+			return nil, &types.NoSuchKey{}
+		}
+		if isArchivalStorageClass(o.StorageClass) {
+			return nil, &types.InvalidObjectState{StorageClass: types.StorageClass(o.StorageClass)}
+		}
+		if params.IfModifiedSince != nil && !o.LastModified.After(*params.IfModifiedSince) {
+			return nil, &fakeHTTPError{StatusCode: http.StatusNotModified}
+		}
+		return &s3.GetObjectOutput{
+			Body:          ioutil.NopCloser(bytes.NewReader(o.Data)),
+			ContentLength: int64(len(o.Data)),
+			LastModified:  aws.Time(o.LastModified),
+			VersionId:     aws.String(o.VersionID),
+		}, nil
+	}
+	for _, o := range c.Objects {
+		if o.Key == key {
+			return nil, &fakeAPIError{Code: "NoSuchVersion"}
+		}
+	}
+	return nil, &types.NoSuchKey{}
+}
+
+func (c *fakeS3Client) ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	c.ListCalls++
+	if c.DenyListVersions {
+		return nil, &fakeAPIError{Code: "AccessDenied"}
+	}
+	if c.ListCalls == c.FailListCall {
+		return nil, &fakeAPIError{Code: "InternalError"}
+	}
+	output := &s3.ListObjectVersionsOutput{EncodingType: params.EncodingType}
+	encode := func(key string) *string {
+		if params.EncodingType == types.EncodingTypeUrl {
+			key = url.QueryEscape(key)
+		}
+		return aws.String(key)
+	}
+	// Listing starts after the object identified by the markers, if any.
+	skipping := params.KeyMarker != nil
+	n := 0
+	var last *fakeS3Object
+	for _, o := range c.Objects {
+		if !strings.HasPrefix(o.Key, aws.ToString(params.Prefix)) {
+			continue
+		}
+		if skipping {
+			skipping = o.Key != aws.ToString(params.KeyMarker) || o.VersionID != aws.ToString(params.VersionIdMarker)
+			continue
+		}
+		if c.PageSize > 0 && n == c.PageSize {
+			output.IsTruncated = true
+			output.NextKeyMarker = encode(last.Key)
+			output.NextVersionIdMarker = aws.String(last.VersionID)
+			break
+		}
+		n++
+		last = o
+		if o.DeleteMarker {
+			output.DeleteMarkers = append(output.DeleteMarkers, types.DeleteMarkerEntry{
+				Key:          encode(o.Key),
+				VersionId:    aws.String(o.VersionID),
+				LastModified: aws.Time(o.LastModified),
+			})
+			continue
+		}
+		output.Versions = append(output.Versions, types.ObjectVersion{
+			ETag:         aws.String(o.ETag),
+			Key:          encode(o.Key),
+			VersionId:    aws.String(o.VersionID),
+			LastModified: aws.Time(o.LastModified),
+			Size:         int64(len(o.Data)),
+			StorageClass: types.ObjectVersionStorageClass(o.StorageClass),
+		})
+	}
+	return output, nil
+}
+
+func (c *fakeS3Client) GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error) {
+	return &s3.GetBucketVersioningOutput{Status: c.VersioningStatus}, nil
+}
+
+func (c *fakeS3Client) GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error) {
+	c.LocationCalls++
+	return &s3.GetBucketLocationOutput{LocationConstraint: c.Location}, nil
+}
+
+func (c *fakeS3Client) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	key := aws.ToString(params.Key)
+	version := aws.ToString(params.VersionId)
+	for _, o := range c.Objects {
+		if o.Key != key || (version != "" && o.VersionID != version) {
+			continue
+		}
+		output := &s3.GetObjectTaggingOutput{VersionId: aws.String(o.VersionID)}
+		for k, v := range o.Tags {
+			output.TagSet = append(output.TagSet, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		return output, nil
+	}
+	return nil, &types.NoSuchKey{}
+}
+
+func (c *fakeS3Client) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	c.RestoreObjectInputs = append(c.RestoreObjectInputs, params)
+	key := aws.ToString(params.Key)
+	version := aws.ToString(params.VersionId)
+	for _, o := range c.Objects {
+		if o.Key != key || (version != "" && o.VersionID != version) {
+			continue
+		}
+		if !isArchivalStorageClass(o.StorageClass) {
+			return nil, &fakeAPIError{Code: "ObjectAlreadyInActiveTierError"}
+		}
+		if o.RestoreInProgress {
+			return nil, &fakeAPIError{Code: "RestoreAlreadyInProgress"}
+		}
+		return &s3.RestoreObjectOutput{}, nil
+	}
+	return nil, &types.NoSuchKey{}
+}
+
+func (c *fakeS3Client) GetObjectAcl(ctx context.Context, params *s3.GetObjectAclInput, optFns ...func(*s3.Options)) (*s3.GetObjectAclOutput, error) {
+	key := aws.ToString(params.Key)
+	version := aws.ToString(params.VersionId)
+	for _, o := range c.Objects {
+		if o.Key != key || (version != "" && o.VersionID != version) {
+			continue
+		}
+		return &s3.GetObjectAclOutput{
+			Owner:  &types.Owner{ID: aws.String("owner-id")},
+			Grants: o.Grants,
+		}, nil
+	}
+	return nil, &types.NoSuchKey{}
+}
+
+func (c *fakeS3Client) GetBucketOwnershipControls(ctx context.Context, params *s3.GetBucketOwnershipControlsInput, optFns ...func(*s3.Options)) (*s3.GetBucketOwnershipControlsOutput, error) {
+	if c.ObjectOwnership == "" {
+		return nil, &fakeAPIError{Code: "OwnershipControlsNotFoundError"}
+	}
+	return &s3.GetBucketOwnershipControlsOutput{
+		OwnershipControls: &types.OwnershipControls{
+			Rules: []types.OwnershipControlsRule{{ObjectOwnership: c.ObjectOwnership}},
+		},
+	}, nil
+}
+
+func (c *fakeS3Client) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	c.HeadBucketCalls++
+	if c.DenyHeadBucket {
+		return nil, &fakeAPIError{Code: "AccessDenied"}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (c *fakeS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	c.HeadCalls++
+	key := aws.ToString(params.Key)
+	version := aws.ToString(params.VersionId)
+	for _, o := range c.Objects {
+		if o.Key != key || (version != "" && o.VersionID != version) {
+			continue
+		}
+		if o.DeleteMarker {
+			return nil, &fakeHTTPError{StatusCode: http.StatusMethodNotAllowed}
+		}
+		return &s3.HeadObjectOutput{
+			ContentLength: int64(len(o.Data)),
+			LastModified:  aws.Time(o.LastModified),
+			VersionId:     aws.String(o.VersionID),
+		}, nil
+	}
+	return nil, &types.NotFound{}
+}
+
+// ListObjectsV2 lists the keys of all objects matching the input's prefix
+// whose latest version is not a delete marker. If the input has a delimiter,
+// keys containing it after the prefix are rolled up into common prefixes.
+// Versions of the same key are expected to be ordered from newest to oldest.
+func (c *fakeS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	output := &s3.ListObjectsV2Output{}
+	prefix := aws.ToString(params.Prefix)
+	delimiter := aws.ToString(params.Delimiter)
+	seen := map[string]bool{}
+	for _, o := range c.Objects {
+		if seen[o.Key] || !strings.HasPrefix(o.Key, prefix) {
+			continue
+		}
+		seen[o.Key] = true
+		if o.DeleteMarker {
+			continue
+		}
+		if delimiter != "" {
+			rest := o.Key[len(prefix):]
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				common := prefix + rest[:i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					output.CommonPrefixes = append(output.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(common)})
+				}
+				continue
+			}
+		}
+		output.Contents = append(output.Contents, types.Object{
+			Key:          aws.String(o.Key),
+			LastModified: aws.Time(o.LastModified),
+			Size:         int64(len(o.Data)),
+			StorageClass: types.ObjectStorageClass(o.StorageClass),
+		})
+	}
+	return output, nil
+}
+
+func TestS3HSDSDomainLoader_LoadDomainVersions(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), DeleteMarker: true},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data"), ETag: `"8d777f385d3dfec8815d20f7496026dc"`},
+			{Key: "db/00000000-00000000/.group.json", VersionID: "other", LastModified: testTimestamp},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	versions, err := loader.LoadDomainVersions(context.Background(), &hsdsDomain{Root: &testRootID})
+	if err != nil {
+		t.Fatalf("LoadDomainVersions() err = %v (want nil)", err)
+	}
+
+	if len(versions) != 1 {
+		t.Fatalf("LoadDomainVersions() = %d keys (want 1)", len(versions))
+	}
+	vv := versions[testChunkKey]
+	if len(vv) != 2 {
+		t.Fatalf("LoadDomainVersions() = %d versions of %s (want 2)", len(vv), testChunkKey)
+	}
+	if vv[0].ID != "chunk-v2" || !vv[0].DeleteMarker {
+		t.Errorf("LoadDomainVersions() latest = %+v (want delete marker chunk-v2)", vv[0])
+	}
+	if vv[1].ID != "chunk-v1" || vv[1].DeleteMarker || vv[1].Size != 4 {
+		t.Errorf("LoadDomainVersions() oldest = %+v (want 4 byte version chunk-v1)", vv[1])
+	}
+	if want := "8d777f385d3dfec8815d20f7496026dc"; vv[1].ETag != want {
+		t.Errorf("LoadDomainVersions() ETag = %q (want %q)", vv[1].ETag, want)
+	}
+}
+
+func TestS3HSDSDomainLoader_AccessPointARN(t *testing.T) {
+	arn := "arn:aws:s3:eu-central-1:123456789012:accesspoint/hsds"
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: arn}
+	_, err := loader.LoadObject(context.Background(), testChunkKey, "chunk-v1")
+	if err != nil {
+		t.Fatalf("LoadObject() err = %v (want nil)", err)
+	}
+	if len(client.GetObjectInputs) != 1 || aws.ToString(client.GetObjectInputs[0].Bucket) != arn {
+		t.Errorf("LoadObject() requested %v (want bucket %s)", client.GetObjectInputs, arn)
+	}
+
+	region, err := loader.BucketRegion(context.Background())
+	if err != nil || region != "eu-central-1" {
+		t.Errorf("BucketRegion() = %q, %v (want %q)", region, err, "eu-central-1")
+	}
+	if client.LocationCalls != 0 {
+		t.Errorf("BucketRegion() called GetBucketLocation %d times (want 0)", client.LocationCalls)
+	}
+}
+
+func TestS3HSDSDomainLoader_LoadPrefixVersionsURLEncoded(t *testing.T) {
+	spaceKey := "db/d12a20a5-6c27622f/notes and logs/read me.txt"
+	unicodeKey := "db/d12a20a5-6c27622f/größe+ü.json"
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: spaceKey, VersionID: "space-v2", LastModified: testTimestamp.Add(time.Hour), DeleteMarker: true},
+			{Key: spaceKey, VersionID: "space-v1", LastModified: testTimestamp, Data: []byte("data")},
+			{Key: unicodeKey, VersionID: "unicode-v1", LastModified: testTimestamp, Data: []byte("data")},
+		},
+		// Pages of a single version require the key marker to be decoded
+		// before it is sent back.
+		PageSize: 1,
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket", URLEncodeKeys: true}
+	versions, err := loader.LoadPrefixVersions(context.Background(), "db/d12a20a5-6c27622f/")
+	if err != nil {
+		t.Fatalf("LoadPrefixVersions() err = %v (want nil)", err)
+	}
+	if len(versions) != 2 || len(versions[spaceKey]) != 2 || len(versions[unicodeKey]) != 1 {
+		t.Errorf("LoadPrefixVersions() = %v (want 2 versions of %q and 1 of %q)", versions, spaceKey, unicodeKey)
+	}
+	if client.ListCalls != 3 {
+		t.Errorf("LoadPrefixVersions() made %d calls (want 3)", client.ListCalls)
+	}
+}
+
+func TestS3HSDSDomainLoader_LoadDomainVersionsPaginated(t *testing.T) {
+	datasetKey := "db/d12a20a5-6c27622f/d/693e-302825-f8c087/.dataset.json"
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+			{Key: datasetKey, VersionID: "dataset-v1", LastModified: testTimestamp, Data: []byte("dataset")},
+			// The versions of the chunk are split across the second
+			// and third page.
+			{Key: testChunkKey, VersionID: "chunk-v3", LastModified: testTimestamp.Add(2 * time.Hour), DeleteMarker: true},
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new data")},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+		},
+		PageSize: 2,
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	versions, err := loader.LoadDomainVersions(context.Background(), &hsdsDomain{Root: &testRootID})
+	if err != nil {
+		t.Fatalf("LoadDomainVersions() err = %v (want nil)", err)
+	}
+	if client.ListCalls != 3 {
+		t.Errorf("ListObjectVersions() calls = %d (want 3)", client.ListCalls)
+	}
+	want := map[string]string{
+		testGroupKey: "group-v1",
+		datasetKey:   "dataset-v1",
+		testChunkKey: "chunk-v3,chunk-v2,chunk-v1",
+	}
+	if len(versions) != len(want) {
+		t.Errorf("LoadDomainVersions() = %v (want versions of %d objects)", versions, len(want))
+	}
+	for key, ids := range want {
+		var got []string
+		for _, v := range versions[key] {
+			got = append(got, v.ID)
+		}
+		if strings.Join(got, ",") != ids {
+			t.Errorf("LoadDomainVersions() %s = %v (want %s)", key, got, ids)
+		}
+	}
+}
+
+func TestS3HSDSDomainLoader_LoadDomainVersionsCheckpoint(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+			{Key: testChunkKey, VersionID: "chunk-v3", LastModified: testTimestamp.Add(2 * time.Hour), DeleteMarker: true},
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new data")},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+		},
+		PageSize:     1,
+		FailListCall: 3,
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket", ListCheckpoint: checkpoint}
+	domain := &hsdsDomain{Root: &testRootID}
+	_, err := loader.LoadDomainVersions(context.Background(), domain)
+	if err == nil {
+		t.Fatalf("LoadDomainVersions() err = nil (want interrupted listing)")
+	}
+
+	// The listing resumes after the second page.
+	versions, err := loader.LoadDomainVersions(context.Background(), domain)
+	if err != nil {
+		t.Fatalf("LoadDomainVersions() err = %v (want nil)", err)
+	}
+	if client.ListCalls != 5 {
+		t.Errorf("ListObjectVersions() calls = %d (want 5)", client.ListCalls)
+	}
+	var ids []string
+	for _, key := range []string{testGroupKey, testChunkKey} {
+		for _, v := range versions[key] {
+			ids = append(ids, v.ID)
+		}
+	}
+	if got, want := strings.Join(ids, ","), "group-v1,chunk-v3,chunk-v2,chunk-v1"; got != want {
+		t.Errorf("LoadDomainVersions() = %s (want %s)", got, want)
+	}
+
+	listings, err := readListingCheckpoints(checkpoint)
+	if err != nil || len(listings) != 0 {
+		t.Errorf("checkpoints after complete listing = %v, %v (want none)", listings, err)
+	}
+}
+
+// fakeDomainS3Loader is an s3HSDSDomainLoader that serves Domain for all
+// domain names instead of loading it from the bucket.
+type fakeDomainS3Loader struct {
+	s3HSDSDomainLoader
+	Domain *hsdsDomain
+}
+
+func TestS3HSDSDomainLoader_LoadDomainVersionsDenied(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v2", LastModified: testTimestamp.Add(time.Hour), Data: []byte("new data")},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+		},
+		DenyListVersions: true,
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	for i := 0; i < 2; i++ {
+		versions, err := loader.LoadDomainVersions(context.Background(), &hsdsDomain{Root: &testRootID})
+		if err != nil {
+			t.Fatalf("LoadDomainVersions() err = %v (want nil)", err)
+		}
+		vv := versions[testChunkKey]
+		if len(versions) != 1 || len(vv) != 1 {
+			t.Fatalf("LoadDomainVersions() = %v (want the current version of %s)", versions, testChunkKey)
+		}
+		if vv[0].ID != "" || vv[0].Size != 8 || !vv[0].LastModified.Equal(testTimestamp.Add(time.Hour)) {
+			t.Errorf("LoadDomainVersions() = %+v (want current version without ID)", vv[0])
+		}
+	}
+	if n := strings.Count(warnings.String(), "-b is unavailable"); n != 1 {
+		t.Errorf("LoadDomainVersions() warned %d times (want once): %q", n, warnings.String())
+	}
+
+	data, err := loader.LoadObject(context.Background(), testChunkKey, "")
+	if err != nil || string(data) != "new data" {
+		t.Errorf("LoadObject() = %q, %v (want current version)", data, err)
+	}
+}
+
+func (l *fakeDomainS3Loader) LoadDomain(ctx context.Context, name string) (*hsdsDomain, error) {
+	return l.Domain, nil
+}
+
+func TestS3HSDSDomainLoader_ListDatabasePrefixes(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp},
+			{Key: "db/00000000-00000000/.group.json", VersionID: "other", LastModified: testTimestamp},
+			{Key: "db/11111111-11111111/.group.json", VersionID: "deleted", LastModified: testTimestamp, DeleteMarker: true},
+			{Key: "home/user/domain.h5/.domain.json", VersionID: "domain", LastModified: testTimestamp},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	prefixes, err := loader.ListDatabasePrefixes(context.Background())
+	if err != nil {
+		t.Fatalf("ListDatabasePrefixes() err = %v (want nil)", err)
+	}
+	want := []string{"db/d12a20a5-6c27622f", "db/00000000-00000000"}
+	if !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("ListDatabasePrefixes() = %q (want %q)", prefixes, want)
+	}
+}
+
+func TestS3HSDSDomainLoader_LoadDomainNotFound(t *testing.T) {
+	for _, validate := range []bool{false, true} {
+		loader := &s3HSDSDomainLoader{Client: &fakeS3Client{}, Bucket: "bucket", ValidateSchema: validate}
+		_, err := loader.LoadDomain(context.Background(), "home/user/missing.h5")
+		var notFound *domainNotFoundError
+		if !errors.As(err, &notFound) || notFound.Name != "home/user/missing.h5" {
+			t.Errorf("validate %v: LoadDomain() err = %v (want *domainNotFoundError)", validate, err)
+		}
+	}
+}
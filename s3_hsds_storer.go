@@ -0,0 +1,146 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3StorerAPI is the subset of the AWS S3 API used by s3HSDSStorer.
+type s3StorerAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+	PutObjectAcl(ctx context.Context, params *s3.PutObjectAclInput, optFns ...func(*s3.Options)) (*s3.PutObjectAclOutput, error)
+}
+
+// s3HSDSStorer is an implementation of the hsdsStorer interface that uses an
+// S3 bucket as its underlying storage. Domains and objects are stored under
+// the same keys as in the source bucket, below Prefix.
+type s3HSDSStorer struct {
+	// Client is the AWS S3 client used to send requests to the AWS S3 API.
+	Client s3StorerAPI
+	// Bucket is the bucket domains and domain objects are stored in.
+	Bucket string
+	// Prefix is prepended to the keys of all stored domains and objects.
+	Prefix string
+	// Region is the region of Bucket. Objects loaded from a bucket in the
+	// same region are copied server-side instead of being uploaded.
+	Region string
+}
+
+func (s *s3HSDSStorer) key(name string) string {
+	return path.Join(s.Prefix, name)
+}
+
+func (s *s3HSDSStorer) put(ctx context.Context, name string, data []byte) error {
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(s.key(name)),
+		Body:          bytes.NewReader(data),
+		ContentLength: int64(len(data)),
+	})
+	return err
+}
+
+func (s *s3HSDSStorer) StoreDomain(ctx context.Context, name string, domain *hsdsDomain) error {
+	b, err := json.Marshal(domain)
+	if err != nil {
+		return err
+	}
+	return s.put(ctx, path.Join(name, domainFileName), b)
+}
+
+func (s *s3HSDSStorer) StoreObject(ctx context.Context, name string, data []byte) error {
+	return s.put(ctx, name, data)
+}
+
+// StoreObjectTags replaces the tag set of the object stored under name with
+// tags.
+func (s *s3HSDSStorer) StoreObjectTags(ctx context.Context, name string, tags map[string]string) error {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tagSet := make([]types.Tag, len(keys))
+	for i, key := range keys {
+		tagSet[i] = types.Tag{Key: aws.String(key), Value: aws.String(tags[key])}
+	}
+	_, err := s.Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(s.Bucket),
+		Key:     aws.String(s.key(name)),
+		Tagging: &types.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+// CanCopyFrom reports whether objects loaded by l can be copied server-side,
+// which is the case if both buckets are known to be in the same region.
+func (s *s3HSDSStorer) CanCopyFrom(ctx context.Context, l *s3HSDSDomainLoader) bool {
+	if s.Region == "" {
+		return false
+	}
+	region, err := l.BucketRegion(ctx)
+	if err != nil {
+		warn("cannot determine region of bucket %s, objects are downloaded: %v", l.Bucket, err)
+		return false
+	}
+	return s.Region == region
+}
+
+// CopyObject copies the given version of the object identified by name from
+// the bucket of l to the storer's bucket, without downloading it.
+func (s *s3HSDSStorer) CopyObject(ctx context.Context, l *s3HSDSDomainLoader, name, version string) error {
+	segments := strings.Split(name, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	source := l.Bucket + "/" + strings.Join(segments, "/")
+	if version != "" {
+		source += "?versionId=" + url.QueryEscape(version)
+	}
+	_, err := s.Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.Bucket),
+		CopySource: aws.String(source),
+		Key:        aws.String(s.key(name)),
+	})
+	var archived *types.InvalidObjectState
+	if errors.As(err, &archived) {
+		return &archivedObjectError{Name: name, Version: version, StorageClass: string(archived.StorageClass)}
+	}
+	return err
+}
+
+// serverSideCopier returns a function copying objects from loader to storer
+// without downloading them, or nil if that is not possible.
+func serverSideCopier(ctx context.Context, loader hsdsObjectLoader, storer hsdsStorer) func(ctx context.Context, name, version string) error {
+	var l *s3HSDSDomainLoader
+	ok := findLoader(loader, func(ol interface{}) (ok bool) {
+		l, ok = ol.(*s3HSDSDomainLoader)
+		return ok
+	})
+	if !ok {
+		return nil
+	}
+	s, ok := storer.(*s3HSDSStorer)
+	if !ok || !s.CanCopyFrom(ctx, l) {
+		return nil
+	}
+	return func(ctx context.Context, name, version string) error {
+		return s.CopyObject(ctx, l, name, version)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3StorerClient is an in-memory implementation of the s3StorerAPI
+// interface recording all stored objects and copy requests.
+type fakeS3StorerClient struct {
+	// Objects maps keys to the data stored with PutObject.
+	Objects map[string][]byte
+	// Copies records the inputs of all CopyObject calls.
+	Copies []*s3.CopyObjectInput
+	// Tags maps keys to the tag sets stored with PutObjectTagging.
+	Tags map[string][]types.Tag
+	// ACLs maps keys to the access control policies stored with
+	// PutObjectAcl.
+	ACLs map[string]*types.AccessControlPolicy
+}
+
+func (c *fakeS3StorerClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Objects == nil {
+		c.Objects = map[string][]byte{}
+	}
+	c.Objects[aws.ToString(params.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *fakeS3StorerClient) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if c.Tags == nil {
+		c.Tags = map[string][]types.Tag{}
+	}
+	c.Tags[aws.ToString(params.Key)] = params.Tagging.TagSet
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (c *fakeS3StorerClient) PutObjectAcl(ctx context.Context, params *s3.PutObjectAclInput, optFns ...func(*s3.Options)) (*s3.PutObjectAclOutput, error) {
+	if c.ACLs == nil {
+		c.ACLs = map[string]*types.AccessControlPolicy{}
+	}
+	c.ACLs[aws.ToString(params.Key)] = params.AccessControlPolicy
+	return &s3.PutObjectAclOutput{}, nil
+}
+
+func (c *fakeS3StorerClient) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	c.Copies = append(c.Copies, params)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func TestExecutePlan_ServerSideCopy(t *testing.T) {
+	source := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+		},
+	}
+	plan := &replicationPlan{
+		Bucket: "bucket",
+		Domains: []*domainPlan{{
+			Name:   "home/user/domain.h5",
+			Domain: &hsdsDomain{Root: &testRootID},
+			Objects: map[string]*hsdsVersion{
+				testChunkKey: {ID: "chunk-v1", LastModified: testTimestamp, Size: 4},
+			},
+		}},
+	}
+
+	for _, region := range []string{"eu-central-1", "us-east-1"} {
+		loader := &s3HSDSDomainLoader{Client: source, Bucket: "bucket", Region: "eu-central-1"}
+		client := &fakeS3StorerClient{}
+		storer := &s3HSDSStorer{Client: client, Bucket: "archive", Prefix: "restore", Region: region}
+		source.GetObjectInputs = nil
+
+		err := executePlan(loader, storer, plan, &runOptions{})
+		if err != nil {
+			t.Fatalf("%s: executePlan() err = %v (want nil)", region, err)
+		}
+		if _, ok := client.Objects["restore/home/user/domain.h5/.domain.json"]; !ok {
+			t.Errorf("%s: executePlan() did not store the domain", region)
+		}
+
+		if region != loader.Region {
+			if len(client.Copies) != 0 || string(client.Objects["restore/"+testChunkKey]) != "data" {
+				t.Errorf("%s: executePlan() copied %d objects (want upload across regions)", region, len(client.Copies))
+			}
+			continue
+		}
+		if len(source.GetObjectInputs) != 0 {
+			t.Errorf("%s: executePlan() downloaded %d objects (want 0)", region, len(source.GetObjectInputs))
+		}
+		if len(client.Copies) != 1 {
+			t.Fatalf("%s: executePlan() copied %d objects (want 1)", region, len(client.Copies))
+		}
+		want := "bucket/" + testChunkKey + "?versionId=chunk-v1"
+		if got := aws.ToString(client.Copies[0].CopySource); got != want {
+			t.Errorf("%s: CopyObject() source = %q (want %q)", region, got, want)
+		}
+		if got := aws.ToString(client.Copies[0].Key); got != "restore/"+testChunkKey {
+			t.Errorf("%s: CopyObject() key = %q (want %q)", region, got, "restore/"+testChunkKey)
+		}
+	}
+}
+
+func TestExecutePlan_RegionResolvedOnce(t *testing.T) {
+	source := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+		},
+		Location: "eu-central-1",
+	}
+	plan := &replicationPlan{Bucket: "bucket"}
+	for _, name := range []string{"home/user/a.h5", "home/user/b.h5", "home/user/c.h5"} {
+		plan.Domains = append(plan.Domains, &domainPlan{
+			Name:   name,
+			Domain: &hsdsDomain{Root: &testRootID},
+			Objects: map[string]*hsdsVersion{
+				testChunkKey: {ID: "chunk-v1", LastModified: testTimestamp, Size: 4},
+			},
+		})
+	}
+	loader := &s3HSDSDomainLoader{Client: source, Bucket: "bucket"}
+	client := &fakeS3StorerClient{}
+	storer := &s3HSDSStorer{Client: client, Bucket: "archive", Region: "eu-central-1"}
+
+	err := executePlan(loader, storer, plan, &runOptions{})
+	if err != nil {
+		t.Fatalf("executePlan() err = %v (want nil)", err)
+	}
+	if source.LocationCalls != 1 {
+		t.Errorf("executePlan() resolved the region %d times (want 1)", source.LocationCalls)
+	}
+	if len(client.Copies) != len(plan.Domains) {
+		t.Errorf("executePlan() copied %d objects (want %d)", len(client.Copies), len(plan.Domains))
+	}
+}
+
+type bucketRegionTestcase struct {
+	location types.BucketLocationConstraint
+	want     string
+}
+
+func TestS3HSDSDomainLoader_BucketRegion(t *testing.T) {
+	testCases := []bucketRegionTestcase{
+		{location: "", want: "us-east-1"},
+		{location: "EU", want: "eu-west-1"},
+		{location: "eu-central-1", want: "eu-central-1"},
+	}
+
+	for _, tc := range testCases {
+		loader := &s3HSDSDomainLoader{Client: &fakeS3Client{Location: tc.location}, Bucket: "bucket"}
+		got, err := loader.BucketRegion(context.Background())
+		if err != nil || got != tc.want {
+			t.Errorf("%q: BucketRegion() = %q, %v (want %q)", tc.location, got, err, tc.want)
+		}
+	}
+}
+
+func TestExecutePlan_CaptureTags(t *testing.T) {
+	tags := map[string]string{"project": "hsds", "retention": "7y"}
+	source := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data"), Tags: tags},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+	plan := &replicationPlan{
+		Bucket: "bucket",
+		Domains: []*domainPlan{{
+			Name:   "home/user/domain.h5",
+			Domain: &hsdsDomain{Root: &testRootID},
+			Objects: map[string]*hsdsVersion{
+				testChunkKey: {ID: "chunk-v1", LastModified: testTimestamp, Size: 4},
+				testGroupKey: {ID: "group-v1", LastModified: testTimestamp, Size: 5},
+			},
+		}},
+	}
+	loader := &s3HSDSDomainLoader{Client: source, Bucket: "bucket"}
+
+	fsStorer := &filesystemHSDSStorer{Root: t.TempDir(), Manifest: newManifest()}
+	err := executePlan(loader, fsStorer, plan, &runOptions{CaptureTags: true, Manifest: fsStorer.Manifest})
+	if err != nil {
+		t.Fatalf("executePlan() err = %v (want nil)", err)
+	}
+	if entry := fsStorer.Manifest.Entry(testChunkKey); entry == nil || !reflect.DeepEqual(entry.Tags, tags) {
+		t.Errorf("manifest entry = %+v (want tags %v)", entry, tags)
+	}
+	if entry := fsStorer.Manifest.Entry(testGroupKey); entry == nil || entry.Tags != nil {
+		t.Errorf("manifest entry = %+v (want no tags)", entry)
+	}
+
+	client := &fakeS3StorerClient{}
+	s3Storer := &s3HSDSStorer{Client: client, Bucket: "archive", Prefix: "restore"}
+	err = executePlan(loader, s3Storer, plan, &runOptions{CaptureTags: true})
+	if err != nil {
+		t.Fatalf("executePlan() err = %v (want nil)", err)
+	}
+	got := map[string]string{}
+	for _, tag := range client.Tags["restore/"+testChunkKey] {
+		got[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	if !reflect.DeepEqual(got, tags) {
+		t.Errorf("stored tags = %v (want %v)", got, tags)
+	}
+	if _, ok := client.Tags["restore/"+testGroupKey]; ok {
+		t.Errorf("stored tags for untagged object %s", testGroupKey)
+	}
+}
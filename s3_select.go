@@ -0,0 +1,132 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// errNoSelector indicates that a loader has no s3Selector to send S3 Select
+// requests with.
+var errNoSelector = errors.New("s3 select: no selector configured")
+
+// errCurrentVersionChanged indicates that the current version of an object
+// is not the version that was expected to be selected.
+var errCurrentVersionChanged = errors.New("s3 select: current version changed")
+
+// s3Selector is the interface wrapping the SelectRecords method.
+//
+// SelectRecords sends the S3 Select request params and returns the
+// concatenated payloads of the records events of its response.
+type s3Selector interface {
+	SelectRecords(ctx context.Context, params *s3.SelectObjectContentInput) ([]byte, error)
+}
+
+// s3ClientSelector is an s3Selector that sends its requests with an AWS S3
+// client.
+type s3ClientSelector struct {
+	Client *s3.Client
+}
+
+func (s *s3ClientSelector) SelectRecords(ctx context.Context, params *s3.SelectObjectContentInput) ([]byte, error) {
+	out, err := s.Client.SelectObjectContent(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	stream := out.GetStream()
+	defer stream.Close()
+
+	var buf bytes.Buffer
+	for event := range stream.Events() {
+		if records, ok := event.(*types.SelectObjectContentEventStreamMemberRecords); ok {
+			buf.Write(records.Value.Payload)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// hsdsObjectFieldSelector is the interface wrapping the SelectObjectFields
+// method.
+//
+// SelectObjectFields returns a JSON object that contains only the given
+// top-level fields of the given version of the JSON object name, which must
+// be its current version. Fields that the object does not have are left out.
+// If version is not the current version, errCurrentVersionChanged is
+// returned.
+type hsdsObjectFieldSelector interface {
+	SelectObjectFields(ctx context.Context, name, version string, fields []string) ([]byte, error)
+}
+
+// selectExpression returns the S3 Select SQL expression that selects the
+// given top-level fields of a JSON document.
+func selectExpression(fields []string) string {
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = `s."` + strings.Replace(field, `"`, `""`, -1) + `"`
+	}
+	return "SELECT " + strings.Join(columns, ", ") + " FROM S3Object s"
+}
+
+// SelectObjectFields loads the given fields of the object name with S3
+// Select, which saves transferring the rest of large metadata objects. The
+// request does not name a version, as SelectObjectContentInput has no version
+// ID in the SDK release used here, so it reads the version that is current
+// when it is sent. It must only be used if version was current when the
+// domain's versions were listed. That listing may be stale by the time the
+// fields are selected, so the current version is compared to version after
+// selecting them.
+func (l *s3HSDSDomainLoader) SelectObjectFields(ctx context.Context, name, version string, fields []string) ([]byte, error) {
+	if l.Selector == nil {
+		return nil, errNoSelector
+	}
+	data, err := l.Selector.SelectRecords(ctx, &s3.SelectObjectContentInput{
+		Bucket:         aws.String(l.Bucket),
+		Key:            aws.String(name),
+		Expression:     aws.String(selectExpression(fields)),
+		ExpressionType: types.ExpressionTypeSql,
+		InputSerialization: &types.InputSerialization{
+			JSON: &types.JSONInput{Type: types.JSONTypeDocument},
+		},
+		OutputSerialization: &types.OutputSerialization{
+			JSON: &types.JSONOutput{RecordDelimiter: aws.String("\n")},
+		},
+	})
+	if isNoSuchObject(err) {
+		return nil, fmt.Errorf("%w: %s: %v", errObjectUnavailable, name, err)
+	} else if err != nil {
+		return nil, err
+	}
+	// A JSON document is a single record.
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.ContainsRune(data, '\n') {
+		return nil, fmt.Errorf("s3 select: %s: expected a single record", name)
+	}
+
+	// The object may have been overwritten since it was listed. If version
+	// is still current after selecting it, it was current while it was
+	// selected, as overwriting an object creates a new version.
+	head, err := l.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if current := aws.ToString(head.VersionId); current != version {
+		return nil, fmt.Errorf("%w: %s: %s instead of %s", errCurrentVersionChanged, name, current, version)
+	}
+	return data, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3Selector is an s3Selector that returns Records for every request.
+type fakeS3Selector struct {
+	Records string
+	// Input is the last request sent.
+	Input *s3.SelectObjectContentInput
+}
+
+func (s *fakeS3Selector) SelectRecords(ctx context.Context, params *s3.SelectObjectContentInput) ([]byte, error) {
+	s.Input = params
+	return []byte(s.Records), nil
+}
+
+type selectExpressionTestcase struct {
+	fields []string
+	want   string
+}
+
+func TestSelectExpression(t *testing.T) {
+	testcases := []selectExpressionTestcase{
+		{[]string{"links"}, `SELECT s."links" FROM S3Object s`},
+		{[]string{"type", "shape"}, `SELECT s."type", s."shape" FROM S3Object s`},
+		{[]string{`a"b`}, `SELECT s."a""b" FROM S3Object s`},
+	}
+	for _, tc := range testcases {
+		got := selectExpression(tc.fields)
+		if got != tc.want {
+			t.Errorf("%q: selectExpression() = %q (want %q)", tc.fields, got, tc.want)
+		}
+	}
+}
+
+func TestS3HSDSDomainLoader_SelectObjectFields(t *testing.T) {
+	selector := &fakeS3Selector{Records: `{"links":{"data":{"class":"H5L_TYPE_HARD"}}}` + "\n"}
+	client := &fakeS3Client{Objects: []*fakeS3Object{
+		{Key: testGroupKey, VersionID: "group-v2", LastModified: testTimestamp},
+		{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp},
+	}}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket", Selector: selector}
+
+	data, err := loader.SelectObjectFields(context.Background(), testGroupKey, "group-v2", []string{"links"})
+	if err != nil {
+		t.Fatalf("SelectObjectFields() err = %v (want nil)", err)
+	}
+	var g hsdsGroup
+	err = json.Unmarshal(data, &g)
+	if err != nil {
+		t.Fatalf("SelectObjectFields() = %q: %v", data, err)
+	}
+	if link, ok := g.Links["data"]; !ok || link.Class != hsdsLinkClassHard {
+		t.Errorf("SelectObjectFields() links = %v (want hard link data)", g.Links)
+	}
+
+	in := selector.Input
+	if aws.ToString(in.Bucket) != "bucket" || aws.ToString(in.Key) != testGroupKey {
+		t.Errorf("SelectObjectFields() selected from %s/%s (want bucket/%s)", aws.ToString(in.Bucket), aws.ToString(in.Key), testGroupKey)
+	}
+	if in.ExpressionType != types.ExpressionTypeSql || aws.ToString(in.Expression) != `SELECT s."links" FROM S3Object s` {
+		t.Errorf("SelectObjectFields() expression = %s %q", in.ExpressionType, aws.ToString(in.Expression))
+	}
+	if in.InputSerialization.JSON == nil || in.InputSerialization.JSON.Type != types.JSONTypeDocument {
+		t.Errorf("SelectObjectFields() input serialization = %+v (want JSON document)", in.InputSerialization)
+	}
+
+	_, err = loader.SelectObjectFields(context.Background(), testGroupKey, "group-v1", []string{"links"})
+	if !errors.Is(err, errCurrentVersionChanged) {
+		t.Errorf("SelectObjectFields() of a previous version err = %v (want %v)", err, errCurrentVersionChanged)
+	}
+
+	selector.Records = "{}\n{}\n"
+	_, err = loader.SelectObjectFields(context.Background(), testGroupKey, "group-v2", []string{"links"})
+	if err == nil {
+		t.Errorf("SelectObjectFields() with multiple records err = nil (want error)")
+	}
+
+	loader.Selector = nil
+	_, err = loader.SelectObjectFields(context.Background(), testGroupKey, "group-v2", []string{"links"})
+	if !errors.Is(err, errNoSelector) {
+		t.Errorf("SelectObjectFields() without selector err = %v (want %v)", err, errNoSelector)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// probeListLimit is the maximum number of object versions listed by -probe.
+const probeListLimit = 10
+
+// errProbeFailed indicates that at least one step of -probe has failed.
+var errProbeFailed = errors.New("probe failed")
+
+// setupProbe runs the steps of -probe, each of which depends on the previous
+// one, and reports their outcomes to w. Steps following a failed step are
+// skipped.
+type setupProbe struct {
+	w      io.Writer
+	failed bool
+}
+
+// step runs fn as the step called name, unless a previous step has failed.
+// fn returns a short description of its result.
+func (p *setupProbe) step(name string, fn func() (string, error)) {
+	if p.failed {
+		fmt.Fprintf(p.w, "skip  %s\n", name)
+		return
+	}
+	detail, err := fn()
+	if err != nil {
+		p.failed = true
+		fmt.Fprintf(p.w, "FAIL  %s: %v\n", name, err)
+		return
+	}
+	fmt.Fprintf(p.w, "ok    %s: %s\n", name, detail)
+}
+
+// probeSetup validates the setup of a dump of the domain identified by name
+// from the bucket of l without dumping it: it retrieves credentials from
+// creds, checks that the bucket is accessible, loads the domain, lists up to
+// probeListLimit versions of its objects and downloads the smallest of them
+// to a temporary file, which is removed afterwards. The outcome of each step
+// is reported to w. If any step fails, errProbeFailed is returned.
+func probeSetup(ctx context.Context, w io.Writer, creds aws.CredentialsProvider, l *s3HSDSDomainLoader, name string) error {
+	p := &setupProbe{w: w}
+	p.step("credentials", func() (string, error) {
+		if creds == nil {
+			return "", errors.New("no credentials configured")
+		}
+		c, err := creds.Retrieve(ctx)
+		if err != nil {
+			return "", err
+		}
+		if c.Source == "" {
+			return "access key " + c.AccessKeyID, nil
+		}
+		return fmt.Sprintf("access key %s from %s", c.AccessKeyID, c.Source), nil
+	})
+	p.step("bucket", func() (string, error) {
+		_, err := l.Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(l.Bucket)})
+		if err != nil {
+			return "", err
+		}
+		return l.Bucket, nil
+	})
+	var domain *hsdsDomain
+	p.step("domain", func() (string, error) {
+		var err error
+		domain, err = l.LoadDomain(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		if domain.Root == nil {
+			return "", fmt.Errorf("domain %q has no root group", name)
+		}
+		return fmt.Sprintf("%s with root group %s", name, domain.Root), nil
+	})
+	var smallest *types.ObjectVersion
+	p.step("versions", func() (string, error) {
+		output, err := l.Client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+			Bucket:  aws.String(l.Bucket),
+			Prefix:  aws.String(domain.DatabasePrefix() + "/"),
+			MaxKeys: probeListLimit,
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(output.Versions) == 0 {
+			return "", fmt.Errorf("no object versions below %s", domain.DatabasePrefix())
+		}
+		for i := range output.Versions {
+			if smallest == nil || output.Versions[i].Size < smallest.Size {
+				smallest = &output.Versions[i]
+			}
+		}
+		return fmt.Sprintf("%d versions below %s", len(output.Versions), domain.DatabasePrefix()), nil
+	})
+	p.step("download", func() (string, error) {
+		key := aws.ToString(smallest.Key)
+		data, err := l.LoadObject(ctx, key, aws.ToString(smallest.VersionId))
+		if err != nil {
+			return "", err
+		}
+		f, err := ioutil.TempFile("", "hss3dump-probe-")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(data)
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		err = f.Close()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (%d bytes)", key, len(data)), nil
+	})
+	if p.failed {
+		return errProbeFailed
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func newProbeClient() *fakeS3Client {
+	domainFile, _ := domainKey(nameEncodingPath, "home/user/domain.h5")
+	return &fakeS3Client{
+		Objects: []*fakeS3Object{
+			{Key: domainFile, VersionID: "domain-v1", LastModified: testTimestamp, Data: []byte(`{"root": "` + testRootID.String() + `"}`)},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data")},
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+		},
+	}
+}
+
+func TestProbeSetup(t *testing.T) {
+	creds := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID", Source: "test"}, nil
+	})
+	client := newProbeClient()
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	var out bytes.Buffer
+	err := probeSetup(context.Background(), &out, creds, loader, "home/user/domain.h5")
+	if err != nil {
+		t.Fatalf("probeSetup() err = %v (want nil)\n%s", err, out.String())
+	}
+	for _, step := range []string{"credentials", "bucket", "domain", "versions", "download"} {
+		if !strings.Contains(out.String(), "ok    "+step+": ") {
+			t.Errorf("probeSetup() output = %q (want step %s ok)", out.String(), step)
+		}
+	}
+	if client.HeadBucketCalls != 1 || client.ListCalls != 1 {
+		t.Errorf("probeSetup() issued %d HeadBucket and %d ListObjectVersions calls (want 1 each)", client.HeadBucketCalls, client.ListCalls)
+	}
+	// The domain file and the smallest object are downloaded.
+	if n := len(client.GetObjectInputs); n != 2 || aws.ToString(client.GetObjectInputs[1].Key) != testChunkKey {
+		t.Errorf("probeSetup() downloaded %d objects (want domain file and %s)", n, testChunkKey)
+	}
+}
+
+func TestProbeSetup_Failure(t *testing.T) {
+	creds := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID"}, nil
+	})
+	client := newProbeClient()
+	client.DenyHeadBucket = true
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	var out bytes.Buffer
+	err := probeSetup(context.Background(), &out, creds, loader, "home/user/domain.h5")
+	if !errors.Is(err, errProbeFailed) {
+		t.Errorf("probeSetup() err = %v (want %v)", err, errProbeFailed)
+	}
+	want := "ok    credentials: access key AKID\nFAIL  bucket: api error AccessDenied\nskip  domain\nskip  versions\nskip  download\n"
+	if out.String() != want {
+		t.Errorf("probeSetup() output = %q (want %q)", out.String(), want)
+	}
+	if len(client.GetObjectInputs) != 0 {
+		t.Errorf("probeSetup() downloaded %d objects after failing (want 0)", len(client.GetObjectInputs))
+	}
+}
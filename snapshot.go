@@ -0,0 +1,167 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTimestamp parses s either as an RFC3339 timestamp or, like the
+// timestamps in HSDS domain files, as the number of seconds since the Unix
+// epoch, which may have a fractional part.
+func parseTimestamp(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := math.Floor(f)
+		nsec := math.Round((f - sec) * 1e9)
+		return time.Unix(int64(sec), int64(nsec)), nil
+	}
+	return time.ParseInLocation(time.RFC3339, s, time.Local)
+}
+
+// domainTimePrefix is the prefix of -b values selecting a point in time
+// relative to each domain's last modification, e.g. domain-1h.
+const domainTimePrefix = "domain-"
+
+// parseDomainOffset parses s of the form domain-DURATION, e.g. domain-1h, and
+// returns the duration. The boolean result reports whether s has this form.
+func parseDomainOffset(s string) (time.Duration, bool, error) {
+	if !strings.HasPrefix(s, domainTimePrefix) {
+		return 0, false, nil
+	}
+	d, err := time.ParseDuration(strings.TrimPrefix(s, domainTimePrefix))
+	if err != nil {
+		return 0, true, err
+	}
+	if d < 0 {
+		return 0, true, fmt.Errorf("negative duration in %s", s)
+	}
+	return d, true, nil
+}
+
+// timestampList is a flag.Value collecting timestamps accepted by
+// parseTimestamp from repeated uses of the same flag.
+type timestampList []time.Time
+
+func (l *timestampList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, len(*l))
+	for i, t := range *l {
+		s[i] = t.Format(time.RFC3339)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *timestampList) Set(s string) error {
+	t, err := parseTimestamp(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, t)
+	return nil
+}
+
+// beforeValue is the flag.Value of -b. It collects timestamps in Times and
+// stores the duration of a value of the form domain-DURATION in DomainOffset.
+type beforeValue struct {
+	Times        timestampList
+	DomainOffset *time.Duration
+}
+
+func (v *beforeValue) String() string {
+	if v == nil {
+		return ""
+	}
+	s := v.Times.String()
+	if v.DomainOffset != nil {
+		if s != "" {
+			s += ","
+		}
+		s += domainTimePrefix + v.DomainOffset.String()
+	}
+	return s
+}
+
+func (v *beforeValue) Set(s string) error {
+	d, ok, err := parseDomainOffset(s)
+	if !ok {
+		return v.Times.Set(s)
+	}
+	if err != nil {
+		return err
+	}
+	if v.DomainOffset != nil {
+		return errors.New("only one timestamp relative to the domain's last modification is supported")
+	}
+	v.DomainOffset = &d
+	return nil
+}
+
+// snapshotDir returns the name of the directory the snapshot of the state at
+// t is stored in. It is based on t in UTC and avoids characters that are not
+// valid in file names on all platforms.
+func snapshotDir(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// deltaDir returns the name of the directory a dump of the changes after t is
+// stored in.
+func deltaDir(t time.Time) string {
+	return "delta-" + snapshotDir(t)
+}
+
+// memoVersionLoader is an hsdsLoader that keeps the results of the
+// underlying loader's LoadDomainVersions method in memory, so each domain is
+// only listed once per run. The optional interfaces of the underlying loader
+// are found through Unwrap.
+type memoVersionLoader struct {
+	hsdsLoader
+
+	versions map[string]map[string][]*hsdsVersion
+}
+
+func (l *memoVersionLoader) Unwrap() hsdsLoader {
+	return l.hsdsLoader
+}
+
+func (l *memoVersionLoader) LoadDomainVersions(ctx context.Context, domain *hsdsDomain) (map[string][]*hsdsVersion, error) {
+	key := domain.DatabasePrefix()
+	if versions, ok := l.versions[key]; ok {
+		return versions, nil
+	}
+	versions, err := l.hsdsLoader.LoadDomainVersions(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if l.versions == nil {
+		l.versions = map[string]map[string][]*hsdsVersion{}
+	}
+	l.versions[key] = versions
+	return versions, nil
+}
+
+// replicateSnapshots replicates the domains identified by domains once for
+// each of the given points in time. The snapshot of each point in time is
+// stored in the storer returned by newStorer for its snapshotDir. The version
+// listings of the domains are shared between all snapshots.
+func replicateSnapshots(loader hsdsLoader, newStorer func(dir string) hsdsStorer, domains []string, times []time.Time, opts *runOptions) error {
+	memo := &memoVersionLoader{hsdsLoader: loader}
+	for _, t := range times {
+		o := *opts
+		o.NotAfter = t
+		err := replicate(memo, newStorer(snapshotDir(t)), domains, &o)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplicateSnapshots(t *testing.T) {
+	loader := newTestLoader()
+	root := t.TempDir()
+	newStorer := func(dir string) hsdsStorer {
+		return &filesystemHSDSStorer{Root: filepath.Join(root, dir)}
+	}
+	times := []time.Time{testTimestamp, testTimestamp.Add(2 * time.Hour)}
+	err := replicateSnapshots(loader, newStorer, []string{"home/user/domain.h5"}, times, &runOptions{})
+	if err != nil {
+		t.Fatalf("replicateSnapshots() err = %v (want nil)", err)
+	}
+	if loader.VersionCalls != 1 {
+		t.Errorf("replicateSnapshots() list calls = %d (want 1)", loader.VersionCalls)
+	}
+
+	want := map[string]string{
+		"20221010T000000Z": "data",
+		"20221010T020000Z": "",
+	}
+	for dir, data := range want {
+		got, err := ioutil.ReadFile(filepath.Join(root, dir, filepath.FromSlash(testChunkKey)))
+		if err != nil {
+			t.Errorf("replicateSnapshots() did not store %s in %s: %v", testChunkKey, dir, err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("replicateSnapshots() stored %q in %s (want %q)", got, dir, data)
+		}
+	}
+}
+
+func TestTimestampList(t *testing.T) {
+	var l timestampList
+	for _, s := range []string{"2022-10-10T00:00:00Z", "2022-11-10T00:00:00+01:00"} {
+		err := l.Set(s)
+		if err != nil {
+			t.Fatalf("Set(%q) err = %v (want nil)", s, err)
+		}
+	}
+	err := l.Set("yesterday")
+	if err == nil {
+		t.Errorf("Set(%q) err = nil (want error)", "yesterday")
+	}
+	want := "2022-10-10T00:00:00Z,2022-11-10T00:00:00+01:00"
+	if l.String() != want {
+		t.Errorf("String() = %q (want %q)", l.String(), want)
+	}
+}
+
+func TestBeforeValue(t *testing.T) {
+	var v beforeValue
+	for _, s := range []string{"2022-10-10T00:00:00Z", "domain-1h30m"} {
+		err := v.Set(s)
+		if err != nil {
+			t.Fatalf("Set(%q) err = %v (want nil)", s, err)
+		}
+	}
+	if len(v.Times) != 1 || !v.Times[0].Equal(testTimestamp) {
+		t.Errorf("Set() times = %v (want [%v])", v.Times, testTimestamp)
+	}
+	if v.DomainOffset == nil || *v.DomainOffset != 90*time.Minute {
+		t.Errorf("Set() domain offset = %v (want %v)", v.DomainOffset, 90*time.Minute)
+	}
+	want := "2022-10-10T00:00:00Z,domain-1h30m0s"
+	if v.String() != want {
+		t.Errorf("String() = %q (want %q)", v.String(), want)
+	}
+	for _, s := range []string{"domain-1h", "domain-yesterday", "domain--1h"} {
+		err := v.Set(s)
+		if err == nil {
+			t.Errorf("Set(%q) err = nil (want error)", s)
+		}
+	}
+}
+
+type parseTimestampTestcase struct {
+	name    string
+	s       string
+	want    time.Time
+	wantErr bool
+}
+
+func TestParseTimestamp(t *testing.T) {
+	testCases := []parseTimestampTestcase{
+		{
+			name: "rfc3339",
+			s:    "2022-10-10T00:00:00+01:00",
+			want: time.Date(2022, 10, 9, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "integer",
+			s:    "1665356400",
+			want: time.Date(2022, 10, 9, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "float",
+			s:    "1665356400.25",
+			want: time.Date(2022, 10, 9, 23, 0, 0, 250000000, time.UTC),
+		},
+		{
+			name:    "invalid",
+			s:       "yesterday",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseTimestamp(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseTimestamp() = %v (want error)", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseTimestamp() err = %v (want nil)", tc.name, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: parseTimestamp() = %v (want %v)", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Archival S3 storage classes. Objects in these classes must be restored
+// before they can be downloaded.
+const (
+	storageClassGlacier     = "GLACIER"
+	storageClassDeepArchive = "DEEP_ARCHIVE"
+)
+
+// isArchivalStorageClass reports whether objects in the S3 storage class
+// class must be restored before they can be downloaded. Glacier Instant
+// Retrieval is not archival in this sense.
+func isArchivalStorageClass(class string) bool {
+	return class == storageClassGlacier || class == storageClassDeepArchive
+}
+
+// archivedObjectError indicates that an object version cannot be downloaded
+// because it is archived and has not been restored. It wraps
+// errObjectUnavailable, so archived objects are skipped by best-effort dumps.
+type archivedObjectError struct {
+	Name    string
+	Version string
+	// StorageClass is the storage class the object is archived in. It may
+	// be empty, e.g. for archive tiers of Intelligent-Tiering.
+	StorageClass string
+}
+
+func (err *archivedObjectError) Error() string {
+	class := ""
+	if err.StorageClass != "" {
+		class = " in storage class " + err.StorageClass
+	}
+	return fmt.Sprintf("%s version %s is archived%s and must be restored before it can be downloaded", err.Name, err.Version, class)
+}
+
+func (err *archivedObjectError) Unwrap() error {
+	return errObjectUnavailable
+}
+
+// warnArchivedObjects warns about the objects of plan whose selected versions
+// have been listed in an archival storage class, as downloading them fails
+// unless they have been restored.
+func warnArchivedObjects(plan *domainPlan) {
+	var keys []string
+	for key, version := range plan.Objects {
+		if isArchivalStorageClass(version.StorageClass) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		debug("domain %q: %s is in storage class %s", plan.Name, key, plan.Objects[key].StorageClass)
+	}
+	warn("domain %q: %d objects are in archival storage classes and must be restored before they can be downloaded, e.g. %s", plan.Name, len(keys), keys[0])
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReplicate_ArchivedObject(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	newLoader := func() *s3HSDSDomainLoader {
+		client := &fakeS3Client{
+			Objects: []*fakeS3Object{
+				domainObject(t, "home/user/domain.h5", &hsdsDomain{Root: &testRootID}),
+				{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group"), StorageClass: "STANDARD"},
+				{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte("data"), StorageClass: storageClassGlacier},
+			},
+		}
+		return &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	}
+
+	storer := &filesystemHSDSStorer{Root: t.TempDir()}
+	err := replicate(newLoader(), storer, []string{"home/user/domain.h5"}, &runOptions{})
+	var archived *archivedObjectError
+	if !errors.As(err, &archived) || archived.Name != testChunkKey || archived.StorageClass != storageClassGlacier {
+		t.Fatalf("replicate() err = %v (want %s archived in %s)", err, testChunkKey, storageClassGlacier)
+	}
+	if !strings.Contains(err.Error(), "must be restored") {
+		t.Errorf("replicate() err = %q (want restore hint)", err)
+	}
+	if want := `domain "home/user/domain.h5": 1 objects are in archival storage classes`; !strings.Contains(warnings.String(), want) {
+		t.Errorf("replicate() warnings = %q (want %q)", warnings.String(), want)
+	}
+
+	// Best-effort dumps skip archived objects and record them as unavailable.
+	manifest := newManifest()
+	storer = &filesystemHSDSStorer{Root: t.TempDir(), Manifest: manifest}
+	opts := &runOptions{BestEffort: true, Manifest: manifest}
+	err = replicate(newLoader(), storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() with best effort err = %v (want nil)", err)
+	}
+	if e := manifest.Entry(testChunkKey); e == nil || !e.Unavailable || e.StorageClass != storageClassGlacier {
+		t.Errorf("manifest entry %s = %+v (want unavailable in %s)", testChunkKey, e, storageClassGlacier)
+	}
+	if e := manifest.Entry(testGroupKey); e == nil || e.Unavailable || e.StorageClass != "STANDARD" {
+		t.Errorf("manifest entry %s = %+v (want stored in STANDARD)", testGroupKey, e)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sync"
+)
+
+// streamMagic starts every stream written by a streamHSDSStorer.
+const streamMagic = "HSS3DMP1"
+
+// streamEntry is a domain file or object stored by a streamHSDSStorer.
+type streamEntry struct {
+	Key  string
+	Data []byte
+}
+
+// streamHSDSStorer is an implementation of the hsdsStorer interface that
+// writes all domains and objects to W as a single stream, preceded by an index
+// of their keys and positions, so they can be piped into another process. As
+// the index must be complete before any data is written, everything is
+// buffered in memory until the storer is finalized. It is meant for dumps of
+// small domains or of their metadata only.
+type streamHSDSStorer struct {
+	W io.Writer
+
+	mu      sync.Mutex
+	entries []*streamEntry
+	// index maps keys to their position in entries. Keys stored again
+	// replace their data, but keep their position.
+	index map[string]int
+}
+
+func (s *streamHSDSStorer) add(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i, ok := s.index[key]; ok {
+		s.entries[i].Data = data
+		return
+	}
+	if s.index == nil {
+		s.index = map[string]int{}
+	}
+	s.index[key] = len(s.entries)
+	s.entries = append(s.entries, &streamEntry{Key: key, Data: data})
+}
+
+func (s *streamHSDSStorer) StoreDomain(ctx context.Context, name string, domain *hsdsDomain) error {
+	b, err := marshalDomain(domain, 0)
+	if err != nil {
+		return err
+	}
+	s.add(path.Join(name, domainFileName), b)
+	return nil
+}
+
+func (s *streamHSDSStorer) StoreObject(ctx context.Context, name string, data []byte) error {
+	s.add(name, data)
+	return nil
+}
+
+// Finalize writes the stream of all stored entries to W.
+func (s *streamHSDSStorer) Finalize(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeStream(s.W, s.entries)
+}
+
+// writeStream writes entries to w as a stream consisting of the following
+// parts. All integers are unsigned and big-endian.
+//
+//	magic       8 bytes, streamMagic
+//	index size  8 bytes, the size of the index in bytes
+//	index       4 bytes entry count, followed by the entries
+//	data        the content of all entries, concatenated
+//
+// Each index entry describes one domain file or object:
+//
+//	offset      8 bytes, relative to the start of the data
+//	size        8 bytes
+//	key size    2 bytes
+//	key         the S3 key, e.g. home/user/domain.h5/.domain.json
+//
+// Entries are listed in the order of entries.
+func writeStream(w io.Writer, entries []*streamEntry) error {
+	if uint64(len(entries)) > math.MaxUint32 {
+		return errors.New("stream: too many entries")
+	}
+	indexSize := 4
+	for _, e := range entries {
+		if len(e.Key) > math.MaxUint16 {
+			return fmt.Errorf("stream: key too long: %s", e.Key)
+		}
+		indexSize += 8 + 8 + 2 + len(e.Key)
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(streamMagic)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(indexSize))
+	bw.Write(buf[:8])
+	binary.BigEndian.PutUint32(buf[:], uint32(len(entries)))
+	bw.Write(buf[:4])
+	var offset uint64
+	for _, e := range entries {
+		binary.BigEndian.PutUint64(buf[:], offset)
+		bw.Write(buf[:8])
+		binary.BigEndian.PutUint64(buf[:], uint64(len(e.Data)))
+		bw.Write(buf[:8])
+		binary.BigEndian.PutUint16(buf[:], uint16(len(e.Key)))
+		bw.Write(buf[:2])
+		bw.WriteString(e.Key)
+		offset += uint64(len(e.Data))
+	}
+	for _, e := range entries {
+		bw.Write(e.Data)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// readStream demultiplexes a stream written by writeStream into a map from
+// keys to contents, as a downstream reader would.
+func readStream(r io.Reader) (map[string][]byte, error) {
+	magic := make([]byte, len(streamMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	if string(magic) != streamMagic {
+		return nil, errors.New("not a stream")
+	}
+	var indexSize uint64
+	err = binary.Read(r, binary.BigEndian, &indexSize)
+	if err != nil {
+		return nil, err
+	}
+	index := make([]byte, indexSize)
+	_, err = io.ReadFull(r, index)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := map[string][]byte{}
+	n := binary.BigEndian.Uint32(index)
+	index = index[4:]
+	for i := uint32(0); i < n; i++ {
+		offset := binary.BigEndian.Uint64(index)
+		size := binary.BigEndian.Uint64(index[8:])
+		keySize := int(binary.BigEndian.Uint16(index[16:]))
+		key := string(index[18 : 18+keySize])
+		index = index[18+keySize:]
+		objects[key] = data[offset : offset+size]
+	}
+	return objects, nil
+}
+
+func TestReplicate_Stream(t *testing.T) {
+	loader := newTestLoader()
+	var buf bytes.Buffer
+	storer := &streamHSDSStorer{W: &buf}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, &runOptions{NotAfter: testTimestamp})
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	objects, err := readStream(&buf)
+	if err != nil {
+		t.Fatalf("readStream() err = %v (want nil)", err)
+	}
+	plan, err := resolveDomain(nil, loader, "home/user/domain.h5", &runOptions{NotAfter: testTimestamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{}
+	for key, version := range plan.Objects {
+		want[key] = loader.Objects[version.ID]
+	}
+	domainKey := "home/user/domain.h5/" + domainFileName
+	var domain hsdsDomain
+	err = json.Unmarshal(objects[domainKey], &domain)
+	if err != nil || domain.Root == nil || *domain.Root != testRootID {
+		t.Errorf("readStream() %s = %q, %v (want domain with root %s)", domainKey, objects[domainKey], err, testRootID)
+	}
+	delete(objects, domainKey)
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("readStream() = %q (want %q)", objects, want)
+	}
+}
+
+func TestStreamHSDSStorer_StoreAgain(t *testing.T) {
+	var buf bytes.Buffer
+	storer := &streamHSDSStorer{W: &buf}
+	for _, o := range []struct{ key, data string }{{"a", "1"}, {"b", ""}, {"a", "22"}} {
+		err := storer.StoreObject(nil, o.key, []byte(o.data))
+		if err != nil {
+			t.Fatalf("StoreObject() err = %v (want nil)", err)
+		}
+	}
+	err := storer.Finalize(nil)
+	if err != nil {
+		t.Fatalf("Finalize() err = %v (want nil)", err)
+	}
+	objects, err := readStream(&buf)
+	if err != nil {
+		t.Fatalf("readStream() err = %v (want nil)", err)
+	}
+	want := map[string][]byte{"a": []byte("22"), "b": {}}
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("readStream() = %q (want %q)", objects, want)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// toolVersion is the version of hss3dump reported in run summaries. It can
+// be set at build time with -ldflags "-X main.toolVersion=...".
+var toolVersion = "dev"
+
+// objectFailure records an object that could not be replicated.
+type objectFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// domainSummary is the outcome of replicating a single domain.
+type domainSummary struct {
+	Name     string           `json:"name"`
+	Objects  int              `json:"objects"`
+	Bytes    int64            `json:"bytes"`
+	Skipped  int              `json:"skipped"`
+	Failures []*objectFailure `json:"failures,omitempty"`
+	// Error is the error that aborted the domain's replication, if any.
+	Error    string        `json:"error,omitempty"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+// runSummary is a machine-readable report of the outcome of a run, meant to
+// be ingested by monitoring tools. Unlike the manifest, it does not list
+// individual files. It is safe for concurrent use. All methods of a nil
+// *runSummary are no-ops.
+type runSummary struct {
+	mu sync.Mutex
+
+	ToolVersion string            `json:"toolVersion"`
+	Options     map[string]string `json:"options"`
+	Started     time.Time         `json:"started"`
+	Duration    time.Duration     `json:"durationNs"`
+	Domains     []*domainSummary  `json:"domains"`
+
+	current *domainSummary
+}
+
+func newRunSummary(options map[string]string) *runSummary {
+	return &runSummary{
+		ToolVersion: toolVersion,
+		Options:     options,
+		Started:     time.Now(),
+		Domains:     []*domainSummary{},
+	}
+}
+
+// StartDomain starts recording the replication of the domain identified by
+// name. All objects recorded until the next call are attributed to it.
+func (s *runSummary) StartDomain(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = &domainSummary{Name: name, Started: time.Now()}
+	s.Domains = append(s.Domains, s.current)
+}
+
+// FinishDomain finishes recording the current domain. err is the error that
+// aborted its replication or nil.
+func (s *runSummary) FinishDomain(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return
+	}
+	if err != nil {
+		s.current.Error = err.Error()
+	}
+	s.current.Duration = time.Since(s.current.Started)
+	s.current = nil
+}
+
+func (s *runSummary) record(fn func(d *domainSummary)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		fn(s.current)
+	}
+}
+
+// ObjectDone records that size bytes have been stored for an object of the
+// current domain.
+func (s *runSummary) ObjectDone(size int) {
+	s.record(func(d *domainSummary) {
+		d.Objects++
+		d.Bytes += int64(size)
+	})
+}
+
+// ObjectSkipped records that an object of the current domain has been
+// skipped.
+func (s *runSummary) ObjectSkipped() {
+	s.record(func(d *domainSummary) {
+		d.Skipped++
+	})
+}
+
+// ObjectFailed records that the object identified by key failed with err.
+func (s *runSummary) ObjectFailed(key string, err error) {
+	s.record(func(d *domainSummary) {
+		d.Failures = append(d.Failures, &objectFailure{Key: key, Error: err.Error()})
+	})
+}
+
+// WriteFile writes s to the file at path, or to stdout if path is "-".
+func (s *runSummary) WriteFile(path string) error {
+	s.mu.Lock()
+	s.Duration = time.Since(s.Started)
+	b, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = os.Stdout.Write(append(b, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
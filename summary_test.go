@@ -0,0 +1,76 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunSummary(t *testing.T) {
+	loader := newTestLoader()
+	loader.Domains["home/user/broken.h5"] = &hsdsDomain{Root: &testRootID}
+	opts := &runOptions{
+		NotAfter: testTimestamp,
+		Summary:  newRunSummary(map[string]string{"b": "2022-10-10T00:00:00Z"}),
+	}
+	storer := &filesystemHSDSStorer{Root: t.TempDir()}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	// The selected chunk version cannot be loaded anymore.
+	delete(loader.Objects, "chunk-v1")
+	err = replicate(loader, storer, []string{"home/user/broken.h5"}, opts)
+	if err == nil {
+		t.Fatalf("replicate() err = nil (want error)")
+	}
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	err = opts.Summary.WriteFile(path)
+	if err != nil {
+		t.Fatalf("WriteFile() err = %v (want nil)", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ToolVersion string            `json:"toolVersion"`
+		Options     map[string]string `json:"options"`
+		Domains     []struct {
+			Name     string `json:"name"`
+			Objects  int    `json:"objects"`
+			Bytes    int64  `json:"bytes"`
+			Error    string `json:"error"`
+			Failures []struct {
+				Key   string `json:"key"`
+				Error string `json:"error"`
+			} `json:"failures"`
+		} `json:"domains"`
+	}
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() err = %v (want nil)", err)
+	}
+
+	if got.ToolVersion != toolVersion || got.Options["b"] != "2022-10-10T00:00:00Z" {
+		t.Errorf("summary = %s (want tool version and options)", b)
+	}
+	if len(got.Domains) != 2 {
+		t.Fatalf("summary has %d domains (want 2)", len(got.Domains))
+	}
+	ok := got.Domains[0]
+	if ok.Name != "home/user/domain.h5" || ok.Objects != 2 || ok.Bytes != 9 || ok.Error != "" || len(ok.Failures) != 0 {
+		t.Errorf("summary domain = %+v (want 2 objects, 9 bytes, no failures)", ok)
+	}
+	broken := got.Domains[1]
+	if broken.Error == "" || len(broken.Failures) != 1 || broken.Failures[0].Key != testChunkKey {
+		t.Errorf("summary domain = %+v (want failure of %s)", broken, testChunkKey)
+	}
+}
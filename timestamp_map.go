@@ -0,0 +1,55 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// readTimestampMap reads a JSON object mapping domain names to timestamps
+// accepted by parseTimestamp from the file at path.
+func readTimestampMap(path string) (map[string]time.Time, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	m := make(map[string]time.Time, len(raw))
+	for name, s := range raw {
+		t, err := parseTimestamp(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: domain %q: %w", path, name, err)
+		}
+		m[name] = t
+	}
+	return m, nil
+}
+
+// warnUnknownMapDomains warns about all domains in m that are not among
+// domains, which usually indicates a typo in the timestamp map.
+func warnUnknownMapDomains(m map[string]time.Time, domains []string) {
+	known := map[string]bool{}
+	for _, name := range domains {
+		known[name] = true
+	}
+	var unknown []string
+	for name := range m {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		warn("timestamp map lists unknown domain %q", name)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTimestampMap(t *testing.T) {
+	var warnings bytes.Buffer
+	warnOutput = &warnings
+	defer func() { warnOutput = os.Stderr }()
+
+	loader := newTestLoader()
+	loader.Domains["home/user/other.h5"] = loader.Domains["home/user/domain.h5"]
+	domains := []string{"home/user/domain.h5", "home/user/other.h5"}
+
+	path := filepath.Join(t.TempDir(), "b-map.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"home/user/domain.h5": "2022-10-10T00:00:00Z",
+		"home/user/typo.h5": "2022-10-10T00:00:00Z"
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := readTimestampMap(path)
+	if err != nil {
+		t.Fatalf("readTimestampMap() err = %v (want nil)", err)
+	}
+	warnUnknownMapDomains(m, domains)
+	if !strings.Contains(warnings.String(), "home/user/typo.h5") {
+		t.Errorf("warnUnknownMapDomains() warnings = %q (want warning about typo.h5)", warnings.String())
+	}
+
+	// The unmapped domain uses the global point in time.
+	opts := &runOptions{NotAfter: testTimestamp.Add(2 * time.Hour), DomainNotAfter: m}
+	plan, err := makePlan(loader, "bucket", domains, opts)
+	if err != nil {
+		t.Fatalf("makePlan() err = %v (want nil)", err)
+	}
+	want := []string{"chunk-v1", "chunk-v2"}
+	for i, dp := range plan.Domains {
+		if got := dp.Objects[testChunkKey].ID; got != want[i] {
+			t.Errorf("makePlan() selected %s for %s (want %s)", got, dp.Name, want[i])
+		}
+	}
+
+	err = ioutil.WriteFile(path, []byte(`{"home/user/domain.h5": "yesterday"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readTimestampMap(path)
+	if err == nil || !strings.Contains(err.Error(), "home/user/domain.h5") {
+		t.Errorf("readTimestampMap() err = %v (want error naming the domain)", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// verifyResult is the outcome of verifying the local copies of a dump.
+type verifyResult struct {
+	// Checked is the number of objects that have been verified.
+	Checked int
+	// Mismatches is the number of objects whose local copy is missing or
+	// does not match its selected version.
+	Mismatches int
+}
+
+// reportMismatch writes a line describing the mismatch of the local copy of
+// the object identified by key to w and counts it in r.
+func (r *verifyResult) reportMismatch(w io.Writer, key, format string, args ...interface{}) {
+	r.Mismatches++
+	fmt.Fprintf(w, "%s: %s\n", key, fmt.Sprintf(format, args...))
+}
+
+// reportSummary writes the number of checked and mismatching objects to w.
+func (r *verifyResult) reportSummary(w io.Writer) {
+	fmt.Fprintf(w, "verified %d objects, %d mismatches\n", r.Checked, r.Mismatches)
+}
+
+// objectSize is the size of a local copy as returned by
+// hsdsObjectSizer.ObjectSize.
+type objectSize struct {
+	Size int64
+	Err  error
+}
+
+// objectSizes returns the sizes of the local copies in storer of the objects
+// identified by keys, in the same order. The sizes of up to workers objects
+// are determined concurrently.
+func objectSizes(ctx context.Context, storer hsdsObjectSizer, keys []string, workers int) []objectSize {
+	if workers < 1 {
+		workers = 1
+	}
+	sizes := make([]objectSize, len(keys))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				sizes[i].Size, sizes[i].Err = storer.ObjectSize(ctx, keys[i])
+			}
+		}()
+	}
+	for i := range keys {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return sizes
+}
+
+// verifySizes resolves the object versions of all domains identified by
+// domains from a fresh listing of loader and compares the sizes of their local
+// copies in storer against the sizes of the selected versions. The sizes of up
+// to opts.Workers local copies are determined concurrently. Mismatches are
+// reported to w in the order of the objects' keys. No object is downloaded or
+// hashed.
+func verifySizes(ctx context.Context, w io.Writer, loader hsdsLoader, storer hsdsObjectSizer, domains []string, opts *runOptions) (*verifyResult, error) {
+	r := &verifyResult{}
+	for _, name := range domains {
+		plan, err := resolveDomain(ctx, loader, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(plan.Objects))
+		for key := range plan.Objects {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		sizes := objectSizes(ctx, storer, keys, opts.Workers)
+		for i, key := range keys {
+			r.Checked++
+			want := plan.Objects[key].Size
+			size, err := sizes[i].Size, sizes[i].Err
+			if errors.Is(err, os.ErrNotExist) {
+				r.reportMismatch(w, key, "missing (want %d bytes)", want)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if size != want {
+				r.reportMismatch(w, key, "size %d bytes (want %d bytes)", size, want)
+			}
+		}
+	}
+	r.reportSummary(w)
+	return r, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySizes(t *testing.T) {
+	loader := newTestLoader()
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	opts := &runOptions{NotAfter: testTimestamp}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	var out bytes.Buffer
+	r, err := verifySizes(context.Background(), &out, loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("verifySizes() err = %v (want nil)", err)
+	}
+	if r.Checked != 2 || r.Mismatches != 0 {
+		t.Errorf("verifySizes() = %+v (want 2 checked, 0 mismatches)\n%s", r, out.String())
+	}
+
+	// The local chunk has been truncated.
+	err = storer.StoreObject(context.Background(), testChunkKey, []byte("da"))
+	if err != nil {
+		t.Fatalf("StoreObject() err = %v (want nil)", err)
+	}
+	out.Reset()
+	r, err = verifySizes(context.Background(), &out, loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("verifySizes() err = %v (want nil)", err)
+	}
+	if r.Mismatches != 1 {
+		t.Errorf("verifySizes() mismatches = %d (want 1)", r.Mismatches)
+	}
+	want := testChunkKey + ": size 2 bytes (want 4 bytes)"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("verifySizes() output = %q (want line %q)", out.String(), want)
+	}
+}
+
+func TestVerifySizes_Workers(t *testing.T) {
+	loader := newTestLoader()
+	for i := 1; i < 50; i++ {
+		key := fmt.Sprintf("db/d12a20a5-6c27622f/d/693e-302825-f8c087/%d", i)
+		id := fmt.Sprintf("chunk%d-v1", i)
+		loader.Versions[key] = []*hsdsVersion{{ID: id, LastModified: testTimestamp.Add(-time.Hour), Size: 4}}
+		loader.Objects[id] = []byte("data")
+	}
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root}
+	opts := &runOptions{NotAfter: testTimestamp}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+	for i := 1; i < 50; i += 7 {
+		key := fmt.Sprintf("db/d12a20a5-6c27622f/d/693e-302825-f8c087/%d", i)
+		if i%2 == 0 {
+			err = os.Remove(filepath.Join(root, filepath.FromSlash(key)))
+		} else {
+			err = storer.StoreObject(context.Background(), key, []byte("da"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var serial bytes.Buffer
+	want, err := verifySizes(context.Background(), &serial, loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("verifySizes() err = %v (want nil)", err)
+	}
+	if want.Mismatches != 7 {
+		t.Errorf("verifySizes() mismatches = %d (want 7)", want.Mismatches)
+	}
+
+	var concurrent bytes.Buffer
+	opts.Workers = 8
+	got, err := verifySizes(context.Background(), &concurrent, loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("verifySizes() err = %v (want nil)", err)
+	}
+	if *got != *want || concurrent.String() != serial.String() {
+		t.Errorf("verifySizes() with 8 workers = %+v\n%s(want %+v\n%s)", got, concurrent.String(), want, serial.String())
+	}
+}
+
+func TestVerifySizes_ZeroByteObject(t *testing.T) {
+	client := &fakeS3Client{
+		Objects: []*fakeS3Object{
+			domainObject(t, "home/user/domain.h5", &hsdsDomain{Root: &testRootID}),
+			{Key: testGroupKey, VersionID: "group-v1", LastModified: testTimestamp, Data: []byte("group")},
+			{Key: testChunkKey, VersionID: "chunk-v1", LastModified: testTimestamp, Data: []byte{}},
+		},
+	}
+	loader := &s3HSDSDomainLoader{Client: client, Bucket: "bucket"}
+	root := t.TempDir()
+	storer := &filesystemHSDSStorer{Root: root, Manifest: newManifest()}
+	opts := &runOptions{DetectCompression: true}
+	err := replicate(loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("replicate() err = %v (want nil)", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(testChunkKey)))
+	if err != nil || fi.Size() != 0 {
+		t.Fatalf("replicate() stored %s: %v, %v (want empty file)", testChunkKey, fi, err)
+	}
+	const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if e := storer.Manifest.Entry(testChunkKey); e == nil || e.Size != 0 || e.SHA256 != emptySHA256 {
+		t.Errorf("manifest entry = %+v (want size 0, sha256 %s)", e, emptySHA256)
+	}
+
+	var out bytes.Buffer
+	r, err := verifySizes(context.Background(), &out, loader, storer, []string{"home/user/domain.h5"}, opts)
+	if err != nil {
+		t.Fatalf("verifySizes() err = %v (want nil)", err)
+	}
+	if r.Checked != 2 || r.Mismatches != 0 {
+		t.Errorf("verifySizes() = %+v (want 2 checked, 0 mismatches)\n%s", r, out.String())
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// versionCacheEntry is a single domain's cached version listing.
+type versionCacheEntry struct {
+	Created  time.Time                 `json:"created"`
+	Versions map[string][]*hsdsVersion `json:"versions"`
+}
+
+// versionCacheFile is the on-disk format of a version cache.
+type versionCacheFile struct {
+	Entries map[string]*versionCacheEntry `json:"entries"`
+}
+
+// cachedVersionLoader is an hsdsLoader that caches the results of the
+// underlying loader's LoadDomainVersions method in a local file. The other
+// methods of the hsdsLoader interface are passed through to the underlying
+// loader. Its optional interfaces are found through Unwrap, so listings of
+// prefixes, e.g. for -group, are not cached.
+//
+// The cache file is read once, when the first domain's versions are loaded.
+// New listings are only written to it by Save, which is called at the end of
+// a run.
+type cachedVersionLoader struct {
+	hsdsLoader
+	// Path is the path of the cache file.
+	Path string
+	// TTL is the duration for which cached entries are considered valid.
+	TTL time.Duration
+	// Bucket is the bucket the underlying loader retrieves domains from.
+	Bucket string
+
+	now func() time.Time
+
+	// mu guards cache and dirty.
+	mu    sync.Mutex
+	cache *versionCacheFile
+	// dirty indicates that cache has entries that have not been saved yet.
+	dirty bool
+}
+
+func (l *cachedVersionLoader) readCache() (*versionCacheFile, error) {
+	cache := &versionCacheFile{Entries: map[string]*versionCacheEntry{}}
+	b, err := ioutil.ReadFile(l.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, cache)
+	if err != nil {
+		return nil, err
+	}
+	if cache.Entries == nil {
+		cache.Entries = map[string]*versionCacheEntry{}
+	}
+	return cache, nil
+}
+
+// Save writes the cached listings to l.Path if any have been added since the
+// cache was read. The file is replaced atomically, so an interrupted save
+// leaves the previous cache intact. Save of a nil *cachedVersionLoader is a
+// no-op.
+func (l *cachedVersionLoader) Save() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	b, err := json.Marshal(l.cache)
+	if err != nil {
+		return err
+	}
+	tmp := tempFileName(filepath.Dir(l.Path), filepath.Base(l.Path))
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, l.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+func (l *cachedVersionLoader) Unwrap() hsdsLoader {
+	return l.hsdsLoader
+}
+
+func (l *cachedVersionLoader) LoadDomainVersions(ctx context.Context, domain *hsdsDomain) (map[string][]*hsdsVersion, error) {
+	now := time.Now
+	if l.now != nil {
+		now = l.now
+	}
+
+	key := path.Join(l.Bucket, domain.DatabasePrefix())
+	l.mu.Lock()
+	if l.cache == nil {
+		cache, err := l.readCache()
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		l.cache = cache
+	}
+	entry, ok := l.cache.Entries[key]
+	l.mu.Unlock()
+	if ok && now().Sub(entry.Created) < l.TTL {
+		return entry.Versions, nil
+	}
+
+	versions, err := l.hsdsLoader.LoadDomainVersions(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.cache.Entries[key] = &versionCacheEntry{
+		Created:  now(),
+		Versions: versions,
+	}
+	l.dirty = true
+	l.mu.Unlock()
+	return versions, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 UL Method Park GmbH. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachedVersionLoader(t *testing.T) {
+	fake := newTestLoader()
+	domain := fake.Domains["home/user/domain.h5"]
+	now := testTimestamp
+	newLoader := func() *cachedVersionLoader {
+		return &cachedVersionLoader{
+			hsdsLoader: fake,
+			Path:       filepath.Join(t.TempDir(), "versions.json"),
+			TTL:        time.Hour,
+			Bucket:     "bucket",
+			now:        func() time.Time { return now },
+		}
+	}
+	loader := newLoader()
+
+	_, err := loader.LoadDomainVersions(context.Background(), domain)
+	if err != nil {
+		t.Fatalf("cold: LoadDomainVersions() err = %v (want nil)", err)
+	}
+	if fake.VersionCalls != 1 {
+		t.Errorf("cold: list calls = %d (want 1)", fake.VersionCalls)
+	}
+	// Listings are only written by Save.
+	_, err = os.Stat(loader.Path)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cold: cache file before Save() err = %v (want %v)", err, os.ErrNotExist)
+	}
+	err = loader.Save()
+	if err != nil {
+		t.Fatalf("cold: Save() err = %v (want nil)", err)
+	}
+
+	// A fresh loader using the same file must be served from the cache.
+	warm := newLoader()
+	warm.Path = loader.Path
+	now = now.Add(30 * time.Minute)
+	got, err := warm.LoadDomainVersions(context.Background(), domain)
+	if err != nil {
+		t.Fatalf("warm: LoadDomainVersions() err = %v (want nil)", err)
+	}
+	if fake.VersionCalls != 1 {
+		t.Errorf("warm: list calls = %d (want 1)", fake.VersionCalls)
+	}
+	if len(got) != len(fake.Versions) {
+		t.Errorf("warm: len(LoadDomainVersions()) = %d (want %d)", len(got), len(fake.Versions))
+	}
+	if got[testChunkKey][1].ID != "chunk-v1" {
+		t.Errorf("warm: cached version ID = %q (want %q)", got[testChunkKey][1].ID, "chunk-v1")
+	}
+
+	now = now.Add(time.Hour)
+	_, err = warm.LoadDomainVersions(context.Background(), domain)
+	if err != nil {
+		t.Fatalf("stale: LoadDomainVersions() err = %v (want nil)", err)
+	}
+	if fake.VersionCalls != 2 {
+		t.Errorf("stale: list calls = %d (want 2)", fake.VersionCalls)
+	}
+}
+
+func TestCachedVersionLoader_Save(t *testing.T) {
+	fake := newTestLoader()
+	domain := fake.Domains["home/user/domain.h5"]
+	dir := t.TempDir()
+	loader := &cachedVersionLoader{
+		hsdsLoader: fake,
+		Path:       filepath.Join(dir, "versions.json"),
+		TTL:        time.Hour,
+		Bucket:     "bucket",
+		now:        func() time.Time { return testTimestamp },
+	}
+	_, err := loader.LoadDomainVersions(context.Background(), domain)
+	if err != nil {
+		t.Fatalf("LoadDomainVersions() err = %v (want nil)", err)
+	}
+	err = loader.Save()
+	if err != nil {
+		t.Fatalf("Save() err = %v (want nil)", err)
+	}
+
+	// The file is read only once, and saved only if listings were added.
+	err = ioutil.WriteFile(loader.Path, []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loader.LoadDomainVersions(context.Background(), domain)
+	if err != nil {
+		t.Fatalf("cached: LoadDomainVersions() err = %v (want nil)", err)
+	}
+	err = loader.Save()
+	if err != nil {
+		t.Fatalf("unchanged: Save() err = %v (want nil)", err)
+	}
+	b, err := ioutil.ReadFile(loader.Path)
+	if err != nil || string(b) != "garbage" {
+		t.Errorf("unchanged: cache file = %q, %v (want it untouched)", b, err)
+	}
+
+	// No temporary files are left behind.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Errorf("files next to the cache = %d, %v (want 1)", len(files), err)
+	}
+
+	var nilLoader *cachedVersionLoader
+	err = nilLoader.Save()
+	if err != nil {
+		t.Errorf("nil: Save() err = %v (want nil)", err)
+	}
+}